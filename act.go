@@ -0,0 +1,649 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/rnn"
+)
+
+// These are the default values for ACTBlock fields.
+const (
+	DefaultACTMaxSteps = 10
+	DefaultACTEpsilon  = 0.01
+)
+
+func init() {
+	var a ACTBlock
+	serializer.RegisterTypedDeserializer(a.SerializerType(), DeserializeACTBlock)
+}
+
+// An ACTBlock runs a Block for a variable number of
+// micro-steps per input, as described in "Adaptive
+// Computation Time for Recurrent Neural Networks"
+// (Graves, 2016).
+//
+// The first component of the Block's output is a halting
+// logit, which is squashed with a sigmoid to get a halting
+// probability.
+// Micro-steps are run until the cumulative halting
+// probability reaches 1-Epsilon, or until MaxSteps is
+// reached.
+// The remaining components of the micro-steps' outputs
+// are mixed according to the halting distribution to get
+// the ACTBlock's output.
+// The Struct states are mixed in the same way, which is
+// why the Block's Struct must be a Mixer (or an RMixer,
+// for the r-operator).
+// The enclosed block's state is taken from the last
+// micro-step.
+type ACTBlock struct {
+	// Block is the block to run at each micro-step.
+	// Its Steps field is ignored.
+	Block *Block
+
+	// MaxSteps is the maximum number of micro-steps.
+	// If it is 0, DefaultACTMaxSteps is used.
+	MaxSteps int
+
+	// Epsilon is the halting threshold.
+	// If it is 0, DefaultACTEpsilon is used.
+	Epsilon float64
+
+	// PonderCost scales the ponder cost, which encourages
+	// the block to use fewer micro-steps.
+	// The ponder cost is never part of the output.
+	// Instead, its gradient is added during
+	// back-propagation as if it were part of the loss.
+	PonderCost float64
+}
+
+type actOptions struct {
+	MaxSteps   int
+	Epsilon    float64
+	PonderCost float64
+}
+
+// DeserializeACTBlock deserializes an ACTBlock.
+func DeserializeACTBlock(d []byte) (*ACTBlock, error) {
+	slice, err := serializer.DeserializeSlice(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(slice) != 2 {
+		return nil, errors.New("invalid ACTBlock slice")
+	}
+	block, ok1 := slice[0].(*Block)
+	optionData, ok2 := slice[1].(serializer.Bytes)
+	if !ok1 || !ok2 {
+		return nil, errors.New("invalid ACTBlock slice")
+	}
+	var options actOptions
+	if err := json.Unmarshal(optionData, &options); err != nil {
+		return nil, fmt.Errorf("invalid ACTBlock options: %s", err)
+	}
+	if err := checkMixer(block.Struct, false); err != nil {
+		return nil, fmt.Errorf("invalid ACTBlock struct: %s", err)
+	}
+	return &ACTBlock{
+		Block:      block,
+		MaxSteps:   options.MaxSteps,
+		Epsilon:    options.Epsilon,
+		PonderCost: options.PonderCost,
+	}, nil
+}
+
+// StartState is like Block.StartState().
+//
+// It panics if the Block's Struct (or a struct inside of
+// it) is not a Mixer.
+func (a *ACTBlock) StartState() rnn.State {
+	if err := checkMixer(a.Block.Struct, false); err != nil {
+		panic(err)
+	}
+	return a.Block.StartState()
+}
+
+// StartRState is like Block.StartRState().
+//
+// It panics if the Block's Struct (or a struct inside of
+// it) is not an RMixer.
+func (a *ACTBlock) StartRState(rv autofunc.RVector) rnn.RState {
+	if err := checkMixer(a.Block.Struct, true); err != nil {
+		panic(err)
+	}
+	return a.Block.StartRState(rv)
+}
+
+// PropagateStart is like Block.PropagateStart().
+func (a *ACTBlock) PropagateStart(s []rnn.State, u []rnn.StateGrad, g autofunc.Gradient) {
+	a.Block.PropagateStart(s, u, g)
+}
+
+// PropagateStartR is like Block.PropagateStartR().
+func (a *ACTBlock) PropagateStartR(s []rnn.RState, u []rnn.RStateGrad,
+	rg autofunc.RGradient, g autofunc.Gradient) {
+	a.Block.PropagateStartR(s, u, rg, g)
+}
+
+// ApplyBlock applies the block to a batch of inputs.
+func (a *ACTBlock) ApplyBlock(s []rnn.State, in []autofunc.Result) rnn.BlockResult {
+	res := &actResult{
+		Block:      a,
+		Mixer:      structMixer(a.Block.Struct),
+		Input:      in,
+		Halting:    make([][]float64, len(in)),
+		Probs:      make([]linalg.Vector, len(in)),
+		StepOuts:   make([][]linalg.Vector, len(in)),
+		StepStates: make([][]State, len(in)),
+	}
+	stepIn := make([]autofunc.Result, len(in))
+	for i, x := range in {
+		v := &autofunc.Variable{Vector: x.Output()}
+		res.InPool = append(res.InPool, v)
+		stepIn[i] = v
+	}
+
+	curStates := append([]rnn.State{}, s...)
+	cumProbs := make([]float64, len(in))
+	active := make([]int, len(in))
+	for i := range active {
+		active[i] = i
+	}
+	for step := 0; len(active) > 0; step++ {
+		var activeStates []rnn.State
+		var activeIn []autofunc.Result
+		for _, idx := range active {
+			activeStates = append(activeStates, curStates[idx])
+			activeIn = append(activeIn, stepIn[idx])
+		}
+		stepRes := a.Block.applyStep(activeStates, activeIn)
+		res.Steps = append(res.Steps, &actStep{Result: stepRes, Indices: active})
+
+		var nextActive []int
+		for j, idx := range active {
+			out := stepRes.Outputs()[j]
+			curStates[idx] = stepRes.States()[j]
+			halt := 1 / (1 + math.Exp(-out[0]))
+			res.Halting[idx] = append(res.Halting[idx], halt)
+			res.StepOuts[idx] = append(res.StepOuts[idx], out)
+			res.StepStates[idx] = append(res.StepStates[idx],
+				curStates[idx].(blockState).StructState)
+			if step+1 == a.maxSteps() || cumProbs[idx]+halt >= 1-a.epsilon() {
+				probs := append(linalg.Vector{}, res.Halting[idx]...)
+				probs[len(probs)-1] = 1 - cumProbs[idx]
+				res.Probs[idx] = probs
+			} else {
+				cumProbs[idx] += halt
+				nextActive = append(nextActive, idx)
+			}
+		}
+		active = nextActive
+	}
+
+	for i, probs := range res.Probs {
+		out := make(linalg.Vector, len(res.StepOuts[i][0])-1)
+		for j, stepOut := range res.StepOuts[i] {
+			out.Add(stepOut[1:].Copy().Scale(probs[j]))
+		}
+		res.OutVecs = append(res.OutVecs, out)
+		res.OutStates = append(res.OutStates, blockState{
+			BlockState:  curStates[i].(blockState).BlockState,
+			StructState: res.Mixer.MixStates(res.StepStates[i], probs),
+		})
+		res.Ponder = append(res.Ponder, float64(len(probs))+probs[len(probs)-1])
+	}
+
+	return res
+}
+
+// ApplyBlockR is like ApplyBlock, but with support for
+// the r-operator.
+func (a *ACTBlock) ApplyBlockR(rv autofunc.RVector, s []rnn.RState,
+	in []autofunc.RResult) rnn.BlockRResult {
+	res := &actRResult{
+		Block:      a,
+		Mixer:      structRMixer(a.Block.Struct),
+		Input:      in,
+		Halting:    make([][]float64, len(in)),
+		HaltingR:   make([][]float64, len(in)),
+		Probs:      make([]linalg.Vector, len(in)),
+		ProbsR:     make([]linalg.Vector, len(in)),
+		StepOuts:   make([][]linalg.Vector, len(in)),
+		StepOutsR:  make([][]linalg.Vector, len(in)),
+		StepStates: make([][]RState, len(in)),
+	}
+	stepIn := make([]autofunc.RResult, len(in))
+	for i, x := range in {
+		v := &autofunc.Variable{Vector: x.Output()}
+		res.InPool = append(res.InPool, v)
+		stepIn[i] = &autofunc.RVariable{
+			Variable:   v,
+			ROutputVec: x.ROutput(),
+		}
+	}
+
+	curStates := append([]rnn.RState{}, s...)
+	cumProbs := make([]float64, len(in))
+	cumProbsR := make([]float64, len(in))
+	active := make([]int, len(in))
+	for i := range active {
+		active[i] = i
+	}
+	for step := 0; len(active) > 0; step++ {
+		var activeStates []rnn.RState
+		var activeIn []autofunc.RResult
+		for _, idx := range active {
+			activeStates = append(activeStates, curStates[idx])
+			activeIn = append(activeIn, stepIn[idx])
+		}
+		stepRes := a.Block.applyStepR(rv, activeStates, activeIn)
+		res.Steps = append(res.Steps, &actRStep{Result: stepRes, Indices: active})
+
+		var nextActive []int
+		for j, idx := range active {
+			out, outR := stepRes.Outputs()[j], stepRes.ROutputs()[j]
+			curStates[idx] = stepRes.RStates()[j]
+			halt := 1 / (1 + math.Exp(-out[0]))
+			haltR := halt * (1 - halt) * outR[0]
+			res.Halting[idx] = append(res.Halting[idx], halt)
+			res.HaltingR[idx] = append(res.HaltingR[idx], haltR)
+			res.StepOuts[idx] = append(res.StepOuts[idx], out)
+			res.StepOutsR[idx] = append(res.StepOutsR[idx], outR)
+			res.StepStates[idx] = append(res.StepStates[idx],
+				curStates[idx].(blockRState).StructState)
+			if step+1 == a.maxSteps() || cumProbs[idx]+halt >= 1-a.epsilon() {
+				probs := append(linalg.Vector{}, res.Halting[idx]...)
+				probsR := append(linalg.Vector{}, res.HaltingR[idx]...)
+				probs[len(probs)-1] = 1 - cumProbs[idx]
+				probsR[len(probsR)-1] = -cumProbsR[idx]
+				res.Probs[idx] = probs
+				res.ProbsR[idx] = probsR
+			} else {
+				cumProbs[idx] += halt
+				cumProbsR[idx] += haltR
+				nextActive = append(nextActive, idx)
+			}
+		}
+		active = nextActive
+	}
+
+	for i, probs := range res.Probs {
+		probsR := res.ProbsR[i]
+		out := make(linalg.Vector, len(res.StepOuts[i][0])-1)
+		outR := make(linalg.Vector, len(out))
+		for j, stepOut := range res.StepOuts[i] {
+			out.Add(stepOut[1:].Copy().Scale(probs[j]))
+			outR.Add(res.StepOutsR[i][j][1:].Copy().Scale(probs[j]))
+			outR.Add(stepOut[1:].Copy().Scale(probsR[j]))
+		}
+		res.OutVecs = append(res.OutVecs, out)
+		res.ROutVecs = append(res.ROutVecs, outR)
+		res.OutStates = append(res.OutStates, blockRState{
+			BlockState:  curStates[i].(blockRState).BlockState,
+			StructState: res.Mixer.MixRStates(res.StepStates[i], probs, probsR),
+		})
+		res.Ponder = append(res.Ponder, float64(len(probs))+probs[len(probs)-1])
+	}
+
+	return res
+}
+
+// Parameters returns the Block's parameters.
+func (a *ACTBlock) Parameters() []*autofunc.Variable {
+	return a.Block.Parameters()
+}
+
+// SerializerType returns the unique ID used to serialize
+// ACTBlocks with the serializer package.
+func (a *ACTBlock) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.ACTBlock"
+}
+
+// Serialize serializes the Block and the ACT options.
+func (a *ACTBlock) Serialize() ([]byte, error) {
+	optionData, err := json.Marshal(&actOptions{
+		MaxSteps:   a.MaxSteps,
+		Epsilon:    a.Epsilon,
+		PonderCost: a.PonderCost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serializer.SerializeSlice([]serializer.Serializer{a.Block,
+		serializer.Bytes(optionData)})
+}
+
+func (a *ACTBlock) maxSteps() int {
+	if a.MaxSteps == 0 {
+		return DefaultACTMaxSteps
+	}
+	return a.MaxSteps
+}
+
+func (a *ACTBlock) epsilon() float64 {
+	if a.Epsilon == 0 {
+		return DefaultACTEpsilon
+	}
+	return a.Epsilon
+}
+
+func structMixer(s Struct) Mixer {
+	if m, ok := s.(Mixer); ok {
+		return m
+	}
+	panic(fmt.Sprintf("struct is not a Mixer: %T", s))
+}
+
+func structRMixer(s Struct) RMixer {
+	if m, ok := s.(RMixer); ok {
+		return m
+	}
+	panic(fmt.Sprintf("struct is not an RMixer: %T", s))
+}
+
+type actStep struct {
+	Result *blockResult
+
+	// Indices maps the batch indices of Result to the
+	// batch indices of the ACTBlock's input.
+	Indices []int
+}
+
+type actResult struct {
+	Block  *ACTBlock
+	Mixer  Mixer
+	Input  []autofunc.Result
+	InPool []*autofunc.Variable
+	Steps  []*actStep
+
+	// These fields are indexed by batch index and then by
+	// micro-step.
+	Halting    [][]float64
+	Probs      []linalg.Vector
+	StepOuts   [][]linalg.Vector
+	StepStates [][]State
+
+	// Ponder stores the ponder cost (before scaling) for
+	// each batch index.
+	Ponder []float64
+
+	OutVecs   []linalg.Vector
+	OutStates []rnn.State
+}
+
+func (a *actResult) Outputs() []linalg.Vector {
+	return a.OutVecs
+}
+
+func (a *actResult) States() []rnn.State {
+	return a.OutStates
+}
+
+func (a *actResult) PropagateGradient(u []linalg.Vector, s []rnn.StateGrad,
+	g autofunc.Gradient) []rnn.StateGrad {
+	if len(a.Input) == 0 {
+		return nil
+	}
+
+	for _, v := range a.InPool {
+		g[v] = make(linalg.Vector, len(v.Vector))
+	}
+
+	haltGrads, mixGrads := a.haltAndMixGrads(u, s)
+
+	downstream := make([]rnn.StateGrad, len(a.Input))
+	for stepIdx := len(a.Steps) - 1; stepIdx >= 0; stepIdx-- {
+		step := a.Steps[stepIdx]
+		upstream := make([]linalg.Vector, len(step.Indices))
+		stateUpstream := make([]rnn.StateGrad, len(step.Indices))
+		for j, idx := range step.Indices {
+			outGrad := make(linalg.Vector, len(a.StepOuts[idx][stepIdx]))
+			outGrad[0] = haltGrads[idx][stepIdx]
+			if u != nil {
+				copy(outGrad[1:], u[idx].Copy().Scale(a.Probs[idx][stepIdx]))
+			}
+			upstream[j] = outGrad
+			stateUpstream[j] = a.stateUpstream(s, downstream, mixGrads, idx, stepIdx)
+		}
+		stepDown := step.Result.PropagateGradient(upstream, stateUpstream, g)
+		for j, idx := range step.Indices {
+			downstream[idx] = stepDown[j]
+		}
+	}
+
+	for i, v := range a.InPool {
+		inGrad := g[v]
+		delete(g, v)
+		a.Input[i].PropagateGradient(inGrad, g)
+	}
+
+	return downstream
+}
+
+// haltAndMixGrads computes the gradients of the halting
+// logits and the upstream Grads from the mixed states.
+func (a *actResult) haltAndMixGrads(u []linalg.Vector,
+	s []rnn.StateGrad) (haltGrads [][]float64, mixGrads [][]Grad) {
+	haltGrads = make([][]float64, len(a.Input))
+	mixGrads = make([][]Grad, len(a.Input))
+	for i, probs := range a.Probs {
+		probsGrad := make(linalg.Vector, len(probs))
+		if u != nil {
+			for j, stepOut := range a.StepOuts[i] {
+				probsGrad[j] = u[i].Dot(stepOut[1:])
+			}
+		}
+		if s != nil && s[i] != nil {
+			bsg := s[i].(blockStateGrad)
+			var mixProbsGrad linalg.Vector
+			mixProbsGrad, mixGrads[i] = a.Mixer.MixGradient(a.StepStates[i], probs,
+				bsg.DataGrad, bsg.StructGrad)
+			probsGrad.Add(mixProbsGrad)
+		}
+
+		// Every halting probability but the last one is
+		// used directly, and the last probability is one
+		// minus the sum of the others.
+		haltGrads[i] = make([]float64, len(probs))
+		lastGrad := probsGrad[len(probs)-1]
+		for j, halt := range a.Halting[i][:len(probs)-1] {
+			haltGrad := probsGrad[j] - lastGrad - a.Block.PonderCost
+			haltGrads[i][j] = haltGrad * halt * (1 - halt)
+		}
+	}
+	return
+}
+
+// stateUpstream computes the upstream StateGrad for a
+// given batch index at a given micro-step.
+func (a *actResult) stateUpstream(s, downstream []rnn.StateGrad, mixGrads [][]Grad,
+	idx, stepIdx int) rnn.StateGrad {
+	var mixGrad Grad
+	if mixGrads[idx] != nil {
+		mixGrad = mixGrads[idx][stepIdx]
+	}
+	if stepIdx == len(a.Probs[idx])-1 {
+		if s == nil || s[idx] == nil {
+			return nil
+		}
+		return blockStateGrad{
+			BlockGrad:  s[idx].(blockStateGrad).BlockGrad,
+			StructGrad: mixGrad,
+			DataGrad:   make(linalg.Vector, a.Block.Block.Struct.DataSize()),
+		}
+	}
+	next := downstream[idx].(blockStateGrad)
+	return blockStateGrad{
+		BlockGrad:  next.BlockGrad,
+		StructGrad: a.Mixer.AddGrads(next.StructGrad, mixGrad),
+		DataGrad:   next.DataGrad,
+	}
+}
+
+type actRStep struct {
+	Result  *blockRResult
+	Indices []int
+}
+
+type actRResult struct {
+	Block  *ACTBlock
+	Mixer  RMixer
+	Input  []autofunc.RResult
+	InPool []*autofunc.Variable
+	Steps  []*actRStep
+
+	Halting    [][]float64
+	HaltingR   [][]float64
+	Probs      []linalg.Vector
+	ProbsR     []linalg.Vector
+	StepOuts   [][]linalg.Vector
+	StepOutsR  [][]linalg.Vector
+	StepStates [][]RState
+
+	Ponder []float64
+
+	OutVecs   []linalg.Vector
+	ROutVecs  []linalg.Vector
+	OutStates []rnn.RState
+}
+
+func (a *actRResult) Outputs() []linalg.Vector {
+	return a.OutVecs
+}
+
+func (a *actRResult) ROutputs() []linalg.Vector {
+	return a.ROutVecs
+}
+
+func (a *actRResult) RStates() []rnn.RState {
+	return a.OutStates
+}
+
+func (a *actRResult) PropagateRGradient(u, uR []linalg.Vector, s []rnn.RStateGrad,
+	rg autofunc.RGradient, g autofunc.Gradient) []rnn.RStateGrad {
+	if len(a.Input) == 0 {
+		return nil
+	}
+
+	if g == nil {
+		g = autofunc.Gradient{}
+	}
+
+	for _, v := range a.InPool {
+		g[v] = make(linalg.Vector, len(v.Vector))
+		rg[v] = make(linalg.Vector, len(v.Vector))
+	}
+
+	haltGrads, haltGradsR, mixGrads := a.haltAndMixGrads(u, uR, s)
+
+	downstream := make([]rnn.RStateGrad, len(a.Input))
+	for stepIdx := len(a.Steps) - 1; stepIdx >= 0; stepIdx-- {
+		step := a.Steps[stepIdx]
+		upstream := make([]linalg.Vector, len(step.Indices))
+		upstreamR := make([]linalg.Vector, len(step.Indices))
+		stateUpstream := make([]rnn.RStateGrad, len(step.Indices))
+		for j, idx := range step.Indices {
+			outGrad := make(linalg.Vector, len(a.StepOuts[idx][stepIdx]))
+			outGradR := make(linalg.Vector, len(outGrad))
+			outGrad[0] = haltGrads[idx][stepIdx]
+			outGradR[0] = haltGradsR[idx][stepIdx]
+			if u != nil {
+				prob, probR := a.Probs[idx][stepIdx], a.ProbsR[idx][stepIdx]
+				copy(outGrad[1:], u[idx].Copy().Scale(prob))
+				copy(outGradR[1:], uR[idx].Copy().Scale(prob).Add(u[idx].Copy().Scale(probR)))
+			}
+			upstream[j] = outGrad
+			upstreamR[j] = outGradR
+			stateUpstream[j] = a.stateUpstream(s, downstream, mixGrads, idx, stepIdx)
+		}
+		stepDown := step.Result.PropagateRGradient(upstream, upstreamR, stateUpstream, rg, g)
+		for j, idx := range step.Indices {
+			downstream[idx] = stepDown[j]
+		}
+	}
+
+	for i, v := range a.InPool {
+		inGrad, inGradR := g[v], rg[v]
+		delete(g, v)
+		delete(rg, v)
+		a.Input[i].PropagateRGradient(inGrad, inGradR, rg, g)
+	}
+
+	return downstream
+}
+
+// haltAndMixGrads is like actResult.haltAndMixGrads, but
+// it also computes the r-gradients of the halting logits.
+func (a *actRResult) haltAndMixGrads(u, uR []linalg.Vector,
+	s []rnn.RStateGrad) (haltGrads, haltGradsR [][]float64, mixGrads [][]RGrad) {
+	haltGrads = make([][]float64, len(a.Input))
+	haltGradsR = make([][]float64, len(a.Input))
+	mixGrads = make([][]RGrad, len(a.Input))
+	for i, probs := range a.Probs {
+		probsR := a.ProbsR[i]
+		probsGrad := make(linalg.Vector, len(probs))
+		probsGradR := make(linalg.Vector, len(probs))
+		if u != nil {
+			for j, stepOut := range a.StepOuts[i] {
+				probsGrad[j] = u[i].Dot(stepOut[1:])
+				probsGradR[j] = uR[i].Dot(stepOut[1:]) + u[i].Dot(a.StepOutsR[i][j][1:])
+			}
+		}
+		if s != nil && s[i] != nil {
+			bsg := s[i].(blockRStateGrad)
+			var mixProbsGrad, mixProbsGradR linalg.Vector
+			mixProbsGrad, mixProbsGradR, mixGrads[i] = a.Mixer.MixRGradient(a.StepStates[i],
+				probs, probsR, bsg.DataGrad, bsg.DataGradR, bsg.StructGrad)
+			probsGrad.Add(mixProbsGrad)
+			probsGradR.Add(mixProbsGradR)
+		}
+
+		haltGrads[i] = make([]float64, len(probs))
+		haltGradsR[i] = make([]float64, len(probs))
+		lastGrad := probsGrad[len(probs)-1]
+		lastGradR := probsGradR[len(probs)-1]
+		for j, halt := range a.Halting[i][:len(probs)-1] {
+			haltR := a.HaltingR[i][j]
+			haltGrad := probsGrad[j] - lastGrad - a.Block.PonderCost
+			haltGradR := probsGradR[j] - lastGradR
+			haltGrads[i][j] = haltGrad * halt * (1 - halt)
+			haltGradsR[i][j] = haltGradR*halt*(1-halt) + haltGrad*(1-2*halt)*haltR
+		}
+	}
+	return
+}
+
+// stateUpstream is like actResult.stateUpstream, but for
+// RStateGrads.
+func (a *actRResult) stateUpstream(s, downstream []rnn.RStateGrad, mixGrads [][]RGrad,
+	idx, stepIdx int) rnn.RStateGrad {
+	var mixGrad RGrad
+	if mixGrads[idx] != nil {
+		mixGrad = mixGrads[idx][stepIdx]
+	}
+	if stepIdx == len(a.Probs[idx])-1 {
+		if s == nil || s[idx] == nil {
+			return nil
+		}
+		dataSize := a.Block.Block.Struct.DataSize()
+		return blockRStateGrad{
+			BlockGrad:  s[idx].(blockRStateGrad).BlockGrad,
+			StructGrad: mixGrad,
+			DataGrad:   make(linalg.Vector, dataSize),
+			DataGradR:  make(linalg.Vector, dataSize),
+		}
+	}
+	next := downstream[idx].(blockRStateGrad)
+	return blockRStateGrad{
+		BlockGrad:  next.BlockGrad,
+		StructGrad: a.Mixer.AddRGrads(next.StructGrad, mixGrad),
+		DataGrad:   next.DataGrad,
+		DataGradR:  next.DataGradR,
+	}
+}
@@ -0,0 +1,354 @@
+package neuralstruct
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/rnn"
+	"github.com/unixpickle/weakai/rnn/rnntest"
+)
+
+const (
+	actTestBatchSize = 2
+	actTestSeqLen    = 3
+	actTestInSize    = 4
+)
+
+func TestACTBlockGradient(t *testing.T) {
+	structs := []RStruct{
+		&Stack{VectorSize: 3, PushBias: 1},
+		&Queue{VectorSize: 3, PushBias: 1},
+		&Queue{VectorSize: 3, PushBias: 1, LogSpace: true},
+		RAggregate{&Stack{VectorSize: 2, PushBias: 1}, &Queue{VectorSize: 2}},
+	}
+	for _, structure := range structs {
+		const outSize = 3
+		block := &ACTBlock{
+			Block: &Block{
+				Block: rnn.NewLSTM(actTestInSize+structure.DataSize(),
+					structure.ControlSize()+outSize),
+				Struct:   structure,
+				Activate: true,
+			},
+			MaxSteps:   4,
+			PonderCost: 0.1,
+		}
+		checker := newACTChecker(block)
+		checker.Check(t)
+		checker.CheckR(t)
+	}
+}
+
+func TestACTBlockR(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	structure := RAggregate{&Stack{VectorSize: 2, PushBias: 1}, &Queue{VectorSize: 2}}
+	block := &ACTBlock{
+		Block: &Block{
+			Block: rnn.NewLSTM(actTestInSize+structure.DataSize(),
+				structure.ControlSize()+3),
+			Struct:   structure,
+			Activate: true,
+		},
+		MaxSteps: 4,
+	}
+	checker := rnntest.NewChecker4In(block, block)
+	checker.FullCheck(t)
+}
+
+func TestACTBlockNonMixer(t *testing.T) {
+	structs := []RStruct{
+		&RChain{First: &Stack{VectorSize: 2}, Second: &Queue{VectorSize: 2}},
+		RAggregate{&Stack{VectorSize: 2}, &RingBuffer{VectorSize: 2, Capacity: 2}},
+	}
+	for i, structure := range structs {
+		block := &ACTBlock{
+			Block: &Block{
+				Block: rnn.NewLSTM(actTestInSize+structure.DataSize(),
+					structure.ControlSize()+1),
+				Struct: structure,
+			},
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("struct %d: expected StartState to panic", i)
+				}
+			}()
+			block.StartState()
+		}()
+		data, err := block.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DeserializeACTBlock(data); err == nil {
+			t.Errorf("struct %d: expected a deserialization error", i)
+		}
+	}
+}
+
+func TestACTBlockHalting(t *testing.T) {
+	structure := &Stack{VectorSize: 3}
+	block := &ACTBlock{
+		Block: &Block{
+			Block:  rnn.NewLSTM(actTestInSize+3, structure.ControlSize()+2),
+			Struct: structure,
+		},
+		MaxSteps: 3,
+	}
+	checker := newACTChecker(block)
+	for _, res := range checker.forward() {
+		for i, probs := range res.Probs {
+			if len(probs) > block.MaxSteps {
+				t.Errorf("too many steps: %d", len(probs))
+			}
+			var sum float64
+			for _, p := range probs {
+				sum += p
+			}
+			if math.Abs(sum-1) > 1e-8 {
+				t.Errorf("probabilities should sum to 1 but got %f", sum)
+			}
+			expectedPonder := float64(len(probs)) + probs[len(probs)-1]
+			if math.Abs(res.Ponder[i]-expectedPonder) > 1e-8 {
+				t.Errorf("ponder should be %f but got %f", expectedPonder, res.Ponder[i])
+			}
+		}
+	}
+}
+
+func TestACTBlockSerialize(t *testing.T) {
+	block := &ACTBlock{
+		Block: &Block{
+			Block:  rnn.NewLSTM(7, 9),
+			Struct: &Stack{VectorSize: 3},
+		},
+		MaxSteps:   5,
+		Epsilon:    0.1,
+		PonderCost: 0.01,
+	}
+	data, err := serializer.SerializeWithType(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBlock, ok := decoded.(*ACTBlock)
+	if !ok {
+		t.Fatalf("type shouldn't be %T", decoded)
+	}
+	if newBlock.MaxSteps != block.MaxSteps || newBlock.Epsilon != block.Epsilon ||
+		newBlock.PonderCost != block.PonderCost {
+		t.Errorf("bad options: %+v", newBlock)
+	}
+}
+
+// actChecker checks the gradients of an ACTBlock using
+// an objective which includes the ponder cost.
+type actChecker struct {
+	Block    *ACTBlock
+	Inputs   [][]*autofunc.Variable
+	Upstream [][]linalg.Vector
+	Vars     []*autofunc.Variable
+}
+
+func newACTChecker(b *ACTBlock) *actChecker {
+	res := &actChecker{Block: b}
+	for t := 0; t < actTestSeqLen; t++ {
+		var inputs []*autofunc.Variable
+		for i := 0; i < actTestBatchSize; i++ {
+			v := &autofunc.Variable{Vector: testRandVec(actTestInSize)}
+			inputs = append(inputs, v)
+			res.Vars = append(res.Vars, v)
+		}
+		res.Inputs = append(res.Inputs, inputs)
+	}
+	res.Vars = append(res.Vars, b.Parameters()...)
+	for _, out := range res.forward() {
+		var upstream []linalg.Vector
+		for _, vec := range out.Outputs() {
+			upstream = append(upstream, testRandVec(len(vec)))
+		}
+		res.Upstream = append(res.Upstream, upstream)
+	}
+	return res
+}
+
+func (a *actChecker) Check(t *testing.T) {
+	g := a.gradient(a.Upstream)
+
+	const epsilon = 1e-6
+	for varIdx, v := range a.Vars {
+		for i := range v.Vector {
+			old := v.Vector[i]
+			v.Vector[i] = old + epsilon
+			plus := a.objective()
+			v.Vector[i] = old - epsilon
+			minus := a.objective()
+			v.Vector[i] = old
+			expected := (plus - minus) / (2 * epsilon)
+			actual := g[v][i]
+			if math.Abs(expected-actual) > 1e-4 {
+				t.Errorf("var %d, entry %d: expected %f but got %f", varIdx, i,
+					expected, actual)
+			}
+		}
+	}
+}
+
+// CheckR checks the r-gradients of the ACTBlock in a
+// random direction by differentiating the gradients.
+func (a *actChecker) CheckR(t *testing.T) {
+	const epsilon = 1e-5
+	rv := a.stableDirection(t, epsilon)
+	var upstreamR [][]linalg.Vector
+	for _, upstream := range a.Upstream {
+		var vecs []linalg.Vector
+		for _, u := range upstream {
+			vecs = append(vecs, testRandVec(len(u)))
+		}
+		upstreamR = append(upstreamR, vecs)
+	}
+
+	g := autofunc.NewGradient(a.Vars)
+	rg := autofunc.NewRGradient(a.Vars)
+	var states []rnn.RState
+	for i := 0; i < actTestBatchSize; i++ {
+		states = append(states, a.Block.StartRState(rv))
+	}
+	startStates := states
+	var results []rnn.BlockRResult
+	for _, inputs := range a.Inputs {
+		var inRes []autofunc.RResult
+		for _, in := range inputs {
+			inRes = append(inRes, autofunc.NewRVariable(in, rv))
+		}
+		out := a.Block.ApplyBlockR(rv, states, inRes)
+		results = append(results, out)
+		states = out.RStates()
+	}
+	var stateGrad []rnn.RStateGrad
+	for t := len(results) - 1; t >= 0; t-- {
+		stateGrad = results[t].PropagateRGradient(a.Upstream[t], upstreamR[t], stateGrad,
+			rg, g)
+	}
+	a.Block.PropagateStartR(startStates, stateGrad, rg, g)
+
+	a.shift(rv, epsilon)
+	plus := a.gradient(a.Upstream)
+	a.shift(rv, -2*epsilon)
+	minus := a.gradient(a.Upstream)
+	a.shift(rv, epsilon)
+
+	// The ponder cost does not depend on the upstream.
+	ponderCost := a.Block.PonderCost
+	a.Block.PonderCost = 0
+	upstreamGrad := a.gradient(upstreamR)
+	a.Block.PonderCost = ponderCost
+
+	for varIdx, v := range a.Vars {
+		for i := range v.Vector {
+			expected := (plus[v][i]-minus[v][i])/(2*epsilon) + upstreamGrad[v][i]
+			actual := rg[v][i]
+			if math.Abs(expected-actual) > 1e-3*math.Max(1, math.Abs(expected)) {
+				t.Errorf("var %d, entry %d: expected R %f but got %f", varIdx, i,
+					expected, actual)
+			}
+		}
+	}
+}
+
+// stableDirection finds a random direction in which the
+// parameters can be moved by epsilon without changing the
+// number of micro-steps, since finite differences are
+// meaningless across a change in the number of steps.
+func (a *actChecker) stableDirection(t *testing.T, epsilon float64) autofunc.RVector {
+	for attempt := 0; attempt < 10; attempt++ {
+		rv := autofunc.RVector{}
+		for _, v := range a.Vars {
+			rv[v] = testRandVec(len(v.Vector))
+		}
+		steps := a.stepCounts()
+		a.shift(rv, epsilon)
+		plusSteps := a.stepCounts()
+		a.shift(rv, -2*epsilon)
+		minusSteps := a.stepCounts()
+		a.shift(rv, epsilon)
+		if reflect.DeepEqual(steps, plusSteps) && reflect.DeepEqual(steps, minusSteps) {
+			return rv
+		}
+	}
+	t.Fatal("could not find a direction with a fixed number of steps")
+	return nil
+}
+
+func (a *actChecker) shift(rv autofunc.RVector, scale float64) {
+	for _, v := range a.Vars {
+		v.Vector.Add(rv[v].Copy().Scale(scale))
+	}
+}
+
+// stepCounts returns the number of micro-steps for every
+// timestep and sequence.
+func (a *actChecker) stepCounts() [][]int {
+	var res [][]int
+	for _, out := range a.forward() {
+		var counts []int
+		for _, probs := range out.Probs {
+			counts = append(counts, len(probs))
+		}
+		res = append(res, counts)
+	}
+	return res
+}
+
+func (a *actChecker) gradient(upstream [][]linalg.Vector) autofunc.Gradient {
+	g := autofunc.NewGradient(a.Vars)
+	results := a.forward()
+	var stateGrad []rnn.StateGrad
+	for t := len(results) - 1; t >= 0; t-- {
+		stateGrad = results[t].PropagateGradient(upstream[t], stateGrad, g)
+	}
+	var startStates []rnn.State
+	for i := 0; i < actTestBatchSize; i++ {
+		startStates = append(startStates, a.Block.StartState())
+	}
+	a.Block.PropagateStart(startStates, stateGrad, g)
+	return g
+}
+
+func (a *actChecker) forward() []*actResult {
+	var states []rnn.State
+	for i := 0; i < actTestBatchSize; i++ {
+		states = append(states, a.Block.StartState())
+	}
+	var res []*actResult
+	for _, inputs := range a.Inputs {
+		var inRes []autofunc.Result
+		for _, in := range inputs {
+			inRes = append(inRes, in)
+		}
+		out := a.Block.ApplyBlock(states, inRes).(*actResult)
+		res = append(res, out)
+		states = out.States()
+	}
+	return res
+}
+
+func (a *actChecker) objective() float64 {
+	var res float64
+	for t, out := range a.forward() {
+		for i, vec := range out.Outputs() {
+			res += vec.Dot(a.Upstream[t][i])
+			res += a.Block.PonderCost * out.Ponder[i]
+		}
+	}
+	return res
+}
@@ -0,0 +1,208 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+func init() {
+	var o Oneplus
+	serializer.RegisterTypedDeserializer(o.SerializerType(), DeserializeOneplus)
+	var s SegmentSoftmax
+	serializer.RegisterTypedDeserializer(s.SerializerType(), DeserializeSegmentSoftmax)
+}
+
+// Oneplus is an activation function which computes
+// 1 + log(1 + e^x) for each component of its input.
+//
+// It is useful for squashing strengths which must be at
+// least one.
+// It is computed stably, so large inputs do not produce
+// infinite outputs or NaN gradients.
+type Oneplus struct{}
+
+// DeserializeOneplus deserializes a Oneplus.
+func DeserializeOneplus(d []byte) (*Oneplus, error) {
+	return &Oneplus{}, nil
+}
+
+// Apply applies the activation function.
+func (o *Oneplus) Apply(in autofunc.Result) autofunc.Result {
+	inVec := in.Output()
+	res := &oneplusResult{
+		OutputVec: make(linalg.Vector, len(inVec)),
+		Sigmoids:  make(linalg.Vector, len(inVec)),
+		Input:     in,
+	}
+	for i, x := range inVec {
+		res.OutputVec[i] = 1 + softplus(x)
+		res.Sigmoids[i] = stableSigmoid(x)
+	}
+	return res
+}
+
+// ApplyR is like Apply but with r-operator support.
+func (o *Oneplus) ApplyR(rv autofunc.RVector, in autofunc.RResult) autofunc.RResult {
+	inVec, inVecR := in.Output(), in.ROutput()
+	res := &oneplusRResult{
+		OutputVec:  make(linalg.Vector, len(inVec)),
+		ROutputVec: make(linalg.Vector, len(inVec)),
+		Sigmoids:   make(linalg.Vector, len(inVec)),
+		Input:      in,
+	}
+	for i, x := range inVec {
+		sig := stableSigmoid(x)
+		res.OutputVec[i] = 1 + softplus(x)
+		res.ROutputVec[i] = sig * inVecR[i]
+		res.Sigmoids[i] = sig
+	}
+	return res
+}
+
+// SerializerType returns the unique ID used to serialize
+// a Oneplus with the serializer package.
+func (o *Oneplus) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.Oneplus"
+}
+
+// Serialize serializes the activation function.
+func (o *Oneplus) Serialize() ([]byte, error) {
+	return []byte{}, nil
+}
+
+type oneplusResult struct {
+	OutputVec linalg.Vector
+	Sigmoids  linalg.Vector
+	Input     autofunc.Result
+}
+
+func (o *oneplusResult) Output() linalg.Vector {
+	return o.OutputVec
+}
+
+func (o *oneplusResult) Constant(g autofunc.Gradient) bool {
+	return o.Input.Constant(g)
+}
+
+func (o *oneplusResult) PropagateGradient(upstream linalg.Vector, g autofunc.Gradient) {
+	if o.Input.Constant(g) {
+		return
+	}
+	downstream := make(linalg.Vector, len(upstream))
+	for i, u := range upstream {
+		downstream[i] = u * o.Sigmoids[i]
+	}
+	o.Input.PropagateGradient(downstream, g)
+}
+
+type oneplusRResult struct {
+	OutputVec  linalg.Vector
+	ROutputVec linalg.Vector
+	Sigmoids   linalg.Vector
+	Input      autofunc.RResult
+}
+
+func (o *oneplusRResult) Output() linalg.Vector {
+	return o.OutputVec
+}
+
+func (o *oneplusRResult) ROutput() linalg.Vector {
+	return o.ROutputVec
+}
+
+func (o *oneplusRResult) Constant(rg autofunc.RGradient, g autofunc.Gradient) bool {
+	return o.Input.Constant(rg, g)
+}
+
+func (o *oneplusRResult) PropagateRGradient(upstream, upstreamR linalg.Vector,
+	rg autofunc.RGradient, g autofunc.Gradient) {
+	if o.Input.Constant(rg, g) {
+		return
+	}
+	inR := o.Input.ROutput()
+	downstream := make(linalg.Vector, len(upstream))
+	downstreamR := make(linalg.Vector, len(upstream))
+	for i, u := range upstream {
+		sig := o.Sigmoids[i]
+		downstream[i] = u * sig
+		downstreamR[i] = upstreamR[i]*sig + u*sig*(1-sig)*inR[i]
+	}
+	o.Input.PropagateRGradient(downstream, downstreamR, rg, g)
+}
+
+// softplus computes log(1 + e^x) without overflowing.
+func softplus(x float64) float64 {
+	return math.Max(x, 0) + math.Log1p(math.Exp(-math.Abs(x)))
+}
+
+// stableSigmoid computes 1/(1 + e^-x) without
+// overflowing.
+func stableSigmoid(x float64) float64 {
+	if x >= 0 {
+		return 1 / (1 + math.Exp(-x))
+	}
+	exp := math.Exp(x)
+	return exp / (1 + exp)
+}
+
+// SegmentSoftmax is an activation function which splits
+// its input into equally sized segments and applies a
+// softmax to each of them.
+type SegmentSoftmax struct {
+	SegmentSize int
+}
+
+// DeserializeSegmentSoftmax deserializes a SegmentSoftmax.
+func DeserializeSegmentSoftmax(d []byte) (*SegmentSoftmax, error) {
+	var res SegmentSoftmax
+	if err := json.Unmarshal(d, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Apply applies the activation function.
+func (s *SegmentSoftmax) Apply(rawIn autofunc.Result) autofunc.Result {
+	if len(rawIn.Output())%s.SegmentSize != 0 {
+		panic("input size must be divisible by segment size")
+	}
+	return autofunc.Pool(rawIn, func(in autofunc.Result) autofunc.Result {
+		softmax := autofunc.Softmax{}
+		var segments []autofunc.Result
+		for i := 0; i < len(in.Output()); i += s.SegmentSize {
+			segments = append(segments, softmax.Apply(autofunc.Slice(in, i, i+s.SegmentSize)))
+		}
+		return autofunc.Concat(segments...)
+	})
+}
+
+// ApplyR is like Apply but with r-operator support.
+func (s *SegmentSoftmax) ApplyR(rv autofunc.RVector, rawIn autofunc.RResult) autofunc.RResult {
+	if len(rawIn.Output())%s.SegmentSize != 0 {
+		panic("input size must be divisible by segment size")
+	}
+	return autofunc.PoolR(rawIn, func(in autofunc.RResult) autofunc.RResult {
+		softmax := autofunc.Softmax{}
+		var segments []autofunc.RResult
+		for i := 0; i < len(in.Output()); i += s.SegmentSize {
+			segments = append(segments, softmax.ApplyR(rv, autofunc.SliceR(in, i,
+				i+s.SegmentSize)))
+		}
+		return autofunc.ConcatR(segments...)
+	})
+}
+
+// SerializerType returns the unique ID used to serialize
+// a SegmentSoftmax with the serializer package.
+func (s *SegmentSoftmax) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.SegmentSoftmax"
+}
+
+// Serialize serializes the activation function.
+func (s *SegmentSoftmax) Serialize() ([]byte, error) {
+	return json.Marshal(s)
+}
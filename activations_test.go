@@ -0,0 +1,69 @@
+package neuralstruct
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/autofunc/functest"
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestOneplusOutput(t *testing.T) {
+	in := &autofunc.Variable{Vector: []float64{-3, 0, 2}}
+	out := (&Oneplus{}).Apply(in).Output()
+	for i, x := range in.Vector {
+		expected := 1 + math.Log(1+math.Exp(x))
+		if math.Abs(out[i]-expected) > 1e-5 {
+			t.Errorf("entry %d should be %f but it's %f", i, expected, out[i])
+		}
+	}
+}
+
+func TestOneplusLargeInputs(t *testing.T) {
+	in := &autofunc.Variable{Vector: []float64{-1000, 800, 1000}}
+	out := (&Oneplus{}).Apply(in)
+	expected := []float64{1, 801, 1001}
+	for i, x := range out.Output() {
+		if math.Abs(x-expected[i]) > 1e-5 {
+			t.Errorf("entry %d should be %f but it's %f", i, expected[i], x)
+		}
+	}
+	grad := autofunc.NewGradient([]*autofunc.Variable{in})
+	out.PropagateGradient([]float64{1, 1, 1}, grad)
+	expectedGrad := []float64{0, 1, 1}
+	for i, x := range grad[in] {
+		if math.Abs(x-expectedGrad[i]) > 1e-5 {
+			t.Errorf("gradient %d should be %f but it's %f", i, expectedGrad[i], x)
+		}
+	}
+}
+
+func TestSegmentSoftmaxOutput(t *testing.T) {
+	in := &autofunc.Variable{Vector: []float64{1, 2, 3, -1, 0, 1}}
+	out := (&SegmentSoftmax{SegmentSize: 3}).Apply(in).Output()
+	if !statesEqual(out[:3], out[3:]) {
+		t.Errorf("segments should match but got %v", out)
+	}
+	var sum float64
+	for _, x := range out[:3] {
+		sum += x
+	}
+	if math.Abs(sum-1) > 1e-5 {
+		t.Errorf("segment sum should be 1 but it's %f", sum)
+	}
+}
+
+func TestActivationDerivatives(t *testing.T) {
+	in := &autofunc.Variable{Vector: []float64{1, -2, 0.5, 3, -1, 0.2}}
+	rv := autofunc.RVector{in: linalg.Vector{0.5, -0.3, 1, 0.2, 0.7, -0.1}}
+	for _, f := range []autofunc.RFunc{&Oneplus{}, &SegmentSoftmax{SegmentSize: 3}} {
+		checker := &functest.RFuncChecker{
+			F:     f,
+			Vars:  []*autofunc.Variable{in},
+			Input: in,
+			RV:    rv,
+		}
+		checker.FullCheck(t)
+	}
+}
@@ -72,6 +72,22 @@ func (a Aggregate) StartState() State {
 	return &res
 }
 
+// StartInferenceState is like StartState, but it returns
+// a forward-only state.
+// Every sub-state is a forward-only state if its struct
+// is an InferenceStruct.
+func (a Aggregate) StartInferenceState() State {
+	res := &aggregateInferenceState{
+		Structs:    a,
+		JoinedData: make(linalg.Vector, a.DataSize()),
+	}
+	for _, s := range a {
+		res.States = append(res.States, startInferenceState(s))
+	}
+	res.joinData()
+	return res
+}
+
 // SerializerType returns the unique ID used to serialize
 // Aggregates with the serializer package.
 func (a Aggregate) SerializerType() string {
@@ -110,6 +126,157 @@ func (a Aggregate) SuggestedActivation() neuralnet.Layer {
 	return pa
 }
 
+// MixStates mixes the states of each structure.
+// All of the structures must be Mixers.
+func (a Aggregate) MixStates(states []State, weights linalg.Vector) State {
+	res := &aggregateState{Structs: a, Workers: states[0].(*aggregateState).Workers}
+	for i, s := range a {
+		mixed := structMixer(s).MixStates(a.subStates(states, i), weights)
+		res.States = append(res.States, mixed)
+		res.JoinedData = append(res.JoinedData, mixed.Data()...)
+	}
+	return res
+}
+
+// MixGradient propagates a gradient through MixStates.
+func (a Aggregate) MixGradient(states []State, weights, dataGrad linalg.Vector,
+	upstream Grad) (linalg.Vector, []Grad) {
+	var gradList []Grad
+	if upstream != nil {
+		gradList = upstream.([]Grad)
+	}
+	weightsGrad := make(linalg.Vector, len(states))
+	grads := make([]Grad, len(states))
+	for i := range grads {
+		grads[i] = make([]Grad, len(a))
+	}
+	var dataIdx int
+	for i, s := range a {
+		subDataGrad := dataGrad[dataIdx : dataIdx+s.DataSize()]
+		dataIdx += s.DataSize()
+		var subUpstream Grad
+		if gradList != nil {
+			subUpstream = gradList[i]
+		}
+		subWeightsGrad, subGrads := structMixer(s).MixGradient(a.subStates(states, i),
+			weights, subDataGrad, subUpstream)
+		weightsGrad.Add(subWeightsGrad)
+		for j, subGrad := range subGrads {
+			grads[j].([]Grad)[i] = subGrad
+		}
+	}
+	return weightsGrad, grads
+}
+
+// AddGrads adds the upstream gradients of each structure.
+func (a Aggregate) AddGrads(g1, g2 Grad) Grad {
+	if g1 == nil {
+		return g2
+	} else if g2 == nil {
+		return g1
+	}
+	l1, l2 := g1.([]Grad), g2.([]Grad)
+	res := make([]Grad, len(a))
+	for i, s := range a {
+		res[i] = structMixer(s).AddGrads(l1[i], l2[i])
+	}
+	return res
+}
+
+// NextStates advances a batch of aggregate states,
+// batching the states of every structure which is a
+// BatchStruct.
+func (a Aggregate) NextStates(states []State, controls []linalg.Vector) []State {
+	newStates := make([]aggregateState, len(states))
+	for i := range newStates {
+		newStates[i].Structs = a
+		newStates[i].Workers = states[i].(*aggregateState).Workers
+	}
+	var ctrlIdx int
+	for i, s := range a {
+		subControls := make([]linalg.Vector, len(controls))
+		for j, ctrl := range controls {
+			subControls[j] = ctrl[ctrlIdx : ctrlIdx+s.ControlSize()]
+		}
+		ctrlIdx += s.ControlSize()
+		for j, sub := range nextStates(s, a.subStates(states, i), subControls) {
+			newStates[j].States = append(newStates[j].States, sub)
+			newStates[j].JoinedData = append(newStates[j].JoinedData, sub.Data()...)
+		}
+	}
+	res := make([]State, len(states))
+	for i := range newStates {
+		res[i] = &newStates[i]
+	}
+	return res
+}
+
+// StateGradients propagates gradients through a batch of
+// aggregate states, batching the states of every
+// structure which is a BatchStruct.
+func (a Aggregate) StateGradients(states []State, dataGrads []linalg.Vector,
+	upstream []Grad) ([]linalg.Vector, []Grad) {
+	subCtrlGrads := make([][]linalg.Vector, len(a))
+	subGrads := make([][]Grad, len(a))
+	var workers int
+	if len(states) > 0 {
+		workers = states[0].(*aggregateState).Workers
+	}
+	dataOffsets := a.dataOffsets()
+	parallelFor(len(a), workers, func(i int) {
+		s := a[i]
+		subDataGrads := make([]linalg.Vector, len(dataGrads))
+		for j, dataGrad := range dataGrads {
+			subDataGrads[j] = dataGrad[dataOffsets[i] : dataOffsets[i]+s.DataSize()]
+		}
+		var subUpstream []Grad
+		if upstream != nil {
+			subUpstream = make([]Grad, len(upstream))
+			for j, up := range upstream {
+				if up != nil {
+					subUpstream[j] = up.([]Grad)[i]
+				}
+			}
+		}
+		subCtrlGrads[i], subGrads[i] = stateGradients(s, a.subStates(states, i),
+			subDataGrads, subUpstream)
+	})
+
+	ctrlGrads := make([]linalg.Vector, len(states))
+	gradLists := make([][]Grad, len(states))
+	for i := range a {
+		for j, subCtrlGrad := range subCtrlGrads[i] {
+			ctrlGrads[j] = append(ctrlGrads[j], subCtrlGrad...)
+			gradLists[j] = append(gradLists[j], subGrads[i][j])
+		}
+	}
+	downstream := make([]Grad, len(states))
+	for i, list := range gradLists {
+		downstream[i] = list
+	}
+	return ctrlGrads, downstream
+}
+
+// dataOffsets returns the index of each structure's data
+// in the aggregate's data vector.
+func (a Aggregate) dataOffsets() []int {
+	res := make([]int, len(a))
+	var idx int
+	for i, s := range a {
+		res[i] = idx
+		idx += s.DataSize()
+	}
+	return res
+}
+
+func (a Aggregate) subStates(states []State, idx int) []State {
+	res := make([]State, len(states))
+	for i, s := range states {
+		res[i] = s.(*aggregateState).States[idx]
+	}
+	return res
+}
+
 // An RAggregate is like an Aggregate, but with support
 // for the r-operator.
 type RAggregate []RStruct
@@ -146,6 +313,12 @@ func (r RAggregate) StartState() State {
 	return r.aggregate().StartState()
 }
 
+// StartInferenceState is like
+// Aggregate.StartInferenceState().
+func (r RAggregate) StartInferenceState() State {
+	return r.aggregate().StartInferenceState()
+}
+
 // StartRState is like StartState, but for RStates.
 func (r RAggregate) StartRState() RState {
 	var res aggregateRState
@@ -197,6 +370,96 @@ func (r RAggregate) SuggestedActivation() neuralnet.Layer {
 	return pa
 }
 
+// MixStates is like Aggregate.MixStates().
+func (r RAggregate) MixStates(states []State, weights linalg.Vector) State {
+	return r.aggregate().MixStates(states, weights)
+}
+
+// MixGradient is like Aggregate.MixGradient().
+func (r RAggregate) MixGradient(states []State, weights, dataGrad linalg.Vector,
+	upstream Grad) (linalg.Vector, []Grad) {
+	return r.aggregate().MixGradient(states, weights, dataGrad, upstream)
+}
+
+// AddGrads is like Aggregate.AddGrads().
+func (r RAggregate) AddGrads(g1, g2 Grad) Grad {
+	return r.aggregate().AddGrads(g1, g2)
+}
+
+// MixRStates is like MixStates, but for RStates.
+// All of the structures must be RMixers.
+func (r RAggregate) MixRStates(states []RState, weights, weightsR linalg.Vector) RState {
+	res := &aggregateRState{Structs: r, Workers: states[0].(*aggregateRState).Workers}
+	for i, s := range r {
+		mixed := structRMixer(s).MixRStates(r.subRStates(states, i), weights, weightsR)
+		res.States = append(res.States, mixed)
+		res.JoinedData = append(res.JoinedData, mixed.Data()...)
+		res.JoinedRData = append(res.JoinedRData, mixed.RData()...)
+	}
+	return res
+}
+
+// MixRGradient propagates a gradient through MixRStates.
+func (r RAggregate) MixRGradient(states []RState, weights, weightsR, dataGrad,
+	dataGradR linalg.Vector, upstream RGrad) (linalg.Vector, linalg.Vector, []RGrad) {
+	var gradList []RGrad
+	if upstream != nil {
+		gradList = upstream.([]RGrad)
+	}
+	weightsGrad := make(linalg.Vector, len(states))
+	weightsGradR := make(linalg.Vector, len(states))
+	grads := make([]RGrad, len(states))
+	for i := range grads {
+		grads[i] = make([]RGrad, len(r))
+	}
+	var dataIdx int
+	for i, s := range r {
+		subDataGrad := dataGrad[dataIdx : dataIdx+s.DataSize()]
+		subDataGradR := dataGradR[dataIdx : dataIdx+s.DataSize()]
+		dataIdx += s.DataSize()
+		var subUpstream RGrad
+		if gradList != nil {
+			subUpstream = gradList[i]
+		}
+		subWeightsGrad, subWeightsGradR, subGrads := structRMixer(s).MixRGradient(
+			r.subRStates(states, i), weights, weightsR, subDataGrad, subDataGradR,
+			subUpstream)
+		weightsGrad.Add(subWeightsGrad)
+		weightsGradR.Add(subWeightsGradR)
+		for j, subGrad := range subGrads {
+			grads[j].([]RGrad)[i] = subGrad
+		}
+	}
+	return weightsGrad, weightsGradR, grads
+}
+
+// AddRGrads adds the upstream r-gradients of each
+// structure.
+func (r RAggregate) AddRGrads(g1, g2 RGrad) RGrad {
+	if g1 == nil {
+		return g2
+	} else if g2 == nil {
+		return g1
+	}
+	l1, l2 := g1.([]RGrad), g2.([]RGrad)
+	res := make([]RGrad, len(r))
+	for i, s := range r {
+		res[i] = structRMixer(s).AddRGrads(l1[i], l2[i])
+	}
+	return res
+}
+
+// NextStates is like Aggregate.NextStates().
+func (r RAggregate) NextStates(states []State, controls []linalg.Vector) []State {
+	return r.aggregate().NextStates(states, controls)
+}
+
+// StateGradients is like Aggregate.StateGradients().
+func (r RAggregate) StateGradients(states []State, dataGrads []linalg.Vector,
+	upstream []Grad) ([]linalg.Vector, []Grad) {
+	return r.aggregate().StateGradients(states, dataGrads, upstream)
+}
+
 func (r RAggregate) aggregate() Aggregate {
 	a := make(Aggregate, len(r))
 	for i, s := range r {
@@ -205,10 +468,22 @@ func (r RAggregate) aggregate() Aggregate {
 	return a
 }
 
+func (r RAggregate) subRStates(states []RState, idx int) []RState {
+	res := make([]RState, len(states))
+	for i, s := range states {
+		res[i] = s.(*aggregateRState).States[idx]
+	}
+	return res
+}
+
 type aggregateState struct {
 	Structs    []Struct
 	States     []State
 	JoinedData linalg.Vector
+
+	// Workers is the maximum number of goroutines to use
+	// for propagating gradients through the sub-states.
+	Workers int
 }
 
 func (a *aggregateState) Data() linalg.Vector {
@@ -220,29 +495,58 @@ func (a *aggregateState) Gradient(upstream linalg.Vector, grad Grad) (linalg.Vec
 	if grad != nil {
 		gradList = grad.([]Grad)
 	}
-	var dataIdx int
-	var downstream linalg.Vector
-	var downstreamGrad []Grad
-	for i, s := range a.States {
-		dataSize := a.Structs[i].DataSize()
-		subUpstream := upstream[dataIdx : dataIdx+dataSize]
-		dataIdx += dataSize
-
-		var subDownstream linalg.Vector
-		var subGrad Grad
+	dataOffsets := Aggregate(a.Structs).dataOffsets()
+	subDownstream := make([]linalg.Vector, len(a.States))
+	downstreamGrad := make([]Grad, len(a.States))
+	parallelFor(len(a.States), a.Workers, func(i int) {
+		dataIdx := dataOffsets[i]
+		subUpstream := upstream[dataIdx : dataIdx+a.Structs[i].DataSize()]
 		if gradList == nil {
-			subDownstream, subGrad = s.Gradient(subUpstream, nil)
+			subDownstream[i], downstreamGrad[i] = a.States[i].Gradient(subUpstream, nil)
 		} else {
-			subDownstream, subGrad = s.Gradient(subUpstream, gradList[i])
+			subDownstream[i], downstreamGrad[i] = a.States[i].Gradient(subUpstream,
+				gradList[i])
 		}
-		downstream = append(downstream, subDownstream...)
-		downstreamGrad = append(downstreamGrad, subGrad)
+	})
+	var downstream linalg.Vector
+	for _, sub := range subDownstream {
+		downstream = append(downstream, sub...)
 	}
 	return downstream, downstreamGrad
 }
 
+// Detach detaches every sub-state.
+// Every sub-state must be a Detacher.
+func (a *aggregateState) Detach() State {
+	res := &aggregateState{
+		Structs:    a.Structs,
+		JoinedData: a.JoinedData.Copy(),
+		Workers:    a.Workers,
+	}
+	for _, s := range a.States {
+		res.States = append(res.States, Detach(s))
+	}
+	return res
+}
+
+// DetachR is like Detach, but for an RState.
+// Every sub-state must be a Detacher, and every struct
+// must be an RStruct.
+func (a *aggregateState) DetachR() RState {
+	res := &aggregateRState{
+		JoinedData:  a.JoinedData.Copy(),
+		JoinedRData: make(linalg.Vector, len(a.JoinedData)),
+		Workers:     a.Workers,
+	}
+	for i, s := range a.States {
+		res.Structs = append(res.Structs, a.Structs[i].(RStruct))
+		res.States = append(res.States, detachR(s))
+	}
+	return res
+}
+
 func (a *aggregateState) NextState(ctrl linalg.Vector) State {
-	newState := &aggregateState{Structs: a.Structs}
+	newState := &aggregateState{Structs: a.Structs, Workers: a.Workers}
 	var ctrlIdx int
 	for i, s := range a.States {
 		ctrlSize := a.Structs[i].ControlSize()
@@ -260,6 +564,9 @@ type aggregateRState struct {
 	States      []RState
 	JoinedData  linalg.Vector
 	JoinedRData linalg.Vector
+
+	// Workers is like aggregateState.Workers.
+	Workers int
 }
 
 func (a *aggregateRState) Data() linalg.Vector {
@@ -276,35 +583,34 @@ func (a *aggregateRState) RGradient(upstream, upstreamR linalg.Vector,
 	if grad != nil {
 		gradList = grad.([]RGrad)
 	}
-	var dataIdx int
-	var downstream linalg.Vector
-	var downstreamR linalg.Vector
-	var downstreamGrad []RGrad
-	for i, s := range a.States {
+	dataOffsets := RAggregate(a.Structs).aggregate().dataOffsets()
+	subDownstream := make([]linalg.Vector, len(a.States))
+	subDownstreamR := make([]linalg.Vector, len(a.States))
+	downstreamGrad := make([]RGrad, len(a.States))
+	parallelFor(len(a.States), a.Workers, func(i int) {
+		dataIdx := dataOffsets[i]
 		dataSize := a.Structs[i].DataSize()
 		subUpstream := upstream[dataIdx : dataIdx+dataSize]
 		subUpstreamR := upstreamR[dataIdx : dataIdx+dataSize]
-		dataIdx += dataSize
-
-		var subDownstream linalg.Vector
-		var subDownstreamR linalg.Vector
-		var subGrad RGrad
 		if gradList == nil {
-			subDownstream, subDownstreamR, subGrad = s.RGradient(subUpstream,
-				subUpstreamR, nil)
+			subDownstream[i], subDownstreamR[i], downstreamGrad[i] = a.States[i].RGradient(
+				subUpstream, subUpstreamR, nil)
 		} else {
-			subDownstream, subDownstreamR, subGrad = s.RGradient(subUpstream,
-				subUpstreamR, gradList[i])
+			subDownstream[i], subDownstreamR[i], downstreamGrad[i] = a.States[i].RGradient(
+				subUpstream, subUpstreamR, gradList[i])
 		}
-		downstream = append(downstream, subDownstream...)
-		downstreamR = append(downstreamR, subDownstreamR...)
-		downstreamGrad = append(downstreamGrad, subGrad)
+	})
+	var downstream linalg.Vector
+	var downstreamR linalg.Vector
+	for i, sub := range subDownstream {
+		downstream = append(downstream, sub...)
+		downstreamR = append(downstreamR, subDownstreamR[i]...)
 	}
 	return downstream, downstreamR, downstreamGrad
 }
 
 func (a *aggregateRState) NextRState(ctrl, ctrlR linalg.Vector) RState {
-	newState := &aggregateRState{Structs: a.Structs}
+	newState := &aggregateRState{Structs: a.Structs, Workers: a.Workers}
 	var ctrlIdx int
 	for i, s := range a.States {
 		ctrlSize := a.Structs[i].ControlSize()
@@ -318,3 +624,40 @@ func (a *aggregateRState) NextRState(ctrl, ctrlR linalg.Vector) RState {
 	}
 	return newState
 }
+
+// aggregateInferenceState is a forward-only aggregate
+// state which is updated in place.
+type aggregateInferenceState struct {
+	Structs    Aggregate
+	States     []State
+	JoinedData linalg.Vector
+}
+
+func (a *aggregateInferenceState) Data() linalg.Vector {
+	return a.JoinedData
+}
+
+func (a *aggregateInferenceState) Gradient(upstream linalg.Vector,
+	grad Grad) (linalg.Vector, Grad) {
+	panic("cannot propagate through inference state")
+}
+
+func (a *aggregateInferenceState) NextState(ctrl linalg.Vector) State {
+	var ctrlIdx int
+	for i, s := range a.States {
+		ctrlSize := a.Structs[i].ControlSize()
+		a.States[i] = s.NextState(ctrl[ctrlIdx : ctrlIdx+ctrlSize])
+		ctrlIdx += ctrlSize
+	}
+	a.joinData()
+	return a
+}
+
+// joinData copies the data of the sub-states into
+// JoinedData.
+func (a *aggregateInferenceState) joinData() {
+	var dataIdx int
+	for _, s := range a.States {
+		dataIdx += copy(a.JoinedData[dataIdx:], s.Data())
+	}
+}
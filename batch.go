@@ -0,0 +1,62 @@
+package neuralstruct
+
+import "github.com/unixpickle/num-analysis/linalg"
+
+// nextStates advances a batch of states, using the
+// BatchStruct API if s supports it.
+func nextStates(s Struct, states []State, controls []linalg.Vector) []State {
+	if b, ok := batchStruct(s); ok {
+		return b.NextStates(states, controls)
+	}
+	res := make([]State, len(states))
+	for i, state := range states {
+		res[i] = state.NextState(controls[i])
+	}
+	return res
+}
+
+// stateGradients propagates gradients through a batch of
+// states, using the BatchStruct API if s supports it.
+func stateGradients(s Struct, states []State, dataGrads []linalg.Vector,
+	upstream []Grad) ([]linalg.Vector, []Grad) {
+	if b, ok := batchStruct(s); ok {
+		return b.StateGradients(states, dataGrads, upstream)
+	}
+	ctrlGrads := make([]linalg.Vector, len(states))
+	downstream := make([]Grad, len(states))
+	for i, state := range states {
+		var up Grad
+		if upstream != nil {
+			up = upstream[i]
+		}
+		ctrlGrads[i], downstream[i] = state.Gradient(dataGrads[i], up)
+	}
+	return ctrlGrads, downstream
+}
+
+func batchStruct(s Struct) (BatchStruct, bool) {
+	if n, ok := s.(*nopRStruct); ok {
+		s = n.Struct
+	}
+	b, ok := s.(BatchStruct)
+	return b, ok
+}
+
+// batchGroups groups the indices of a batch by a size,
+// such as the depth of each state, so that the entries in
+// a group can be stored as the rows of one matrix.
+// Groups are ordered by their first index.
+func batchGroups(count int, size func(i int) int) [][]int {
+	var res [][]int
+	groupIdx := map[int]int{}
+	for i := 0; i < count; i++ {
+		key := size(i)
+		if idx, ok := groupIdx[key]; ok {
+			res[idx] = append(res[idx], i)
+		} else {
+			groupIdx[key] = len(res)
+			res = append(res, []int{i})
+		}
+	}
+	return res
+}
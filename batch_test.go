@@ -0,0 +1,187 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+const (
+	batchTestSize  = 3
+	batchTestSteps = 4
+
+	benchmarkBatchSize = 16
+)
+
+func TestBatchStructs(t *testing.T) {
+	structs := []BatchStruct{
+		&Stack{VectorSize: 3},
+		&Stack{VectorSize: 3, NoReplace: true},
+		&Queue{VectorSize: 3},
+		&Stack{VectorSize: 3, Float32: true},
+		&Queue{VectorSize: 3, Float32: true},
+		&Queue{VectorSize: 3, LogSpace: true},
+		&Stack{VectorSize: 3, Checkpoint: 2},
+		&Queue{VectorSize: 3, Checkpoint: 2},
+		Aggregate{&Stack{VectorSize: 2}, &Queue{VectorSize: 3}, &RingBuffer{VectorSize: 2, Capacity: 3}},
+		RAggregate{&Queue{VectorSize: 2}, &Stack{VectorSize: 4}},
+	}
+	for _, s := range structs {
+		controls := make([][]linalg.Vector, batchTestSteps)
+		dataGrads := make([][]linalg.Vector, batchTestSteps)
+		for i := range controls {
+			for j := 0; j < batchTestSize; j++ {
+				controls[i] = append(controls[i], testRandVec(s.ControlSize()))
+				dataGrads[i] = append(dataGrads[i], testRandVec(s.DataSize()))
+			}
+		}
+
+		var batchStates, singleStates [][]State
+		batch := make([]State, batchTestSize)
+		single := make([]State, batchTestSize)
+		for i := range batch {
+			batch[i] = s.StartState()
+			single[i] = s.StartState()
+		}
+
+		// Give the first entry a different depth than the
+		// others, so that a batch has states of both depths.
+		firstCtrl := testRandVec(s.ControlSize())
+		batch[0] = batch[0].NextState(firstCtrl)
+		single[0] = single[0].NextState(firstCtrl)
+		for _, stepCtrl := range controls {
+			batch = s.NextStates(batch, stepCtrl)
+			for i, state := range single {
+				single[i] = state.NextState(stepCtrl[i])
+			}
+			batchStates = append(batchStates, batch)
+			singleStates = append(singleStates, single)
+			single = append([]State{}, single...)
+		}
+
+		for step := range batchStates {
+			for i, state := range batchStates[step] {
+				actual := state.Data()
+				expected := singleStates[step][i].Data()
+				if !statesEqual(actual, expected) {
+					t.Errorf("%T: step %d, entry %d: expected %v but got %v", s, step, i,
+						expected, actual)
+				}
+			}
+		}
+
+		var batchUp []Grad
+		singleUp := make([]Grad, batchTestSize)
+		for step := len(batchStates) - 1; step >= 0; step-- {
+			var batchCtrl []linalg.Vector
+			batchCtrl, batchUp = s.StateGradients(batchStates[step], dataGrads[step],
+				batchUp)
+			for i, state := range singleStates[step] {
+				var ctrlGrad linalg.Vector
+				ctrlGrad, singleUp[i] = state.Gradient(dataGrads[step][i], singleUp[i])
+				if !statesEqual(ctrlGrad, batchCtrl[i]) {
+					t.Errorf("%T: step %d, entry %d: expected gradient %v but got %v",
+						s, step, i, ctrlGrad, batchCtrl[i])
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkStackBatchForward(b *testing.B) {
+	batchForwardBenchmark(b, &Stack{VectorSize: benchmarkVectorSize}, true)
+}
+
+func BenchmarkStackLoopForward(b *testing.B) {
+	batchForwardBenchmark(b, &Stack{VectorSize: benchmarkVectorSize}, false)
+}
+
+func BenchmarkStackBatchBackward(b *testing.B) {
+	batchBackwardBenchmark(b, &Stack{VectorSize: benchmarkVectorSize}, true)
+}
+
+func BenchmarkStackLoopBackward(b *testing.B) {
+	batchBackwardBenchmark(b, &Stack{VectorSize: benchmarkVectorSize}, false)
+}
+
+func BenchmarkQueueBatchForward(b *testing.B) {
+	batchForwardBenchmark(b, &Queue{VectorSize: benchmarkVectorSize}, true)
+}
+
+func BenchmarkQueueLoopForward(b *testing.B) {
+	batchForwardBenchmark(b, &Queue{VectorSize: benchmarkVectorSize}, false)
+}
+
+func BenchmarkQueueBatchBackward(b *testing.B) {
+	batchBackwardBenchmark(b, &Queue{VectorSize: benchmarkVectorSize}, true)
+}
+
+func BenchmarkQueueLoopBackward(b *testing.B) {
+	batchBackwardBenchmark(b, &Queue{VectorSize: benchmarkVectorSize}, false)
+}
+
+// batchForwardBenchmark advances a batch of states with
+// NextStates if batched is true, or by calling NextState
+// on every state otherwise.
+func batchForwardBenchmark(b *testing.B, s BatchStruct, batched bool) {
+	controls := make([]linalg.Vector, benchmarkBatchSize)
+	for i := range controls {
+		controls[i] = testRandVec(s.ControlSize())
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		states := make([]State, benchmarkBatchSize)
+		for j := range states {
+			states[j] = s.StartState()
+		}
+		for j := 0; j < benchmarkTimeSteps; j++ {
+			states = benchmarkNextStates(s, states, controls, batched)
+		}
+	}
+}
+
+// batchBackwardBenchmark is like batchForwardBenchmark,
+// but it also propagates gradients through the states,
+// using StateGradients if batched is true.
+func batchBackwardBenchmark(b *testing.B, s BatchStruct, batched bool) {
+	controls := make([]linalg.Vector, benchmarkBatchSize)
+	dataGrads := make([]linalg.Vector, benchmarkBatchSize)
+	for i := range controls {
+		controls[i] = testRandVec(s.ControlSize())
+		dataGrads[i] = make(linalg.Vector, s.DataSize())
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		states := make([]State, benchmarkBatchSize)
+		for j := range states {
+			states[j] = s.StartState()
+		}
+		var allStates [][]State
+		for j := 0; j < benchmarkTimeSteps; j++ {
+			states = benchmarkNextStates(s, states, controls, batched)
+			allStates = append(allStates, states)
+		}
+		ups := make([]Grad, benchmarkBatchSize)
+		for j := len(allStates) - 1; j >= 0; j-- {
+			if batched {
+				_, ups = s.StateGradients(allStates[j], dataGrads, ups)
+				continue
+			}
+			for k, state := range allStates[j] {
+				_, ups[k] = state.Gradient(dataGrads[k], ups[k])
+			}
+		}
+	}
+}
+
+func benchmarkNextStates(s BatchStruct, states []State, controls []linalg.Vector,
+	batched bool) []State {
+	if batched {
+		return s.NextStates(states, controls)
+	}
+	res := make([]State, len(states))
+	for i, state := range states {
+		res[i] = state.NextState(controls[i])
+	}
+	return res
+}
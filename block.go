@@ -1,6 +1,7 @@
 package neuralstruct
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/unixpickle/num-analysis/linalg"
 	"github.com/unixpickle/serializer"
 	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/neuralnet"
 	"github.com/unixpickle/weakai/rnn"
 )
 
@@ -47,9 +49,52 @@ type blockRStateGrad struct {
 // When it generates an output, the head of that output
 // will be used as control data for the structure.
 // In both contexts, "head" means the beginning.
+// A different arrangement can be chosen via Layout.
 type Block struct {
 	Block  rnn.Block
 	Struct RStruct
+
+	// Layout determines how the structure's data and
+	// control are arranged in the enclosed block's input
+	// and output.
+	Layout BlockLayout
+
+	// ControlNet, if non-nil, computes the control vector
+	// from the enclosed block's entire output.
+	// In this case, Layout.Control is ignored and the
+	// block's entire output is used as the Block's output.
+	ControlNet neuralnet.Network
+
+	// Activate, if true, indicates that the Struct's
+	// suggested activation should be applied to the
+	// control vector before it is fed to the Struct.
+	// This has no effect if the Struct is not an Activator.
+	Activate bool
+
+	// Steps is the number of micro-steps to run for each
+	// input.
+	// During every micro-step, the enclosed block receives
+	// the same input (combined with the structure's latest
+	// data) and controls the structure.
+	// Only the output of the last micro-step is used as
+	// the Block's output.
+	// A value of 0 is treated like 1.
+	Steps int
+
+	// Workers, if greater than 1, is the maximum number of
+	// goroutines to use while propagating gradients through
+	// the struct states of a batch.
+	// The gradients do not depend on the number of workers.
+	Workers int
+}
+
+// blockOptions stores the serialized fields of a Block
+// which are not serializers themselves.
+type blockOptions struct {
+	Activate bool
+	Layout   BlockLayout
+	Steps    int
+	Workers  int
 }
 
 // DeserializeBlock deserializes a Block.
@@ -58,7 +103,7 @@ func DeserializeBlock(d []byte) (*Block, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(slice) != 2 {
+	if len(slice) < 2 || len(slice) > 4 {
 		return nil, errors.New("invalid Block slice")
 	}
 	block, ok1 := slice[0].(rnn.Block)
@@ -66,18 +111,65 @@ func DeserializeBlock(d []byte) (*Block, error) {
 	if !ok1 || !ok2 {
 		return nil, errors.New("invalid Block slice")
 	}
-	return &Block{Block: block, Struct: structure}, nil
+	res := &Block{Block: block, Struct: structure}
+
+	// Blocks from older versions of this package did not
+	// have any options.
+	if len(slice) >= 3 {
+		optionData, ok := slice[2].(serializer.Bytes)
+		if !ok {
+			return nil, errors.New("invalid Block slice")
+		}
+		var options blockOptions
+		if err := json.Unmarshal(optionData, &options); err != nil {
+			return nil, fmt.Errorf("invalid Block options: %s", err)
+		}
+		res.Activate = options.Activate
+		res.Layout = options.Layout
+		res.Steps = options.Steps
+		res.Workers = options.Workers
+	}
+
+	if len(slice) == 4 {
+		net, ok := slice[3].(neuralnet.Network)
+		if !ok {
+			return nil, errors.New("invalid Block slice")
+		}
+		res.ControlNet = net
+	}
+
+	return res, nil
 }
 
 // StartState returns a state encompassing the block's
 // start state and the struct's start state.
 func (b *Block) StartState() rnn.State {
+	return b.StartStateFrom(b.Struct.StartState())
+}
+
+// StartStateFrom is like StartState, but it uses the
+// given struct state as the initial struct state.
+// This makes it possible to continue with the struct
+// contents from a previous run (see Detach), as in
+// truncated back-propagation through time.
+// Every sequence in a batch should get its own start
+// state from its own previous run.
+// To do this with rnn.BlockSeqFunc, use a StartFromBlock.
+//
+// Gradients are not propagated through the struct state.
+func (b *Block) StartStateFrom(structState State) rnn.State {
 	return blockState{
 		BlockState:  b.Block.StartState(),
-		StructState: b.Struct.StartState(),
+		StructState: structState,
 	}
 }
 
+// StructState returns the struct state from one of the
+// block's states, such as a state produced by ApplyBlock.
+func (b *Block) StructState(s rnn.State) State {
+	return s.(blockState).StructState
+}
+
 // StartRState is like StartState for rnn.RStates.
 func (b *Block) StartRState(rv autofunc.RVector) rnn.RState {
 	return blockRState{
@@ -86,13 +178,29 @@ func (b *Block) StartRState(rv autofunc.RVector) rnn.RState {
 	}
 }
 
+// StartRStateFrom is like StartStateFrom for rnn.RStates.
+// The struct state must be a Detacher, since it is
+// detached to get an RState.
+func (b *Block) StartRStateFrom(rv autofunc.RVector, structState State) rnn.RState {
+	return blockRState{
+		BlockState:  b.Block.StartRState(rv),
+		StructState: detachR(structState),
+	}
+}
+
 // PropagateStart back-propagates through the start state.
+//
+// Gradients are never propagated through the initial
+// struct states, even if they are not start states, so
+// the struct components of the gradients are dropped.
 func (b *Block) PropagateStart(s []rnn.State, u []rnn.StateGrad, g autofunc.Gradient) {
 	block := make([]rnn.StateGrad, len(s))
 	blockS := make([]rnn.State, len(s))
-	for i, stateObj := range u {
-		block[i] = stateObj.(blockStateGrad).BlockGrad
-		blockS[i] = s[i].(blockState).BlockState
+	for i, stateObj := range s {
+		blockS[i] = stateObj.(blockState).BlockState
+		if u != nil && u[i] != nil {
+			block[i] = u[i].(blockStateGrad).BlockGrad
+		}
 	}
 	b.Block.PropagateStart(blockS, block, g)
 }
@@ -103,15 +211,37 @@ func (b *Block) PropagateStartR(s []rnn.RState, u []rnn.RStateGrad, rg autofunc.
 	g autofunc.Gradient) {
 	block := make([]rnn.RStateGrad, len(s))
 	blockS := make([]rnn.RState, len(s))
-	for i, stateObj := range u {
-		block[i] = stateObj.(blockRStateGrad).BlockGrad
-		blockS[i] = s[i].(blockRState).BlockState
+	for i, stateObj := range s {
+		blockS[i] = stateObj.(blockRState).BlockState
+		if u != nil && u[i] != nil {
+			block[i] = u[i].(blockRStateGrad).BlockGrad
+		}
 	}
 	b.Block.PropagateStartR(blockS, block, rg, g)
 }
 
 // ApplyBlock applies the block to a batch of inputs.
 func (b *Block) ApplyBlock(s []rnn.State, in []autofunc.Result) rnn.BlockResult {
+	if b.Steps <= 1 {
+		return b.applyStep(s, in)
+	}
+	res := &microStepResult{Input: in}
+	stepIn := make([]autofunc.Result, len(in))
+	for i, x := range in {
+		v := &autofunc.Variable{Vector: x.Output()}
+		res.InPool = append(res.InPool, v)
+		stepIn[i] = v
+	}
+	for i := 0; i < b.Steps; i++ {
+		step := b.applyStep(s, stepIn)
+		res.Steps = append(res.Steps, step)
+		s = step.States()
+	}
+	return res
+}
+
+// applyStep runs a single micro-step.
+func (b *Block) applyStep(s []rnn.State, in []autofunc.Result) *blockResult {
 	var augmentedPool []*autofunc.Variable
 	var augmentedRes []autofunc.Result
 	var innerStates []rnn.State
@@ -119,13 +249,9 @@ func (b *Block) ApplyBlock(s []rnn.State, in []autofunc.Result) rnn.BlockResult
 		state := stateObj.(blockState)
 		innerStates = append(innerStates, state.BlockState)
 
-		augLen := b.Struct.DataSize() + len(in[i].Output())
 		poolVar := &autofunc.Variable{
-			Vector: make(linalg.Vector, augLen),
+			Vector: b.Layout.joinInput(state.StructState.Data(), in[i].Output()),
 		}
-		copy(poolVar.Vector, state.StructState.Data())
-		copy(poolVar.Vector[b.Struct.DataSize():], in[i].Output())
-
 		augmentedPool = append(augmentedPool, poolVar)
 		augmentedRes = append(augmentedRes, poolVar)
 	}
@@ -133,26 +259,44 @@ func (b *Block) ApplyBlock(s []rnn.State, in []autofunc.Result) rnn.BlockResult
 	blockOuts := b.Block.ApplyBlock(innerStates, augmentedRes)
 
 	var outputs []linalg.Vector
-	var newStates []rnn.State
+	var ctrlVecs []linalg.Vector
+	var oldStructStates []State
+	var ctrlVars []*autofunc.Variable
+	var ctrlResults []autofunc.Result
 
+	ctrlNet := b.controlNet()
 	for i, fullOut := range blockOuts.Outputs() {
-		ctrlVec := fullOut[:b.Struct.ControlSize()]
-		outputs = append(outputs, fullOut[b.Struct.ControlSize():])
+		ctrlVec, rest := b.splitOutput(fullOut)
+		if ctrlNet != nil {
+			ctrlVar := &autofunc.Variable{Vector: ctrlVec}
+			ctrlRes := ctrlNet.Apply(ctrlVar)
+			ctrlVec = ctrlRes.Output()
+			ctrlVars = append(ctrlVars, ctrlVar)
+			ctrlResults = append(ctrlResults, ctrlRes)
+		}
 		oldStructState := s[i].(blockState).StructState
-		newStructState := oldStructState.NextState(ctrlVec)
+		outputs = append(outputs, b.Layout.output(rest, oldStructState.Data()))
+		ctrlVecs = append(ctrlVecs, ctrlVec)
+		oldStructStates = append(oldStructStates, oldStructState)
+	}
+
+	var newStates []rnn.State
+	for i, structState := range nextStates(b.Struct, oldStructStates, ctrlVecs) {
 		newStates = append(newStates, blockState{
-			StructState: newStructState,
+			StructState: structState,
 			BlockState:  blockOuts.States()[i],
 		})
 	}
 
 	return &blockResult{
-		Struct:    b.Struct,
-		Input:     in,
-		InPool:    augmentedPool,
-		BlockRes:  blockOuts,
-		OutStates: newStates,
-		OutVecs:   outputs,
+		Block:       b,
+		Input:       in,
+		InPool:      augmentedPool,
+		BlockRes:    blockOuts,
+		OutStates:   newStates,
+		OutVecs:     outputs,
+		CtrlVars:    ctrlVars,
+		CtrlResults: ctrlResults,
 	}
 }
 
@@ -160,6 +304,31 @@ func (b *Block) ApplyBlock(s []rnn.State, in []autofunc.Result) rnn.BlockResult
 // the r-operator.
 func (b *Block) ApplyBlockR(rv autofunc.RVector, s []rnn.RState,
 	in []autofunc.RResult) rnn.BlockRResult {
+	if b.Steps <= 1 {
+		return b.applyStepR(rv, s, in)
+	}
+	res := &microStepRResult{Input: in}
+	stepIn := make([]autofunc.RResult, len(in))
+	for i, x := range in {
+		v := &autofunc.Variable{Vector: x.Output()}
+		res.InPool = append(res.InPool, v)
+		stepIn[i] = &autofunc.RVariable{
+			Variable:   v,
+			ROutputVec: x.ROutput(),
+		}
+	}
+	for i := 0; i < b.Steps; i++ {
+		step := b.applyStepR(rv, s, stepIn)
+		res.Steps = append(res.Steps, step)
+		s = step.RStates()
+	}
+	return res
+}
+
+// applyStepR is like applyStep, but with support for the
+// r-operator.
+func (b *Block) applyStepR(rv autofunc.RVector, s []rnn.RState,
+	in []autofunc.RResult) *blockRResult {
 	var augmentedPool []*autofunc.Variable
 	var augmentedRes []autofunc.RResult
 	var innerStates []rnn.RState
@@ -167,16 +336,10 @@ func (b *Block) ApplyBlockR(rv autofunc.RVector, s []rnn.RState,
 		state := stateObj.(blockRState)
 		innerStates = append(innerStates, state.BlockState)
 
-		augLen := b.Struct.DataSize() + len(in[i].Output())
 		poolVar := &autofunc.Variable{
-			Vector: make(linalg.Vector, augLen),
+			Vector: b.Layout.joinInput(state.StructState.Data(), in[i].Output()),
 		}
-		copy(poolVar.Vector, state.StructState.Data())
-		copy(poolVar.Vector[b.Struct.DataSize():], in[i].Output())
-
-		augR := make(linalg.Vector, len(poolVar.Vector))
-		copy(augR, state.StructState.RData())
-		copy(augR[b.Struct.DataSize():], in[i].ROutput())
+		augR := b.Layout.joinInput(state.StructState.RData(), in[i].ROutput())
 
 		augmentedPool = append(augmentedPool, poolVar)
 		augmentedRes = append(augmentedRes, &autofunc.RVariable{
@@ -190,15 +353,27 @@ func (b *Block) ApplyBlockR(rv autofunc.RVector, s []rnn.RState,
 	var outputs []linalg.Vector
 	var outputsR []linalg.Vector
 	var newStates []rnn.RState
+	var ctrlVars []*autofunc.Variable
+	var ctrlResults []autofunc.RResult
 
+	ctrlNet := b.controlNet()
 	rOuts := blockOuts.ROutputs()
 	for i, fullOut := range blockOuts.Outputs() {
-		fullOutR := rOuts[i]
-		ctrlVec := fullOut[:b.Struct.ControlSize()]
-		ctrlVecR := fullOutR[:b.Struct.ControlSize()]
-		outputs = append(outputs, fullOut[b.Struct.ControlSize():])
-		outputsR = append(outputsR, fullOutR[b.Struct.ControlSize():])
+		ctrlVec, rest := b.splitOutput(fullOut)
+		ctrlVecR, restR := b.splitOutput(rOuts[i])
+		if ctrlNet != nil {
+			ctrlVar := &autofunc.Variable{Vector: ctrlVec}
+			ctrlRes := ctrlNet.ApplyR(rv, &autofunc.RVariable{
+				Variable:   ctrlVar,
+				ROutputVec: ctrlVecR,
+			})
+			ctrlVec, ctrlVecR = ctrlRes.Output(), ctrlRes.ROutput()
+			ctrlVars = append(ctrlVars, ctrlVar)
+			ctrlResults = append(ctrlResults, ctrlRes)
+		}
 		oldStructState := s[i].(blockRState).StructState
+		outputs = append(outputs, b.Layout.output(rest, oldStructState.Data()))
+		outputsR = append(outputsR, b.Layout.output(restR, oldStructState.RData()))
 		newStructState := oldStructState.NextRState(ctrlVec, ctrlVecR)
 		newStates = append(newStates, blockRState{
 			StructState: newStructState,
@@ -207,24 +382,30 @@ func (b *Block) ApplyBlockR(rv autofunc.RVector, s []rnn.RState,
 	}
 
 	return &blockRResult{
-		Struct:    b.Struct,
-		Input:     in,
-		InPool:    augmentedPool,
-		BlockRes:  blockOuts,
-		OutStates: newStates,
-		OutVecs:   outputs,
-		ROutVecs:  outputsR,
+		Block:       b,
+		Input:       in,
+		InPool:      augmentedPool,
+		BlockRes:    blockOuts,
+		OutStates:   newStates,
+		OutVecs:     outputs,
+		ROutVecs:    outputsR,
+		CtrlVars:    ctrlVars,
+		CtrlResults: ctrlResults,
 	}
 }
 
 // Parameters returns the underlying block's parameters
-// if it implements sgd.Learner, or nil otherwise.
+// if it implements sgd.Learner, followed by the
+// parameters of the ControlNet.
 func (b *Block) Parameters() []*autofunc.Variable {
+	var res []*autofunc.Variable
 	if l, ok := b.Block.(sgd.Learner); ok {
-		return l.Parameters()
-	} else {
-		return nil
+		res = append(res, l.Parameters()...)
+	}
+	if b.ControlNet != nil {
+		res = append(res, b.ControlNet.Parameters()...)
 	}
+	return res
 }
 
 // SerializerType returns the unique ID used to serialize
@@ -233,8 +414,9 @@ func (b *Block) SerializerType() string {
 	return "github.com/unixpickle/neuralstruct.Block"
 }
 
-// Serialize serializes the underlying block and struct.
-// If either of those two things is not a
+// Serialize serializes the underlying block, struct,
+// options, and ControlNet (if there is one).
+// If the block or the struct is not a
 // serializer.Serializer, this returns an error.
 func (b *Block) Serialize() ([]byte, error) {
 	blockSerializer, ok := b.Block.(serializer.Serializer)
@@ -245,17 +427,76 @@ func (b *Block) Serialize() ([]byte, error) {
 	if !ok {
 		return nil, fmt.Errorf("struct is not a Serializer: %T", b.Struct)
 	}
-	list := []serializer.Serializer{blockSerializer, structSerializer}
+	optionData, err := json.Marshal(&blockOptions{
+		Activate: b.Activate,
+		Layout:   b.Layout,
+		Steps:    b.Steps,
+		Workers:  b.Workers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := []serializer.Serializer{blockSerializer, structSerializer,
+		serializer.Bytes(optionData)}
+	if b.ControlNet != nil {
+		list = append(list, b.ControlNet)
+	}
 	return serializer.SerializeSlice(list)
 }
 
+// splitOutput splits an output from the enclosed block
+// into the input to controlNet (or the raw control vector)
+// and the rest of the output.
+func (b *Block) splitOutput(out linalg.Vector) (ctrl, rest linalg.Vector) {
+	if b.ControlNet != nil {
+		return out, out
+	}
+	return b.Layout.splitOutput(out, b.Struct.ControlSize())
+}
+
+// controlNet returns the network which produces control
+// vectors from the result of splitOutput, or nil if the
+// control vectors should be used as-is.
+func (b *Block) controlNet() neuralnet.Network {
+	var res neuralnet.Network
+	res = append(res, b.ControlNet...)
+	if activation := b.activation(); activation != nil {
+		res = append(res, activation)
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// activation returns the activation to apply to control
+// vectors, or nil if there is none.
+func (b *Block) activation() neuralnet.Layer {
+	if !b.Activate {
+		return nil
+	}
+	var structure Struct = b.Struct
+	if n, ok := structure.(*nopRStruct); ok {
+		structure = n.Struct
+	}
+	if a, ok := structure.(Activator); ok {
+		return a.SuggestedActivation()
+	}
+	return nil
+}
+
 type blockResult struct {
-	Struct    Struct
+	Block     *Block
 	Input     []autofunc.Result
 	InPool    []*autofunc.Variable
 	BlockRes  rnn.BlockResult
 	OutStates []rnn.State
 	OutVecs   []linalg.Vector
+
+	// CtrlVars and CtrlResults are non-nil if a control
+	// network or an activation produced the control vectors.
+	CtrlVars    []*autofunc.Variable
+	CtrlResults []autofunc.Result
 }
 
 func (b *blockResult) Outputs() []linalg.Vector {
@@ -272,21 +513,31 @@ func (b *blockResult) PropagateGradient(u []linalg.Vector, s []rnn.StateGrad,
 		return nil
 	}
 
+	structCtrlGrads, structGrads := b.structGradients(s)
+
 	blockUpstream := make([]linalg.Vector, len(b.OutVecs))
 	blockStateUp := make([]rnn.StateGrad, len(b.OutVecs))
-	structGrads := make([]Grad, len(b.OutVecs))
-	for i, outState := range b.OutStates {
-		blockUpstream[i] = make(linalg.Vector, len(b.OutVecs[i])+b.Struct.ControlSize())
+	skipGrads := make([]linalg.Vector, len(b.OutVecs))
+	for i := range b.OutStates {
+		blockUpstream[i] = make(linalg.Vector, len(b.BlockRes.Outputs()[i]))
+		ctrlUp, restUp := b.Block.splitOutput(blockUpstream[i])
 		if s != nil && s[i] != nil {
 			bsg := s[i].(blockStateGrad)
-			structState := outState.(blockState).StructState
-			var ctrl linalg.Vector
-			ctrl, structGrads[i] = structState.Gradient(bsg.DataGrad, bsg.StructGrad)
-			copy(blockUpstream[i], ctrl)
+			ctrl := structCtrlGrads[i]
+			if b.CtrlResults != nil {
+				ctrlVar := b.CtrlVars[i]
+				g[ctrlVar] = ctrlUp
+				b.CtrlResults[i].PropagateGradient(ctrl, g)
+				delete(g, ctrlVar)
+			} else {
+				copy(ctrlUp, ctrl)
+			}
 			blockStateUp[i] = bsg.BlockGrad
 		}
 		if u != nil {
-			copy(blockUpstream[i][b.Struct.ControlSize():], u[i])
+			var restGrad linalg.Vector
+			restGrad, skipGrads[i] = b.Block.Layout.splitOutputGrad(u[i], b.Block.Struct.DataSize())
+			restUp.Add(restGrad)
 		}
 	}
 
@@ -303,25 +554,84 @@ func (b *blockResult) PropagateGradient(u []linalg.Vector, s []rnn.StateGrad,
 
 	downstream := make([]rnn.StateGrad, len(b.OutVecs))
 	for i, v := range inputGrads {
-		b.Input[i].PropagateGradient(v[b.Struct.DataSize():], g)
+		dataGrad, inGrad := b.Block.Layout.splitInput(v, b.Block.Struct.DataSize())
+		if skipGrads[i] != nil {
+			dataGrad.Add(skipGrads[i])
+		}
+		b.Input[i].PropagateGradient(inGrad, g)
 		downstream[i] = blockStateGrad{
 			BlockGrad:  blockDown[i],
 			StructGrad: structGrads[i],
-			DataGrad:   v[:b.Struct.DataSize()],
+			DataGrad:   dataGrad,
 		}
 	}
 
 	return downstream
 }
 
+// structGradients propagates the struct components of
+// the upstream state gradients through the struct states.
+// The results are nil for every nil upstream gradient.
+func (b *blockResult) structGradients(s []rnn.StateGrad) (ctrlGrads []linalg.Vector,
+	structGrads []Grad) {
+	ctrlGrads = make([]linalg.Vector, len(b.OutStates))
+	structGrads = make([]Grad, len(b.OutStates))
+	if s == nil {
+		return
+	}
+
+	var indices []int
+	var states []State
+	var dataGrads []linalg.Vector
+	var upstream []Grad
+	for i, grad := range s {
+		if grad == nil {
+			continue
+		}
+		bsg := grad.(blockStateGrad)
+		indices = append(indices, i)
+		states = append(states, b.OutStates[i].(blockState).StructState)
+		dataGrads = append(dataGrads, bsg.DataGrad)
+		upstream = append(upstream, bsg.StructGrad)
+	}
+
+	// Each worker handles a contiguous chunk of the batch.
+	workers := b.Block.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	chunkSize := (len(states) + workers - 1) / workers
+	numChunks := 0
+	if chunkSize > 0 {
+		numChunks = (len(states) + chunkSize - 1) / chunkSize
+	}
+	parallelFor(numChunks, workers, func(chunk int) {
+		start := chunk * chunkSize
+		end := start + chunkSize
+		if end > len(states) {
+			end = len(states)
+		}
+		batchCtrl, batchGrads := stateGradients(b.Block.Struct, states[start:end],
+			dataGrads[start:end], upstream[start:end])
+		for i, idx := range indices[start:end] {
+			ctrlGrads[idx] = batchCtrl[i]
+			structGrads[idx] = batchGrads[i]
+		}
+	})
+	return
+}
+
 type blockRResult struct {
-	Struct    RStruct
+	Block     *Block
 	Input     []autofunc.RResult
 	InPool    []*autofunc.Variable
 	BlockRes  rnn.BlockRResult
 	OutStates []rnn.RState
 	OutVecs   []linalg.Vector
 	ROutVecs  []linalg.Vector
+
+	CtrlVars    []*autofunc.Variable
+	CtrlResults []autofunc.RResult
 }
 
 func (b *blockRResult) Outputs() []linalg.Vector {
@@ -350,22 +660,38 @@ func (b *blockRResult) PropagateRGradient(u, uR []linalg.Vector, s []rnn.RStateG
 	blockUpstreamR := make([]linalg.Vector, len(b.OutVecs))
 	blockStateUp := make([]rnn.RStateGrad, len(b.OutVecs))
 	structGrads := make([]RGrad, len(b.OutVecs))
+	skipGrads := make([]linalg.Vector, len(b.OutVecs))
+	skipGradsR := make([]linalg.Vector, len(b.OutVecs))
 	for i, outState := range b.OutStates {
-		blockUpstream[i] = make(linalg.Vector, len(b.OutVecs[i])+b.Struct.ControlSize())
-		blockUpstreamR[i] = make(linalg.Vector, len(b.OutVecs[i])+b.Struct.ControlSize())
+		blockUpstream[i] = make(linalg.Vector, len(b.BlockRes.Outputs()[i]))
+		blockUpstreamR[i] = make(linalg.Vector, len(blockUpstream[i]))
+		ctrlUp, restUp := b.Block.splitOutput(blockUpstream[i])
+		ctrlUpR, restUpR := b.Block.splitOutput(blockUpstreamR[i])
 		if s != nil && s[i] != nil {
 			bsg := s[i].(blockRStateGrad)
 			structState := outState.(blockRState).StructState
 			var ctrl, ctrlR linalg.Vector
 			ctrl, ctrlR, structGrads[i] = structState.RGradient(bsg.DataGrad,
 				bsg.DataGradR, bsg.StructGrad)
-			copy(blockUpstream[i], ctrl)
-			copy(blockUpstreamR[i], ctrlR)
+			if b.CtrlResults != nil {
+				ctrlVar := b.CtrlVars[i]
+				g[ctrlVar] = ctrlUp
+				rg[ctrlVar] = ctrlUpR
+				b.CtrlResults[i].PropagateRGradient(ctrl, ctrlR, rg, g)
+				delete(g, ctrlVar)
+				delete(rg, ctrlVar)
+			} else {
+				copy(ctrlUp, ctrl)
+				copy(ctrlUpR, ctrlR)
+			}
 			blockStateUp[i] = bsg.BlockGrad
 		}
 		if u != nil {
-			copy(blockUpstream[i][b.Struct.ControlSize():], u[i])
-			copy(blockUpstreamR[i][b.Struct.ControlSize():], uR[i])
+			var restGrad, restGradR linalg.Vector
+			restGrad, skipGrads[i] = b.Block.Layout.splitOutputGrad(u[i], b.Block.Struct.DataSize())
+			restGradR, skipGradsR[i] = b.Block.Layout.splitOutputGrad(uR[i], b.Block.Struct.DataSize())
+			restUp.Add(restGrad)
+			restUpR.Add(restGradR)
 		}
 	}
 
@@ -387,14 +713,18 @@ func (b *blockRResult) PropagateRGradient(u, uR []linalg.Vector, s []rnn.RStateG
 
 	downstream := make([]rnn.RStateGrad, len(b.OutVecs))
 	for i, v := range inputGrads {
-		vR := inputGradsR[i]
-		b.Input[i].PropagateRGradient(v[b.Struct.DataSize():],
-			vR[b.Struct.DataSize():], rg, g)
+		dataGrad, inGrad := b.Block.Layout.splitInput(v, b.Block.Struct.DataSize())
+		dataGradR, inGradR := b.Block.Layout.splitInput(inputGradsR[i], b.Block.Struct.DataSize())
+		if skipGrads[i] != nil {
+			dataGrad.Add(skipGrads[i])
+			dataGradR.Add(skipGradsR[i])
+		}
+		b.Input[i].PropagateRGradient(inGrad, inGradR, rg, g)
 		downstream[i] = blockRStateGrad{
 			BlockGrad:  blockDown[i],
 			StructGrad: structGrads[i],
-			DataGrad:   v[:b.Struct.DataSize()],
-			DataGradR:  vR[:b.Struct.DataSize()],
+			DataGrad:   dataGrad,
+			DataGradR:  dataGradR,
 		}
 	}
 
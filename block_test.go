@@ -3,6 +3,9 @@ package neuralstruct
 import (
 	"testing"
 
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
 	"github.com/unixpickle/weakai/rnn"
 	"github.com/unixpickle/weakai/rnn/rnntest"
 )
@@ -18,3 +21,202 @@ func TestBlock(t *testing.T) {
 	checker := rnntest.NewChecker4In(b, b)
 	checker.FullCheck(t)
 }
+
+func TestBlockActivate(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	b := &Block{
+		Block:    rnn.NewLSTM(7, 9),
+		Struct:   &Stack{VectorSize: 3, PushBias: 1},
+		Activate: true,
+	}
+	checker := rnntest.NewChecker4In(b, b)
+	checker.FullCheck(t)
+}
+
+func TestBlockLayouts(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	layouts := []BlockLayout{
+		{Data: DataAppend},
+		{Data: DataInterleave, Control: ControlTail},
+		{Control: ControlTail, SkipData: true},
+	}
+	for _, layout := range layouts {
+		b := &Block{
+			Block:    rnn.NewLSTM(7, 9),
+			Struct:   &Stack{VectorSize: 3, PushBias: 1},
+			Activate: true,
+			Layout:   layout,
+		}
+		checker := rnntest.NewChecker4In(b, b)
+		checker.FullCheck(t)
+	}
+}
+
+func TestBlockControlNet(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	controlNet := neuralnet.Network{
+		&neuralnet.DenseLayer{
+			InputCount:  9,
+			OutputCount: 7,
+		},
+	}
+	controlNet.Randomize()
+	b := &Block{
+		Block:      rnn.NewLSTM(7, 9),
+		Struct:     &Stack{VectorSize: 3, PushBias: 1},
+		Activate:   true,
+		ControlNet: controlNet,
+	}
+	checker := rnntest.NewChecker4In(b, b)
+	checker.FullCheck(t)
+}
+
+func TestBlockSteps(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	b := &Block{
+		Block:    rnn.NewLSTM(7, 9),
+		Struct:   &Stack{VectorSize: 3, PushBias: 1},
+		Activate: true,
+		Layout:   BlockLayout{SkipData: true},
+		Steps:    3,
+	}
+	checker := rnntest.NewChecker4In(b, b)
+	checker.FullCheck(t)
+}
+
+func TestBlockWorkers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	structure := &ParallelAggregate{
+		Structs: RAggregate{&Stack{VectorSize: 2}, &Queue{VectorSize: 1}},
+		Workers: 2,
+	}
+	b := &Block{
+		Block:   rnn.NewLSTM(4+structure.DataSize(), structure.ControlSize()+2),
+		Struct:  structure,
+		Workers: 3,
+	}
+	checker := rnntest.NewChecker4In(b, b)
+	checker.FullCheck(t)
+}
+
+func TestBlockStartStateFrom(t *testing.T) {
+	structure := &Stack{VectorSize: 3}
+	var structStates []State
+	for seq := 0; seq < 2; seq++ {
+		state := structure.StartState()
+		for i := 0; i < 3; i++ {
+			state = state.NextState(testRandVec(structure.ControlSize()))
+		}
+		structStates = append(structStates, Detach(state))
+	}
+	b := &Block{
+		Block:  rnn.NewLSTM(7, 9),
+		Struct: structure,
+	}
+
+	inputs := []autofunc.Result{
+		&autofunc.Variable{Vector: testRandVec(4)},
+		&autofunc.Variable{Vector: testRandVec(4)},
+	}
+	batch := b.ApplyBlock([]rnn.State{
+		b.StartStateFrom(structStates[0]),
+		b.StartStateFrom(structStates[1]),
+	}, inputs)
+	for i, structState := range structStates {
+		single := b.ApplyBlock([]rnn.State{b.StartStateFrom(structState)},
+			inputs[i:i+1])
+		if !statesEqual(batch.Outputs()[i], single.Outputs()[0]) {
+			t.Errorf("sequence %d: expected output %v but got %v", i,
+				single.Outputs()[0], batch.Outputs()[i])
+		}
+	}
+
+}
+
+func TestBlockSerialize(t *testing.T) {
+	b := &Block{
+		Block:    rnn.NewLSTM(7, 9),
+		Struct:   &Stack{VectorSize: 3},
+		Activate: true,
+		Layout:   BlockLayout{Data: DataAppend, Control: ControlTail, SkipData: true},
+		Steps:    2,
+		Workers:  4,
+	}
+	data, err := serializer.SerializeWithType(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBlock, ok := decoded.(*Block)
+	if !ok {
+		t.Fatalf("type shouldn't be %T", decoded)
+	}
+	if !newBlock.Activate {
+		t.Error("expected Activate to be true")
+	}
+	if newBlock.Layout != b.Layout {
+		t.Errorf("expected layout %v but got %v", b.Layout, newBlock.Layout)
+	}
+	if newBlock.Steps != b.Steps {
+		t.Errorf("expected %d steps but got %d", b.Steps, newBlock.Steps)
+	}
+	if newBlock.Workers != b.Workers {
+		t.Errorf("expected %d workers but got %d", b.Workers, newBlock.Workers)
+	}
+	if newBlock.ControlNet != nil {
+		t.Error("expected no ControlNet")
+	}
+
+	b.ControlNet = neuralnet.Network{
+		&neuralnet.DenseLayer{
+			InputCount:  9,
+			OutputCount: 7,
+		},
+	}
+	b.ControlNet.Randomize()
+	data, err = serializer.SerializeWithType(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = serializer.DeserializeWithType(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBlock = decoded.(*Block)
+	if len(newBlock.ControlNet) != 1 {
+		t.Fatalf("expected 1 ControlNet layer but got %d", len(newBlock.ControlNet))
+	}
+	if len(newBlock.Parameters()) != len(b.Parameters()) {
+		t.Errorf("expected %d parameters but got %d", len(b.Parameters()),
+			len(newBlock.Parameters()))
+	}
+
+	// Blocks used to be serialized without options.
+	legacyData, err := serializer.SerializeSlice([]serializer.Serializer{
+		b.Block.(serializer.Serializer),
+		b.Struct.(serializer.Serializer),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := DeserializeBlock(legacyData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Activate {
+		t.Error("expected Activate to be false")
+	}
+}
@@ -0,0 +1,484 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func init() {
+	var c Chain
+	var r RChain
+	serializer.RegisterTypedDeserializer(c.SerializerType(), DeserializeChain)
+	serializer.RegisterTypedDeserializer(r.SerializerType(), DeserializeRChain)
+}
+
+// A Chain is a Struct in which the data output of one
+// struct drives part of the control of another.
+//
+// At every timestep, the First struct is updated with the
+// start of the control vector.
+// Its new data is fed through Transform and placed at the
+// end of the control vector for the Second struct, whose
+// remaining control components come from the rest of the
+// Chain's control vector.
+//
+// For example, chaining a Stack into a Queue (with no
+// Transform) yields a queue which is pushed the top of
+// the stack at every timestep.
+//
+// Only fixed transforms are supported: gradients flow
+// through Transform to the First struct, but a Transform
+// may not have trainable parameters, since a Struct has
+// no way to report parameter gradients.
+// For a learned mapping, use an Aggregate of the two
+// structs and let the controller read one and write the
+// other.
+//
+// The data output is the data of the First struct,
+// followed by the data of the Second struct.
+type Chain struct {
+	First  Struct
+	Second Struct
+
+	// Transform is an optional function to apply to the
+	// First struct's data before it is fed to the Second.
+	// If it is nil, the identity function is used.
+	// It must not have parameters (e.g. it may be an
+	// activation function, but not a DenseLayer).
+	Transform neuralnet.Layer
+
+	// TransformSize is the output size of Transform.
+	// If it is 0, Transform must produce outputs of the
+	// same size as its inputs.
+	TransformSize int
+}
+
+type chainOptions struct {
+	TransformSize int
+}
+
+// DeserializeChain deserializes a Chain.
+func DeserializeChain(d []byte) (*Chain, error) {
+	structs, transform, options, err := deserializeChainParts(d)
+	if err != nil {
+		return nil, err
+	}
+	res := &Chain{First: structs[0], Second: structs[1], Transform: transform,
+		TransformSize: options.TransformSize}
+	if err := res.validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ControlSize returns the control size of the First
+// struct plus the part of the Second struct's control
+// which is not produced by the First struct.
+func (c *Chain) ControlSize() int {
+	return c.First.ControlSize() + c.secondControlSize()
+}
+
+// DataSize returns the sum of the data sizes of the
+// chained structs.
+func (c *Chain) DataSize() int {
+	return c.First.DataSize() + c.Second.DataSize()
+}
+
+// StartState returns a state representing the start
+// states of both structs.
+//
+// It panics if the Chain is misconfigured, e.g. if the
+// Transform has parameters.
+func (c *Chain) StartState() State {
+	if err := c.validate(); err != nil {
+		panic(err)
+	}
+	return &chainState{
+		Chain:  c,
+		First:  c.First.StartState(),
+		Second: c.Second.StartState(),
+	}
+}
+
+// SerializerType returns the unique ID used to serialize
+// Chains with the serializer package.
+func (c *Chain) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.Chain"
+}
+
+// Serialize encodes the chain, given that the structs
+// are serializers.
+func (c *Chain) Serialize() ([]byte, error) {
+	return serializeChainParts(c.First, c.Second, c.Transform,
+		&chainOptions{TransformSize: c.TransformSize})
+}
+
+// SuggestedActivation suggests an activation function
+// using the suggestions of the chained structures.
+//
+// Since part of the Second struct's control does not come
+// from the controller, the Second struct's activation is
+// only used if it is a PartialActivation, in which case
+// its ranges are clipped to the controller's part.
+func (c *Chain) SuggestedActivation() neuralnet.Layer {
+	pa := &PartialActivation{}
+	firstSize := c.First.ControlSize()
+	if sugger, ok := c.First.(Activator); ok {
+		pa.Ranges = append(pa.Ranges, ComponentRange{Start: 0, End: firstSize})
+		pa.Activations = append(pa.Activations, sugger.SuggestedActivation())
+	}
+	if sugger, ok := c.Second.(Activator); ok {
+		second, ok := sugger.SuggestedActivation().(*PartialActivation)
+		if ok {
+			clipped := clipActivation(second, c.secondControlSize())
+			pa.Ranges = append(pa.Ranges, ComponentRange{
+				Start: firstSize,
+				End:   firstSize + c.secondControlSize(),
+			})
+			pa.Activations = append(pa.Activations, clipped)
+		}
+	}
+	return pa
+}
+
+// validate checks that the Chain's fields make sense
+// together.
+func (c *Chain) validate() error {
+	if c.Transform == nil && c.TransformSize != 0 {
+		return errors.New("chain has a TransformSize but no Transform")
+	}
+	if l, ok := c.Transform.(sgd.Learner); ok && len(l.Parameters()) > 0 {
+		return errors.New("chain Transform must not have parameters")
+	}
+	if size, ctrlSize := c.transformSize(), c.Second.ControlSize(); size > ctrlSize {
+		return fmt.Errorf("chain transform size %d exceeds control size %d", size,
+			ctrlSize)
+	}
+	return nil
+}
+
+func (c *Chain) transformSize() int {
+	if c.Transform == nil || c.TransformSize == 0 {
+		return c.First.DataSize()
+	}
+	return c.TransformSize
+}
+
+func (c *Chain) secondControlSize() int {
+	res := c.Second.ControlSize() - c.transformSize()
+	if res < 0 {
+		panic(c.validate())
+	}
+	return res
+}
+
+// An RChain is like a Chain, but with support for the
+// r-operator.
+type RChain struct {
+	First         RStruct
+	Second        RStruct
+	Transform     neuralnet.Layer
+	TransformSize int
+}
+
+// DeserializeRChain deserializes an RChain.
+func DeserializeRChain(d []byte) (*RChain, error) {
+	structs, transform, options, err := deserializeChainParts(d)
+	if err != nil {
+		return nil, err
+	}
+	res := &RChain{Transform: transform, TransformSize: options.TransformSize}
+	var ok1, ok2 bool
+	res.First, ok1 = structs[0].(RStruct)
+	res.Second, ok2 = structs[1].(RStruct)
+	if !ok1 || !ok2 {
+		return nil, errors.New("chained structs must be RStructs")
+	}
+	if err := res.chain().validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ControlSize is like Chain.ControlSize().
+func (r *RChain) ControlSize() int {
+	return r.chain().ControlSize()
+}
+
+// DataSize is like Chain.DataSize().
+func (r *RChain) DataSize() int {
+	return r.chain().DataSize()
+}
+
+// StartState is like Chain.StartState().
+func (r *RChain) StartState() State {
+	return r.chain().StartState()
+}
+
+// StartRState is like StartState, but for RStates.
+func (r *RChain) StartRState() RState {
+	if err := r.chain().validate(); err != nil {
+		panic(err)
+	}
+	return &chainRState{
+		Chain:  r,
+		First:  r.First.StartRState(),
+		Second: r.Second.StartRState(),
+	}
+}
+
+// SerializerType returns the unique ID used to serialize
+// RChains with the serializer package.
+func (r *RChain) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.RChain"
+}
+
+// Serialize encodes the chain, given that the structs
+// are serializers.
+func (r *RChain) Serialize() ([]byte, error) {
+	return r.chain().Serialize()
+}
+
+// SuggestedActivation is like Chain.SuggestedActivation().
+func (r *RChain) SuggestedActivation() neuralnet.Layer {
+	return r.chain().SuggestedActivation()
+}
+
+func (r *RChain) chain() *Chain {
+	return &Chain{First: r.First, Second: r.Second, Transform: r.Transform,
+		TransformSize: r.TransformSize}
+}
+
+func serializeChainParts(first, second Struct, transform neuralnet.Layer,
+	options *chainOptions) ([]byte, error) {
+	var serializers []serializer.Serializer
+	for _, x := range []Struct{first, second} {
+		if s, ok := x.(serializer.Serializer); ok {
+			serializers = append(serializers, s)
+		} else {
+			return nil, fmt.Errorf("struct is not a serializer: %T", x)
+		}
+	}
+	optionData, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	serializers = append(serializers, serializer.Bytes(optionData))
+	if transform != nil {
+		serializers = append(serializers, transform)
+	}
+	return serializer.SerializeSlice(serializers)
+}
+
+func deserializeChainParts(d []byte) ([]Struct, neuralnet.Layer, *chainOptions, error) {
+	slice, err := serializer.DeserializeSlice(d)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(slice) != 3 && len(slice) != 4 {
+		return nil, nil, nil, errors.New("invalid chain slice")
+	}
+	structs := make([]Struct, 2)
+	for i := range structs {
+		s, ok := slice[i].(Struct)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("deserialized type is not Struct: %T",
+				slice[i])
+		}
+		structs[i] = s
+	}
+	optionData, ok := slice[2].(serializer.Bytes)
+	if !ok {
+		return nil, nil, nil, errors.New("invalid chain options")
+	}
+	var options chainOptions
+	if err := json.Unmarshal(optionData, &options); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid chain options: %s", err)
+	}
+	var transform neuralnet.Layer
+	if len(slice) == 4 {
+		transform, ok = slice[3].(neuralnet.Layer)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("deserialized type is not Layer: %T",
+				slice[3])
+		}
+	}
+	return structs, transform, &options, nil
+}
+
+// clipActivation creates a PartialActivation which only
+// covers the components before the given end index.
+func clipActivation(p *PartialActivation, end int) *PartialActivation {
+	res := &PartialActivation{}
+	for i, r := range p.Ranges {
+		if r.Start >= end {
+			break
+		}
+		if r.End > end {
+			r.End = end
+		}
+		res.Ranges = append(res.Ranges, r)
+		res.Activations = append(res.Activations, p.Activations[i])
+	}
+	return res
+}
+
+type chainState struct {
+	Chain  *Chain
+	First  State
+	Second State
+}
+
+func (c *chainState) Data() linalg.Vector {
+	return append(append(linalg.Vector{}, c.First.Data()...), c.Second.Data()...)
+}
+
+func (c *chainState) Gradient(dataGrad linalg.Vector, upstream Grad) (linalg.Vector, Grad) {
+	upstreamPair := [2]Grad{}
+	if upstream != nil {
+		upstreamPair = upstream.([2]Grad)
+	}
+
+	firstSize := c.Chain.First.DataSize()
+	secondCtrlGrad, secondGrad := c.Second.Gradient(dataGrad[firstSize:], upstreamPair[1])
+	headSize := c.Chain.secondControlSize()
+
+	firstDataGrad := dataGrad[:firstSize].Copy()
+	transformGrad := secondCtrlGrad[headSize:]
+	if c.Chain.Transform == nil {
+		firstDataGrad.Add(transformGrad)
+	} else {
+		inVar := &autofunc.Variable{Vector: c.First.Data()}
+		g := autofunc.Gradient{inVar: firstDataGrad}
+		c.Chain.Transform.Apply(inVar).PropagateGradient(transformGrad, g)
+	}
+
+	firstCtrlGrad, firstGrad := c.First.Gradient(firstDataGrad, upstreamPair[0])
+	ctrlGrad := append(append(linalg.Vector{}, firstCtrlGrad...), secondCtrlGrad[:headSize]...)
+	return ctrlGrad, [2]Grad{firstGrad, secondGrad}
+}
+
+// Detach returns a chain state with the same contents and
+// no history, by detaching both sub-states.
+// Both sub-states must be Detachers.
+func (c *chainState) Detach() State {
+	return &chainState{
+		Chain:  c.Chain,
+		First:  Detach(c.First),
+		Second: Detach(c.Second),
+	}
+}
+
+// DetachR is like Detach, but for an RState.
+// Both sub-states must be Detachers, and both structs
+// must be RStructs.
+func (c *chainState) DetachR() RState {
+	return &chainRState{
+		Chain: &RChain{
+			First:         c.Chain.First.(RStruct),
+			Second:        c.Chain.Second.(RStruct),
+			Transform:     c.Chain.Transform,
+			TransformSize: c.Chain.TransformSize,
+		},
+		First:  detachR(c.First),
+		Second: detachR(c.Second),
+	}
+}
+
+func (c *chainState) NextState(control linalg.Vector) State {
+	firstCtrlSize := c.Chain.First.ControlSize()
+	first := c.First.NextState(control[:firstCtrlSize])
+
+	transformed := first.Data()
+	if c.Chain.Transform != nil {
+		transformed = c.Chain.Transform.Apply(&autofunc.Variable{Vector: transformed}).Output()
+	}
+	secondCtrl := append(append(linalg.Vector{}, control[firstCtrlSize:]...), transformed...)
+
+	return &chainState{
+		Chain:  c.Chain,
+		First:  first,
+		Second: c.Second.NextState(secondCtrl),
+	}
+}
+
+type chainRState struct {
+	Chain  *RChain
+	First  RState
+	Second RState
+}
+
+func (c *chainRState) Data() linalg.Vector {
+	return append(append(linalg.Vector{}, c.First.Data()...), c.Second.Data()...)
+}
+
+func (c *chainRState) RData() linalg.Vector {
+	return append(append(linalg.Vector{}, c.First.RData()...), c.Second.RData()...)
+}
+
+func (c *chainRState) RGradient(dataGrad, dataGradR linalg.Vector,
+	upstream RGrad) (linalg.Vector, linalg.Vector, RGrad) {
+	upstreamPair := [2]RGrad{}
+	if upstream != nil {
+		upstreamPair = upstream.([2]RGrad)
+	}
+
+	firstSize := c.Chain.First.DataSize()
+	secondCtrlGrad, secondCtrlGradR, secondGrad := c.Second.RGradient(dataGrad[firstSize:],
+		dataGradR[firstSize:], upstreamPair[1])
+	headSize := c.Chain.chain().secondControlSize()
+
+	firstDataGrad := dataGrad[:firstSize].Copy()
+	firstDataGradR := dataGradR[:firstSize].Copy()
+	transformGrad := secondCtrlGrad[headSize:]
+	transformGradR := secondCtrlGradR[headSize:]
+	if c.Chain.Transform == nil {
+		firstDataGrad.Add(transformGrad)
+		firstDataGradR.Add(transformGradR)
+	} else {
+		inVar := &autofunc.Variable{Vector: c.First.Data()}
+		g := autofunc.Gradient{inVar: firstDataGrad}
+		rg := autofunc.RGradient{inVar: firstDataGradR}
+		c.Chain.Transform.ApplyR(autofunc.RVector{}, &autofunc.RVariable{
+			Variable:   inVar,
+			ROutputVec: c.First.RData(),
+		}).PropagateRGradient(transformGrad, transformGradR, rg, g)
+	}
+
+	firstCtrlGrad, firstCtrlGradR, firstGrad := c.First.RGradient(firstDataGrad,
+		firstDataGradR, upstreamPair[0])
+	ctrlGrad := append(append(linalg.Vector{}, firstCtrlGrad...), secondCtrlGrad[:headSize]...)
+	ctrlGradR := append(append(linalg.Vector{}, firstCtrlGradR...),
+		secondCtrlGradR[:headSize]...)
+	return ctrlGrad, ctrlGradR, [2]RGrad{firstGrad, secondGrad}
+}
+
+func (c *chainRState) NextRState(control, controlR linalg.Vector) RState {
+	firstCtrlSize := c.Chain.First.ControlSize()
+	first := c.First.NextRState(control[:firstCtrlSize], controlR[:firstCtrlSize])
+
+	transformed, transformedR := first.Data(), first.RData()
+	if c.Chain.Transform != nil {
+		res := c.Chain.Transform.ApplyR(autofunc.RVector{}, &autofunc.RVariable{
+			Variable:   &autofunc.Variable{Vector: transformed},
+			ROutputVec: transformedR,
+		})
+		transformed, transformedR = res.Output(), res.ROutput()
+	}
+	secondCtrl := append(append(linalg.Vector{}, control[firstCtrlSize:]...), transformed...)
+	secondCtrlR := append(append(linalg.Vector{}, controlR[firstCtrlSize:]...),
+		transformedR...)
+
+	return &chainRState{
+		Chain:  c.Chain,
+		First:  first,
+		Second: c.Second.NextRState(secondCtrl, secondCtrlR),
+	}
+}
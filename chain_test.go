@@ -0,0 +1,113 @@
+package neuralstruct
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func TestChainData(t *testing.T) {
+	stack := &Stack{VectorSize: 2, NoReplace: true}
+	queue := &Queue{VectorSize: 2}
+	chain := &Chain{First: stack, Second: queue}
+	if chain.ControlSize() != stack.ControlSize()+queueFlagCount {
+		t.Fatalf("unexpected control size %d", chain.ControlSize())
+	}
+
+	stackState := stack.StartState()
+	queueState := queue.StartState()
+	state := chain.StartState()
+
+	controls := []linalg.Vector{
+		{math.Log(0.1), math.Log(0.9), math.Log(1e-5), 1, 2, 0, 1, 0},
+		{math.Log(0.5), math.Log(0.5), math.Log(1e-5), 3, 4, 0, 1, 0},
+		{math.Log(0.3), math.Log(0.3), math.Log(0.4), 0, 0, 0, 0, 1},
+	}
+	for i, control := range controls {
+		state = state.NextState(control)
+		stackState = stackState.NextState(control[:5])
+		queueCtrl := append(append(linalg.Vector{}, control[5:]...), stackState.Data()...)
+		queueState = queueState.NextState(queueCtrl)
+		expected := append(append(linalg.Vector{}, stackState.Data()...), queueState.Data()...)
+		if !statesEqual(state.Data(), expected) {
+			t.Errorf("step %d: expected %v but got %v", i, expected, state.Data())
+		}
+	}
+}
+
+func TestChainDerivatives(t *testing.T) {
+	testAllDerivatives(t, &RChain{
+		First:  &Stack{VectorSize: 3},
+		Second: &Queue{VectorSize: 3},
+	})
+}
+
+func TestChainDerivativesTransform(t *testing.T) {
+	testAllDerivatives(t, &RChain{
+		First:     &Stack{VectorSize: 3},
+		Second:    &Queue{VectorSize: 3},
+		Transform: &neuralnet.HyperbolicTangent{},
+	})
+}
+
+func TestChainValidation(t *testing.T) {
+	dense := &neuralnet.DenseLayer{InputCount: 3, OutputCount: 2}
+	dense.Randomize()
+	invalid := []*Chain{
+		{First: &Stack{VectorSize: 3}, Second: &Queue{VectorSize: 2}, Transform: dense,
+			TransformSize: 2},
+		{First: &Stack{VectorSize: 3}, Second: &Queue{VectorSize: 3}, TransformSize: 2},
+		{First: &Stack{VectorSize: 3}, Second: &Queue{VectorSize: 3},
+			Transform: &neuralnet.HyperbolicTangent{}, TransformSize: 7},
+		{First: &Stack{VectorSize: 5}, Second: &Queue{VectorSize: 1}},
+	}
+	for i, chain := range invalid {
+		if chain.validate() == nil {
+			t.Errorf("chain %d: expected an error", i)
+		}
+	}
+
+	chain := &Chain{First: &Stack{VectorSize: 3}, Second: &Queue{VectorSize: 3},
+		Transform: &neuralnet.HyperbolicTangent{}, TransformSize: 2}
+	if err := chain.validate(); err != nil {
+		t.Error(err)
+	}
+	if size := chain.ControlSize(); size != 7+4 {
+		t.Errorf("expected control size 11 but got %d", size)
+	}
+}
+
+func TestChainSerialize(t *testing.T) {
+	chain := &RChain{
+		First:         &Stack{VectorSize: 3},
+		Second:        &Queue{VectorSize: 3},
+		Transform:     &neuralnet.HyperbolicTangent{},
+		TransformSize: 3,
+	}
+	data, err := serializer.SerializeWithType(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newChain, ok := decoded.(*RChain)
+	if !ok {
+		t.Fatalf("type shouldn't be %T", decoded)
+	}
+	if newChain.ControlSize() != chain.ControlSize() {
+		t.Errorf("expected control size %d but got %d", chain.ControlSize(),
+			newChain.ControlSize())
+	}
+	if newChain.TransformSize != chain.TransformSize {
+		t.Errorf("expected transform size %d but got %d", chain.TransformSize,
+			newChain.TransformSize)
+	}
+	if _, ok := newChain.Transform.(*neuralnet.HyperbolicTangent); !ok {
+		t.Errorf("transform shouldn't be %T", newChain.Transform)
+	}
+}
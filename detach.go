@@ -0,0 +1,32 @@
+package neuralstruct
+
+import "fmt"
+
+// Detach returns a state with the same contents as s, but
+// without any references to the states that led up to it.
+// This makes it possible to carry a structure's contents
+// from one training segment to the next without keeping
+// the entire history in memory.
+//
+// Gradients are not propagated through the result if it
+// is passed to Block.StartStateFrom.
+//
+// It panics if s is not a Detacher, rather than silently
+// keeping the history of s.
+func Detach(s State) State {
+	return detacher(s).Detach()
+}
+
+// detachR detaches a state and turns it into an RState.
+// It panics if s is not a Detacher.
+func detachR(s State) RState {
+	return detacher(s).DetachR()
+}
+
+func detacher(s State) Detacher {
+	d, ok := s.(Detacher)
+	if !ok {
+		panic(fmt.Sprintf("state is not a Detacher: %T", s))
+	}
+	return d
+}
@@ -0,0 +1,76 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestDetach(t *testing.T) {
+	structs := []Struct{
+		&Stack{VectorSize: 3},
+		&Stack{VectorSize: 3, Checkpoint: 3},
+		&Queue{VectorSize: 2},
+		&MultiStack{VectorSize: 2, StackCount: 3},
+		&RingBuffer{VectorSize: 2, Capacity: 3},
+		&FastWeights{KeySize: 3, ValueSize: 2},
+		&DNC{WordSize: 2, MemorySize: 3, ReadHeads: 1},
+		Aggregate{&Stack{VectorSize: 2}, &Queue{VectorSize: 2}},
+		RMixture{&Stack{VectorSize: 2}, &Queue{VectorSize: 2}},
+		&RChain{First: &Stack{VectorSize: 2}, Second: &Queue{VectorSize: 2}},
+		&Grid{Width: 3, Height: 2, VectorSize: 2},
+		&Tree{Depth: 3, VectorSize: 2},
+	}
+	for _, s := range structs {
+		state := s.StartState()
+		for i := 0; i < 5; i++ {
+			state = state.NextState(testRandVec(s.ControlSize()))
+		}
+		detached := Detach(state)
+		if _, ok := detached.(Detacher); !ok {
+			t.Errorf("%T: state is not a Detacher", s)
+			continue
+		}
+		if !statesEqual(detached.Data(), state.Data()) {
+			t.Errorf("%T: expected data %v but got %v", s, state.Data(), detached.Data())
+		}
+		detachedR := detached.(Detacher).DetachR()
+		if !statesEqual(detachedR.Data(), state.Data()) {
+			t.Errorf("%T: expected R data %v but got %v", s, state.Data(), detachedR.Data())
+		}
+		if !statesEqual(detachedR.RData(), make(linalg.Vector, s.DataSize())) {
+			t.Errorf("%T: expected zero RData but got %v", s, detachedR.RData())
+		}
+		for i := 0; i < 3; i++ {
+			control := testRandVec(s.ControlSize())
+			state = state.NextState(control)
+			detached = detached.NextState(control)
+			detachedR = detachedR.NextRState(control, make(linalg.Vector, len(control)))
+			if !statesEqual(detached.Data(), state.Data()) {
+				t.Errorf("%T: step %d: expected data %v but got %v", s, i, state.Data(),
+					detached.Data())
+			}
+			if !statesEqual(detachedR.Data(), state.Data()) {
+				t.Errorf("%T: step %d: expected R data %v but got %v", s, i, state.Data(),
+					detachedR.Data())
+			}
+		}
+	}
+}
+
+func TestDetachNonDetacher(t *testing.T) {
+	state := (&Stack{VectorSize: 2}).StartInferenceState()
+	for i, detach := range []func(){
+		func() { Detach(state) },
+		func() { detachR(state) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("function %d: expected a panic", i)
+				}
+			}()
+			detach()
+		}()
+	}
+}
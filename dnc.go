@@ -0,0 +1,424 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+// These are the read modes (in order) of each read head
+// of a DNC.
+const (
+	DNCReadBackward int = iota
+	DNCReadContent
+	DNCReadForward
+)
+
+const dncReadModeCount = 3
+
+// dncNormEpsilon is added to squared norms before they
+// are used for cosine similarities, preventing division
+// by zero for empty memory locations.
+const dncNormEpsilon = 1e-6
+
+func init() {
+	var d DNC
+	serializer.RegisterTypedDeserializer(d.SerializerType(), DeserializeDNC)
+}
+
+// A DNC is a Struct which implements the external memory
+// of a Differentiable Neural Computer, as described in
+// https://www.nature.com/articles/nature20101.
+//
+// The memory has one write head and several read heads.
+// The write head chooses locations using a mix of content
+// lookup and dynamic allocation, where allocation prefers
+// locations with low usage.
+// Read heads can look up locations by content, or follow
+// a temporal link matrix forwards or backwards to visit
+// locations in the order in which they were written.
+//
+// The control vector is the DNC's interface vector, which
+// consists of (in order):
+//
+//   - the read keys, one per read head
+//   - the read strengths, one per read head
+//   - the write key
+//   - the write strength
+//   - the erase vector
+//   - the write vector
+//   - the free gates, one per read head
+//   - the allocation gate
+//   - the write gate
+//   - the read modes, three per read head
+//
+// Unlike most structures, the DNC does not squash any of
+// its control components by itself.
+// The interface vector should be squashed by the layer
+// from SuggestedActivation.
+//
+// The data output is the vector read by each read head.
+type DNC struct {
+	WordSize   int
+	MemorySize int
+	ReadHeads  int
+}
+
+// DeserializeDNC deserializes a DNC.
+func DeserializeDNC(d []byte) (*DNC, error) {
+	var res DNC
+	if err := json.Unmarshal(d, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ControlSize returns the size of the interface vector.
+func (d *DNC) ControlSize() int {
+	return d.layout().End
+}
+
+// DataSize returns the total size of all the read
+// vectors.
+func (d *DNC) DataSize() int {
+	return d.WordSize * d.ReadHeads
+}
+
+// StartState returns a state with empty memory.
+func (d *DNC) StartState() State {
+	return &funcState{
+		Transition: d.transition,
+		DataSize:   d.DataSize(),
+		Joined:     make(linalg.Vector, d.DataSize()+d.internalSize()),
+	}
+}
+
+// StartRState is like StartState, but for an RState.
+func (d *DNC) StartRState() RState {
+	size := d.DataSize() + d.internalSize()
+	return &funcRState{
+		Transition: d.transition,
+		DataSize:   d.DataSize(),
+		Joined:     make(linalg.Vector, size),
+		RJoined:    make(linalg.Vector, size),
+	}
+}
+
+// SerializerType returns the unique ID used to serialize
+// DNCs with the serializer package.
+func (d *DNC) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.DNC"
+}
+
+// Serialize encodes the DNC's parameters.
+func (d *DNC) Serialize() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+// SuggestedActivation returns an activation function
+// which applies a oneplus to the strengths, a sigmoid to
+// the erase vector and the gates, and a softmax to the
+// read modes of each read head.
+// Keys and the write vector are left untouched.
+func (d *DNC) SuggestedActivation() neuralnet.Layer {
+	l := d.layout()
+	return &PartialActivation{
+		Ranges: []ComponentRange{
+			{Start: l.ReadStrengths, End: l.WriteKey},
+			{Start: l.WriteStrength, End: l.Erase},
+			{Start: l.Erase, End: l.WriteVector},
+			{Start: l.FreeGates, End: l.ReadModes},
+			{Start: l.ReadModes, End: l.End},
+		},
+		Activations: []neuralnet.Layer{
+			&Oneplus{},
+			&Oneplus{},
+			&neuralnet.Sigmoid{},
+			&neuralnet.Sigmoid{},
+			&SegmentSoftmax{SegmentSize: dncReadModeCount},
+		},
+	}
+}
+
+// dncLayout stores the start index of each part of the
+// interface vector.
+type dncLayout struct {
+	ReadKeys      int
+	ReadStrengths int
+	WriteKey      int
+	WriteStrength int
+	Erase         int
+	WriteVector   int
+	FreeGates     int
+	AllocGate     int
+	WriteGate     int
+	ReadModes     int
+	End           int
+}
+
+func (d *DNC) layout() *dncLayout {
+	var l dncLayout
+	l.ReadStrengths = l.ReadKeys + d.ReadHeads*d.WordSize
+	l.WriteKey = l.ReadStrengths + d.ReadHeads
+	l.WriteStrength = l.WriteKey + d.WordSize
+	l.Erase = l.WriteStrength + 1
+	l.WriteVector = l.Erase + d.WordSize
+	l.FreeGates = l.WriteVector + d.WordSize
+	l.AllocGate = l.FreeGates + d.ReadHeads
+	l.WriteGate = l.AllocGate + 1
+	l.ReadModes = l.WriteGate + 1
+	l.End = l.ReadModes + d.ReadHeads*dncReadModeCount
+	return &l
+}
+
+// internalSize returns the size of the internal vector.
+//
+// The internal vector stores the memory matrix, the link
+// matrix, the precedence weights, the usage vector, the
+// write weights, and the read weights of every read head,
+// in that order.
+func (d *DNC) internalSize() int {
+	n := d.MemorySize
+	return n*d.WordSize + n*n + n*(3+d.ReadHeads)
+}
+
+func (d *DNC) transition(last, control autofunc.RResult) autofunc.RResult {
+	n := d.MemorySize
+	memSize := n * d.WordSize
+	linkStart := memSize
+	precStart := linkStart + n*n
+	usageStart := precStart + n
+	writeStart := usageStart + n
+	readStart := writeStart + n
+
+	l := d.layout()
+	part := func(vec autofunc.RResult, start, size int) autofunc.RResult {
+		return autofunc.SliceR(vec, start, start+size)
+	}
+
+	return autofunc.PoolR(last, func(last autofunc.RResult) autofunc.RResult {
+		return autofunc.PoolR(control, func(control autofunc.RResult) autofunc.RResult {
+			oldMemory := part(last, 0, memSize)
+			oldLink := part(last, linkStart, n*n)
+			oldPrecedence := part(last, precStart, n)
+			oldReads := make([]autofunc.RResult, d.ReadHeads)
+			freeTerms := make([]autofunc.RResult, d.ReadHeads)
+			for i := range oldReads {
+				oldReads[i] = part(last, readStart+i*n, n)
+				freeGate := part(control, l.FreeGates+i, 1)
+				freeTerms[i] = oneMinusR(autofunc.ScaleFirstR(oldReads[i], freeGate))
+			}
+			usage := d.nextUsage(part(last, usageStart, n), part(last, writeStart, n),
+				freeTerms)
+
+			return autofunc.PoolR(usage, func(usage autofunc.RResult) autofunc.RResult {
+				contentWeights := d.contentWeights(oldMemory, part(control, l.WriteKey, d.WordSize),
+					part(control, l.WriteStrength, 1))
+				allocGate := part(control, l.AllocGate, 1)
+				writeWeights := autofunc.ScaleFirstR(autofunc.AddR(
+					autofunc.ScaleFirstR(d.allocation(usage), allocGate),
+					autofunc.ScaleFirstR(contentWeights, oneMinusR(allocGate)),
+				), part(control, l.WriteGate, 1))
+
+				return autofunc.PoolR(writeWeights, func(ww autofunc.RResult) autofunc.RResult {
+					memory := d.nextMemory(oldMemory, ww, part(control, l.Erase, d.WordSize),
+						part(control, l.WriteVector, d.WordSize))
+					link := d.nextLink(oldLink, oldPrecedence, ww)
+					precedence := autofunc.AddR(autofunc.ScaleFirstR(oldPrecedence,
+						oneMinusR(autofunc.SumAllR(ww))), ww)
+
+					return autofunc.PoolR(memory, func(memory autofunc.RResult) autofunc.RResult {
+						return autofunc.PoolR(link, func(link autofunc.RResult) autofunc.RResult {
+							readWeights := make([]autofunc.RResult, d.ReadHeads)
+							readVecs := make([]autofunc.RResult, d.ReadHeads)
+							for i := range readWeights {
+								key := part(control, l.ReadKeys+i*d.WordSize, d.WordSize)
+								strength := part(control, l.ReadStrengths+i, 1)
+								modes := part(control, l.ReadModes+i*dncReadModeCount,
+									dncReadModeCount)
+								readWeights[i] = d.readWeights(memory, link, oldReads[i], key,
+									strength, modes)
+							}
+							joinedReads := autofunc.ConcatR(readWeights...)
+							return autofunc.PoolR(joinedReads,
+								func(joinedReads autofunc.RResult) autofunc.RResult {
+									for i := range readVecs {
+										readVecs[i] = weightedCellsR(memory,
+											part(joinedReads, i*n, n), d.identity())
+									}
+									res := append(readVecs, memory, link, precedence, usage, ww,
+										joinedReads)
+									return autofunc.ConcatR(res...)
+								})
+						})
+					})
+				})
+			})
+		})
+	})
+}
+
+// nextUsage computes the new usage vector from the old
+// usage vector, the old write weights, and the retention
+// terms of each read head.
+func (d *DNC) nextUsage(usage, writeWeights autofunc.RResult,
+	freeTerms []autofunc.RResult) autofunc.RResult {
+	retention := freeTerms[0]
+	for _, term := range freeTerms[1:] {
+		retention = autofunc.MulR(retention, term)
+	}
+	written := autofunc.SubR(autofunc.AddR(usage, writeWeights),
+		autofunc.MulR(usage, writeWeights))
+	return autofunc.MulR(written, retention)
+}
+
+// allocation computes the allocation weights for a usage
+// vector.
+//
+// The order of the locations (sorted by usage) is treated
+// as a constant, since it is not differentiable.
+func (d *DNC) allocation(usage autofunc.RResult) autofunc.RResult {
+	order := &dncUsageOrder{Usage: usage.Output(), Indices: d.identity()}
+	sort.Stable(order)
+
+	parts := make([]autofunc.RResult, d.MemorySize)
+	var product autofunc.RResult
+	for _, idx := range order.Indices {
+		u := autofunc.SliceR(usage, idx, idx+1)
+		if product == nil {
+			parts[idx] = oneMinusR(u)
+			product = u
+		} else {
+			parts[idx] = autofunc.MulR(oneMinusR(u), product)
+			product = autofunc.MulR(product, u)
+		}
+	}
+	return autofunc.ConcatR(parts...)
+}
+
+// contentWeights computes a softmax over the cosine
+// similarities between a key and every memory location,
+// scaled by a strength.
+func (d *DNC) contentWeights(memory, key, strength autofunc.RResult) autofunc.RResult {
+	return autofunc.PoolR(key, func(key autofunc.RResult) autofunc.RResult {
+		keyScale := inverseNormR(key)
+		similarities := make([]autofunc.RResult, d.MemorySize)
+		for i := range similarities {
+			row := autofunc.SliceR(memory, i*d.WordSize, (i+1)*d.WordSize)
+			dot := autofunc.SumAllR(autofunc.MulR(row, key))
+			similarities[i] = autofunc.MulR(autofunc.MulR(dot, inverseNormR(row)), keyScale)
+		}
+		softmax := autofunc.Softmax{}
+		return softmax.ApplyR(autofunc.RVector{},
+			autofunc.ScaleFirstR(autofunc.ConcatR(similarities...), strength))
+	})
+}
+
+// nextMemory erases and writes to the memory matrix.
+func (d *DNC) nextMemory(memory, writeWeights, erase, write autofunc.RResult) autofunc.RResult {
+	rows := make([]autofunc.RResult, d.MemorySize)
+	for i := range rows {
+		row := autofunc.SliceR(memory, i*d.WordSize, (i+1)*d.WordSize)
+		weight := autofunc.SliceR(writeWeights, i, i+1)
+		erased := autofunc.SubR(row, autofunc.ScaleFirstR(autofunc.MulR(row, erase), weight))
+		rows[i] = autofunc.AddR(erased, autofunc.ScaleFirstR(write, weight))
+	}
+	return autofunc.ConcatR(rows...)
+}
+
+// nextLink updates the temporal link matrix, whose entry
+// (i, j) indicates how much location i was written right
+// after location j.
+func (d *DNC) nextLink(link, precedence, writeWeights autofunc.RResult) autofunc.RResult {
+	n := d.MemorySize
+	return autofunc.PoolR(oneMinusR(writeWeights), func(keep autofunc.RResult) autofunc.RResult {
+		rows := make([]autofunc.RResult, n)
+		for i := range rows {
+			row := autofunc.SliceR(link, i*n, (i+1)*n)
+			weight := autofunc.SliceR(writeWeights, i, i+1)
+			newRow := autofunc.SubR(autofunc.MulR(row, keep), autofunc.ScaleFirstR(row, weight))
+			newRow = autofunc.AddR(newRow, autofunc.ScaleFirstR(precedence, weight))
+
+			mask := make(linalg.Vector, n)
+			for j := range mask {
+				if j != i {
+					mask[j] = 1
+				}
+			}
+			rows[i] = autofunc.MulR(newRow, &autofunc.RVariable{
+				Variable:   &autofunc.Variable{Vector: mask},
+				ROutputVec: make(linalg.Vector, n),
+			})
+		}
+		return autofunc.ConcatR(rows...)
+	})
+}
+
+// readWeights computes the new weights of a read head by
+// mixing the backward, content, and forward weightings.
+func (d *DNC) readWeights(memory, link, lastWeights, key, strength,
+	modes autofunc.RResult) autofunc.RResult {
+	n := d.MemorySize
+	forwardParts := make([]autofunc.RResult, n)
+	for i := range forwardParts {
+		row := autofunc.SliceR(link, i*n, (i+1)*n)
+		forwardParts[i] = autofunc.SumAllR(autofunc.MulR(row, lastWeights))
+	}
+	forward := autofunc.ConcatR(forwardParts...)
+	backward := weightedCellsR(link, lastWeights, d.identity())
+	content := d.contentWeights(memory, key, strength)
+
+	mode := func(m int) autofunc.RResult {
+		return autofunc.SliceR(modes, m, m+1)
+	}
+	return sumR([]autofunc.RResult{
+		autofunc.ScaleFirstR(backward, mode(DNCReadBackward)),
+		autofunc.ScaleFirstR(content, mode(DNCReadContent)),
+		autofunc.ScaleFirstR(forward, mode(DNCReadForward)),
+	})
+}
+
+// dncUsageOrder sorts memory locations by usage.
+type dncUsageOrder struct {
+	Usage   linalg.Vector
+	Indices []int
+}
+
+func (d *dncUsageOrder) Len() int {
+	return len(d.Indices)
+}
+
+func (d *dncUsageOrder) Less(i, j int) bool {
+	return d.Usage[d.Indices[i]] < d.Usage[d.Indices[j]]
+}
+
+func (d *dncUsageOrder) Swap(i, j int) {
+	d.Indices[i], d.Indices[j] = d.Indices[j], d.Indices[i]
+}
+
+func (d *DNC) identity() []int {
+	res := make([]int, d.MemorySize)
+	for i := range res {
+		res[i] = i
+	}
+	return res
+}
+
+// oneMinusR computes 1 - x for each component of x.
+func oneMinusR(vec autofunc.RResult) autofunc.RResult {
+	return autofunc.AddScalerR(autofunc.ScaleR(vec, -1), 1)
+}
+
+// inverseNormR computes the reciprocal of a vector's
+// (slightly padded) Euclidean norm.
+func inverseNormR(vec autofunc.RResult) autofunc.RResult {
+	squaredNorm := autofunc.AddScalerR(autofunc.SumAllR(autofunc.MulR(vec, vec)), dncNormEpsilon)
+	exp := autofunc.Exp{}
+	log := autofunc.Log{}
+	return exp.ApplyR(autofunc.RVector{},
+		autofunc.ScaleR(log.ApplyR(autofunc.RVector{}, squaredNorm), -0.5))
+}
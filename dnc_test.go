@@ -0,0 +1,47 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestDNCData(t *testing.T) {
+	dnc := &DNC{WordSize: 2, MemorySize: 3, ReadHeads: 1}
+	l := dnc.layout()
+	state := dnc.StartState()
+
+	values := []linalg.Vector{{1, -1}, {0.5, 2}}
+	for i, value := range values {
+		control := make(linalg.Vector, dnc.ControlSize())
+		control[l.ReadStrengths] = 30
+		control[l.WriteStrength] = 1
+		copy(control[l.WriteVector:], value)
+		control[l.AllocGate] = 1
+		control[l.WriteGate] = 1
+		if i == 0 {
+			// Look up the first value by content.
+			copy(control[l.ReadKeys:], value)
+			control[l.ReadModes+DNCReadContent] = 1
+		} else {
+			// Follow the link from the first value.
+			control[l.ReadModes+DNCReadForward] = 1
+		}
+		state = state.NextState(control)
+		if !statesEqual(state.Data(), value) {
+			t.Errorf("step %d: expected %v but got %v", i, value, state.Data())
+		}
+	}
+}
+
+func TestDNCDerivatives(t *testing.T) {
+	testActivatedDerivatives(t, &DNC{WordSize: 2, MemorySize: 3, ReadHeads: 2})
+}
+
+func BenchmarkDNCForward(b *testing.B) {
+	forwardBenchmark(b, &DNC{WordSize: benchmarkVectorSize, MemorySize: 16, ReadHeads: 2})
+}
+
+func BenchmarkDNCBackward(b *testing.B) {
+	backwardBenchmark(b, &DNC{WordSize: benchmarkVectorSize, MemorySize: 16, ReadHeads: 2})
+}
@@ -0,0 +1,313 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func init() {
+	var f FastWeights
+	serializer.RegisterTypedDeserializer(f.SerializerType(), DeserializeFastWeights)
+}
+
+// FastWeights is a Struct which stores an associative
+// matrix memory.
+//
+// The control vector consists of a key, a value, and a
+// query, in that order.
+// At every timestep, the matrix is decayed and then the
+// outer product of the value and the key is added to it.
+// The data output is the product of the new matrix and
+// the query.
+//
+// Unlike a Stack or a Queue, the memory needed for one
+// timestep does not grow with the number of timesteps.
+type FastWeights struct {
+	// KeySize is the size of keys and queries.
+	KeySize int
+
+	// ValueSize is the size of values, which is also the
+	// size of the data output.
+	ValueSize int
+
+	// Decay is the factor by which the matrix is scaled
+	// before every update.
+	// Reasonable values are slightly less than 1.
+	// If it is 0, 1 is used (i.e. there is no decay).
+	Decay float64
+
+	// LearningRate scales every outer product before it
+	// is added to the matrix.
+	// If it is 0, 1 is used.
+	LearningRate float64
+}
+
+// DeserializeFastWeights deserializes a FastWeights.
+func DeserializeFastWeights(d []byte) (*FastWeights, error) {
+	var f FastWeights
+	if err := json.Unmarshal(d, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ControlSize returns the total size of a key, a value,
+// and a query.
+func (f *FastWeights) ControlSize() int {
+	return f.KeySize*2 + f.ValueSize
+}
+
+// DataSize returns the value size.
+func (f *FastWeights) DataSize() int {
+	return f.ValueSize
+}
+
+// StartState returns a state with a zero matrix.
+func (f *FastWeights) StartState() State {
+	return &fastWeightsState{
+		Weights:    *f,
+		Matrix:     make(linalg.Vector, f.KeySize*f.ValueSize),
+		OutputData: make(linalg.Vector, f.ValueSize),
+	}
+}
+
+// StartRState returns a state with a zero matrix.
+func (f *FastWeights) StartRState() RState {
+	return &fastWeightsRState{
+		Weights:     *f,
+		Matrix:      make(linalg.Vector, f.KeySize*f.ValueSize),
+		MatrixR:     make(linalg.Vector, f.KeySize*f.ValueSize),
+		OutputData:  make(linalg.Vector, f.ValueSize),
+		ROutputData: make(linalg.Vector, f.ValueSize),
+	}
+}
+
+// SerializerType returns the unique ID used to serialize
+// FastWeights with the serializer package.
+func (f *FastWeights) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.FastWeights"
+}
+
+// Serialize encodes the memory's parameters.
+func (f *FastWeights) Serialize() ([]byte, error) {
+	return json.Marshal(f)
+}
+
+// SuggestedActivation returns an activation function
+// which applies a hyperbolic tangent to the keys, values,
+// and queries.
+func (f *FastWeights) SuggestedActivation() neuralnet.Layer {
+	return &PartialActivation{
+		Ranges:      []ComponentRange{{Start: 0, End: f.ControlSize()}},
+		Activations: []neuralnet.Layer{&neuralnet.HyperbolicTangent{}},
+	}
+}
+
+func (f *FastWeights) decay() float64 {
+	if f.Decay == 0 {
+		return 1
+	}
+	return f.Decay
+}
+
+func (f *FastWeights) learningRate() float64 {
+	if f.LearningRate == 0 {
+		return 1
+	}
+	return f.LearningRate
+}
+
+// splitControl returns the key, value, and query from a
+// control vector.
+func (f *FastWeights) splitControl(control linalg.Vector) (k, v, q linalg.Vector) {
+	k = control[:f.KeySize]
+	v = control[f.KeySize : f.KeySize+f.ValueSize]
+	q = control[f.KeySize+f.ValueSize:]
+	return
+}
+
+// joinControl is the inverse of splitControl.
+func (f *FastWeights) joinControl(k, v, q linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, 0, f.ControlSize())
+	res = append(res, k...)
+	res = append(res, v...)
+	return append(res, q...)
+}
+
+// addOuter adds scale*v*k^T to the row-major matrix m.
+func (f *FastWeights) addOuter(m, v, k linalg.Vector, scale float64) {
+	for i, vi := range v {
+		row := m[i*f.KeySize : (i+1)*f.KeySize]
+		row.Add(k.Copy().Scale(vi * scale))
+	}
+}
+
+// mulVec computes m*k for a row-major matrix m.
+func (f *FastWeights) mulVec(m, k linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, f.ValueSize)
+	for i := range res {
+		res[i] = m[i*f.KeySize : (i+1)*f.KeySize].Dot(k)
+	}
+	return res
+}
+
+// mulTransposeVec computes m^T*v for a row-major matrix m.
+func (f *FastWeights) mulTransposeVec(m, v linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, f.KeySize)
+	for i, vi := range v {
+		res.Add(m[i*f.KeySize : (i+1)*f.KeySize].Copy().Scale(vi))
+	}
+	return res
+}
+
+type fastWeightsState struct {
+	Last       *fastWeightsState
+	Weights    FastWeights
+	Matrix     linalg.Vector
+	OutputData linalg.Vector
+	Control    linalg.Vector
+}
+
+func (f *fastWeightsState) Data() linalg.Vector {
+	return f.OutputData
+}
+
+func (f *fastWeightsState) Gradient(dataGrad linalg.Vector, upstream Grad) (linalg.Vector,
+	Grad) {
+	if f.Last == nil {
+		panic("cannot propagate through start state")
+	}
+	w := &f.Weights
+	k, v, q := w.splitControl(f.Control)
+
+	var matrixGrad linalg.Vector
+	if upstream != nil {
+		matrixGrad = upstream.(linalg.Vector)
+	} else {
+		matrixGrad = make(linalg.Vector, len(f.Matrix))
+	}
+	w.addOuter(matrixGrad, dataGrad, q, 1)
+
+	rate := w.learningRate()
+	kGrad := w.mulTransposeVec(matrixGrad, v).Scale(rate)
+	vGrad := w.mulVec(matrixGrad, k).Scale(rate)
+	qGrad := w.mulTransposeVec(f.Matrix, dataGrad)
+
+	return w.joinControl(kGrad, vGrad, qGrad), matrixGrad.Scale(w.decay())
+}
+
+func (f *fastWeightsState) NextState(control linalg.Vector) State {
+	w := &f.Weights
+	k, v, q := w.splitControl(control)
+	matrix := f.Matrix.Copy().Scale(w.decay())
+	w.addOuter(matrix, v, k, w.learningRate())
+	return &fastWeightsState{
+		Last:       f,
+		Weights:    f.Weights,
+		Matrix:     matrix,
+		OutputData: w.mulVec(matrix, q),
+		Control:    control,
+	}
+}
+
+// Detach returns a state with the same matrix and no
+// history.
+func (f *fastWeightsState) Detach() State {
+	return &fastWeightsState{
+		Weights:    f.Weights,
+		Matrix:     f.Matrix.Copy(),
+		OutputData: f.OutputData.Copy(),
+	}
+}
+
+// DetachR is like Detach, but for an RState.
+func (f *fastWeightsState) DetachR() RState {
+	return &fastWeightsRState{
+		Weights:     f.Weights,
+		Matrix:      f.Matrix.Copy(),
+		MatrixR:     make(linalg.Vector, len(f.Matrix)),
+		OutputData:  f.OutputData.Copy(),
+		ROutputData: make(linalg.Vector, len(f.OutputData)),
+	}
+}
+
+type fastWeightsRState struct {
+	Last        *fastWeightsRState
+	Weights     FastWeights
+	Matrix      linalg.Vector
+	MatrixR     linalg.Vector
+	OutputData  linalg.Vector
+	ROutputData linalg.Vector
+	Control     linalg.Vector
+	ControlR    linalg.Vector
+}
+
+func (f *fastWeightsRState) Data() linalg.Vector {
+	return f.OutputData
+}
+
+func (f *fastWeightsRState) RData() linalg.Vector {
+	return f.ROutputData
+}
+
+func (f *fastWeightsRState) RGradient(dataGrad, dataGradR linalg.Vector,
+	upstream RGrad) (linalg.Vector, linalg.Vector, RGrad) {
+	if f.Last == nil {
+		panic("cannot propagate through start state")
+	}
+	w := &f.Weights
+	k, v, q := w.splitControl(f.Control)
+	kR, vR, qR := w.splitControl(f.ControlR)
+
+	var matrixGrad, matrixGradR linalg.Vector
+	if upstream != nil {
+		upstreamVal := upstream.([2]linalg.Vector)
+		matrixGrad, matrixGradR = upstreamVal[0], upstreamVal[1]
+	} else {
+		matrixGrad = make(linalg.Vector, len(f.Matrix))
+		matrixGradR = make(linalg.Vector, len(f.Matrix))
+	}
+	w.addOuter(matrixGrad, dataGrad, q, 1)
+	w.addOuter(matrixGradR, dataGradR, q, 1)
+	w.addOuter(matrixGradR, dataGrad, qR, 1)
+
+	rate := w.learningRate()
+	kGrad := w.mulTransposeVec(matrixGrad, v).Scale(rate)
+	kGradR := w.mulTransposeVec(matrixGradR, v).Add(w.mulTransposeVec(matrixGrad, vR))
+	kGradR.Scale(rate)
+	vGrad := w.mulVec(matrixGrad, k).Scale(rate)
+	vGradR := w.mulVec(matrixGradR, k).Add(w.mulVec(matrixGrad, kR)).Scale(rate)
+	qGrad := w.mulTransposeVec(f.Matrix, dataGrad)
+	qGradR := w.mulTransposeVec(f.MatrixR, dataGrad)
+	qGradR.Add(w.mulTransposeVec(f.Matrix, dataGradR))
+
+	return w.joinControl(kGrad, vGrad, qGrad), w.joinControl(kGradR, vGradR, qGradR),
+		[2]linalg.Vector{matrixGrad.Scale(w.decay()), matrixGradR.Scale(w.decay())}
+}
+
+func (f *fastWeightsRState) NextRState(control, controlR linalg.Vector) RState {
+	w := &f.Weights
+	k, v, q := w.splitControl(control)
+	kR, vR, qR := w.splitControl(controlR)
+	rate := w.learningRate()
+
+	matrix := f.Matrix.Copy().Scale(w.decay())
+	w.addOuter(matrix, v, k, rate)
+	matrixR := f.MatrixR.Copy().Scale(w.decay())
+	w.addOuter(matrixR, vR, k, rate)
+	w.addOuter(matrixR, v, kR, rate)
+
+	return &fastWeightsRState{
+		Last:        f,
+		Weights:     f.Weights,
+		Matrix:      matrix,
+		MatrixR:     matrixR,
+		OutputData:  w.mulVec(matrix, q),
+		ROutputData: w.mulVec(matrixR, q).Add(w.mulVec(matrix, qR)),
+		Control:     control,
+		ControlR:    controlR,
+	}
+}
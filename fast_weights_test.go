@@ -0,0 +1,55 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestFastWeightsData(t *testing.T) {
+	weights := &FastWeights{KeySize: 2, ValueSize: 2, Decay: 0.5}
+	state := weights.StartState()
+
+	controls := []linalg.Vector{
+		{1, 0, 1, 2, 1, 1},
+		{0, 1, 3, 4, 1, 1},
+		{1, -1, 0, 0, 2, 1},
+	}
+	expected := []linalg.Vector{
+		{1, 2},
+		{3.5, 5},
+		{0.25*2 + 1.5, 0.5*2 + 2},
+	}
+
+	for i, control := range controls {
+		state = state.NextState(control)
+		if !statesEqual(state.Data(), expected[i]) {
+			t.Errorf("bad state %d: expected %v got %v", i, expected[i], state.Data())
+		}
+	}
+}
+
+func TestFastWeightsZeroDecay(t *testing.T) {
+	weights := &FastWeights{KeySize: 2, ValueSize: 2}
+	state := weights.StartState()
+	state = state.NextState(linalg.Vector{1, 0, 1, 2, 1, 0})
+	state = state.NextState(linalg.Vector{0, 1, 3, 4, 1, 0})
+	if expected := (linalg.Vector{1, 2}); !statesEqual(state.Data(), expected) {
+		t.Errorf("expected %v but got %v", expected, state.Data())
+	}
+}
+
+func TestFastWeightsDerivatives(t *testing.T) {
+	testAllDerivatives(t, &FastWeights{KeySize: 3, ValueSize: 2, Decay: 0.9,
+		LearningRate: 0.5})
+}
+
+func BenchmarkFastWeightsForward(b *testing.B) {
+	forwardBenchmark(b, &FastWeights{KeySize: benchmarkVectorSize,
+		ValueSize: benchmarkVectorSize, Decay: 0.95})
+}
+
+func BenchmarkFastWeightsBackward(b *testing.B) {
+	backwardBenchmark(b, &FastWeights{KeySize: benchmarkVectorSize,
+		ValueSize: benchmarkVectorSize, Decay: 0.95})
+}
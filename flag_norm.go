@@ -0,0 +1,354 @@
+package neuralstruct
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// A FlagNormKind is a function which turns flag
+// components into flag probabilities.
+type FlagNormKind int
+
+// These are the supported kinds of flag normalization.
+const (
+	// FlagSoftmax applies a softmax to the flags.
+	FlagSoftmax FlagNormKind = iota
+
+	// FlagSparsemax projects the flags onto the
+	// probability simplex.
+	// Unlike a softmax, it can assign a probability of
+	// exactly zero to unlikely flags.
+	FlagSparsemax
+
+	// FlagGumbel adds Gumbel noise to the flags before
+	// applying a softmax.
+	FlagGumbel
+)
+
+// A FlagNorm determines how a Stack or Queue turns the
+// flag components of its control vectors into flag
+// probabilities.
+// The zero value applies a plain softmax.
+type FlagNorm struct {
+	Kind FlagNormKind
+
+	// Temperature divides the flag components before they
+	// are normalized, so lower temperatures give sharper
+	// flag probabilities.
+	// A value of 0 is treated as 1.
+	Temperature float64
+
+	// Hard, if true, makes FlagGumbel produce a one-hot
+	// vector for the most likely flag.
+	// Gradients and r-operators are computed as if the
+	// soft flags had been used (the straight-through
+	// estimator).
+	Hard bool
+}
+
+// temperature returns the effective temperature.
+func (f FlagNorm) temperature() float64 {
+	if f.Temperature == 0 {
+		return 1
+	}
+	return f.Temperature
+}
+
+// hard returns whether straight-through estimation is
+// in use.
+func (f FlagNorm) hard() bool {
+	return f.Kind == FlagGumbel && f.Hard
+}
+
+// noise samples the noise for one flag vector.
+// It returns nil if the normalization is deterministic.
+func (f FlagNorm) noise(n int) linalg.Vector {
+	if f.Kind != FlagGumbel {
+		return nil
+	}
+	res := make(linalg.Vector, n)
+	for i := range res {
+		u := rand.Float64()
+		for u == 0 {
+			u = rand.Float64()
+		}
+		res[i] = -math.Log(-math.Log(u))
+	}
+	return res
+}
+
+// batchNoise is like noise, but for a batch of flag
+// vectors.
+// It returns nil if the normalization is deterministic.
+func (f FlagNorm) batchNoise(count, n int) []linalg.Vector {
+	if f.Kind != FlagGumbel {
+		return nil
+	}
+	res := make([]linalg.Vector, count)
+	for i := range res {
+		res[i] = f.noise(n)
+	}
+	return res
+}
+
+// apply computes the flag probabilities for some flag
+// components, given noise from the noise method.
+func (f FlagNorm) apply(in, noise linalg.Vector) linalg.Vector {
+	res := f.soft(in, noise)
+	if f.hard() {
+		return oneHot(res)
+	}
+	return res
+}
+
+// applyInto is like apply, but it writes the result to
+// dst.
+func (f FlagNorm) applyInto(dst, in, noise linalg.Vector) {
+	if f == (FlagNorm{}) {
+		softmaxInto(dst, in)
+		return
+	}
+	copy(dst, f.apply(in, noise))
+}
+
+// batchApply applies the normalization to the first n
+// components of each control vector.
+// The results are the rows of the returned matrix.
+// The noises argument may be nil.
+func (f FlagNorm) batchApply(controls, noises []linalg.Vector, n int) rowMatrix {
+	if f == (FlagNorm{}) {
+		return batchSoftmax(controls, n)
+	}
+	res := newRowMatrix(len(controls), n)
+	for i, control := range controls {
+		var noise linalg.Vector
+		if noises != nil {
+			noise = noises[i]
+		}
+		copy(res.Row(i), f.apply(control[:n], noise))
+	}
+	return res
+}
+
+// applyR is like apply, but it also computes the
+// r-operator of the flag probabilities.
+func (f FlagNorm) applyR(in, inR, noise linalg.Vector) (flags, flagsR linalg.Vector) {
+	soft := f.soft(in, noise)
+	t := f.temperature()
+	flagsR = make(linalg.Vector, len(soft))
+	if f.Kind == FlagSparsemax {
+		mean := supportMean(soft, inR)
+		for i, y := range soft {
+			if y > 0 {
+				flagsR[i] = (inR[i] - mean) / t
+			}
+		}
+	} else {
+		dot := soft.Dot(inR)
+		for i, y := range soft {
+			flagsR[i] = y * (inR[i] - dot) / t
+		}
+	}
+	if f.hard() {
+		return oneHot(soft), flagsR
+	}
+	return soft, flagsR
+}
+
+// addGradient adds the gradient of the flag components to
+// dst, given the gradient of the flag probabilities.
+func (f FlagNorm) addGradient(dst, in, noise, upstream linalg.Vector) {
+	soft := f.soft(in, noise)
+	t := f.temperature()
+	if f.Kind == FlagSparsemax {
+		mean := supportMean(soft, upstream)
+		for i, y := range soft {
+			if y > 0 {
+				dst[i] += (upstream[i] - mean) / t
+			}
+		}
+		return
+	}
+	dot := soft.Dot(upstream)
+	for i, y := range soft {
+		dst[i] += y * (upstream[i] - dot) / t
+	}
+}
+
+// addGradientR is like addGradient, but it also adds the
+// r-gradient to dstR.
+func (f FlagNorm) addGradientR(dst, dstR, in, inR, noise, upstream, upstreamR linalg.Vector) {
+	soft := f.soft(in, noise)
+	t := f.temperature()
+	if f.Kind == FlagSparsemax {
+		mean := supportMean(soft, upstream)
+		meanR := supportMean(soft, upstreamR)
+		for i, y := range soft {
+			if y > 0 {
+				dst[i] += (upstream[i] - mean) / t
+				dstR[i] += (upstreamR[i] - meanR) / t
+			}
+		}
+		return
+	}
+	_, softR := FlagNorm{Kind: FlagSoftmax, Temperature: f.Temperature}.applyR(in, inR, noise)
+	dot := soft.Dot(upstream)
+	dotR := softR.Dot(upstream) + soft.Dot(upstreamR)
+	for i, y := range soft {
+		dst[i] += y * (upstream[i] - dot) / t
+		dstR[i] += (softR[i]*(upstream[i]-dot) + y*(upstreamR[i]-dotR)) / t
+	}
+}
+
+// logFlags computes the logarithm of the flag
+// probabilities without underflowing.
+// Flags with a probability of zero have a log of -Inf.
+func (f FlagNorm) logFlags(in, noise linalg.Vector) linalg.Vector {
+	if f.Kind == FlagSparsemax || f.hard() {
+		res := f.apply(in, noise)
+		for i, x := range res {
+			res[i] = math.Log(x)
+		}
+		return res
+	}
+	return logSoftmax(f.scaled(in, noise))
+}
+
+// logFlagsR computes the r-operator of logFlags.
+func (f FlagNorm) logFlagsR(in, inR, noise linalg.Vector) linalg.Vector {
+	flags, flagsR := f.applyR(in, inR, noise)
+	if f.Kind == FlagSparsemax || f.hard() {
+		res := make(linalg.Vector, len(flags))
+		for i, x := range flags {
+			if x != 0 {
+				res[i] = flagsR[i] / x
+			}
+		}
+		return res
+	}
+	scaledR := inR.Copy().Scale(1 / f.temperature())
+	return logSoftmaxR(f.soft(in, noise), scaledR)
+}
+
+// addLogGradient is like addGradient, but upstream is the
+// gradient of the log of the flag probabilities.
+func (f FlagNorm) addLogGradient(dst, in, noise, upstream linalg.Vector) {
+	if f.Kind == FlagSparsemax || f.hard() {
+		f.addGradient(dst, in, noise, logToProbGrad(f.apply(in, noise), upstream))
+		return
+	}
+	scaledDst := make(linalg.Vector, len(dst))
+	logSoftmaxGradient(scaledDst, f.soft(in, noise), upstream)
+	addScaled(dst, scaledDst, 1/f.temperature())
+}
+
+// addLogGradientR is like addLogGradient, but it also
+// adds the r-gradient to dstR.
+func (f FlagNorm) addLogGradientR(dst, dstR, in, inR, noise, upstream,
+	upstreamR linalg.Vector) {
+	if f.Kind == FlagSparsemax || f.hard() {
+		flags, flagsR := f.applyR(in, inR, noise)
+		probGrad := logToProbGrad(flags, upstream)
+		probGradR := make(linalg.Vector, len(flags))
+		for i, x := range flags {
+			if x != 0 {
+				probGradR[i] = upstreamR[i]/x - upstream[i]*flagsR[i]/(x*x)
+			}
+		}
+		f.addGradientR(dst, dstR, in, inR, noise, probGrad, probGradR)
+		return
+	}
+	soft, softR := FlagNorm{Kind: FlagSoftmax, Temperature: f.Temperature}.applyR(in,
+		inR, noise)
+	scaledDst := make(linalg.Vector, len(dst))
+	scaledDstR := make(linalg.Vector, len(dst))
+	logSoftmaxGradientR(scaledDst, scaledDstR, soft, softR, upstream, upstreamR)
+	addScaled(dst, scaledDst, 1/f.temperature())
+	addScaled(dstR, scaledDstR, 1/f.temperature())
+}
+
+// scaled adds the noise to the flag components and
+// divides them by the temperature.
+func (f FlagNorm) scaled(in, noise linalg.Vector) linalg.Vector {
+	t := f.temperature()
+	res := make(linalg.Vector, len(in))
+	for i, x := range in {
+		if noise != nil {
+			x += noise[i]
+		}
+		res[i] = x / t
+	}
+	return res
+}
+
+// soft computes the flag probabilities before any
+// straight-through rounding.
+func (f FlagNorm) soft(in, noise linalg.Vector) linalg.Vector {
+	res := f.scaled(in, noise)
+	if f.Kind == FlagSparsemax {
+		sparsemaxInto(res, res)
+	} else {
+		softmaxInto(res, res)
+	}
+	return res
+}
+
+// sparsemaxInto writes the sparsemax of vec to dst.
+func sparsemaxInto(dst, vec linalg.Vector) {
+	sorted := append(linalg.Vector{}, vec...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	var sum, threshold float64
+	for i, x := range sorted {
+		sum += x
+		if 1+float64(i+1)*x > sum {
+			threshold = (sum - 1) / float64(i+1)
+		}
+	}
+	for i, x := range vec {
+		dst[i] = math.Max(x-threshold, 0)
+	}
+}
+
+// supportMean computes the mean of the entries of vec for
+// which probs is non-zero.
+func supportMean(probs, vec linalg.Vector) float64 {
+	var sum float64
+	var count int
+	for i, p := range probs {
+		if p > 0 {
+			sum += vec[i]
+			count++
+		}
+	}
+	return sum / float64(count)
+}
+
+// oneHot returns a one-hot vector for the largest entry
+// in vec.
+func oneHot(vec linalg.Vector) linalg.Vector {
+	var maxIdx int
+	for i, x := range vec {
+		if x > vec[maxIdx] {
+			maxIdx = i
+		}
+	}
+	res := make(linalg.Vector, len(vec))
+	res[maxIdx] = 1
+	return res
+}
+
+// logToProbGrad converts the gradient of the log of some
+// probabilities into the gradient of the probabilities.
+// Zero probabilities get a gradient of zero.
+func logToProbGrad(probs, logGrad linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, len(probs))
+	for i, p := range probs {
+		if p != 0 {
+			res[i] = logGrad[i] / p
+		}
+	}
+	return res
+}
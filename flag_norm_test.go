@@ -0,0 +1,174 @@
+package neuralstruct
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+var flagNormTestNorms = []FlagNorm{
+	{},
+	{Temperature: 0.5},
+	{Kind: FlagSparsemax},
+	{Kind: FlagSparsemax, Temperature: 0.3},
+	{Kind: FlagGumbel, Temperature: 0.7},
+}
+
+func TestFlagNormGradients(t *testing.T) {
+	const epsilon = 1e-6
+	for _, norm := range flagNormTestNorms {
+		in := testRandVec(4)
+		inR := testRandVec(4)
+		upstream := testRandVec(4)
+		upstreamR := testRandVec(4)
+		noise := norm.noise(4)
+
+		objective := func(in linalg.Vector) float64 {
+			return norm.apply(in, noise).Dot(upstream)
+		}
+		logObjective := func(in linalg.Vector) float64 {
+			// Flags with zero probability are left out, since
+			// their logs are -Inf.
+			var res float64
+			for i, x := range norm.logFlags(in, noise) {
+				if !math.IsInf(x, -1) {
+					res += x * upstream[i]
+				}
+			}
+			return res
+		}
+		gradient := func(in linalg.Vector) linalg.Vector {
+			res := make(linalg.Vector, len(in))
+			norm.addGradient(res, in, noise, upstream)
+			return res
+		}
+
+		actual := gradient(in)
+		expected := flagNormTestNumGrad(objective, in, epsilon)
+		if !statesEqual(actual, expected) {
+			t.Errorf("%+v: expected gradient %v but got %v", norm, expected, actual)
+		}
+
+		actual = make(linalg.Vector, len(in))
+		norm.addLogGradient(actual, in, noise, upstream)
+		expected = flagNormTestNumGrad(logObjective, in, epsilon)
+		if !statesEqual(actual, expected) {
+			t.Errorf("%+v: expected log gradient %v but got %v", norm, expected, actual)
+		}
+
+		_, actualR := norm.applyR(in, inR, noise)
+		plus := norm.apply(in.Copy().Add(inR.Copy().Scale(epsilon)), noise)
+		minus := norm.apply(in.Copy().Add(inR.Copy().Scale(-epsilon)), noise)
+		expectedR := plus.Add(minus.Scale(-1)).Scale(1 / (2 * epsilon))
+		if !statesEqual(actualR, expectedR) {
+			t.Errorf("%+v: expected r-output %v but got %v", norm, expectedR, actualR)
+		}
+
+		grad := make(linalg.Vector, len(in))
+		gradR := make(linalg.Vector, len(in))
+		norm.addGradientR(grad, gradR, in, inR, noise, upstream, upstreamR)
+		if !statesEqual(grad, gradient(in)) {
+			t.Errorf("%+v: expected gradient %v but got %v", norm, gradient(in), grad)
+		}
+		plusGrad := make(linalg.Vector, len(in))
+		minusGrad := make(linalg.Vector, len(in))
+		norm.addGradient(plusGrad, in.Copy().Add(inR.Copy().Scale(epsilon)), noise,
+			upstream.Copy().Add(upstreamR.Copy().Scale(epsilon)))
+		norm.addGradient(minusGrad, in.Copy().Add(inR.Copy().Scale(-epsilon)), noise,
+			upstream.Copy().Add(upstreamR.Copy().Scale(-epsilon)))
+		expectedGradR := plusGrad.Add(minusGrad.Scale(-1)).Scale(1 / (2 * epsilon))
+		if !statesEqual(gradR, expectedGradR) {
+			t.Errorf("%+v: expected r-gradient %v but got %v", norm, expectedGradR, gradR)
+		}
+	}
+}
+
+func TestFlagNormSparsemax(t *testing.T) {
+	norm := FlagNorm{Kind: FlagSparsemax}
+	flags := norm.apply(linalg.Vector{3, 1, 2.5, -1}, nil)
+	expected := linalg.Vector{0.75, 0, 0.25, 0}
+	if !statesEqual(flags, expected) {
+		t.Errorf("expected %v but got %v", expected, flags)
+	}
+}
+
+func TestFlagNormHard(t *testing.T) {
+	norm := FlagNorm{Kind: FlagGumbel, Hard: true}
+	soft := FlagNorm{Kind: FlagGumbel}
+	for i := 0; i < 10; i++ {
+		in := testRandVec(3)
+		upstream := testRandVec(3)
+		noise := norm.noise(3)
+		flags := norm.apply(in, noise)
+		expectedFlags := oneHot(soft.apply(in, noise))
+		if !statesEqual(flags, expectedFlags) {
+			t.Errorf("expected flags %v but got %v", expectedFlags, flags)
+		}
+		actual := make(linalg.Vector, 3)
+		expected := make(linalg.Vector, 3)
+		norm.addGradient(actual, in, noise, upstream)
+		soft.addGradient(expected, in, noise, upstream)
+		if !statesEqual(actual, expected) {
+			t.Errorf("expected gradient %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestFlagNormStructDerivatives(t *testing.T) {
+	structs := []RStruct{
+		&Stack{VectorSize: 3, FlagNorm: FlagNorm{Kind: FlagSparsemax}},
+		&Stack{VectorSize: 3, FlagNorm: FlagNorm{Temperature: 0.5}},
+		&Queue{VectorSize: 3, FlagNorm: FlagNorm{Kind: FlagSparsemax, Temperature: 2}},
+		&Queue{VectorSize: 3, FlagNorm: FlagNorm{Temperature: 0.5}, LogSpace: true},
+	}
+	for _, s := range structs {
+		testAllDerivatives(t, s)
+	}
+}
+
+func TestFlagNormSerialize(t *testing.T) {
+	norm := FlagNorm{Kind: FlagGumbel, Temperature: 0.5, Hard: true}
+	structs := []serializer.Serializer{
+		&Stack{VectorSize: 3, FlagNorm: norm},
+		&Queue{VectorSize: 3, FlagNorm: norm},
+	}
+	for _, s := range structs {
+		data, err := serializer.SerializeWithType(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := serializer.DeserializeWithType(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual FlagNorm
+		switch decoded := decoded.(type) {
+		case *Stack:
+			actual = decoded.FlagNorm
+		case *Queue:
+			actual = decoded.FlagNorm
+		default:
+			t.Fatalf("unexpected type %T", decoded)
+		}
+		if actual != norm {
+			t.Errorf("%T: expected %+v but got %+v", s, norm, actual)
+		}
+	}
+}
+
+func flagNormTestNumGrad(f func(linalg.Vector) float64, in linalg.Vector,
+	epsilon float64) linalg.Vector {
+	res := make(linalg.Vector, len(in))
+	for i := range in {
+		old := in[i]
+		in[i] = old + epsilon
+		plus := f(in)
+		in[i] = old - epsilon
+		minus := f(in)
+		in[i] = old
+		res[i] = (plus - minus) / (2 * epsilon)
+	}
+	return res
+}
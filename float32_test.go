@@ -0,0 +1,41 @@
+package neuralstruct
+
+import "testing"
+
+const (
+	float32TestSteps     = 20
+	float32TestTolerance = 1e-4
+)
+
+func TestFloat32(t *testing.T) {
+	pairs := [][2]Struct{
+		{&Stack{VectorSize: 3}, &Stack{VectorSize: 3, Float32: true}},
+		{&Stack{VectorSize: 3}, &Stack{VectorSize: 3, Float32: true, Checkpoint: 3}},
+		{&Queue{VectorSize: 3}, &Queue{VectorSize: 3, Float32: true}},
+		{&Queue{VectorSize: 3}, &Queue{VectorSize: 3, Float32: true, Checkpoint: 3}},
+		{
+			Aggregate{&Stack{VectorSize: 2}, &Queue{VectorSize: 3}},
+			Aggregate{&Stack{VectorSize: 2, Float32: true}, &Queue{VectorSize: 3, Float32: true}},
+		},
+	}
+	for _, pair := range pairs {
+		testEquivalent(t, pair[0], pair[1], float32TestSteps,
+			closeWithin(float32TestTolerance))
+	}
+}
+
+func TestFloat32Storage(t *testing.T) {
+	stack := &Stack{VectorSize: 3, Float32: true}
+	queue := &Queue{VectorSize: 3, Float32: true}
+	stackSt, queueSt := stack.StartState(), queue.StartState()
+	for i := 0; i < 3; i++ {
+		stackSt = stackSt.NextState(testRandVec(stack.ControlSize()))
+		queueSt = queueSt.NextState(testRandVec(queue.ControlSize()))
+	}
+	if s := stackSt.(*stackState); s.Expected != nil || len(s.Expected32) != 9 {
+		t.Error("stack contents should be stored as float32 values")
+	}
+	if q := queueSt.(*queueState); q.Expected != nil || len(q.Expected32) != 9 {
+		t.Error("queue contents should be stored as float32 values")
+	}
+}
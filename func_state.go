@@ -0,0 +1,250 @@
+package neuralstruct
+
+import (
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// A transitionFunc computes one timestep of a structure
+// as a differentiable function.
+//
+// It takes the structure's previous internal vector and
+// a control vector, and it returns the new data output
+// followed by the new internal vector.
+type transitionFunc func(last, control autofunc.RResult) autofunc.RResult
+
+// funcState is a State for structures whose timesteps
+// are expressed with transitionFuncs.
+//
+// Gradients are computed by re-building the timestep's
+// computation graph and back-propagating through it.
+// Plain gradients are computed with a zero r-operator,
+// trading a bit of speed for a single implementation
+// of each structure.
+type funcState struct {
+	Transition transitionFunc
+	DataSize   int
+
+	// Joined is the data output followed by the internal
+	// vector of the structure.
+	Joined linalg.Vector
+
+	Last    *funcState
+	Control linalg.Vector
+}
+
+func (f *funcState) Data() linalg.Vector {
+	return f.Joined[:f.DataSize]
+}
+
+func (f *funcState) Gradient(dataGrad linalg.Vector, upstream Grad) (linalg.Vector, Grad) {
+	if f.Last == nil {
+		panic("cannot propagate through start state")
+	}
+	lastVar := &autofunc.Variable{Vector: f.Last.internal()}
+	ctrlVar := &autofunc.Variable{Vector: f.Control}
+	res := f.Transition(autofunc.NewRVariable(lastVar, autofunc.RVector{}),
+		autofunc.NewRVariable(ctrlVar, autofunc.RVector{}))
+
+	joinedGrad := make(linalg.Vector, len(f.Joined))
+	copy(joinedGrad, dataGrad)
+	if upstream != nil {
+		copy(joinedGrad[f.DataSize:], upstream.(linalg.Vector))
+	}
+
+	g := autofunc.NewGradient([]*autofunc.Variable{lastVar, ctrlVar})
+	res.PropagateRGradient(joinedGrad, make(linalg.Vector, len(joinedGrad)),
+		autofunc.RGradient{}, g)
+	return g[ctrlVar], g[lastVar]
+}
+
+func (f *funcState) NextState(control linalg.Vector) State {
+	lastVar := &autofunc.Variable{Vector: f.internal()}
+	ctrlVar := &autofunc.Variable{Vector: control}
+	res := f.Transition(autofunc.NewRVariable(lastVar, autofunc.RVector{}),
+		autofunc.NewRVariable(ctrlVar, autofunc.RVector{}))
+	return &funcState{
+		Transition: f.Transition,
+		DataSize:   f.DataSize,
+		Joined:     res.Output(),
+		Last:       f,
+		Control:    control,
+	}
+}
+
+// Detach returns a state with the same contents and no
+// history.
+func (f *funcState) Detach() State {
+	return &funcState{
+		Transition: f.Transition,
+		DataSize:   f.DataSize,
+		Joined:     f.Joined.Copy(),
+	}
+}
+
+// DetachR is like Detach, but for an RState.
+func (f *funcState) DetachR() RState {
+	return &funcRState{
+		Transition: f.Transition,
+		DataSize:   f.DataSize,
+		Joined:     f.Joined.Copy(),
+		RJoined:    make(linalg.Vector, len(f.Joined)),
+	}
+}
+
+func (f *funcState) internal() linalg.Vector {
+	return f.Joined[f.DataSize:]
+}
+
+// funcRState is the RState equivalent of funcState.
+type funcRState struct {
+	Transition transitionFunc
+	DataSize   int
+
+	Joined  linalg.Vector
+	RJoined linalg.Vector
+
+	Last     *funcRState
+	Control  linalg.Vector
+	ControlR linalg.Vector
+}
+
+func (f *funcRState) Data() linalg.Vector {
+	return f.Joined[:f.DataSize]
+}
+
+func (f *funcRState) RData() linalg.Vector {
+	return f.RJoined[:f.DataSize]
+}
+
+func (f *funcRState) RGradient(dataGrad, dataGradR linalg.Vector,
+	upstream RGrad) (linalg.Vector, linalg.Vector, RGrad) {
+	if f.Last == nil {
+		panic("cannot propagate through start state")
+	}
+	lastVar := &autofunc.Variable{Vector: f.Last.Joined[f.DataSize:]}
+	ctrlVar := &autofunc.Variable{Vector: f.Control}
+	res := f.Transition(&autofunc.RVariable{
+		Variable:   lastVar,
+		ROutputVec: f.Last.RJoined[f.DataSize:],
+	}, &autofunc.RVariable{
+		Variable:   ctrlVar,
+		ROutputVec: f.ControlR,
+	})
+
+	joinedGrad := make(linalg.Vector, len(f.Joined))
+	joinedGradR := make(linalg.Vector, len(f.Joined))
+	copy(joinedGrad, dataGrad)
+	copy(joinedGradR, dataGradR)
+	if upstream != nil {
+		upstreamVal := upstream.([2]linalg.Vector)
+		copy(joinedGrad[f.DataSize:], upstreamVal[0])
+		copy(joinedGradR[f.DataSize:], upstreamVal[1])
+	}
+
+	vars := []*autofunc.Variable{lastVar, ctrlVar}
+	g := autofunc.NewGradient(vars)
+	rg := autofunc.NewRGradient(vars)
+	res.PropagateRGradient(joinedGrad, joinedGradR, rg, g)
+	return g[ctrlVar], rg[ctrlVar], [2]linalg.Vector{g[lastVar], rg[lastVar]}
+}
+
+func (f *funcRState) NextRState(control, controlR linalg.Vector) RState {
+	res := f.Transition(&autofunc.RVariable{
+		Variable:   &autofunc.Variable{Vector: f.Joined[f.DataSize:]},
+		ROutputVec: f.RJoined[f.DataSize:],
+	}, &autofunc.RVariable{
+		Variable:   &autofunc.Variable{Vector: control},
+		ROutputVec: controlR,
+	})
+	return &funcRState{
+		Transition: f.Transition,
+		DataSize:   f.DataSize,
+		Joined:     res.Output(),
+		RJoined:    res.ROutput(),
+		Last:       f,
+		Control:    control,
+		ControlR:   controlR,
+	}
+}
+
+// permuteR creates a vector whose i-th component is the
+// perm[i]-th component of vec.
+func permuteR(vec autofunc.RResult, perm []int) autofunc.RResult {
+	parts := make([]autofunc.RResult, len(perm))
+	for i, j := range perm {
+		parts[i] = autofunc.SliceR(vec, j, j+1)
+	}
+	return autofunc.ConcatR(parts...)
+}
+
+// sumR adds a non-empty list of equally sized vectors.
+func sumR(vecs []autofunc.RResult) autofunc.RResult {
+	res := vecs[0]
+	for _, v := range vecs[1:] {
+		res = autofunc.AddR(res, v)
+	}
+	return res
+}
+
+// gatherR creates a vector whose j-th component is the
+// sum of the components of vec whose indices i satisfy
+// targets[i] = j.
+// Components with a negative target are dropped.
+func gatherR(vec autofunc.RResult, targets []int, size int) autofunc.RResult {
+	sources := make([][]int, size)
+	for i, j := range targets {
+		if j >= 0 {
+			sources[j] = append(sources[j], i)
+		}
+	}
+	zero := &autofunc.RVariable{
+		Variable:   &autofunc.Variable{Vector: make(linalg.Vector, 1)},
+		ROutputVec: make(linalg.Vector, 1),
+	}
+	parts := make([]autofunc.RResult, size)
+	for j, list := range sources {
+		if len(list) == 0 {
+			parts[j] = zero
+			continue
+		}
+		var terms []autofunc.RResult
+		for _, i := range list {
+			terms = append(terms, autofunc.SliceR(vec, i, i+1))
+		}
+		parts[j] = sumR(terms)
+	}
+	return autofunc.ConcatR(parts...)
+}
+
+// blendCellsR moves each cell of a joined list of cells
+// towards vec by the corresponding amount.
+// In other words, cell i becomes
+//
+//	cell_i + amounts_i*(vec - cell_i)
+func blendCellsR(cells, amounts, vec autofunc.RResult) autofunc.RResult {
+	return autofunc.PoolR(amounts, func(amounts autofunc.RResult) autofunc.RResult {
+		vecSize := len(vec.Output())
+		newCells := make([]autofunc.RResult, len(amounts.Output()))
+		for i := range newCells {
+			cell := autofunc.SliceR(cells, i*vecSize, (i+1)*vecSize)
+			diff := autofunc.SubR(vec, cell)
+			amount := autofunc.SliceR(amounts, i, i+1)
+			newCells[i] = autofunc.AddR(cell, autofunc.ScaleFirstR(diff, amount))
+		}
+		return autofunc.ConcatR(newCells...)
+	})
+}
+
+// weightedCellsR computes the weighted sum of cells from
+// a joined list of cells, where the i-th weight applies
+// to the cell with index indices[i].
+func weightedCellsR(cells, weights autofunc.RResult, indices []int) autofunc.RResult {
+	vecSize := len(cells.Output()) / len(indices)
+	terms := make([]autofunc.RResult, len(indices))
+	for i, idx := range indices {
+		cell := autofunc.SliceR(cells, idx*vecSize, (idx+1)*vecSize)
+		terms[i] = autofunc.ScaleFirstR(cell, autofunc.SliceR(weights, i, i+1))
+	}
+	return sumR(terms)
+}
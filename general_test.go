@@ -9,6 +9,7 @@ import (
 	"github.com/unixpickle/autofunc"
 	"github.com/unixpickle/autofunc/functest"
 	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/neuralnet"
 )
 
 const (
@@ -28,8 +29,27 @@ func statesEqual(d1, d2 linalg.Vector) bool {
 	return true
 }
 
+// closeWithin returns a comparator for testEquivalent
+// which allows every component to differ by tol times the
+// magnitude of the expected component (or by tol, for
+// components with magnitudes below 1).
+// NaN components never compare as close.
+func closeWithin(tol float64) func(expected, actual linalg.Vector) bool {
+	return func(expected, actual linalg.Vector) bool {
+		if len(expected) != len(actual) {
+			return false
+		}
+		for i, x := range expected {
+			if !(math.Abs(x-actual[i]) <= tol*math.Max(1, math.Abs(x))) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
 func forwardBenchmark(b *testing.B, s Struct) {
-	inputVec := make(linalg.Vector, s.DataSize())
+	inputVec := make(linalg.Vector, s.ControlSize())
 	for i := range inputVec {
 		inputVec[i] = rand.NormFloat64()
 	}
@@ -62,13 +82,69 @@ func backwardBenchmark(b *testing.B, s Struct) {
 	}
 }
 
+// testEquivalent checks that two structs give the same
+// outputs and gradients for the same random controls, as
+// judged by the equal function.
+// It returns the states of both structs after the
+// gradients have been computed.
+func testEquivalent(t *testing.T, expected, actual Struct, steps int,
+	equal func(expected, actual linalg.Vector) bool) (expStates, actStates []State) {
+	var controls, dataGrads []linalg.Vector
+	for i := 0; i < steps; i++ {
+		controls = append(controls, testRandVec(expected.ControlSize()))
+		dataGrads = append(dataGrads, testRandVec(expected.DataSize()))
+	}
+
+	expState, actState := expected.StartState(), actual.StartState()
+	for i, control := range controls {
+		expState = expState.NextState(control)
+		actState = actState.NextState(control)
+		expStates = append(expStates, expState)
+		actStates = append(actStates, actState)
+		if !equal(expState.Data(), actState.Data()) {
+			t.Errorf("%T step %d: expected data %v but got %v", actual, i,
+				expState.Data(), actState.Data())
+		}
+	}
+
+	var expUp, actUp Grad
+	for i := steps - 1; i >= 0; i-- {
+		var expGrad, actGrad linalg.Vector
+		expGrad, expUp = expStates[i].Gradient(dataGrads[i], expUp)
+		actGrad, actUp = actStates[i].Gradient(dataGrads[i], actUp)
+		if !equal(expGrad, actGrad) {
+			t.Errorf("%T step %d: expected gradient %v but got %v", actual, i,
+				expGrad, actGrad)
+		}
+	}
+
+	return
+}
+
 func testAllDerivatives(t *testing.T, s RStruct) {
+	checkStructDerivatives(t, s.ControlSize(), &structRFunc{Struct: s})
+}
+
+// testActivatedDerivatives is like testAllDerivatives,
+// but it squashes the control vectors with the struct's
+// suggested activation first.
+//
+// This is useful for structs which are numerically
+// unstable for unsquashed control vectors.
+func testActivatedDerivatives(t *testing.T, s RStruct) {
+	checkStructDerivatives(t, s.ControlSize(), &activatedRFunc{
+		Activation:  s.(Activator).SuggestedActivation(),
+		ControlSize: s.ControlSize(),
+		F:           &structRFunc{Struct: s},
+	})
+}
+
+func checkStructDerivatives(t *testing.T, controlSize int, f autofunc.RFunc) {
 	for depth := 1; depth <= 4; depth++ {
 		name := fmt.Sprintf("Depth%d", depth)
 		t.Run(name, func(t *testing.T) {
-			f := &structRFunc{Struct: s}
-			inVec := make(linalg.Vector, depth*s.ControlSize())
-			inVecR := make(linalg.Vector, depth*s.ControlSize())
+			inVec := make(linalg.Vector, depth*controlSize)
+			inVecR := make(linalg.Vector, depth*controlSize)
 			for i := range inVec {
 				inVec[i] = rand.NormFloat64()
 				inVecR[i] = rand.NormFloat64()
@@ -85,6 +161,37 @@ func testAllDerivatives(t *testing.T, s RStruct) {
 	}
 }
 
+// activatedRFunc applies an activation to each control
+// vector in a joined list of control vectors before
+// passing the list to another function.
+type activatedRFunc struct {
+	Activation  neuralnet.Layer
+	ControlSize int
+	F           autofunc.RFunc
+}
+
+func (a *activatedRFunc) Apply(in autofunc.Result) autofunc.Result {
+	return autofunc.Pool(in, func(in autofunc.Result) autofunc.Result {
+		var controls []autofunc.Result
+		for i := 0; i < len(in.Output()); i += a.ControlSize {
+			control := autofunc.Slice(in, i, i+a.ControlSize)
+			controls = append(controls, a.Activation.Apply(control))
+		}
+		return a.F.Apply(autofunc.Concat(controls...))
+	})
+}
+
+func (a *activatedRFunc) ApplyR(rv autofunc.RVector, in autofunc.RResult) autofunc.RResult {
+	return autofunc.PoolR(in, func(in autofunc.RResult) autofunc.RResult {
+		var controls []autofunc.RResult
+		for i := 0; i < len(in.Output()); i += a.ControlSize {
+			control := autofunc.SliceR(in, i, i+a.ControlSize)
+			controls = append(controls, a.Activation.ApplyR(rv, control))
+		}
+		return a.F.ApplyR(rv, autofunc.ConcatR(controls...))
+	})
+}
+
 type structFunc struct {
 	Struct Struct
 }
@@ -227,3 +334,11 @@ func (s *structFuncRRes) PropagateRGradient(upstream, upstreamR linalg.Vector,
 
 	s.Controls.PropagateRGradient(controlGrad, controlGradR, rg, g)
 }
+
+func testRandVec(size int) linalg.Vector {
+	res := make(linalg.Vector, size)
+	for i := range res {
+		res[i] = rand.NormFloat64()
+	}
+	return res
+}
@@ -0,0 +1,257 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+const gridMoveCount = 5
+
+// These are the head movement flags (in order) of a Grid.
+const (
+	GridStay int = iota
+	GridUp
+	GridDown
+	GridLeft
+	GridRight
+)
+
+// These are the gates of a Grid, which come right after
+// the movement flags in the control vector.
+const (
+	GridWriteGate int = gridMoveCount + iota
+	GridReadGate
+)
+
+const gridFlagCount = gridMoveCount + 2
+
+func init() {
+	var g Grid
+	serializer.RegisterTypedDeserializer(g.SerializerType(), DeserializeGrid)
+}
+
+// A Grid is a differentiable two-dimensional array of
+// vectors with a soft read/write head.
+//
+// At every timestep, the head moves up, down, left, or
+// right (or stays put) according to a softmax over the
+// movement flags.
+// The grid wraps around at its edges, so every move keeps
+// the head on the grid.
+// After moving, the head blends the control's data vector
+// into the cell under it, weighted by a sigmoid write gate.
+// Finally, the data output is the cell under the head,
+// scaled by a sigmoid read gate.
+//
+// The head starts in the top-left cell, and every cell
+// starts out as a zero vector.
+type Grid struct {
+	// Width and Height are the dimensions of the grid.
+	// Both must be at least 1.
+	Width      int
+	Height     int
+	VectorSize int
+
+	// ReadNeighbors, if true, indicates that the data
+	// output should include the four cells adjacent to
+	// the head (up, down, left, right) after the cell
+	// under the head.
+	ReadNeighbors bool
+}
+
+// DeserializeGrid deserializes a Grid.
+func DeserializeGrid(d []byte) (*Grid, error) {
+	var g Grid
+	if err := json.Unmarshal(d, &g); err != nil {
+		return nil, err
+	}
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// ControlSize returns the number of control components,
+// which varies based on the vector size.
+func (g *Grid) ControlSize() int {
+	return gridFlagCount + g.VectorSize
+}
+
+// DataSize returns the number of data components, which
+// is a multiple of the vector size.
+func (g *Grid) DataSize() int {
+	if g.ReadNeighbors {
+		return g.VectorSize * gridMoveCount
+	}
+	return g.VectorSize
+}
+
+// StartState returns a zero grid with the head in the
+// top-left corner.
+//
+// The state copies the Grid's fields, so later changes to
+// the Grid do not affect it.
+// StartState panics if the Grid is misconfigured, e.g. if
+// it has no cells.
+func (g *Grid) StartState() State {
+	config := g.config()
+	return &funcState{
+		Transition: config.transition,
+		DataSize:   config.DataSize(),
+		Joined:     config.startJoined(),
+	}
+}
+
+// StartRState is like StartState, but for an RState.
+func (g *Grid) StartRState() RState {
+	config := g.config()
+	joined := config.startJoined()
+	return &funcRState{
+		Transition: config.transition,
+		DataSize:   config.DataSize(),
+		Joined:     joined,
+		RJoined:    make(linalg.Vector, len(joined)),
+	}
+}
+
+// SerializerType returns the unique ID used to serialize
+// Grids with the serializer package.
+func (g *Grid) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.Grid"
+}
+
+// Serialize encodes the grid's parameters.
+func (g *Grid) Serialize() ([]byte, error) {
+	return json.Marshal(g)
+}
+
+// SuggestedActivation returns an activation function
+// which applies a hyperbolic tangent to the data outputs
+// while leaving the control outputs untouched.
+func (g *Grid) SuggestedActivation() neuralnet.Layer {
+	return &PartialActivation{
+		Ranges:      []ComponentRange{{Start: gridFlagCount, End: g.ControlSize()}},
+		Activations: []neuralnet.Layer{&neuralnet.HyperbolicTangent{}},
+	}
+}
+
+// FlagNames returns the names of the movement flags and
+// the gates.
+func (g *Grid) FlagNames() []string {
+	return []string{"stay", "up", "down", "left", "right", "write gate", "read gate"}
+}
+
+func (g *Grid) cellCount() int {
+	return g.Width * g.Height
+}
+
+// startJoined returns the joined data and internal
+// vector for the start state.
+// The internal vector stores the cells in row-major
+// order, followed by the head's probability for each
+// cell.
+// config validates the grid and returns a copy of it for
+// states to use.
+func (g *Grid) config() *Grid {
+	if err := g.validate(); err != nil {
+		panic(err)
+	}
+	res := *g
+	return &res
+}
+
+func (g *Grid) validate() error {
+	if g.Width < 1 || g.Height < 1 {
+		return errors.New("grid dimensions must be at least 1")
+	}
+	if g.VectorSize < 0 {
+		return errors.New("grid vector size must be non-negative")
+	}
+	return nil
+}
+
+func (g *Grid) startJoined() linalg.Vector {
+	res := make(linalg.Vector, g.DataSize()+g.cellCount()*(g.VectorSize+1))
+	res[g.DataSize()+g.cellCount()*g.VectorSize] = 1
+	return res
+}
+
+// neighbor returns the index of the cell adjacent to a
+// cell in the given direction.
+func (g *Grid) neighbor(cell, direction int) int {
+	x, y := cell%g.Width, cell/g.Width
+	switch direction {
+	case GridUp:
+		y = (y + g.Height - 1) % g.Height
+	case GridDown:
+		y = (y + 1) % g.Height
+	case GridLeft:
+		x = (x + g.Width - 1) % g.Width
+	case GridRight:
+		x = (x + 1) % g.Width
+	}
+	return y*g.Width + x
+}
+
+// neighbors returns, for every cell, the index of its
+// neighbor in the given direction.
+func (g *Grid) neighbors(direction int) []int {
+	res := make([]int, g.cellCount())
+	for i := range res {
+		res[i] = g.neighbor(i, direction)
+	}
+	return res
+}
+
+func (g *Grid) transition(last, control autofunc.RResult) autofunc.RResult {
+	cellsSize := g.cellCount() * g.VectorSize
+	return autofunc.PoolR(control, func(control autofunc.RResult) autofunc.RResult {
+		softmax := autofunc.Softmax{}
+		moves := softmax.ApplyR(autofunc.RVector{}, autofunc.SliceR(control, 0, gridMoveCount))
+		return autofunc.PoolR(moves, func(moves autofunc.RResult) autofunc.RResult {
+			oldHead := autofunc.SliceR(last, cellsSize, cellsSize+g.cellCount())
+			headTerms := []autofunc.RResult{
+				autofunc.ScaleFirstR(oldHead, autofunc.SliceR(moves, GridStay, GridStay+1)),
+			}
+			opposites := []int{GridDown, GridUp, GridRight, GridLeft}
+			for i, opposite := range opposites {
+				// The head moves into a cell from the cell in
+				// the opposite direction.
+				dir := GridUp + i
+				shifted := permuteR(oldHead, g.neighbors(opposite))
+				headTerms = append(headTerms, autofunc.ScaleFirstR(shifted,
+					autofunc.SliceR(moves, dir, dir+1)))
+			}
+			return autofunc.PoolR(sumR(headTerms), func(head autofunc.RResult) autofunc.RResult {
+				sigmoid := autofunc.Sigmoid{}
+				gates := sigmoid.ApplyR(autofunc.RVector{},
+					autofunc.SliceR(control, gridMoveCount, gridFlagCount))
+				writeVec := autofunc.SliceR(control, gridFlagCount, g.ControlSize())
+				amounts := autofunc.ScaleFirstR(head, autofunc.SliceR(gates, 0, 1))
+				cells := blendCellsR(autofunc.SliceR(last, 0, cellsSize), amounts, writeVec)
+				return autofunc.PoolR(cells, func(cells autofunc.RResult) autofunc.RResult {
+					data := g.readCells(cells, head)
+					data = autofunc.ScaleFirstR(data, autofunc.SliceR(gates, 1, 2))
+					return autofunc.ConcatR(data, cells, head)
+				})
+			})
+		})
+	})
+}
+
+func (g *Grid) readCells(cells, head autofunc.RResult) autofunc.RResult {
+	directions := []int{GridStay}
+	if g.ReadNeighbors {
+		directions = append(directions, GridUp, GridDown, GridLeft, GridRight)
+	}
+	var reads []autofunc.RResult
+	for _, dir := range directions {
+		reads = append(reads, weightedCellsR(cells, head, g.neighbors(dir)))
+	}
+	return autofunc.ConcatR(reads...)
+}
@@ -0,0 +1,83 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestGridData(t *testing.T) {
+	grid := &Grid{Width: 3, Height: 2, VectorSize: 2, ReadNeighbors: true}
+	state := grid.StartState()
+
+	controls := []linalg.Vector{
+		{0, 0, 0, 0, 50, 50, 50, 1, 2},
+		{0, 0, 50, 0, 0, -50, 50, 9, 9},
+		{0, 50, 0, 0, 0, -50, 50, 9, 9},
+		{0, 0, 0, 0, 50, -50, 50, 9, 9},
+		{0, 0, 0, 50, 0, -50, -50, 9, 9},
+	}
+	expected := []linalg.Vector{
+		{1, 2, 0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 1, 2, 1, 2, 0, 0, 0, 0},
+		{1, 2, 0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 1, 2, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+
+	for i, control := range controls {
+		state = state.NextState(control)
+		if !statesEqual(state.Data(), expected[i]) {
+			t.Errorf("bad state %d: expected %v got %v", i, expected[i], state.Data())
+		}
+	}
+}
+
+func TestGridDerivatives(t *testing.T) {
+	testAllDerivatives(t, &Grid{Width: 3, Height: 2, VectorSize: 2})
+}
+
+func TestGridDerivativesNeighbors(t *testing.T) {
+	testAllDerivatives(t, &Grid{Width: 2, Height: 2, VectorSize: 2, ReadNeighbors: true})
+}
+
+func BenchmarkGridForward(b *testing.B) {
+	forwardBenchmark(b, &Grid{Width: 5, Height: 5, VectorSize: benchmarkVectorSize})
+}
+
+func BenchmarkGridBackward(b *testing.B) {
+	backwardBenchmark(b, &Grid{Width: 5, Height: 5, VectorSize: benchmarkVectorSize})
+}
+
+func TestGridConfigCopy(t *testing.T) {
+	grid := &Grid{Width: 3, Height: 2, VectorSize: 2}
+	reference := &Grid{Width: 3, Height: 2, VectorSize: 2}
+	state, refState := grid.StartState(), reference.StartState()
+	grid.Width, grid.Height = 5, 4
+	for i := 0; i < 4; i++ {
+		control := testRandVec(grid.ControlSize())
+		state = state.NextState(control)
+		refState = refState.NextState(control)
+		if !statesEqual(state.Data(), refState.Data()) {
+			t.Errorf("step %d: expected %v but got %v", i, refState.Data(), state.Data())
+		}
+	}
+}
+
+func TestGridValidation(t *testing.T) {
+	invalid := []*Grid{
+		{VectorSize: 2},
+		{Width: 3, VectorSize: 2},
+		{Height: 3, VectorSize: 2},
+		{Width: 3, Height: 3, VectorSize: -1},
+	}
+	for i, grid := range invalid {
+		if grid.validate() == nil {
+			t.Errorf("grid %d: expected an error", i)
+		}
+		data, _ := grid.Serialize()
+		if _, err := DeserializeGrid(data); err == nil {
+			t.Errorf("grid %d: expected a deserialization error", i)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package neuralstruct
+
+// startInferenceState creates a forward-only start state
+// for s if it is an InferenceStruct, or a regular start
+// state otherwise.
+func startInferenceState(s Struct) State {
+	if i, ok := s.(InferenceStruct); ok {
+		return i.StartInferenceState()
+	}
+	return s.StartState()
+}
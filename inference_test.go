@@ -0,0 +1,47 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestInferenceStates(t *testing.T) {
+	structs := []InferenceStruct{
+		&Stack{VectorSize: 3},
+		&Stack{VectorSize: 3, NoReplace: true},
+		&Queue{VectorSize: 3},
+		&Queue{VectorSize: 3, LogSpace: true},
+		Aggregate{&Stack{VectorSize: 2}, &Queue{VectorSize: 3}, &RingBuffer{VectorSize: 2, Capacity: 3}},
+		RAggregate{&Queue{VectorSize: 2}, &Stack{VectorSize: 4}},
+		&ParallelAggregate{Structs: RAggregate{&Stack{VectorSize: 2}}, Workers: 2},
+	}
+	for _, s := range structs {
+		state := s.StartState()
+		inference := s.StartInferenceState()
+		for i := 0; i < 10; i++ {
+			if !statesEqual(state.Data(), inference.Data()) {
+				t.Errorf("%T: step %d: expected %v but got %v", s, i, state.Data(),
+					inference.Data())
+			}
+			control := testRandVec(s.ControlSize())
+			state = state.NextState(control)
+			inference = inference.NextState(control)
+		}
+	}
+}
+
+func TestInferenceStatesInPlace(t *testing.T) {
+	structs := []InferenceStruct{
+		&Stack{VectorSize: 3},
+		&Queue{VectorSize: 3},
+		Aggregate{&Stack{VectorSize: 2}, &Queue{VectorSize: 3}},
+	}
+	for _, s := range structs {
+		state := s.StartInferenceState()
+		next := state.NextState(make(linalg.Vector, s.ControlSize()))
+		if next != state {
+			t.Errorf("%T: expected state to be updated in place", s)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package neuralstruct
+
+import "github.com/unixpickle/num-analysis/linalg"
+
+// A DataLayout determines where a Struct's data is placed
+// in the input of a controller.
+type DataLayout int
+
+// These are the supported data layouts.
+const (
+	// DataPrepend puts the data before the input.
+	DataPrepend DataLayout = iota
+
+	// DataAppend puts the data after the input.
+	DataAppend
+
+	// DataInterleave alternates between data components
+	// and input components, starting with data.
+	// Once one of the two vectors runs out, the remaining
+	// components of the other are placed at the end.
+	DataInterleave
+)
+
+// A ControlLayout determines where a Struct's control
+// vector is taken from in the output of a controller.
+type ControlLayout int
+
+// These are the supported control layouts.
+const (
+	// ControlHead takes the control vector from the start
+	// of the output.
+	ControlHead ControlLayout = iota
+
+	// ControlTail takes the control vector from the end of
+	// the output.
+	ControlTail
+)
+
+// A BlockLayout describes how a controller's inputs and
+// outputs are combined with a Struct's data and control.
+//
+// The zero value is the default layout, where data is
+// prepended to the input and control is taken from the
+// head of the output.
+type BlockLayout struct {
+	Data    DataLayout
+	Control ControlLayout
+
+	// SkipData, if true, indicates that the Struct's data
+	// (i.e. the data fed to the controller at the current
+	// timestep) should be appended to the output.
+	SkipData bool
+}
+
+// joinInput combines the struct data with an input.
+func (b BlockLayout) joinInput(data, in linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, len(data)+len(in))
+	dataPos, inPos := b.inputPositions(len(data), len(in))
+	for i, x := range data {
+		res[dataPos[i]] = x
+	}
+	for i, x := range in {
+		res[inPos[i]] = x
+	}
+	return res
+}
+
+// splitInput is the inverse of joinInput.
+// The resulting vectors are copies.
+func (b BlockLayout) splitInput(joined linalg.Vector, dataSize int) (data, in linalg.Vector) {
+	dataPos, inPos := b.inputPositions(dataSize, len(joined)-dataSize)
+	data = make(linalg.Vector, len(dataPos))
+	in = make(linalg.Vector, len(inPos))
+	for i, p := range dataPos {
+		data[i] = joined[p]
+	}
+	for i, p := range inPos {
+		in[i] = joined[p]
+	}
+	return
+}
+
+func (b BlockLayout) inputPositions(dataSize, inSize int) (dataPos, inPos []int) {
+	dataPos = make([]int, dataSize)
+	inPos = make([]int, inSize)
+	switch b.Data {
+	case DataPrepend:
+		for i := range dataPos {
+			dataPos[i] = i
+		}
+		for i := range inPos {
+			inPos[i] = i + dataSize
+		}
+	case DataAppend:
+		for i := range inPos {
+			inPos[i] = i
+		}
+		for i := range dataPos {
+			dataPos[i] = i + inSize
+		}
+	case DataInterleave:
+		var idx int
+		for i := 0; i < dataSize || i < inSize; i++ {
+			if i < dataSize {
+				dataPos[i] = idx
+				idx++
+			}
+			if i < inSize {
+				inPos[i] = idx
+				idx++
+			}
+		}
+	default:
+		panic("unknown data layout")
+	}
+	return
+}
+
+// splitOutput splits a controller output into control
+// and the remaining output.
+// The resulting vectors are slices of out.
+func (b BlockLayout) splitOutput(out linalg.Vector, ctrlSize int) (ctrl, rest linalg.Vector) {
+	switch b.Control {
+	case ControlHead:
+		return out[:ctrlSize], out[ctrlSize:]
+	case ControlTail:
+		restSize := len(out) - ctrlSize
+		return out[restSize:], out[:restSize]
+	default:
+		panic("unknown control layout")
+	}
+}
+
+// output produces the final output vector from the
+// remaining output and the struct data.
+func (b BlockLayout) output(rest, data linalg.Vector) linalg.Vector {
+	if !b.SkipData {
+		return rest
+	}
+	res := make(linalg.Vector, len(rest)+len(data))
+	copy(res, rest)
+	copy(res[len(rest):], data)
+	return res
+}
+
+// splitOutputGrad is the inverse of output.
+// The data gradient is nil if SkipData is false.
+func (b BlockLayout) splitOutputGrad(grad linalg.Vector,
+	dataSize int) (rest, data linalg.Vector) {
+	if !b.SkipData {
+		return grad, nil
+	}
+	restSize := len(grad) - dataSize
+	return grad[:restSize], grad[restSize:]
+}
@@ -0,0 +1,43 @@
+package neuralstruct
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestBlockLayoutInput(t *testing.T) {
+	data := linalg.Vector{1, 2, 3}
+	in := linalg.Vector{-1, -2, -3, -4, -5}
+	expected := map[DataLayout]linalg.Vector{
+		DataPrepend:    {1, 2, 3, -1, -2, -3, -4, -5},
+		DataAppend:     {-1, -2, -3, -4, -5, 1, 2, 3},
+		DataInterleave: {1, -1, 2, -2, 3, -3, -4, -5},
+	}
+	for dataLayout, exp := range expected {
+		layout := BlockLayout{Data: dataLayout}
+		joined := layout.joinInput(data, in)
+		if !reflect.DeepEqual(joined, exp) {
+			t.Errorf("layout %d: expected %v but got %v", dataLayout, exp, joined)
+		}
+		splitData, splitIn := layout.splitInput(joined, len(data))
+		if !reflect.DeepEqual(splitData, data) || !reflect.DeepEqual(splitIn, in) {
+			t.Errorf("layout %d: bad split %v %v", dataLayout, splitData, splitIn)
+		}
+	}
+}
+
+func TestBlockLayoutOutput(t *testing.T) {
+	out := linalg.Vector{1, 2, 3, 4, 5}
+	layout := BlockLayout{Control: ControlTail, SkipData: true}
+	ctrl, rest := layout.splitOutput(out, 2)
+	if !reflect.DeepEqual(ctrl, linalg.Vector{4, 5}) ||
+		!reflect.DeepEqual(rest, linalg.Vector{1, 2, 3}) {
+		t.Fatalf("bad split: %v %v", ctrl, rest)
+	}
+	full := layout.output(rest, linalg.Vector{6, 7})
+	if !reflect.DeepEqual(full, linalg.Vector{1, 2, 3, 6, 7}) {
+		t.Errorf("unexpected output: %v", full)
+	}
+}
@@ -0,0 +1,105 @@
+package neuralstruct
+
+import (
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/rnn"
+)
+
+// microStepResult is the result of a Block which runs
+// multiple micro-steps per input.
+type microStepResult struct {
+	Input  []autofunc.Result
+	InPool []*autofunc.Variable
+	Steps  []*blockResult
+}
+
+func (m *microStepResult) Outputs() []linalg.Vector {
+	return m.Steps[len(m.Steps)-1].Outputs()
+}
+
+func (m *microStepResult) States() []rnn.State {
+	return m.Steps[len(m.Steps)-1].States()
+}
+
+func (m *microStepResult) PropagateGradient(u []linalg.Vector, s []rnn.StateGrad,
+	g autofunc.Gradient) []rnn.StateGrad {
+	if len(m.Input) == 0 {
+		return nil
+	}
+
+	for _, v := range m.InPool {
+		g[v] = make(linalg.Vector, len(v.Vector))
+	}
+
+	// Only the last micro-step's output is visible, so
+	// earlier micro-steps only receive state gradients.
+	for i := len(m.Steps) - 1; i >= 0; i-- {
+		var stepUpstream []linalg.Vector
+		if i == len(m.Steps)-1 {
+			stepUpstream = u
+		}
+		s = m.Steps[i].PropagateGradient(stepUpstream, s, g)
+	}
+
+	for i, v := range m.InPool {
+		inGrad := g[v]
+		delete(g, v)
+		m.Input[i].PropagateGradient(inGrad, g)
+	}
+
+	return s
+}
+
+// microStepRResult is like microStepResult, but with
+// support for the r-operator.
+type microStepRResult struct {
+	Input  []autofunc.RResult
+	InPool []*autofunc.Variable
+	Steps  []*blockRResult
+}
+
+func (m *microStepRResult) Outputs() []linalg.Vector {
+	return m.Steps[len(m.Steps)-1].Outputs()
+}
+
+func (m *microStepRResult) ROutputs() []linalg.Vector {
+	return m.Steps[len(m.Steps)-1].ROutputs()
+}
+
+func (m *microStepRResult) RStates() []rnn.RState {
+	return m.Steps[len(m.Steps)-1].RStates()
+}
+
+func (m *microStepRResult) PropagateRGradient(u, uR []linalg.Vector, s []rnn.RStateGrad,
+	rg autofunc.RGradient, g autofunc.Gradient) []rnn.RStateGrad {
+	if len(m.Input) == 0 {
+		return nil
+	}
+
+	if g == nil {
+		g = autofunc.Gradient{}
+	}
+
+	for _, v := range m.InPool {
+		g[v] = make(linalg.Vector, len(v.Vector))
+		rg[v] = make(linalg.Vector, len(v.Vector))
+	}
+
+	for i := len(m.Steps) - 1; i >= 0; i-- {
+		var stepUpstream, stepUpstreamR []linalg.Vector
+		if i == len(m.Steps)-1 {
+			stepUpstream, stepUpstreamR = u, uR
+		}
+		s = m.Steps[i].PropagateRGradient(stepUpstream, stepUpstreamR, s, rg, g)
+	}
+
+	for i, v := range m.InPool {
+		inGrad, inGradR := g[v], rg[v]
+		delete(g, v)
+		delete(rg, v)
+		m.Input[i].PropagateRGradient(inGrad, inGradR, rg, g)
+	}
+
+	return s
+}
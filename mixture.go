@@ -0,0 +1,529 @@
+package neuralstruct
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func init() {
+	var m Mixture
+	var r RMixture
+	serializer.RegisterTypedDeserializer(m.SerializerType(), DeserializeMixture)
+	serializer.RegisterTypedDeserializer(r.SerializerType(), DeserializeRMixture)
+}
+
+// A Mixture combines several alternative Structs with the
+// same data size into a single struct whose data is a
+// weighted sum of theirs.
+//
+// The control vector starts with one weight per struct,
+// followed by the control vectors of every struct.
+// A softmax over the weights determines both how much
+// each struct is updated and how much of each struct's
+// data makes it into the data output.
+// At every timestep, each struct's new state is a
+// weighted sum of its old state and the state its
+// control vector produces, using MixStates.
+// Thus, a struct with a weight near zero is left almost
+// unchanged.
+//
+// Since the structs' states are mixed, every struct must
+// be a Mixer (or an RMixer for an RMixture), as must the
+// structs inside of any aggregates.
+// Currently, this means that a Mixture may only contain
+// stacks, queues, and aggregates of them.
+// Other structs, such as RingBuffers, Grids, Trees, and
+// Chains, are not supported.
+// Use NewMixture to check this when building a Mixture.
+type Mixture []Struct
+
+// NewMixture creates a Mixture of the given structs.
+// It fails if the structs cannot be mixed, or if their
+// data sizes differ.
+func NewMixture(structs ...Struct) (Mixture, error) {
+	res := Mixture(structs)
+	if err := res.validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeserializeMixture deserializes a Mixture.
+func DeserializeMixture(d []byte) (Mixture, error) {
+	agg, err := DeserializeAggregate(d)
+	if err != nil {
+		return nil, err
+	}
+	return NewMixture(agg...)
+}
+
+// ControlSize returns the number of structs plus the sum
+// of their control sizes.
+func (m Mixture) ControlSize() int {
+	return len(m) + Aggregate(m).ControlSize()
+}
+
+// DataSize returns the data size shared by the structs.
+func (m Mixture) DataSize() int {
+	if len(m) == 0 {
+		return 0
+	}
+	return m[0].DataSize()
+}
+
+// StartState returns a state representing the start
+// states of every struct.
+// The data of the start state is an unweighted average
+// of the structs' start data.
+//
+// It panics if the structs cannot be mixed, or if their
+// data sizes differ.
+func (m Mixture) StartState() State {
+	if err := m.validate(); err != nil {
+		panic(err)
+	}
+	res := &mixtureState{
+		Structs: m,
+		Weights: uniformWeights(len(m)),
+	}
+	for _, s := range m {
+		res.States = append(res.States, s.StartState())
+	}
+	res.JoinedData = res.mixData()
+	return res
+}
+
+// SerializerType returns the unique ID used to serialize
+// Mixtures with the serializer package.
+func (m Mixture) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.Mixture"
+}
+
+// Serialize encodes the mixture, given that all of the
+// contained structs are serializers.
+func (m Mixture) Serialize() ([]byte, error) {
+	return Aggregate(m).Serialize()
+}
+
+// SuggestedActivation suggests an activation function
+// using the suggestions of the enclosed structures.
+// The weights are left untouched.
+func (m Mixture) SuggestedActivation() neuralnet.Layer {
+	return offsetActivation(Aggregate(m).SuggestedActivation().(*PartialActivation),
+		len(m))
+}
+
+func (m Mixture) validate() error {
+	if len(m) == 0 {
+		return errors.New("mixture needs at least one struct")
+	}
+	for _, s := range m {
+		if err := checkMixer(s, false); err != nil {
+			return err
+		}
+		if s.DataSize() != m.DataSize() {
+			return fmt.Errorf("mismatching data sizes: %d and %d", s.DataSize(),
+				m.DataSize())
+		}
+	}
+	return nil
+}
+
+// An RMixture is like a Mixture, but with support for
+// the r-operator.
+type RMixture []RStruct
+
+// NewRMixture is like NewMixture, but for an RMixture.
+func NewRMixture(structs ...RStruct) (RMixture, error) {
+	res := RMixture(structs)
+	if err := res.validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeserializeRMixture deserializes an RMixture.
+func DeserializeRMixture(d []byte) (RMixture, error) {
+	agg, err := DeserializeRAggregate(d)
+	if err != nil {
+		return nil, err
+	}
+	return NewRMixture(agg...)
+}
+
+// ControlSize is like Mixture.ControlSize().
+func (r RMixture) ControlSize() int {
+	return r.mixture().ControlSize()
+}
+
+// DataSize is like Mixture.DataSize().
+func (r RMixture) DataSize() int {
+	return r.mixture().DataSize()
+}
+
+// StartState is like Mixture.StartState().
+func (r RMixture) StartState() State {
+	return r.mixture().StartState()
+}
+
+// StartRState is like StartState, but for RStates.
+func (r RMixture) StartRState() RState {
+	if err := r.validate(); err != nil {
+		panic(err)
+	}
+	res := &mixtureRState{
+		Structs:  r,
+		Weights:  uniformWeights(len(r)),
+		WeightsR: make(linalg.Vector, len(r)),
+	}
+	for _, s := range r {
+		res.States = append(res.States, s.StartRState())
+	}
+	res.JoinedData, res.JoinedRData = res.mixData()
+	return res
+}
+
+// SerializerType returns the unique ID used to serialize
+// RMixtures with the serializer package.
+func (r RMixture) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.RMixture"
+}
+
+// Serialize encodes the mixture, given that all of the
+// contained structs are serializers.
+func (r RMixture) Serialize() ([]byte, error) {
+	return RAggregate(r).Serialize()
+}
+
+// SuggestedActivation is like Mixture.SuggestedActivation().
+func (r RMixture) SuggestedActivation() neuralnet.Layer {
+	return r.mixture().SuggestedActivation()
+}
+
+func (r RMixture) validate() error {
+	if err := r.mixture().validate(); err != nil {
+		return err
+	}
+	for _, s := range r {
+		if err := checkMixer(s, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r RMixture) mixture() Mixture {
+	m := make(Mixture, len(r))
+	for i, s := range r {
+		m[i] = s
+	}
+	return m
+}
+
+// offsetActivation shifts the ranges of a partial
+// activation by a fixed offset.
+func offsetActivation(p *PartialActivation, offset int) *PartialActivation {
+	for i, r := range p.Ranges {
+		p.Ranges[i] = ComponentRange{Start: r.Start + offset, End: r.End + offset}
+	}
+	return p
+}
+
+// checkMixer returns an error if the states of s cannot
+// be mixed, either because s is not a Mixer (or an
+// RMixer, if r is true) or because it is an aggregate
+// containing such a struct.
+func checkMixer(s Struct, r bool) error {
+	if _, ok := s.(Mixer); !ok {
+		return fmt.Errorf("struct is not a Mixer: %T", s)
+	}
+	if _, ok := s.(RMixer); r && !ok {
+		return fmt.Errorf("struct is not an RMixer: %T", s)
+	}
+	var subStructs []Struct
+	switch s := s.(type) {
+	case Aggregate:
+		subStructs = s
+	case RAggregate:
+		subStructs = s.aggregate()
+	case *ParallelAggregate:
+		subStructs = s.Structs.aggregate()
+	}
+	for _, sub := range subStructs {
+		if err := checkMixer(sub, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uniformWeights(count int) linalg.Vector {
+	res := make(linalg.Vector, count)
+	for i := range res {
+		res[i] = 1 / float64(count)
+	}
+	return res
+}
+
+type mixtureState struct {
+	Structs []Struct
+
+	// States stores the gated state of each struct.
+	States     []State
+	Weights    linalg.Vector
+	JoinedData linalg.Vector
+
+	// Logits and Last are nil for start states.
+	// Updates stores the state of each struct after an
+	// ungated update.
+	Logits  linalg.Vector
+	Last    *mixtureState
+	Updates []State
+}
+
+func (m *mixtureState) Data() linalg.Vector {
+	return m.JoinedData
+}
+
+func (m *mixtureState) Gradient(upstream linalg.Vector, grad Grad) (linalg.Vector, Grad) {
+	if m.Logits == nil {
+		panic("cannot propagate through start state")
+	}
+	var gradList []Grad
+	if grad != nil {
+		gradList = grad.([]Grad)
+	}
+
+	weightsGrad := make(linalg.Vector, len(m.States))
+	downstream := make(linalg.Vector, len(m.States))
+	downstreamGrad := make([]Grad, len(m.States))
+	for i, s := range m.States {
+		mixer := structMixer(m.Structs[i])
+		var subUpstream Grad
+		if gradList != nil {
+			subUpstream = gradList[i]
+		}
+		weightsGrad[i] = upstream.Dot(s.Data())
+		gateGrad, gateDown := mixer.MixGradient(
+			[]State{m.Last.States[i], m.Updates[i]},
+			gateWeights(m.Weights[i]),
+			upstream.Copy().Scale(m.Weights[i]),
+			subUpstream,
+		)
+		weightsGrad[i] += gateGrad[1] - gateGrad[0]
+		zeroData := make(linalg.Vector, len(s.Data()))
+		subDownstream, updateDown := m.Updates[i].Gradient(zeroData, gateDown[1])
+		downstream = append(downstream, subDownstream...)
+		downstreamGrad[i] = mixer.AddGrads(gateDown[0], updateDown)
+	}
+
+	logitsVar := &autofunc.Variable{Vector: m.Logits}
+	softmax := autofunc.Softmax{}
+	g := autofunc.Gradient{logitsVar: downstream[:len(m.States)]}
+	softmax.Apply(logitsVar).PropagateGradient(weightsGrad, g)
+
+	return downstream, downstreamGrad
+}
+
+// Detach returns a mixture state with the same contents
+// and weights, but with no history.
+// The sub-states are detached as well, so they must be
+// Detachers.
+func (m *mixtureState) Detach() State {
+	res := &mixtureState{
+		Structs:    m.Structs,
+		Weights:    m.Weights.Copy(),
+		JoinedData: m.JoinedData.Copy(),
+	}
+	for _, s := range m.States {
+		res.States = append(res.States, Detach(s))
+	}
+	return res
+}
+
+// DetachR is like Detach, but for an RState.
+// Every sub-state must be a Detacher, and every struct
+// must be an RStruct.
+func (m *mixtureState) DetachR() RState {
+	res := &mixtureRState{
+		Weights:     m.Weights.Copy(),
+		WeightsR:    make(linalg.Vector, len(m.Weights)),
+		JoinedData:  m.JoinedData.Copy(),
+		JoinedRData: make(linalg.Vector, len(m.JoinedData)),
+	}
+	for i, s := range m.States {
+		res.Structs = append(res.Structs, m.Structs[i].(RStruct))
+		res.States = append(res.States, detachR(s))
+	}
+	return res
+}
+
+func (m *mixtureState) NextState(ctrl linalg.Vector) State {
+	logits := ctrl[:len(m.States)]
+	softmax := autofunc.Softmax{}
+	newState := &mixtureState{
+		Structs: m.Structs,
+		Weights: softmax.Apply(&autofunc.Variable{Vector: logits}).Output(),
+		Logits:  logits,
+		Last:    m,
+	}
+	ctrlIdx := len(m.States)
+	for i, s := range m.States {
+		ctrlSize := m.Structs[i].ControlSize()
+		subCtrl := ctrl[ctrlIdx : ctrlIdx+ctrlSize]
+		ctrlIdx += ctrlSize
+		update := s.NextState(subCtrl)
+		gated := structMixer(m.Structs[i]).MixStates([]State{s, update},
+			gateWeights(newState.Weights[i]))
+		newState.Updates = append(newState.Updates, update)
+		newState.States = append(newState.States, gated)
+	}
+	newState.JoinedData = newState.mixData()
+	return newState
+}
+
+func (m *mixtureState) mixData() linalg.Vector {
+	res := make(linalg.Vector, len(m.States[0].Data()))
+	for i, s := range m.States {
+		res.Add(s.Data().Copy().Scale(m.Weights[i]))
+	}
+	return res
+}
+
+type mixtureRState struct {
+	Structs     []RStruct
+	States      []RState
+	Weights     linalg.Vector
+	WeightsR    linalg.Vector
+	JoinedData  linalg.Vector
+	JoinedRData linalg.Vector
+
+	Logits  linalg.Vector
+	LogitsR linalg.Vector
+	Last    *mixtureRState
+	Updates []RState
+}
+
+func (m *mixtureRState) Data() linalg.Vector {
+	return m.JoinedData
+}
+
+func (m *mixtureRState) RData() linalg.Vector {
+	return m.JoinedRData
+}
+
+func (m *mixtureRState) RGradient(upstream, upstreamR linalg.Vector,
+	grad RGrad) (linalg.Vector, linalg.Vector, RGrad) {
+	if m.Logits == nil {
+		panic("cannot propagate through start state")
+	}
+	var gradList []RGrad
+	if grad != nil {
+		gradList = grad.([]RGrad)
+	}
+
+	weightsGrad := make(linalg.Vector, len(m.States))
+	weightsGradR := make(linalg.Vector, len(m.States))
+	downstream := make(linalg.Vector, len(m.States))
+	downstreamR := make(linalg.Vector, len(m.States))
+	downstreamGrad := make([]RGrad, len(m.States))
+	for i, s := range m.States {
+		mixer := structRMixer(m.Structs[i])
+		var subUpstream RGrad
+		if gradList != nil {
+			subUpstream = gradList[i]
+		}
+		weightsGrad[i] = upstream.Dot(s.Data())
+		weightsGradR[i] = upstreamR.Dot(s.Data()) + upstream.Dot(s.RData())
+		subDataGrad := upstream.Copy().Scale(m.Weights[i])
+		subDataGradR := upstreamR.Copy().Scale(m.Weights[i])
+		addScaled(subDataGradR, upstream, m.WeightsR[i])
+		gateGrad, gateGradR, gateDown := mixer.MixRGradient(
+			[]RState{m.Last.States[i], m.Updates[i]},
+			gateWeights(m.Weights[i]),
+			gateWeightsR(m.WeightsR[i]),
+			subDataGrad,
+			subDataGradR,
+			subUpstream,
+		)
+		weightsGrad[i] += gateGrad[1] - gateGrad[0]
+		weightsGradR[i] += gateGradR[1] - gateGradR[0]
+		zeroData := make(linalg.Vector, len(s.Data()))
+		subDownstream, subDownstreamR, updateDown := m.Updates[i].RGradient(zeroData,
+			zeroData, gateDown[1])
+		downstream = append(downstream, subDownstream...)
+		downstreamR = append(downstreamR, subDownstreamR...)
+		downstreamGrad[i] = mixer.AddRGrads(gateDown[0], updateDown)
+	}
+
+	logitsVar := &autofunc.Variable{Vector: m.Logits}
+	softmax := autofunc.Softmax{}
+	g := autofunc.Gradient{logitsVar: downstream[:len(m.States)]}
+	rg := autofunc.RGradient{logitsVar: downstreamR[:len(m.States)]}
+	softmax.ApplyR(autofunc.RVector{}, &autofunc.RVariable{
+		Variable:   logitsVar,
+		ROutputVec: m.LogitsR,
+	}).PropagateRGradient(weightsGrad, weightsGradR, rg, g)
+
+	return downstream, downstreamR, downstreamGrad
+}
+
+func (m *mixtureRState) NextRState(ctrl, ctrlR linalg.Vector) RState {
+	logits := ctrl[:len(m.States)]
+	logitsR := ctrlR[:len(m.States)]
+	softmax := autofunc.Softmax{}
+	weights := softmax.ApplyR(autofunc.RVector{}, &autofunc.RVariable{
+		Variable:   &autofunc.Variable{Vector: logits},
+		ROutputVec: logitsR,
+	})
+	newState := &mixtureRState{
+		Structs:  m.Structs,
+		Weights:  weights.Output(),
+		WeightsR: weights.ROutput(),
+		Logits:   logits,
+		LogitsR:  logitsR,
+		Last:     m,
+	}
+	ctrlIdx := len(m.States)
+	for i, s := range m.States {
+		ctrlSize := m.Structs[i].ControlSize()
+		subCtrl := ctrl[ctrlIdx : ctrlIdx+ctrlSize]
+		subCtrlR := ctrlR[ctrlIdx : ctrlIdx+ctrlSize]
+		ctrlIdx += ctrlSize
+		update := s.NextRState(subCtrl, subCtrlR)
+		gated := structRMixer(m.Structs[i]).MixRStates([]RState{s, update},
+			gateWeights(newState.Weights[i]), gateWeightsR(newState.WeightsR[i]))
+		newState.Updates = append(newState.Updates, update)
+		newState.States = append(newState.States, gated)
+	}
+	newState.JoinedData, newState.JoinedRData = newState.mixData()
+	return newState
+}
+
+func (m *mixtureRState) mixData() (data, dataR linalg.Vector) {
+	data = make(linalg.Vector, len(m.States[0].Data()))
+	dataR = make(linalg.Vector, len(data))
+	for i, s := range m.States {
+		data.Add(s.Data().Copy().Scale(m.Weights[i]))
+		dataR.Add(s.RData().Copy().Scale(m.Weights[i]))
+		dataR.Add(s.Data().Copy().Scale(m.WeightsR[i]))
+	}
+	return
+}
+
+// gateWeights returns the mixing weights for a gated
+// update, where the old state is kept with probability
+// 1-weight and replaced with probability weight.
+func gateWeights(weight float64) linalg.Vector {
+	return linalg.Vector{1 - weight, weight}
+}
+
+// gateWeightsR computes the r-operator of gateWeights.
+func gateWeightsR(weightR float64) linalg.Vector {
+	return linalg.Vector{-weightR, weightR}
+}
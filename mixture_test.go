@@ -0,0 +1,122 @@
+package neuralstruct
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestMixtureData(t *testing.T) {
+	stack := &Stack{VectorSize: 2, NoReplace: true}
+	queue := &Queue{VectorSize: 2}
+	mixture := Mixture{stack, queue}
+
+	stackState := stack.StartState()
+	queueState := queue.StartState()
+	state := mixture.StartState()
+
+	controls := []linalg.Vector{
+		{math.Log(0.3), math.Log(0.7), 0, 1, 0, 1, 2, 0, 1, 0, 1, 2},
+		{math.Log(0.9), math.Log(0.1), 0, 1, 0, 3, 4, 0, 1, 0, 3, 4},
+		{math.Log(0.5), math.Log(0.5), 0, 0, 1, 0, 0, 0, 0, 1, 0, 0},
+	}
+	weights := [][2]float64{{0.3, 0.7}, {0.9, 0.1}, {0.5, 0.5}}
+
+	for i, control := range controls {
+		state = state.NextState(control)
+		stackState = stack.MixStates([]State{stackState, stackState.NextState(control[2:7])},
+			linalg.Vector{1 - weights[i][0], weights[i][0]})
+		queueState = queue.MixStates([]State{queueState, queueState.NextState(control[7:])},
+			linalg.Vector{1 - weights[i][1], weights[i][1]})
+		expected := stackState.Data().Copy().Scale(weights[i][0])
+		expected.Add(queueState.Data().Copy().Scale(weights[i][1]))
+		if !statesEqual(state.Data(), expected) {
+			t.Errorf("step %d: expected %v but got %v", i, expected, state.Data())
+		}
+	}
+}
+
+func TestMixtureGating(t *testing.T) {
+	stack := &Stack{VectorSize: 2, NoReplace: true}
+	mixture := Mixture{stack, &Queue{VectorSize: 2}}
+	state := mixture.StartState()
+	state = state.NextState(linalg.Vector{-20, 20, 0, 50, 0, 1, 2, 0, 50, 0, 1, 2})
+	state = state.NextState(linalg.Vector{20, -20, 0, 50, 0, 3, 4, 0, 50, 0, 3, 4})
+
+	// The stack's first push was gated out, so it should
+	// only contain the second push.
+	// Contents are padded with (almost) zero entries.
+	stackState := state.(*mixtureState).States[0].(*stackState)
+	if expected := (linalg.Vector{3, 4, 0, 0}); !statesEqual(stackState.expected(), expected) {
+		t.Errorf("expected stack %v but got %v", expected, stackState.expected())
+	}
+
+	// The queue's second push was gated out, so it should
+	// only contain the first push.
+	queueState := state.(*mixtureState).States[1].(*queueState)
+	if expected := (linalg.Vector{1, 2, 0, 0}); !statesEqual(queueState.expected(), expected) {
+		t.Errorf("expected queue %v but got %v", expected, queueState.expected())
+	}
+	sizeProbs := queueState.sizeProbs()
+	if math.Abs(sizeProbs[1]-1) > 1e-4 {
+		t.Errorf("expected queue size 1 but got probabilities %v", sizeProbs)
+	}
+}
+
+func TestMixtureDerivatives(t *testing.T) {
+	structures := []RStruct{
+		RMixture{
+			&Stack{VectorSize: 3},
+			&Queue{VectorSize: 3},
+		},
+		RMixture{
+			&Queue{VectorSize: 2, LogSpace: true},
+			RAggregate{&Stack{VectorSize: 1}, &Queue{VectorSize: 1}},
+		},
+	}
+	for _, structure := range structures {
+		testAllDerivatives(t, structure)
+	}
+}
+
+func TestMixtureActivation(t *testing.T) {
+	structure := RMixture{
+		&Stack{VectorSize: 3},
+		&Queue{VectorSize: 3},
+	}
+	activation := structure.SuggestedActivation().(*PartialActivation)
+	expected := []ComponentRange{{Start: 2, End: 9}, {Start: 9, End: 15}}
+	if len(activation.Ranges) != len(expected) {
+		t.Fatalf("expected %d ranges but got %d", len(expected), len(activation.Ranges))
+	}
+	for i, r := range expected {
+		if activation.Ranges[i] != r {
+			t.Errorf("range %d: expected %v but got %v", i, r, activation.Ranges[i])
+		}
+	}
+}
+
+func TestMixtureValidation(t *testing.T) {
+	invalid := [][]RStruct{
+		{},
+		{&Stack{VectorSize: 2}, &RingBuffer{VectorSize: 2, Capacity: 3}},
+		{&Stack{VectorSize: 2}, RAggregate{&Tree{VectorSize: 2, Depth: 2}}},
+		{&Stack{VectorSize: 2}, &Queue{VectorSize: 3}},
+	}
+	for i, structs := range invalid {
+		if _, err := NewRMixture(structs...); err == nil {
+			t.Errorf("mixture %d: expected an error", i)
+		}
+		data, err := RMixture(structs).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DeserializeRMixture(data); err == nil {
+			t.Errorf("mixture %d: expected a deserialization error", i)
+		}
+	}
+	if _, err := NewMixture(&Stack{VectorSize: 2}, Aggregate{&Queue{VectorSize: 2}}); err != nil {
+		t.Error(err)
+	}
+}
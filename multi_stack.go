@@ -0,0 +1,417 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func init() {
+	var m MultiStack
+	serializer.RegisterTypedDeserializer(m.SerializerType(), DeserializeMultiStack)
+}
+
+// A MultiStack is a Struct which stores several stacks
+// of vectors that share one set of control flags.
+//
+// The control vector starts with one selection value per
+// stack, followed by the flags and the data vector of a
+// Stack.
+// A softmax over the selection values decides which stack
+// the operation applies to.
+// Every stack performs the operation with the probability
+// that it was selected, and does nothing otherwise.
+//
+// The data output is the top of every stack, in order.
+type MultiStack struct {
+	VectorSize int
+	StackCount int
+
+	// NoReplace, if true, indicates that the stacks should
+	// not provide a "replace" flag in the control signal.
+	NoReplace bool
+
+	// PushBias determines an optional bias towards pushing
+	// from the SuggestedActivation() method.
+	// See Stack.PushBias for more details.
+	PushBias float64
+}
+
+// DeserializeMultiStack deserializes a MultiStack.
+func DeserializeMultiStack(d []byte) (*MultiStack, error) {
+	var res MultiStack
+	if err := json.Unmarshal(d, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ControlSize returns the number of control components,
+// which varies based on the vector size and the number
+// of stacks.
+func (m *MultiStack) ControlSize() int {
+	return m.StackCount + m.stack().ControlSize()
+}
+
+// DataSize returns the vector size times the number of
+// stacks.
+func (m *MultiStack) DataSize() int {
+	return m.VectorSize * m.StackCount
+}
+
+// StartState returns a state with every stack empty.
+func (m *MultiStack) StartState() State {
+	return &multiStackState{
+		Stack:    *m,
+		Expected: make([]linalg.Vector, m.StackCount),
+	}
+}
+
+// StartRState returns a state with every stack empty.
+func (m *MultiStack) StartRState() RState {
+	return &multiStackRState{
+		Stack:     *m,
+		Expected:  make([]linalg.Vector, m.StackCount),
+		ExpectedR: make([]linalg.Vector, m.StackCount),
+	}
+}
+
+// SerializerType returns the unique ID for serializing
+// multi-stacks with the serializer package.
+func (m *MultiStack) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.MultiStack"
+}
+
+// Serialize serializes the multi-stack's parameters.
+func (m *MultiStack) Serialize() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// SuggestedActivation returns an activation function
+// which applies a hyperbolic tangent to the data outputs
+// while leaving the selection and flag outputs untouched.
+func (m *MultiStack) SuggestedActivation() neuralnet.Layer {
+	flagStart := m.StackCount
+	res := &PartialActivation{
+		Ranges: []ComponentRange{
+			{Start: flagStart + m.stack().flagCount(), End: m.ControlSize()},
+		},
+		Activations: []neuralnet.Layer{&neuralnet.HyperbolicTangent{}},
+	}
+	if m.PushBias != 0 {
+		res.Ranges = append([]ComponentRange{
+			{Start: flagStart + StackPush, End: flagStart + StackPush + 1},
+		}, res.Ranges...)
+		res.Activations = append([]neuralnet.Layer{
+			&neuralnet.RescaleLayer{Scale: 1, Bias: m.PushBias},
+		}, res.Activations...)
+	}
+	return res
+}
+
+// FlagNames returns the names of the selection values,
+// followed by the names of the stack flags.
+func (m *MultiStack) FlagNames() []string {
+	var res []string
+	for i := 0; i < m.StackCount; i++ {
+		res = append(res, fmt.Sprintf("stack %d", i))
+	}
+	return append(res, m.stack().FlagNames()...)
+}
+
+// stack returns a Stack which performs the operations of
+// each individual stack.
+func (m *MultiStack) stack() *Stack {
+	return &Stack{VectorSize: m.VectorSize, NoReplace: m.NoReplace}
+}
+
+// splitControl splits a control vector into its selection
+// logits, flag logits, and data vector.
+func (m *MultiStack) splitControl(control linalg.Vector) (sel, flags, data linalg.Vector) {
+	flagEnd := m.StackCount + m.stack().flagCount()
+	return control[:m.StackCount], control[m.StackCount:flagEnd], control[flagEnd:]
+}
+
+// stackFlags computes the flag probabilities which each
+// individual stack sees, given the selection and flag
+// probabilities.
+func (m *MultiStack) stackFlags(sel, flags linalg.Vector) []linalg.Vector {
+	res := make([]linalg.Vector, m.StackCount)
+	for i, s := range sel {
+		res[i] = flags.Copy().Scale(s)
+		res[i][StackNop] += 1 - s
+	}
+	return res
+}
+
+// stackFlagsR is like stackFlags, but it also computes
+// the derivatives of the flags.
+func (m *MultiStack) stackFlagsR(sel, selR, flags, flagsR linalg.Vector) (res,
+	resR []linalg.Vector) {
+	res = m.stackFlags(sel, flags)
+	resR = make([]linalg.Vector, m.StackCount)
+	for i, s := range sel {
+		resR[i] = flags.Copy().Scale(selR[i]).Add(flagsR.Copy().Scale(s))
+		resR[i][StackNop] -= selR[i]
+	}
+	return
+}
+
+// tops joins the top vectors of the given stacks, using
+// zero vectors for empty stacks.
+func (m *MultiStack) tops(stacks []linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, 0, m.DataSize())
+	for _, expected := range stacks {
+		if len(expected) == 0 {
+			res = append(res, make(linalg.Vector, m.VectorSize)...)
+		} else {
+			res = append(res, expected[:m.VectorSize]...)
+		}
+	}
+	return res
+}
+
+type multiStackState struct {
+	Last     *multiStackState
+	Stack    MultiStack
+	Expected []linalg.Vector
+	Control  linalg.Vector
+}
+
+func (m *multiStackState) Data() linalg.Vector {
+	return m.Stack.tops(m.Expected)
+}
+
+func (m *multiStackState) Gradient(dataGrad linalg.Vector, upstreamGrad Grad) (linalg.Vector,
+	Grad) {
+	if m.Last == nil {
+		panic("cannot propagate through start state")
+	}
+
+	stack := m.Stack.stack()
+	vecSize := m.Stack.VectorSize
+
+	var upstream []linalg.Vector
+	if upstreamGrad != nil {
+		upstream = upstreamGrad.([]linalg.Vector)
+	} else {
+		upstream = make([]linalg.Vector, m.Stack.StackCount)
+	}
+
+	selVec, flagVec, controlData := m.Stack.splitControl(m.Control)
+	softmax := autofunc.Softmax{}
+	selVar := &autofunc.Variable{Vector: selVec}
+	flagVar := &autofunc.Variable{Vector: flagVec}
+	selRes := softmax.Apply(selVar)
+	flagRes := softmax.Apply(flagVar)
+	sel, flags := selRes.Output(), flagRes.Output()
+	stackFlags := m.Stack.stackFlags(sel, flags)
+
+	selGrad := make(linalg.Vector, len(sel))
+	flagsGrad := make(linalg.Vector, len(flags))
+	controlDataGrad := make(linalg.Vector, len(controlData))
+	downstream := make([]linalg.Vector, m.Stack.StackCount)
+	for i, expected := range m.Expected {
+		stackUpstream := stack.upstreamExpected(dataGrad[i*vecSize:(i+1)*vecSize],
+			upstream[i], len(expected))
+		var stackFlagsGrad, stackDataGrad linalg.Vector
+		stackFlagsGrad, stackDataGrad, downstream[i] = stack.expectedGradient(
+			m.Last.Expected[i], stackFlags[i], controlData, stackUpstream)
+		controlDataGrad.Add(stackDataGrad)
+		flagsGrad.Add(stackFlagsGrad.Copy().Scale(sel[i]))
+		selGrad[i] = stackFlagsGrad.Dot(flags) - stackFlagsGrad[StackNop]
+	}
+
+	controlDownstream := make(linalg.Vector, len(m.Control))
+	copy(controlDownstream[len(sel)+len(flags):], controlDataGrad)
+	g := autofunc.Gradient{
+		selVar:  controlDownstream[:len(sel)],
+		flagVar: controlDownstream[len(sel) : len(sel)+len(flags)],
+	}
+	selRes.PropagateGradient(selGrad, g)
+	flagRes.PropagateGradient(flagsGrad, g)
+
+	return controlDownstream, downstream
+}
+
+// Detach returns a state with the same stacks and no
+// history.
+func (m *multiStackState) Detach() State {
+	res := &multiStackState{
+		Stack:    m.Stack,
+		Expected: make([]linalg.Vector, len(m.Expected)),
+	}
+	for i, expected := range m.Expected {
+		res.Expected[i] = expected.Copy()
+	}
+	return res
+}
+
+// DetachR is like Detach, but for an RState.
+func (m *multiStackState) DetachR() RState {
+	res := &multiStackRState{
+		Stack:     m.Stack,
+		Expected:  make([]linalg.Vector, len(m.Expected)),
+		ExpectedR: make([]linalg.Vector, len(m.Expected)),
+	}
+	for i, expected := range m.Expected {
+		res.Expected[i] = expected.Copy()
+		res.ExpectedR[i] = make(linalg.Vector, len(expected))
+	}
+	return res
+}
+
+func (m *multiStackState) NextState(control linalg.Vector) State {
+	stack := m.Stack.stack()
+	selVec, flagVec, controlData := m.Stack.splitControl(control)
+	softmax := autofunc.Softmax{}
+	sel := softmax.Apply(&autofunc.Variable{Vector: selVec}).Output()
+	flags := softmax.Apply(&autofunc.Variable{Vector: flagVec}).Output()
+	stackFlags := m.Stack.stackFlags(sel, flags)
+
+	expected := make([]linalg.Vector, len(m.Expected))
+	for i, last := range m.Expected {
+		expected[i] = stack.nextExpected(last, stackFlags[i], controlData)
+	}
+
+	return &multiStackState{
+		Last:     m,
+		Stack:    m.Stack,
+		Expected: expected,
+		Control:  control,
+	}
+}
+
+type multiStackRState struct {
+	Last      *multiStackRState
+	Stack     MultiStack
+	Expected  []linalg.Vector
+	ExpectedR []linalg.Vector
+	Control   linalg.Vector
+	ControlR  linalg.Vector
+}
+
+func (m *multiStackRState) Data() linalg.Vector {
+	return m.Stack.tops(m.Expected)
+}
+
+func (m *multiStackRState) RData() linalg.Vector {
+	return m.Stack.tops(m.ExpectedR)
+}
+
+func (m *multiStackRState) RGradient(dataGrad, dataGradR linalg.Vector,
+	upstreamGrad RGrad) (linalg.Vector, linalg.Vector, RGrad) {
+	if m.Last == nil {
+		panic("cannot propagate through start state")
+	}
+
+	stack := m.Stack.stack()
+	vecSize := m.Stack.VectorSize
+
+	var upstream, upstreamR []linalg.Vector
+	if upstreamGrad != nil {
+		upstreamVal := upstreamGrad.([2][]linalg.Vector)
+		upstream, upstreamR = upstreamVal[0], upstreamVal[1]
+	} else {
+		upstream = make([]linalg.Vector, m.Stack.StackCount)
+		upstreamR = make([]linalg.Vector, m.Stack.StackCount)
+	}
+
+	selVec, flagVec, controlData := m.Stack.splitControl(m.Control)
+	selVecR, flagVecR, controlDataR := m.Stack.splitControl(m.ControlR)
+	softmax := autofunc.Softmax{}
+	selVar := &autofunc.Variable{Vector: selVec}
+	flagVar := &autofunc.Variable{Vector: flagVec}
+	selRes := softmax.ApplyR(autofunc.RVector{}, &autofunc.RVariable{
+		Variable:   selVar,
+		ROutputVec: selVecR,
+	})
+	flagRes := softmax.ApplyR(autofunc.RVector{}, &autofunc.RVariable{
+		Variable:   flagVar,
+		ROutputVec: flagVecR,
+	})
+	sel, selR := selRes.Output(), selRes.ROutput()
+	flags, flagsR := flagRes.Output(), flagRes.ROutput()
+	stackFlags, stackFlagsR := m.Stack.stackFlagsR(sel, selR, flags, flagsR)
+
+	selGrad := make(linalg.Vector, len(sel))
+	selGradR := make(linalg.Vector, len(sel))
+	flagsGrad := make(linalg.Vector, len(flags))
+	flagsGradR := make(linalg.Vector, len(flags))
+	controlDataGrad := make(linalg.Vector, len(controlData))
+	controlDataGradR := make(linalg.Vector, len(controlData))
+	downstream := make([]linalg.Vector, m.Stack.StackCount)
+	downstreamR := make([]linalg.Vector, m.Stack.StackCount)
+	for i, expected := range m.Expected {
+		stackUpstream := stack.upstreamExpected(dataGrad[i*vecSize:(i+1)*vecSize],
+			upstream[i], len(expected))
+		stackUpstreamR := stack.upstreamExpected(dataGradR[i*vecSize:(i+1)*vecSize],
+			upstreamR[i], len(expected))
+		fGrad, fGradR, dGrad, dGradR, down, downR := stack.expectedGradientR(
+			m.Last.Expected[i], m.Last.ExpectedR[i], stackFlags[i], stackFlagsR[i],
+			controlData, controlDataR, stackUpstream, stackUpstreamR)
+		downstream[i], downstreamR[i] = down, downR
+
+		controlDataGrad.Add(dGrad)
+		controlDataGradR.Add(dGradR)
+		flagsGrad.Add(fGrad.Copy().Scale(sel[i]))
+		flagsGradR.Add(fGradR.Copy().Scale(sel[i])).Add(fGrad.Copy().Scale(selR[i]))
+		selGrad[i] = fGrad.Dot(flags) - fGrad[StackNop]
+		selGradR[i] = fGradR.Dot(flags) + fGrad.Dot(flagsR) - fGradR[StackNop]
+	}
+
+	controlDownstream := make(linalg.Vector, len(m.Control))
+	controlDownstreamR := make(linalg.Vector, len(m.Control))
+	copy(controlDownstream[len(sel)+len(flags):], controlDataGrad)
+	copy(controlDownstreamR[len(sel)+len(flags):], controlDataGradR)
+	g := autofunc.Gradient{
+		selVar:  controlDownstream[:len(sel)],
+		flagVar: controlDownstream[len(sel) : len(sel)+len(flags)],
+	}
+	rg := autofunc.RGradient{
+		selVar:  controlDownstreamR[:len(sel)],
+		flagVar: controlDownstreamR[len(sel) : len(sel)+len(flags)],
+	}
+	selRes.PropagateRGradient(selGrad, selGradR, rg, g)
+	flagRes.PropagateRGradient(flagsGrad, flagsGradR, rg, g)
+
+	return controlDownstream, controlDownstreamR,
+		[2][]linalg.Vector{downstream, downstreamR}
+}
+
+func (m *multiStackRState) NextRState(control, controlR linalg.Vector) RState {
+	stack := m.Stack.stack()
+	selVec, flagVec, controlData := m.Stack.splitControl(control)
+	selVecR, flagVecR, controlDataR := m.Stack.splitControl(controlR)
+	softmax := autofunc.Softmax{}
+	selRes := softmax.ApplyR(autofunc.RVector{}, &autofunc.RVariable{
+		Variable:   &autofunc.Variable{Vector: selVec},
+		ROutputVec: selVecR,
+	})
+	flagRes := softmax.ApplyR(autofunc.RVector{}, &autofunc.RVariable{
+		Variable:   &autofunc.Variable{Vector: flagVec},
+		ROutputVec: flagVecR,
+	})
+	stackFlags, stackFlagsR := m.Stack.stackFlagsR(selRes.Output(), selRes.ROutput(),
+		flagRes.Output(), flagRes.ROutput())
+
+	expected := make([]linalg.Vector, len(m.Expected))
+	expectedR := make([]linalg.Vector, len(m.Expected))
+	for i, last := range m.Expected {
+		expected[i], expectedR[i] = stack.nextExpectedR(last, m.ExpectedR[i],
+			stackFlags[i], stackFlagsR[i], controlData, controlDataR)
+	}
+
+	return &multiStackRState{
+		Last:      m,
+		Stack:     m.Stack,
+		Expected:  expected,
+		ExpectedR: expectedR,
+		Control:   control,
+		ControlR:  controlR,
+	}
+}
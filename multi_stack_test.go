@@ -0,0 +1,49 @@
+package neuralstruct
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestMultiStackData(t *testing.T) {
+	multi := &MultiStack{VectorSize: 2, StackCount: 2, NoReplace: true}
+	state := multi.StartState()
+
+	// Selection probabilities, then nop, push, pop, then data.
+	controls := []linalg.Vector{
+		{math.Log(1), math.Log(3), math.Log(0.5), math.Log(0.5), math.Log(1e-300), 1, 2},
+		{math.Log(3), math.Log(1), math.Log(1e-300), math.Log(1), math.Log(1e-300), 3, 4},
+		{math.Log(1), math.Log(1), math.Log(0.5), math.Log(1e-300), math.Log(0.5), 0, 0},
+	}
+	expected := []linalg.Vector{
+		{0.125, 0.25, 0.375, 0.75},
+		{0.25*0.125 + 0.75*3, 0.25*0.25 + 0.75*4, 0.75*0.375 + 0.25*3, 0.75*0.75 + 0.25*4},
+		{0.75*2.28125 + 0.25*0.75*0.125, 0.75*3.0625 + 0.25*0.75*0.25,
+			0.75*1.03125 + 0.25*0.25*0.375, 0.75*1.5625 + 0.25*0.25*0.75},
+	}
+
+	for i, control := range controls {
+		state = state.NextState(control)
+		if !statesEqual(state.Data(), expected[i]) {
+			t.Errorf("bad state %d: expected %v got %v", i, expected[i], state.Data())
+		}
+	}
+}
+
+func TestMultiStackDerivatives(t *testing.T) {
+	testAllDerivatives(t, &MultiStack{VectorSize: 3, StackCount: 3})
+}
+
+func TestMultiStackDerivativesNoReplace(t *testing.T) {
+	testAllDerivatives(t, &MultiStack{VectorSize: 3, StackCount: 2, NoReplace: true})
+}
+
+func BenchmarkMultiStackForward(b *testing.B) {
+	forwardBenchmark(b, &MultiStack{VectorSize: benchmarkVectorSize, StackCount: 4})
+}
+
+func BenchmarkMultiStackBackward(b *testing.B) {
+	backwardBenchmark(b, &MultiStack{VectorSize: benchmarkVectorSize, StackCount: 4})
+}
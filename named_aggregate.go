@@ -0,0 +1,212 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func init() {
+	var n NamedAggregate
+	serializer.RegisterTypedDeserializer(n.SerializerType(), DeserializeNamedAggregate)
+}
+
+// A FlagNamer is a Struct which can name the flags at
+// the start of its control vector.
+type FlagNamer interface {
+	FlagNames() []string
+}
+
+// A LayoutEntry describes where a sub-structure of a
+// NamedAggregate lives in the aggregate's control and
+// data vectors.
+type LayoutEntry struct {
+	Name    string
+	Control ComponentRange
+	Data    ComponentRange
+
+	// Flags contains the names of the control flags at the
+	// start of the control range, or nil if the structure
+	// is not a FlagNamer.
+	Flags []string
+}
+
+// A NamedAggregate is like an RAggregate, but it gives a
+// name to each of its sub-structures.
+//
+// The names make it possible to look up the parts of a
+// control or data vector which belong to a particular
+// sub-structure.
+type NamedAggregate struct {
+	// Names contains one unique name per struct.
+	Names []string
+
+	Structs RAggregate
+}
+
+// DeserializeNamedAggregate deserializes a NamedAggregate.
+func DeserializeNamedAggregate(d []byte) (*NamedAggregate, error) {
+	slice, err := serializer.DeserializeSlice(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(slice) != 2 {
+		return nil, errors.New("invalid NamedAggregate slice")
+	}
+	namesData, ok := slice[0].(serializer.Bytes)
+	if !ok {
+		return nil, errors.New("invalid NamedAggregate slice (entry 0)")
+	}
+	structs, ok := slice[1].(RAggregate)
+	if !ok {
+		return nil, errors.New("invalid NamedAggregate slice (entry 1)")
+	}
+	res := &NamedAggregate{Structs: structs}
+	if err := json.Unmarshal(namesData, &res.Names); err != nil {
+		return nil, fmt.Errorf("invalid NamedAggregate names: %s", err)
+	}
+	if err := res.validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ControlSize is like Aggregate.ControlSize().
+func (n *NamedAggregate) ControlSize() int {
+	return n.Structs.ControlSize()
+}
+
+// DataSize is like Aggregate.DataSize().
+func (n *NamedAggregate) DataSize() int {
+	return n.Structs.DataSize()
+}
+
+// StartState is like Aggregate.StartState().
+func (n *NamedAggregate) StartState() State {
+	return n.Structs.StartState()
+}
+
+// StartInferenceState is like
+// Aggregate.StartInferenceState().
+func (n *NamedAggregate) StartInferenceState() State {
+	return n.Structs.StartInferenceState()
+}
+
+// StartRState is like RAggregate.StartRState().
+func (n *NamedAggregate) StartRState() RState {
+	return n.Structs.StartRState()
+}
+
+// SerializerType returns the unique ID used to serialize
+// NamedAggregates with the serializer package.
+func (n *NamedAggregate) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.NamedAggregate"
+}
+
+// Serialize encodes the names and the structures, given
+// that all of the structures are serializers.
+func (n *NamedAggregate) Serialize() ([]byte, error) {
+	namesData, err := json.Marshal(n.Names)
+	if err != nil {
+		return nil, err
+	}
+	return serializer.SerializeSlice([]serializer.Serializer{
+		serializer.Bytes(namesData),
+		n.Structs,
+	})
+}
+
+// SuggestedActivation suggests an activation function
+// using the suggestions of the enclosed structures.
+func (n *NamedAggregate) SuggestedActivation() neuralnet.Layer {
+	pa := &PartialActivation{}
+	for i, entry := range n.Layout() {
+		if sugger, ok := n.Structs[i].(Activator); ok {
+			pa.Ranges = append(pa.Ranges, entry.Control)
+			pa.Activations = append(pa.Activations, sugger.SuggestedActivation())
+		}
+	}
+	return pa
+}
+
+// Layout returns one entry per sub-structure, in order.
+//
+// This panics if the number of names does not match the
+// number of structures, or if two structures share a name.
+func (n *NamedAggregate) Layout() []LayoutEntry {
+	if err := n.validate(); err != nil {
+		panic(err)
+	}
+	res := make([]LayoutEntry, len(n.Structs))
+	var ctrlIdx, dataIdx int
+	for i, s := range n.Structs {
+		res[i] = LayoutEntry{
+			Name:    n.Names[i],
+			Control: ComponentRange{Start: ctrlIdx, End: ctrlIdx + s.ControlSize()},
+			Data:    ComponentRange{Start: dataIdx, End: dataIdx + s.DataSize()},
+		}
+		if namer, ok := s.(FlagNamer); ok {
+			res[i].Flags = namer.FlagNames()
+		}
+		ctrlIdx += s.ControlSize()
+		dataIdx += s.DataSize()
+	}
+	return res
+}
+
+// Entry returns the layout entry for the structure with
+// the given name.
+// The second return value is false if no structure has
+// the name.
+func (n *NamedAggregate) Entry(name string) (LayoutEntry, bool) {
+	for _, entry := range n.Layout() {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return LayoutEntry{}, false
+}
+
+func (n *NamedAggregate) validate() error {
+	if len(n.Names) != len(n.Structs) {
+		return fmt.Errorf("have %d names for %d structs", len(n.Names), len(n.Structs))
+	}
+	seen := map[string]bool{}
+	for _, name := range n.Names {
+		if seen[name] {
+			return fmt.Errorf("duplicate struct name: %s", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// SplitControl maps each structure's name to its part of
+// a control vector.
+// The resulting vectors are slices of the original.
+func (n *NamedAggregate) SplitControl(control linalg.Vector) map[string]linalg.Vector {
+	if len(control) != n.ControlSize() {
+		panic("incorrect control size")
+	}
+	res := map[string]linalg.Vector{}
+	for _, entry := range n.Layout() {
+		res[entry.Name] = control[entry.Control.Start:entry.Control.End]
+	}
+	return res
+}
+
+// SplitData is like SplitControl, but for data vectors.
+func (n *NamedAggregate) SplitData(data linalg.Vector) map[string]linalg.Vector {
+	if len(data) != n.DataSize() {
+		panic("incorrect data size")
+	}
+	res := map[string]linalg.Vector{}
+	for _, entry := range n.Layout() {
+		res[entry.Name] = data[entry.Data.Start:entry.Data.End]
+	}
+	return res
+}
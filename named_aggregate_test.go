@@ -0,0 +1,109 @@
+package neuralstruct
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+func TestNamedAggregateLayout(t *testing.T) {
+	structure := &NamedAggregate{
+		Names: []string{"stack", "queue", "grid"},
+		Structs: RAggregate{
+			&Stack{VectorSize: 3, NoReplace: true},
+			&Queue{VectorSize: 2},
+			&Grid{Width: 2, Height: 2, VectorSize: 1},
+		},
+	}
+	expected := []LayoutEntry{
+		{
+			Name:    "stack",
+			Control: ComponentRange{Start: 0, End: 6},
+			Data:    ComponentRange{Start: 0, End: 3},
+			Flags:   []string{"nop", "push", "pop"},
+		},
+		{
+			Name:    "queue",
+			Control: ComponentRange{Start: 6, End: 11},
+			Data:    ComponentRange{Start: 3, End: 5},
+			Flags:   []string{"nop", "push", "pop"},
+		},
+		{
+			Name:    "grid",
+			Control: ComponentRange{Start: 11, End: 19},
+			Data:    ComponentRange{Start: 5, End: 6},
+			Flags:   []string{"stay", "up", "down", "left", "right", "write gate", "read gate"},
+		},
+	}
+	if actual := structure.Layout(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+
+	control := make(linalg.Vector, structure.ControlSize())
+	for i := range control {
+		control[i] = float64(i)
+	}
+	split := structure.SplitControl(control)
+	if !reflect.DeepEqual(split["queue"], control[6:11]) {
+		t.Errorf("bad queue control: %v", split["queue"])
+	}
+	data := linalg.Vector{1, 2, 3, 4, 5, 6}
+	if split := structure.SplitData(data); !reflect.DeepEqual(split["grid"], data[5:]) {
+		t.Errorf("bad grid data: %v", split["grid"])
+	}
+
+	if _, ok := structure.Entry("tree"); ok {
+		t.Error("unexpected entry for missing name")
+	}
+	if entry, ok := structure.Entry("stack"); !ok || entry.Control.End != 6 {
+		t.Errorf("bad stack entry: %v", entry)
+	}
+}
+
+func TestNamedAggregateActivation(t *testing.T) {
+	structs := RAggregate{
+		&Stack{VectorSize: 3},
+		&Queue{VectorSize: 7},
+	}
+	named := &NamedAggregate{Names: []string{"a", "b"}, Structs: structs}
+	expected := structs.SuggestedActivation()
+	if actual := named.SuggestedActivation(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+}
+
+func TestNamedAggregateSerialize(t *testing.T) {
+	structure := &NamedAggregate{
+		Names:   []string{"stack", "queue"},
+		Structs: RAggregate{&Stack{VectorSize: 3}, &Queue{VectorSize: 2}},
+	}
+	data, err := serializer.SerializeWithType(structure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, structure) {
+		t.Errorf("expected %v but got %v", structure, decoded)
+	}
+}
+
+func TestNamedAggregateValidation(t *testing.T) {
+	invalid := []*NamedAggregate{
+		{Names: []string{"a"}, Structs: RAggregate{&Stack{VectorSize: 3}, &Queue{VectorSize: 2}}},
+		{Names: []string{"a", "a"}, Structs: RAggregate{&Stack{VectorSize: 3}, &Queue{VectorSize: 2}}},
+	}
+	for i, structure := range invalid {
+		if structure.validate() == nil {
+			t.Errorf("aggregate %d: expected an error", i)
+		}
+		data, _ := structure.Serialize()
+		if _, err := DeserializeNamedAggregate(data); err == nil {
+			t.Errorf("aggregate %d: expected a deserialization error", i)
+		}
+	}
+}
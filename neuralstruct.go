@@ -70,3 +70,118 @@ type RState interface {
 	// and uses r-operator information.
 	NextRState(control, controlR linalg.Vector) RState
 }
+
+// A Detacher is a State which can be detached from the
+// states that led up to it.
+type Detacher interface {
+	State
+
+	// Detach returns a state with the same contents as
+	// this state, but with no history.
+	// The resulting state may be used like a start state.
+	Detach() State
+
+	// DetachR is like Detach, but it returns an RState.
+	// Since a detached state does not depend on anything,
+	// its r-operator values are all zero.
+	DetachR() RState
+}
+
+// A Mixer is a Struct whose States can be combined with a
+// differentiable weighted sum.
+type Mixer interface {
+	Struct
+
+	// MixStates computes the weighted sum of some states,
+	// all of which must have been created by this Mixer.
+	//
+	// The resulting state may be used like any other
+	// state, except that its Gradient method should not be
+	// called.
+	// Instead, MixGradient should be used to propagate
+	// gradients through the mixed state.
+	MixStates(states []State, weights linalg.Vector) State
+
+	// MixGradient propagates a gradient through MixStates.
+	// The dataGrad and upstream arguments are like the
+	// arguments to State.Gradient for the mixed state.
+	//
+	// The result is the gradient of the weights, along
+	// with one upstream Grad for each of the states.
+	MixGradient(states []State, weights, dataGrad linalg.Vector,
+		upstream Grad) (linalg.Vector, []Grad)
+
+	// AddGrads returns the sum of two upstream Grads for
+	// the same state.
+	// Either argument may be nil.
+	//
+	// The arguments should not be used again after this
+	// call.
+	AddGrads(g1, g2 Grad) Grad
+}
+
+// An RMixer is a Mixer whose RStates can be mixed as
+// well.
+type RMixer interface {
+	Mixer
+	RStruct
+
+	// MixRStates is like MixStates, but for RStates.
+	// The weightsR argument is the r-operator of the
+	// weights.
+	MixRStates(states []RState, weights, weightsR linalg.Vector) RState
+
+	// MixRGradient is like MixGradient, but for
+	// MixRStates.
+	// It returns the gradient of the weights and its
+	// r-operator, along with one upstream RGrad for each
+	// of the states.
+	MixRGradient(states []RState, weights, weightsR, dataGrad, dataGradR linalg.Vector,
+		upstream RGrad) (linalg.Vector, linalg.Vector, []RGrad)
+
+	// AddRGrads is like AddGrads, but for RGrads.
+	AddRGrads(g1, g2 RGrad) RGrad
+}
+
+// A BatchStruct is a Struct which can advance (and
+// propagate gradients through) a batch of States in one call.
+//
+// Stacks and Queues store the contents of a batch as the
+// rows of one matrix, so that every update is a handful
+// of row-wise operations over the whole batch rather than
+// a series of small vector operations per State.
+// Since the sequences in a batch usually advance in lock
+// step, all of their States tend to have the same depth;
+// States of different depths are split into groups.
+type BatchStruct interface {
+	Struct
+
+	// NextStates is equivalent to calling NextState on
+	// every state with the corresponding control vector.
+	NextStates(states []State, controls []linalg.Vector) []State
+
+	// StateGradients is equivalent to calling Gradient on
+	// every state with the corresponding data gradient and
+	// upstream Grad.
+	// The upstream slice itself may be nil, as may any of
+	// its entries.
+	StateGradients(states []State, dataGrads []linalg.Vector,
+		upstream []Grad) ([]linalg.Vector, []Grad)
+}
+
+// An InferenceStruct is a Struct which can create
+// lightweight States for running a model without
+// computing gradients.
+type InferenceStruct interface {
+	Struct
+
+	// StartInferenceState returns a start state which
+	// only supports Data and NextState.
+	//
+	// To save memory, NextState may update the state in
+	// place and return it, so a state should not be used
+	// after it has been advanced.
+	// For the same reason, the vector returned by Data
+	// may be overwritten by the next call to NextState.
+	StartInferenceState() State
+}
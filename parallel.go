@@ -0,0 +1,39 @@
+package neuralstruct
+
+import "sync"
+
+// parallelFor calls f for every integer in [0, n), using
+// at most the given number of goroutines.
+// If workers is less than 2, f is called sequentially on
+// the current goroutine.
+//
+// Calls to f must be independent of one another, so that
+// the results do not depend on scheduling.
+func parallelFor(n, workers int, f func(i int)) {
+	if workers < 2 || n < 2 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	if workers > n {
+		workers = n
+	}
+	indices := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				f(idx)
+			}
+		}()
+	}
+	wg.Wait()
+}
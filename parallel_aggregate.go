@@ -0,0 +1,156 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func init() {
+	var p ParallelAggregate
+	serializer.RegisterTypedDeserializer(p.SerializerType(), DeserializeParallelAggregate)
+}
+
+// A ParallelAggregate is like an RAggregate, but it
+// propagates gradients through its sub-structures
+// concurrently.
+//
+// The gradients are the same as those of the equivalent
+// RAggregate, regardless of how goroutines are scheduled.
+type ParallelAggregate struct {
+	Structs RAggregate
+
+	// Workers is the maximum number of goroutines to use
+	// while propagating gradients.
+	// Values less than 2 disable parallelism.
+	Workers int
+}
+
+// DeserializeParallelAggregate deserializes a
+// ParallelAggregate.
+func DeserializeParallelAggregate(d []byte) (*ParallelAggregate, error) {
+	slice, err := serializer.DeserializeSlice(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(slice) != 2 {
+		return nil, errors.New("invalid ParallelAggregate slice")
+	}
+	workersData, ok := slice[0].(serializer.Bytes)
+	if !ok {
+		return nil, errors.New("invalid ParallelAggregate slice (entry 0)")
+	}
+	structs, ok := slice[1].(RAggregate)
+	if !ok {
+		return nil, errors.New("invalid ParallelAggregate slice (entry 1)")
+	}
+	res := &ParallelAggregate{Structs: structs}
+	if err := json.Unmarshal(workersData, &res.Workers); err != nil {
+		return nil, fmt.Errorf("invalid ParallelAggregate workers: %s", err)
+	}
+	return res, nil
+}
+
+// ControlSize is like Aggregate.ControlSize().
+func (p *ParallelAggregate) ControlSize() int {
+	return p.Structs.ControlSize()
+}
+
+// DataSize is like Aggregate.DataSize().
+func (p *ParallelAggregate) DataSize() int {
+	return p.Structs.DataSize()
+}
+
+// StartState is like Aggregate.StartState().
+func (p *ParallelAggregate) StartState() State {
+	res := p.Structs.StartState().(*aggregateState)
+	res.Workers = p.Workers
+	return res
+}
+
+// StartInferenceState is like
+// Aggregate.StartInferenceState().
+func (p *ParallelAggregate) StartInferenceState() State {
+	return p.Structs.StartInferenceState()
+}
+
+// StartRState is like RAggregate.StartRState().
+func (p *ParallelAggregate) StartRState() RState {
+	res := p.Structs.StartRState().(*aggregateRState)
+	res.Workers = p.Workers
+	return res
+}
+
+// SerializerType returns the unique ID used to serialize
+// ParallelAggregates with the serializer package.
+func (p *ParallelAggregate) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.ParallelAggregate"
+}
+
+// Serialize encodes the worker count and the structures,
+// given that all of the structures are serializers.
+func (p *ParallelAggregate) Serialize() ([]byte, error) {
+	workersData, err := json.Marshal(p.Workers)
+	if err != nil {
+		return nil, err
+	}
+	return serializer.SerializeSlice([]serializer.Serializer{
+		serializer.Bytes(workersData),
+		p.Structs,
+	})
+}
+
+// SuggestedActivation is like
+// RAggregate.SuggestedActivation().
+func (p *ParallelAggregate) SuggestedActivation() neuralnet.Layer {
+	return p.Structs.SuggestedActivation()
+}
+
+// MixStates is like Aggregate.MixStates().
+func (p *ParallelAggregate) MixStates(states []State, weights linalg.Vector) State {
+	return p.Structs.MixStates(states, weights)
+}
+
+// MixGradient is like Aggregate.MixGradient().
+func (p *ParallelAggregate) MixGradient(states []State, weights, dataGrad linalg.Vector,
+	upstream Grad) (linalg.Vector, []Grad) {
+	return p.Structs.MixGradient(states, weights, dataGrad, upstream)
+}
+
+// AddGrads is like Aggregate.AddGrads().
+func (p *ParallelAggregate) AddGrads(g1, g2 Grad) Grad {
+	return p.Structs.AddGrads(g1, g2)
+}
+
+// MixRStates is like RAggregate.MixRStates().
+func (p *ParallelAggregate) MixRStates(states []RState, weights,
+	weightsR linalg.Vector) RState {
+	return p.Structs.MixRStates(states, weights, weightsR)
+}
+
+// MixRGradient is like RAggregate.MixRGradient().
+func (p *ParallelAggregate) MixRGradient(states []RState, weights, weightsR, dataGrad,
+	dataGradR linalg.Vector, upstream RGrad) (linalg.Vector, linalg.Vector, []RGrad) {
+	return p.Structs.MixRGradient(states, weights, weightsR, dataGrad, dataGradR, upstream)
+}
+
+// AddRGrads is like RAggregate.AddRGrads().
+func (p *ParallelAggregate) AddRGrads(g1, g2 RGrad) RGrad {
+	return p.Structs.AddRGrads(g1, g2)
+}
+
+// NextStates is like Aggregate.NextStates().
+func (p *ParallelAggregate) NextStates(states []State, controls []linalg.Vector) []State {
+	return p.Structs.NextStates(states, controls)
+}
+
+// StateGradients is like Aggregate.StateGradients(), but
+// the sub-structures are handled concurrently.
+func (p *ParallelAggregate) StateGradients(states []State, dataGrads []linalg.Vector,
+	upstream []Grad) ([]linalg.Vector, []Grad) {
+	return p.Structs.StateGradients(states, dataGrads, upstream)
+}
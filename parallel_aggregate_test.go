@@ -0,0 +1,84 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+func TestParallelAggregateDerivatives(t *testing.T) {
+	testAllDerivatives(t, &ParallelAggregate{
+		Structs: RAggregate{&Stack{VectorSize: 3}, &Queue{VectorSize: 2},
+			&Stack{VectorSize: 2, NoReplace: true}},
+		Workers: 2,
+	})
+}
+
+func TestParallelAggregateDeterministic(t *testing.T) {
+	structs := RAggregate{&Stack{VectorSize: 3}, &Queue{VectorSize: 2},
+		&RingBuffer{VectorSize: 2, Capacity: 3}}
+	parallel := &ParallelAggregate{Structs: structs, Workers: 3}
+
+	const steps = 5
+	var controls, dataGrads []linalg.Vector
+	for i := 0; i < steps; i++ {
+		controls = append(controls, testRandVec(structs.ControlSize()))
+		dataGrads = append(dataGrads, testRandVec(structs.DataSize()))
+	}
+
+	gradients := func(s Struct) []linalg.Vector {
+		var states []State
+		state := s.StartState()
+		for _, ctrl := range controls {
+			state = state.NextState(ctrl)
+			states = append(states, state)
+		}
+		var res []linalg.Vector
+		var upstream Grad
+		for i := len(states) - 1; i >= 0; i-- {
+			var ctrlGrad linalg.Vector
+			ctrlGrad, upstream = states[i].Gradient(dataGrads[i], upstream)
+			res = append(res, ctrlGrad)
+		}
+		return res
+	}
+
+	expected := gradients(structs)
+	for trial := 0; trial < 10; trial++ {
+		actual := gradients(parallel)
+		for i, x := range expected {
+			for j, y := range x {
+				if actual[i][j] != y {
+					t.Fatalf("trial %d: gradient %d differs at %d: expected %f but got %f",
+						trial, i, j, y, actual[i][j])
+				}
+			}
+		}
+	}
+}
+
+func TestParallelAggregateSerialize(t *testing.T) {
+	p := &ParallelAggregate{
+		Structs: RAggregate{&Stack{VectorSize: 3}, &Queue{VectorSize: 2}},
+		Workers: 4,
+	}
+	data, err := serializer.SerializeWithType(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAgg, ok := decoded.(*ParallelAggregate)
+	if !ok {
+		t.Fatalf("type shouldn't be %T", decoded)
+	}
+	if newAgg.Workers != p.Workers {
+		t.Errorf("expected %d workers but got %d", p.Workers, newAgg.Workers)
+	}
+	if len(newAgg.Structs) != len(p.Structs) {
+		t.Errorf("expected %d structs but got %d", len(p.Structs), len(newAgg.Structs))
+	}
+}
@@ -2,8 +2,8 @@ package neuralstruct
 
 import (
 	"encoding/json"
+	"math"
 
-	"github.com/unixpickle/autofunc"
 	"github.com/unixpickle/num-analysis/linalg"
 	"github.com/unixpickle/serializer"
 	"github.com/unixpickle/weakai/neuralnet"
@@ -32,7 +32,27 @@ type Queue struct {
 	// from the SuggestedActivation() method.
 	// Reasonable values are -1, 0, or 1, for pushing being
 	// e times less likely, unbiased, or e times more likely.
+	// The bias is scaled by the flag temperature, so these
+	// odds hold at the temperature the activation was
+	// created with.
 	PushBias float64
+
+	// Checkpoint is like Stack.Checkpoint.
+	Checkpoint int
+
+	// Float32 is like Stack.Float32.
+	// Only the queue entries are stored as float32 values;
+	// the size probabilities are kept as float64 values.
+	Float32 bool
+
+	// LogSpace, if true, makes the queue keep its size
+	// probabilities in log space.
+	// Otherwise, the size probabilities may underflow to
+	// zero on very long sequences, killing gradients.
+	LogSpace bool
+
+	// FlagNorm is like Stack.FlagNorm.
+	FlagNorm FlagNorm
 }
 
 // DeserializeQueue deserializes a Queue.
@@ -59,8 +79,22 @@ func (q *Queue) DataSize() int {
 // StartState returns a state representing an empty queue.
 func (q *Queue) StartState() State {
 	return &queueState{
-		SizeProbs:  []float64{1},
+		SizeProbs:  q.startSizeProbs(),
 		OutputData: make(linalg.Vector, q.VectorSize),
+		Checkpoint: q.Checkpoint,
+		Float32:    q.Float32,
+		LogSpace:   q.LogSpace,
+		FlagNorm:   q.FlagNorm,
+	}
+}
+
+// StartInferenceState returns a forward-only state
+// representing an empty queue.
+func (q *Queue) StartInferenceState() State {
+	return &queueInferenceState{
+		Queue:     *q,
+		SizeProbs: q.startSizeProbs(),
+		Flags:     make(linalg.Vector, queueFlagCount),
 	}
 }
 
@@ -68,11 +102,22 @@ func (q *Queue) StartState() State {
 func (q *Queue) StartRState() RState {
 	zeroVec := make(linalg.Vector, q.VectorSize)
 	return &queueRState{
-		SizeProbs:   []float64{1},
+		SizeProbs:   q.startSizeProbs(),
 		RSizeProbs:  []float64{0},
 		OutputData:  zeroVec,
 		ROutputData: zeroVec,
+		LogSpace:    q.LogSpace,
+		FlagNorm:    q.FlagNorm,
+	}
+}
+
+// startSizeProbs returns the size probabilities of an
+// empty queue.
+func (q *Queue) startSizeProbs() linalg.Vector {
+	if q.LogSpace {
+		return linalg.Vector{0}
 	}
+	return linalg.Vector{1}
 }
 
 // SerializerType returns the unique ID used to serialize
@@ -98,19 +143,563 @@ func (q *Queue) SuggestedActivation() neuralnet.Layer {
 		res.Ranges = append([]ComponentRange{{Start: QueuePush, End: QueuePush + 1}},
 			res.Ranges...)
 		res.Activations = append([]neuralnet.Layer{
-			&neuralnet.RescaleLayer{Scale: 1, Bias: q.PushBias},
+			&neuralnet.RescaleLayer{Scale: 1, Bias: q.PushBias * q.FlagNorm.temperature()},
 		}, res.Activations...)
 	}
 	return res
 }
 
+// FlagNames returns the names of the control flags.
+func (q *Queue) FlagNames() []string {
+	return []string{"nop", "push", "pop"}
+}
+
+// MixStates computes a weighted sum of queue states.
+// Queues with fewer entries are padded with zeroes.
+func (q *Queue) MixStates(states []State, weights linalg.Vector) State {
+	var size int
+	for _, state := range states {
+		if l := len(state.(*queueState).SizeProbs); l > size {
+			size = l
+		}
+	}
+	res := &queueState{
+		Expected:   make(linalg.Vector, (size-1)*q.VectorSize),
+		SizeProbs:  make([]float64, size),
+		Checkpoint: q.Checkpoint,
+		Float32:    q.Float32,
+		LogSpace:   q.LogSpace,
+		FlagNorm:   q.FlagNorm,
+	}
+	for i, stateObj := range states {
+		state := stateObj.(*queueState)
+		addScaled(res.Expected, state.expected(), weights[i])
+		if !q.LogSpace {
+			addScaled(res.SizeProbs, state.SizeProbs, weights[i])
+		}
+	}
+	if q.LogSpace {
+		res.SizeProbs = q.mixLogSizeProbs(states, weights, size)
+	}
+	if len(res.Expected) == 0 {
+		res.OutputData = make(linalg.Vector, q.VectorSize)
+	} else {
+		res.OutputData = res.Expected[:q.VectorSize]
+	}
+	res.store()
+	return res
+}
+
+// MixGradient propagates a gradient through MixStates.
+func (q *Queue) MixGradient(states []State, weights, dataGrad linalg.Vector,
+	upstream Grad) (linalg.Vector, []Grad) {
+	var up *queueUpstream
+	if upstream != nil {
+		up = upstream.(*queueUpstream)
+		up.Expected[:len(dataGrad)].Add(dataGrad)
+	} else {
+		var size int
+		for _, state := range states {
+			if l := len(state.(*queueState).SizeProbs); l > size {
+				size = l
+			}
+		}
+		up = &queueUpstream{
+			Expected:  make(linalg.Vector, (size-1)*q.VectorSize),
+			SizeProbs: make(linalg.Vector, size),
+		}
+		copy(up.Expected, dataGrad)
+	}
+
+	var mixed linalg.Vector
+	if q.LogSpace {
+		mixed = q.mixLogSizeProbs(states, weights, len(up.SizeProbs))
+	}
+
+	weightsGrad := make(linalg.Vector, len(states))
+	grads := make([]Grad, len(states))
+	for i, stateObj := range states {
+		state := stateObj.(*queueState)
+		expected := state.expected()
+		expectedUp := up.Expected[:len(expected)]
+		sizeUp := up.SizeProbs[:len(state.SizeProbs)]
+		weightsGrad[i] = expected.Dot(expectedUp)
+		grad := &queueUpstream{Expected: expectedUp.Copy().Scale(weights[i])}
+		if q.LogSpace {
+			grad.SizeProbs = make(linalg.Vector, len(sizeUp))
+			for j, x := range state.SizeProbs {
+				if math.IsInf(mixed[j], -1) {
+					continue
+				}
+				g := math.Exp(x-mixed[j]) * sizeUp[j]
+				weightsGrad[i] += g
+				grad.SizeProbs[j] = g * weights[i]
+			}
+		} else {
+			weightsGrad[i] += state.SizeProbs.Dot(sizeUp)
+			grad.SizeProbs = sizeUp.Copy().Scale(weights[i])
+		}
+		grads[i] = grad
+	}
+	return weightsGrad, grads
+}
+
+// mixLogSizeProbs computes the log of the weighted sum
+// of the size probabilities of log-space queue states.
+// The weights must not be negative.
+func (q *Queue) mixLogSizeProbs(states []State, weights linalg.Vector,
+	size int) linalg.Vector {
+	res := make(linalg.Vector, size)
+	for j := range res {
+		max := math.Inf(-1)
+		for _, state := range states {
+			if probs := state.(*queueState).SizeProbs; j < len(probs) {
+				max = math.Max(max, probs[j])
+			}
+		}
+		if math.IsInf(max, -1) {
+			res[j] = max
+			continue
+		}
+		var sum float64
+		for i, state := range states {
+			if probs := state.(*queueState).SizeProbs; j < len(probs) {
+				sum += weights[i] * math.Exp(probs[j]-max)
+			}
+		}
+		res[j] = max + math.Log(sum)
+	}
+	return res
+}
+
+// MixRStates is like MixStates, but for RStates.
+func (q *Queue) MixRStates(states []RState, weights, weightsR linalg.Vector) RState {
+	var size int
+	for _, state := range states {
+		if l := len(state.(*queueRState).SizeProbs); l > size {
+			size = l
+		}
+	}
+	res := &queueRState{
+		Expected:   make(linalg.Vector, (size-1)*q.VectorSize),
+		RExpected:  make(linalg.Vector, (size-1)*q.VectorSize),
+		SizeProbs:  make(linalg.Vector, size),
+		RSizeProbs: make(linalg.Vector, size),
+		LogSpace:   q.LogSpace,
+		FlagNorm:   q.FlagNorm,
+	}
+	for i, stateObj := range states {
+		state := stateObj.(*queueRState)
+		n := len(state.Expected)
+		addScaled(res.Expected[:n], state.Expected, weights[i])
+		addScaled(res.RExpected[:n], state.RExpected, weights[i])
+		addScaled(res.RExpected[:n], state.Expected, weightsR[i])
+		if !q.LogSpace {
+			n = len(state.SizeProbs)
+			addScaled(res.SizeProbs[:n], state.SizeProbs, weights[i])
+			addScaled(res.RSizeProbs[:n], state.RSizeProbs, weights[i])
+			addScaled(res.RSizeProbs[:n], state.SizeProbs, weightsR[i])
+		}
+	}
+	if q.LogSpace {
+		res.SizeProbs, res.RSizeProbs = q.mixLogSizeProbsR(states, weights, weightsR, size)
+	}
+	if len(res.Expected) == 0 {
+		res.OutputData = make(linalg.Vector, q.VectorSize)
+		res.ROutputData = make(linalg.Vector, q.VectorSize)
+	} else {
+		res.OutputData = res.Expected[:q.VectorSize]
+		res.ROutputData = res.RExpected[:q.VectorSize]
+	}
+	return res
+}
+
+// MixRGradient propagates a gradient through MixRStates.
+func (q *Queue) MixRGradient(states []RState, weights, weightsR, dataGrad,
+	dataGradR linalg.Vector, upstream RGrad) (linalg.Vector, linalg.Vector, []RGrad) {
+	var size int
+	for _, state := range states {
+		if l := len(state.(*queueRState).SizeProbs); l > size {
+			size = l
+		}
+	}
+	var up *queueRUpstream
+	if upstream != nil {
+		up = upstream.(*queueRUpstream)
+	} else {
+		up = &queueRUpstream{
+			Expected:   make(linalg.Vector, (size-1)*q.VectorSize),
+			RExpected:  make(linalg.Vector, (size-1)*q.VectorSize),
+			SizeProbs:  make(linalg.Vector, size),
+			RSizeProbs: make(linalg.Vector, size),
+		}
+	}
+	if len(up.Expected) > 0 {
+		up.Expected[:len(dataGrad)].Add(dataGrad)
+		up.RExpected[:len(dataGradR)].Add(dataGradR)
+	}
+
+	var mixed, mixedR linalg.Vector
+	if q.LogSpace {
+		mixed, mixedR = q.mixLogSizeProbsR(states, weights, weightsR, size)
+	}
+
+	weightsGrad := make(linalg.Vector, len(states))
+	weightsGradR := make(linalg.Vector, len(states))
+	grads := make([]RGrad, len(states))
+	for i, stateObj := range states {
+		state := stateObj.(*queueRState)
+		n := len(state.Expected)
+		expectedUp, expectedUpR := up.Expected[:n], up.RExpected[:n]
+		weightsGrad[i] = state.Expected.Dot(expectedUp)
+		weightsGradR[i] = state.RExpected.Dot(expectedUp) + state.Expected.Dot(expectedUpR)
+		grad := &queueRUpstream{
+			Expected:   expectedUp.Copy().Scale(weights[i]),
+			RExpected:  expectedUpR.Copy().Scale(weights[i]),
+			SizeProbs:  make(linalg.Vector, len(state.SizeProbs)),
+			RSizeProbs: make(linalg.Vector, len(state.SizeProbs)),
+		}
+		addScaled(grad.RExpected, expectedUp, weightsR[i])
+		for j, x := range state.SizeProbs {
+			xR := state.RSizeProbs[j]
+			sizeUp, sizeUpR := up.SizeProbs[j], up.RSizeProbs[j]
+			if q.LogSpace {
+				if math.IsInf(mixed[j], -1) {
+					continue
+				}
+				// The mixed log probability depends on
+				// weights[i]*exp(x-mixed[j]).
+				ratio := math.Exp(x - mixed[j])
+				ratioR := ratio * (xR - mixedR[j])
+				weightsGrad[i] += ratio * sizeUp
+				weightsGradR[i] += ratioR*sizeUp + ratio*sizeUpR
+				grad.SizeProbs[j] = weights[i] * ratio * sizeUp
+				grad.RSizeProbs[j] = weightsR[i]*ratio*sizeUp + weights[i]*ratioR*sizeUp +
+					weights[i]*ratio*sizeUpR
+			} else {
+				weightsGrad[i] += x * sizeUp
+				weightsGradR[i] += xR*sizeUp + x*sizeUpR
+				grad.SizeProbs[j] = weights[i] * sizeUp
+				grad.RSizeProbs[j] = weightsR[i]*sizeUp + weights[i]*sizeUpR
+			}
+		}
+		grads[i] = grad
+	}
+	return weightsGrad, weightsGradR, grads
+}
+
+// mixLogSizeProbsR is like mixLogSizeProbs, but for
+// RStates.
+// It also computes the r-operator of the result.
+func (q *Queue) mixLogSizeProbsR(states []RState, weights, weightsR linalg.Vector,
+	size int) (res, resR linalg.Vector) {
+	res = make(linalg.Vector, size)
+	resR = make(linalg.Vector, size)
+	for j := range res {
+		max := math.Inf(-1)
+		for _, state := range states {
+			if probs := state.(*queueRState).SizeProbs; j < len(probs) {
+				max = math.Max(max, probs[j])
+			}
+		}
+		if math.IsInf(max, -1) {
+			res[j] = max
+			continue
+		}
+		var sum, sumR float64
+		for i, stateObj := range states {
+			state := stateObj.(*queueRState)
+			if j < len(state.SizeProbs) {
+				scaled := math.Exp(state.SizeProbs[j] - max)
+				sum += weights[i] * scaled
+				sumR += (weightsR[i] + weights[i]*state.RSizeProbs[j]) * scaled
+			}
+		}
+		res[j] = max + math.Log(sum)
+		resR[j] = sumR / sum
+	}
+	return
+}
+
+// AddRGrads adds two upstream r-gradients for a queue
+// state.
+func (q *Queue) AddRGrads(g1, g2 RGrad) RGrad {
+	if g1 == nil {
+		return g2
+	} else if g2 == nil {
+		return g1
+	}
+	u1, u2 := g1.(*queueRUpstream), g2.(*queueRUpstream)
+	u1.Expected.Add(u2.Expected)
+	u1.RExpected.Add(u2.RExpected)
+	u1.SizeProbs.Add(u2.SizeProbs)
+	u1.RSizeProbs.Add(u2.RSizeProbs)
+	return u1
+}
+
+// AddGrads adds two upstream gradients for a queue state.
+func (q *Queue) AddGrads(g1, g2 Grad) Grad {
+	if g1 == nil {
+		return g2
+	} else if g2 == nil {
+		return g1
+	}
+	u1, u2 := g1.(*queueUpstream), g2.(*queueUpstream)
+	u1.Expected.Add(u2.Expected)
+	u1.SizeProbs.Add(u2.SizeProbs)
+	return u1
+}
+
+// NextStates advances a batch of queue states.
+//
+// States with the same depth are advanced together, with
+// their contents stored as the rows of one matrix.
+func (q *Queue) NextStates(states []State, controls []linalg.Vector) []State {
+	res := make([]State, len(states))
+	groups := batchGroups(len(states), func(i int) int {
+		return len(states[i].(*queueState).SizeProbs)
+	})
+	for _, group := range groups {
+		groupStates := make([]*queueState, len(group))
+		groupControls := make([]linalg.Vector, len(group))
+		for i, idx := range group {
+			groupStates[i] = states[idx].(*queueState)
+			groupControls[i] = controls[idx]
+		}
+		next := q.nextStateRows(groupStates, groupControls)
+		for i, idx := range group {
+			res[idx] = next[i]
+		}
+	}
+	for _, state := range states {
+		state.(*queueState).discard()
+	}
+	return res
+}
+
+// nextStateRows advances a batch of queue states which
+// all have the same depth.
+func (q *Queue) nextStateRows(states []*queueState, controls []linalg.Vector) []State {
+	noises := q.FlagNorm.batchNoise(len(states), queueFlagCount)
+	flags := q.FlagNorm.batchApply(controls, noises, queueFlagCount)
+	ctrl := joinRows(controls, q.ControlSize())
+
+	lastExpected := make([]linalg.Vector, len(states))
+	lastProbs := make([]linalg.Vector, len(states))
+	for i, state := range states {
+		lastExpected[i] = state.expected()
+		lastProbs[i] = state.sizeProbs()
+	}
+	last := joinRows(lastExpected, states[0].expectedLen())
+	probs := joinRows(lastProbs, len(states[0].SizeProbs))
+
+	nextExpected := newRowMatrix(len(states), last.Cols+q.VectorSize)
+	nextProbs := newRowMatrix(len(states), probs.Cols+1)
+	q.addNextExpectedRows(nextExpected, last, probs, flags,
+		ctrl.Columns(queueFlagCount, ctrl.Cols))
+
+	newStates := make([]queueState, len(states))
+	res := make([]State, len(states))
+	for i, state := range states {
+		var noise linalg.Vector
+		if noises != nil {
+			noise = noises[i]
+		}
+		newState := &newStates[i]
+		newState.Expected = nextExpected.Row(i)
+		newState.SizeProbs = nextProbs.Row(i)
+		state.addNextSizeProbs(newState.SizeProbs, flags.Row(i), controls[i], noise)
+		state.finishNext(newState, controls[i], noise)
+		res[i] = newState
+	}
+	return res
+}
+
+// StateGradients propagates gradients through a batch of
+// queue states.
+//
+// Like NextStates, this handles states of the same depth
+// together as the rows of one matrix.
+func (q *Queue) StateGradients(states []State, dataGrads []linalg.Vector,
+	upstream []Grad) ([]linalg.Vector, []Grad) {
+	for _, state := range states {
+		if state.(*queueState).Last == nil {
+			panic("cannot propagate through start state")
+		}
+	}
+	ctrlGrads := make([]linalg.Vector, len(states))
+	downGrads := make([]Grad, len(states))
+	groups := batchGroups(len(states), func(i int) int {
+		return len(states[i].(*queueState).SizeProbs)
+	})
+	for _, group := range groups {
+		groupStates := make([]*queueState, len(group))
+		groupUpstream := make([]*queueUpstream, len(group))
+		for i, idx := range group {
+			groupStates[i] = states[idx].(*queueState)
+			var up *queueUpstream
+			if upstream != nil && upstream[idx] != nil {
+				up = upstream[idx].(*queueUpstream)
+			}
+			groupUpstream[i] = groupStates[i].upstream(dataGrads[idx], up)
+		}
+		ctrl, down := q.stateGradientRows(groupStates, groupUpstream)
+		for i, idx := range group {
+			ctrlGrads[idx] = ctrl.Row(i)
+			downGrads[idx] = down[i]
+		}
+	}
+	return ctrlGrads, downGrads
+}
+
+// stateGradientRows propagates gradients through a batch
+// of queue states which all have the same depth.
+func (q *Queue) stateGradientRows(states []*queueState,
+	upstream []*queueUpstream) (rowMatrix, []*queueUpstream) {
+	controls := make([]linalg.Vector, len(states))
+	noises := make([]linalg.Vector, len(states))
+	lastExpected := make([]linalg.Vector, len(states))
+	lastProbs := make([]linalg.Vector, len(states))
+	upExpected := make([]linalg.Vector, len(states))
+	for i, state := range states {
+		controls[i] = state.ControlIn
+		noises[i] = state.Noise
+		lastExpected[i] = state.Last.expected()
+		lastProbs[i] = state.Last.sizeProbs()
+		upExpected[i] = upstream[i].Expected
+	}
+	flags := q.FlagNorm.batchApply(controls, noises, queueFlagCount)
+	ctrl := joinRows(controls, q.ControlSize())
+	last := joinRows(lastExpected, states[0].Last.expectedLen())
+	probs := joinRows(lastProbs, len(states[0].Last.SizeProbs))
+	up := joinRows(upExpected, last.Cols+q.VectorSize)
+
+	flagsGrad := newRowMatrix(len(states), queueFlagCount)
+	logFlagsGrad := newRowMatrix(len(states), queueFlagCount)
+	ctrlGrad := newRowMatrix(len(states), q.ControlSize())
+	downExpected := newRowMatrix(len(states), last.Cols)
+	downProbs := newRowMatrix(len(states), probs.Cols)
+	q.addExpectedGradientRows(flagsGrad, ctrlGrad.Columns(queueFlagCount, ctrlGrad.Cols),
+		downExpected, downProbs, last, probs, flags, ctrl.Columns(queueFlagCount, ctrl.Cols),
+		up)
+
+	down := make([]queueUpstream, len(states))
+	downPtrs := make([]*queueUpstream, len(states))
+	for i, state := range states {
+		down[i] = queueUpstream{Expected: downExpected.Row(i), SizeProbs: downProbs.Row(i)}
+		downPtrs[i] = &down[i]
+		state.addSizeProbsGradient(flags.Row(i), upstream[i].SizeProbs, down[i].SizeProbs,
+			flagsGrad.Row(i), logFlagsGrad.Row(i))
+		flagIn := state.ControlIn[:queueFlagCount]
+		ctrlRow := ctrlGrad.Row(i)
+		q.FlagNorm.addGradient(ctrlRow[:queueFlagCount], flagIn, state.Noise,
+			flagsGrad.Row(i))
+		if q.LogSpace {
+			q.FlagNorm.addLogGradient(ctrlRow[:queueFlagCount], flagIn, state.Noise,
+				logFlagsGrad.Row(i))
+		}
+	}
+	return ctrlGrad, downPtrs
+}
+
+// addNextExpectedRows computes the expected entries for
+// a batch of queues, given their previous entries, their
+// (non-log) size probabilities, their flags, and the data
+// they may push.
+// Every argument is a matrix with one row per queue, and
+// the results are added to res.
+func (q *Queue) addNextExpectedRows(res, last, sizeProbs, flags, pushData rowMatrix) {
+	size := q.VectorSize
+	n := last.Cols
+	push := flags.Column(QueuePush)
+	keep := flags.Column(QueueNop).Add(push)
+	addScaledRows(res.Columns(0, n), last, keep)
+	if n > size {
+		addScaledRows(res.Columns(0, n-size), last.Columns(size, n), flags.Column(QueuePop))
+	}
+	scales := make(linalg.Vector, len(push))
+	for i := 0; i < sizeProbs.Cols; i++ {
+		for j, p := range push {
+			scales[j] = p * sizeProbs.Data[j*sizeProbs.Stride+i]
+		}
+		addScaledRows(res.Columns(i*size, (i+1)*size), pushData, scales)
+	}
+}
+
+// addExpectedGradientRows back-propagates through
+// addNextExpectedRows.
+// The gradients are added to flagsGrad, pushDataGrad,
+// downstream, and sizeProbsGrad.
+// In log space, sizeProbsGrad is the gradient of the log
+// size probabilities.
+func (q *Queue) addExpectedGradientRows(flagsGrad, pushDataGrad, downstream, sizeProbsGrad,
+	last, sizeProbs, flags, pushData, upstream rowMatrix) {
+	size := q.VectorSize
+	n := last.Cols
+	push := flags.Column(QueuePush)
+	keep := flags.Column(QueueNop).Add(push)
+
+	addScaledRows(downstream, upstream.Columns(0, n), keep)
+	keepDot := rowDots(last, upstream.Columns(0, n))
+	flagsGrad.AddColumn(QueueNop, keepDot)
+	flagsGrad.AddColumn(QueuePush, keepDot)
+	if n > size {
+		popUpstream := upstream.Columns(0, n-size)
+		addScaledRows(downstream.Columns(size, n), popUpstream, flags.Column(QueuePop))
+		flagsGrad.AddColumn(QueuePop, rowDots(last.Columns(size, n), popUpstream))
+	}
+
+	scales := make(linalg.Vector, len(push))
+	for i := 0; i < sizeProbs.Cols; i++ {
+		entryUpstream := upstream.Columns(i*size, (i+1)*size)
+		for j, p := range push {
+			scales[j] = p * sizeProbs.Data[j*sizeProbs.Stride+i]
+		}
+		addScaledRows(pushDataGrad, entryUpstream, scales)
+		for j, dot := range rowDots(entryUpstream, pushData) {
+			prob := sizeProbs.Data[j*sizeProbs.Stride+i]
+			flagsGrad.Data[j*flagsGrad.Stride+QueuePush] += prob * dot
+			probGrad := push[j] * dot
+			if q.LogSpace {
+				probGrad *= prob
+			}
+			sizeProbsGrad.Data[j*sizeProbsGrad.Stride+i] += probGrad
+		}
+	}
+}
+
 type queueState struct {
-	Expected   []linalg.Vector
-	SizeProbs  []float64
+	// Expected stores the expected queue entries back to
+	// back, starting with the front of the queue.
+	// It is nil if the entries were discarded due to
+	// checkpointing, or if they are stored in Expected32.
+	Expected linalg.Vector
+
+	// SizeProbs stores the probability of each queue size,
+	// or its logarithm if LogSpace is set.
+	SizeProbs  linalg.Vector
 	OutputData linalg.Vector
 
+	// Expected32 replaces Expected if Float32 is set.
+	Expected32 []float32
+
 	ControlIn linalg.Vector
 	Last      *queueState
+
+	// Noise is the noise which the FlagNorm used to
+	// compute the flags from ControlIn, if any.
+	Noise linalg.Vector
+
+	// Checkpoint, Float32, LogSpace, and FlagNorm are the
+	// Queue's fields.
+	Checkpoint int
+	Float32    bool
+	LogSpace   bool
+	FlagNorm   FlagNorm
+
+	// Depth is the number of steps since the last state
+	// with no Last state.
+	Depth int
 }
 
 func (q *queueState) Data() linalg.Vector {
@@ -121,137 +710,378 @@ func (q *queueState) Gradient(dataGrad linalg.Vector, upstreamGrad Grad) (linalg
 	if q.Last == nil {
 		panic("cannot propagate through start state")
 	}
-	softmax := autofunc.Softmax{}
-	flagsVar := &autofunc.Variable{Vector: q.ControlIn[:queueFlagCount]}
-	flagRes := softmax.Apply(flagsVar)
-	flags := flagRes.Output()
-
-	flagsGrad := make(linalg.Vector, queueFlagCount)
+	flagIn := q.ControlIn[:queueFlagCount]
+	flags := q.FlagNorm.apply(flagIn, q.Noise)
 
 	var upstream *queueUpstream
 	if upstreamGrad != nil {
 		upstream = upstreamGrad.(*queueUpstream)
-		upstream.Expected[0].Add(dataGrad)
-	} else {
-		upstream = new(queueUpstream)
-		upstream.SizeProbs = make([]float64, len(q.SizeProbs))
-		upstream.Expected = make([]linalg.Vector, len(q.Expected))
-		upstream.Expected[0] = dataGrad
-		zeroVec := make(linalg.Vector, len(dataGrad))
-		for i := 1; i < len(upstream.Expected); i++ {
-			upstream.Expected[i] = zeroVec
-		}
 	}
+	upstream = q.upstream(dataGrad, upstream)
 
 	downstream := &queueUpstream{
-		Expected:  make([]linalg.Vector, len(q.Last.Expected)),
-		SizeProbs: make([]float64, len(q.Last.SizeProbs)),
-	}
-	for i, vec := range q.Last.Expected {
-		downstream.Expected[i] = upstream.Expected[i].Copy().Scale(flags[QueueNop] +
-			flags[QueuePush])
-		flagsGrad[QueueNop] += vec.Dot(upstream.Expected[i])
-		flagsGrad[QueuePush] += vec.Dot(upstream.Expected[i])
-		if i > 0 {
-			downstream.Expected[i].Add(upstream.Expected[i-1].Copy().Scale(flags[QueuePop]))
-			flagsGrad[QueuePop] += vec.Dot(upstream.Expected[i-1])
-		}
+		Expected:  make(linalg.Vector, q.Last.expectedLen()),
+		SizeProbs: make(linalg.Vector, len(q.Last.SizeProbs)),
+	}
+	flagsGrad := make(linalg.Vector, queueFlagCount)
+	logFlagsGrad := make(linalg.Vector, queueFlagCount)
+	ctrlGrad := make(linalg.Vector, len(q.ControlIn))
+	q.addGradient(flags, upstream, downstream, flagsGrad, logFlagsGrad,
+		ctrlGrad[queueFlagCount:])
+
+	q.FlagNorm.addGradient(ctrlGrad[:queueFlagCount], flagIn, q.Noise, flagsGrad)
+	if q.LogSpace {
+		q.FlagNorm.addLogGradient(ctrlGrad[:queueFlagCount], flagIn, q.Noise, logFlagsGrad)
 	}
 
-	pushDataGrad := make(linalg.Vector, len(q.Data()))
+	return ctrlGrad, downstream
+}
 
-	for i, prob := range q.Last.SizeProbs {
-		pushData := q.ControlIn[queueFlagCount:]
-		pushDataGrad.Add(upstream.Expected[i].Copy().Scale(flags[QueuePush] * prob))
-		upstreamDot := upstream.Expected[i].Dot(pushData)
-		flagsGrad[QueuePush] += prob * upstreamDot
-		downstream.SizeProbs[i] += flags[QueuePush] * upstreamDot
+func (q *queueState) NextState(ctrl linalg.Vector) State {
+	noise := q.FlagNorm.noise(queueFlagCount)
+	flags := q.FlagNorm.apply(ctrl[:queueFlagCount], noise)
+
+	res := &queueState{
+		Expected:  make(linalg.Vector, q.expectedLen()+len(ctrl)-queueFlagCount),
+		SizeProbs: make(linalg.Vector, len(q.SizeProbs)+1),
 	}
+	q.addNext(res, flags, ctrl, noise)
+	q.discard()
+	return res
+}
 
-	for i, old := range q.Last.SizeProbs {
-		downstream.SizeProbs[i] += flags[QueueNop] * upstream.SizeProbs[i]
-		flagsGrad[QueueNop] += old * upstream.SizeProbs[i]
-		if i > 0 {
-			downstream.SizeProbs[i] += flags[QueuePop] * upstream.SizeProbs[i-1]
-			flagsGrad[QueuePop] += old * upstream.SizeProbs[i-1]
-		} else {
-			downstream.SizeProbs[i] += flags[QueuePop] * upstream.SizeProbs[i]
-			flagsGrad[QueuePop] += old * upstream.SizeProbs[i]
+// addNext computes the state after q, given the flag
+// probabilities, the control vector, and the FlagNorm's
+// noise.
+// The expected entries and size probabilities are added
+// to the pre-allocated buffers in res.
+func (q *queueState) addNext(res *queueState, flags, ctrl, noise linalg.Vector) {
+	pushData := ctrl[queueFlagCount:]
+	size := len(pushData)
+
+	q.addNextSizeProbs(res.SizeProbs, flags, ctrl, noise)
+
+	expected := q.expected()
+	addScaled(res.Expected, expected, flags[QueueNop]+flags[QueuePush])
+	if len(expected) > size {
+		addScaled(res.Expected, expected[size:], flags[QueuePop])
+	}
+
+	for i, prob := range q.sizeProbs() {
+		addScaled(res.Expected[i*size:(i+1)*size], pushData, flags[QueuePush]*prob)
+	}
+
+	q.finishNext(res, ctrl, noise)
+}
+
+// addNextSizeProbs adds the size probabilities of the
+// state after q to res, or writes them in log space.
+func (q *queueState) addNextSizeProbs(res, flags, ctrl, noise linalg.Vector) {
+	if q.LogSpace {
+		nextLogSizeProbs(res, q.SizeProbs, q.FlagNorm.logFlags(ctrl[:queueFlagCount], noise))
+	} else {
+		addNextSizeProbs(res, q.SizeProbs, flags)
+	}
+}
+
+// finishNext fills in the remaining fields of res, the
+// state after q, once its expected entries and size
+// probabilities have been computed.
+func (q *queueState) finishNext(res *queueState, ctrl, noise linalg.Vector) {
+	res.OutputData = res.Expected[:len(ctrl)-queueFlagCount]
+	res.ControlIn = ctrl
+	res.Noise = noise
+	res.Last = q
+	res.Checkpoint = q.Checkpoint
+	res.Float32 = q.Float32
+	res.LogSpace = q.LogSpace
+	res.FlagNorm = q.FlagNorm
+	res.Depth = q.Depth + 1
+	res.store()
+}
+
+// Detach returns a queue state with the same contents
+// and no history.
+func (q *queueState) Detach() State {
+	res := &queueState{
+		Expected:   q.expected().Copy(),
+		SizeProbs:  q.SizeProbs.Copy(),
+		OutputData: q.OutputData.Copy(),
+		Checkpoint: q.Checkpoint,
+		Float32:    q.Float32,
+		LogSpace:   q.LogSpace,
+		FlagNorm:   q.FlagNorm,
+	}
+	res.store()
+	return res
+}
+
+// DetachR is like Detach, but for an RState.
+func (q *queueState) DetachR() RState {
+	expected := q.expected().Copy()
+	return &queueRState{
+		Expected:    expected,
+		RExpected:   make(linalg.Vector, len(expected)),
+		SizeProbs:   q.SizeProbs.Copy(),
+		RSizeProbs:  make(linalg.Vector, len(q.SizeProbs)),
+		OutputData:  q.OutputData.Copy(),
+		ROutputData: make(linalg.Vector, len(q.OutputData)),
+		LogSpace:    q.LogSpace,
+		FlagNorm:    q.FlagNorm,
+	}
+}
+
+// expectedLen returns the length of the expected queue
+// contents, even if they have been discarded.
+func (q *queueState) expectedLen() int {
+	return (len(q.SizeProbs) - 1) * len(q.OutputData)
+}
+
+// expected returns the expected queue contents,
+// recomputing them from the nearest checkpoint if they
+// have been discarded.
+// Recomputed contents are not stored in the state.
+func (q *queueState) expected() linalg.Vector {
+	if q.stored() || q.Last == nil {
+		return q.storedExpected()
+	}
+	var path []*queueState
+	state := q
+	for !state.stored() && state.Last != nil {
+		path = append(path, state)
+		state = state.Last
+	}
+	cur := &queueState{
+		Expected:  state.storedExpected(),
+		SizeProbs: state.SizeProbs,
+		Float32:   state.Float32,
+		LogSpace:  state.LogSpace,
+		FlagNorm:  state.FlagNorm,
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		ctrl, noise := path[i].ControlIn, path[i].Noise
+		flags := q.FlagNorm.apply(ctrl[:queueFlagCount], noise)
+		next := &queueState{
+			Expected:  make(linalg.Vector, len(cur.SizeProbs)*(len(ctrl)-queueFlagCount)),
+			SizeProbs: make(linalg.Vector, len(cur.SizeProbs)+1),
 		}
-		downstream.SizeProbs[i] += flags[QueuePush] * upstream.SizeProbs[i+1]
-		flagsGrad[QueuePush] += old * upstream.SizeProbs[i+1]
+		cur.addNext(next, flags, ctrl, noise)
+		cur = next
 	}
+	return cur.storedExpected()
+}
 
-	fg := autofunc.NewGradient([]*autofunc.Variable{flagsVar})
-	flagRes.PropagateGradient(flagsGrad, fg)
+// sizeProbs returns the size probabilities, taking them
+// out of log space if necessary.
+func (q *queueState) sizeProbs() linalg.Vector {
+	if !q.LogSpace {
+		return q.SizeProbs
+	}
+	res := make(linalg.Vector, len(q.SizeProbs))
+	for i, x := range q.SizeProbs {
+		res[i] = math.Exp(x)
+	}
+	return res
+}
 
-	ctrlGrad := make(linalg.Vector, queueFlagCount+len(pushDataGrad))
-	copy(ctrlGrad, fg[flagsVar])
-	copy(ctrlGrad[queueFlagCount:], pushDataGrad)
+// store converts the expected queue contents to float32
+// values if the state calls for it.
+func (q *queueState) store() {
+	if !q.Float32 || q.Expected == nil {
+		return
+	}
+	q.Expected32 = toFloat32(q.Expected)
+	q.Expected = nil
+	if len(q.Expected32) > 0 {
+		q.OutputData = fromFloat32(q.Expected32[:len(q.OutputData)])
+	}
+}
 
-	return ctrlGrad, downstream
+// stored returns whether the state stores its expected
+// queue contents.
+func (q *queueState) stored() bool {
+	return q.Expected != nil || q.Expected32 != nil
 }
 
-func (q *queueState) NextState(ctrl linalg.Vector) State {
-	probs := ctrl[:queueFlagCount]
-	softmax := autofunc.Softmax{}
-	flags := softmax.Apply(&autofunc.Variable{Vector: probs}).Output()
+// storedExpected returns the stored expected queue
+// contents as a linalg.Vector.
+func (q *queueState) storedExpected() linalg.Vector {
+	if q.Expected32 != nil {
+		return fromFloat32(q.Expected32)
+	}
+	return q.Expected
+}
 
-	var res queueState
+// discard discards the expected queue contents if the
+// state is not a checkpoint.
+func (q *queueState) discard() {
+	if q.Checkpoint < 2 || q.Last == nil || !q.stored() ||
+		q.Depth%q.Checkpoint == 0 {
+		return
+	}
+	q.OutputData = q.OutputData.Copy()
+	q.Expected = nil
+	q.Expected32 = nil
+}
 
-	res.Expected = make([]linalg.Vector, len(q.Expected)+1)
-	res.SizeProbs = make([]float64, len(q.SizeProbs)+1)
+// upstream creates an upstream gradient for the state by
+// adding a data gradient to an optional upstream gradient
+// from the next state.
+func (q *queueState) upstream(dataGrad linalg.Vector, upstream *queueUpstream) *queueUpstream {
+	if upstream != nil {
+		upstream.Expected[:len(dataGrad)].Add(dataGrad)
+		return upstream
+	}
+	upstream = &queueUpstream{
+		Expected:  make(linalg.Vector, q.expectedLen()),
+		SizeProbs: make(linalg.Vector, len(q.SizeProbs)),
+	}
+	copy(upstream.Expected, dataGrad)
+	return upstream
+}
 
-	for i, old := range q.SizeProbs {
-		res.SizeProbs[i] += old * flags[QueueNop]
-		if i > 0 {
-			res.SizeProbs[i-1] += old * flags[QueuePop]
+// addGradient back-propagates an upstream gradient
+// through the transition from q.Last to q.
+// The gradients are added to the pre-allocated downstream,
+// flagsGrad, logFlagsGrad, and pushDataGrad arguments.
+// Gradients with respect to the log of the flags are only
+// produced in log space.
+func (q *queueState) addGradient(flags linalg.Vector, upstream, downstream *queueUpstream,
+	flagsGrad, logFlagsGrad, pushDataGrad linalg.Vector) {
+	size := len(pushDataGrad)
+	last := q.Last.expected()
+
+	addScaled(downstream.Expected, upstream.Expected[:len(last)],
+		flags[QueueNop]+flags[QueuePush])
+	keepDot := last.Dot(upstream.Expected[:len(last)])
+	flagsGrad[QueueNop] += keepDot
+	flagsGrad[QueuePush] += keepDot
+	if len(last) > size {
+		popUpstream := upstream.Expected[:len(last)-size]
+		addScaled(downstream.Expected[size:], popUpstream, flags[QueuePop])
+		flagsGrad[QueuePop] += last[size:].Dot(popUpstream)
+	}
+
+	pushData := q.ControlIn[queueFlagCount:]
+	for i, prob := range q.Last.sizeProbs() {
+		entryUpstream := upstream.Expected[i*size : (i+1)*size]
+		addScaled(pushDataGrad, entryUpstream, flags[QueuePush]*prob)
+		upstreamDot := entryUpstream.Dot(pushData)
+		flagsGrad[QueuePush] += prob * upstreamDot
+		if q.LogSpace {
+			downstream.SizeProbs[i] += flags[QueuePush] * upstreamDot * prob
 		} else {
-			res.SizeProbs[i] += old * flags[QueuePop]
+			downstream.SizeProbs[i] += flags[QueuePush] * upstreamDot
 		}
-		res.SizeProbs[i+1] += old * flags[QueuePush]
 	}
 
-	for i, vec := range q.Expected {
-		res.Expected[i] = vec.Copy().Scale(flags[QueueNop] + flags[QueuePush])
+	q.addSizeProbsGradient(flags, upstream.SizeProbs, downstream.SizeProbs, flagsGrad,
+		logFlagsGrad)
+}
+
+// addSizeProbsGradient back-propagates an upstream
+// gradient through the size probabilities of q, given
+// the size probabilities of q.Last.
+// The gradients are added to downstream, flagsGrad, and
+// logFlagsGrad, as in addGradient.
+func (q *queueState) addSizeProbsGradient(flags, upstream, downstream, flagsGrad,
+	logFlagsGrad linalg.Vector) {
+	if q.LogSpace {
+		logFlags := q.FlagNorm.logFlags(q.ControlIn[:queueFlagCount], q.Noise)
+		queueSizeTransitions(len(q.Last.SizeProbs), func(src, dst, flag int) {
+			if math.IsInf(q.SizeProbs[dst], -1) {
+				return
+			}
+			weight := math.Exp(q.Last.SizeProbs[src] + logFlags[flag] - q.SizeProbs[dst])
+			downstream[src] += weight * upstream[dst]
+			logFlagsGrad[flag] += weight * upstream[dst]
+		})
+		return
+	}
+
+	for i, old := range q.Last.SizeProbs {
+		downstream[i] += flags[QueueNop] * upstream[i]
+		flagsGrad[QueueNop] += old * upstream[i]
 		if i > 0 {
-			res.Expected[i-1].Add(vec.Copy().Scale(flags[QueuePop]))
+			downstream[i] += flags[QueuePop] * upstream[i-1]
+			flagsGrad[QueuePop] += old * upstream[i-1]
+		} else {
+			downstream[i] += flags[QueuePop] * upstream[i]
+			flagsGrad[QueuePop] += old * upstream[i]
 		}
+		downstream[i] += flags[QueuePush] * upstream[i+1]
+		flagsGrad[QueuePush] += old * upstream[i+1]
 	}
+}
 
-	pushData := ctrl[queueFlagCount:]
-	for i, prob := range q.SizeProbs {
-		pushVec := pushData.Copy().Scale(flags[QueuePush] * prob)
-		if i == len(res.Expected)-1 {
-			res.Expected[i] = pushVec
+// addNextSizeProbs adds the size probabilities for the
+// next state to res, given the previous size probabilities
+// and the flags.
+func addNextSizeProbs(res, old, flags linalg.Vector) {
+	for i, x := range old {
+		res[i] += x * flags[QueueNop]
+		if i > 0 {
+			res[i-1] += x * flags[QueuePop]
 		} else {
-			res.Expected[i].Add(pushVec)
+			res[i] += x * flags[QueuePop]
 		}
+		res[i+1] += x * flags[QueuePush]
 	}
+}
 
-	res.OutputData = res.Expected[0]
-	res.ControlIn = ctrl
-	res.Last = q
+// nextLogSizeProbs computes log-space size probabilities
+// for the next state, given the previous log-space size
+// probabilities and the log of the flags.
+// The result is written to res.
+func nextLogSizeProbs(res, old, logFlags linalg.Vector) {
+	for i := range res {
+		res[i] = math.Inf(-1)
+	}
+	queueSizeTransitions(len(old), func(src, dst, flag int) {
+		res[dst] = logAdd(res[dst], old[src]+logFlags[flag])
+	})
+}
 
-	return &res
+// queueSizeTransitions calls f for every way a flag can
+// change the size of a queue, given the number of sizes
+// the queue might currently have.
+func queueSizeTransitions(count int, f func(src, dst, flag int)) {
+	for i := 0; i < count; i++ {
+		f(i, i, QueueNop)
+		if i > 0 {
+			f(i, i-1, QueuePop)
+		} else {
+			f(i, i, QueuePop)
+		}
+		f(i, i+1, QueuePush)
+	}
 }
 
 type queueUpstream struct {
-	Expected  []linalg.Vector
-	SizeProbs []float64
+	Expected  linalg.Vector
+	SizeProbs linalg.Vector
 }
 
 type queueRState struct {
-	Expected    []linalg.Vector
-	RExpected   []linalg.Vector
-	SizeProbs   []float64
-	RSizeProbs  []float64
+	Expected    linalg.Vector
+	RExpected   linalg.Vector
+	SizeProbs   linalg.Vector
+	RSizeProbs  linalg.Vector
 	OutputData  linalg.Vector
 	ROutputData linalg.Vector
 
 	ControlIn  linalg.Vector
 	RControlIn linalg.Vector
 	Last       *queueRState
+
+	// Noise is like queueState.Noise.
+	Noise linalg.Vector
+
+	// LogSpace and FlagNorm are the Queue's fields.
+	// If LogSpace is set, SizeProbs and RSizeProbs are in
+	// log space.
+	LogSpace bool
+	FlagNorm FlagNorm
 }
 
 func (q *queueRState) Data() linalg.Vector {
@@ -267,14 +1097,8 @@ func (q *queueRState) RGradient(dataGrad, dataGradR linalg.Vector,
 	if q.Last == nil {
 		panic("cannot propagate through start state")
 	}
-	softmax := autofunc.Softmax{}
-	flagsVar := &autofunc.RVariable{
-		Variable:   &autofunc.Variable{Vector: q.ControlIn[:queueFlagCount]},
-		ROutputVec: q.RControlIn[:queueFlagCount],
-	}
-	flagRes := softmax.ApplyR(autofunc.RVector{}, flagsVar)
-	flags := flagRes.Output()
-	flagsR := flagRes.ROutput()
+	flagIn, flagInR := q.ControlIn[:queueFlagCount], q.RControlIn[:queueFlagCount]
+	flags, flagsR := q.FlagNorm.applyR(flagIn, flagInR, q.Noise)
 
 	flagsGrad := make(linalg.Vector, queueFlagCount)
 	flagsGradR := make(linalg.Vector, queueFlagCount)
@@ -282,178 +1106,196 @@ func (q *queueRState) RGradient(dataGrad, dataGradR linalg.Vector,
 	var upstream *queueRUpstream
 	if upstreamGrad != nil {
 		upstream = upstreamGrad.(*queueRUpstream)
-		upstream.Expected[0].Add(dataGrad)
-		upstream.RExpected[0].Add(dataGradR)
+		upstream.Expected[:len(dataGrad)].Add(dataGrad)
+		upstream.RExpected[:len(dataGradR)].Add(dataGradR)
 	} else {
-		upstream = new(queueRUpstream)
-		upstream.SizeProbs = make([]float64, len(q.SizeProbs))
-		upstream.RSizeProbs = make([]float64, len(q.SizeProbs))
-		upstream.Expected = make([]linalg.Vector, len(q.Expected))
-		upstream.RExpected = make([]linalg.Vector, len(q.Expected))
-		upstream.Expected[0] = dataGrad
-		upstream.RExpected[0] = dataGradR
-		zeroVec := make(linalg.Vector, len(dataGrad))
-		for i := 1; i < len(upstream.Expected); i++ {
-			upstream.Expected[i] = zeroVec
-			upstream.RExpected[i] = zeroVec
+		upstream = &queueRUpstream{
+			Expected:   make(linalg.Vector, len(q.Expected)),
+			RExpected:  make(linalg.Vector, len(q.Expected)),
+			SizeProbs:  make(linalg.Vector, len(q.SizeProbs)),
+			RSizeProbs: make(linalg.Vector, len(q.SizeProbs)),
 		}
+		copy(upstream.Expected, dataGrad)
+		copy(upstream.RExpected, dataGradR)
 	}
 
+	size := len(dataGrad)
+	last, lastR := q.Last.Expected, q.Last.RExpected
 	downstream := &queueRUpstream{
-		Expected:   make([]linalg.Vector, len(q.Last.Expected)),
-		RExpected:  make([]linalg.Vector, len(q.Last.Expected)),
-		SizeProbs:  make([]float64, len(q.Last.SizeProbs)),
-		RSizeProbs: make([]float64, len(q.Last.SizeProbs)),
-	}
-	for i, vec := range q.Last.Expected {
-		vecR := q.Last.RExpected[i]
-		downstream.Expected[i] = upstream.Expected[i].Copy().Scale(flags[QueueNop] +
-			flags[QueuePush])
-		downstream.RExpected[i] = upstream.RExpected[i].Copy().Scale(flags[QueueNop] +
-			flags[QueuePush])
-		downstream.RExpected[i].Add(upstream.Expected[i].Copy().Scale(flagsR[QueueNop] +
-			flagsR[QueuePush]))
-		vecDot := vec.Dot(upstream.Expected[i])
-		vecDotR := vec.Dot(upstream.RExpected[i]) + vecR.Dot(upstream.Expected[i])
-		flagsGrad[QueueNop] += vecDot
-		flagsGrad[QueuePush] += vecDot
-		flagsGradR[QueueNop] += vecDotR
-		flagsGradR[QueuePush] += vecDotR
-		if i > 0 {
-			downstream.Expected[i].Add(upstream.Expected[i-1].Copy().Scale(flags[QueuePop]))
-			downstream.RExpected[i].Add(upstream.RExpected[i-1].Copy().Scale(flags[QueuePop]))
-			downstream.RExpected[i].Add(upstream.Expected[i-1].Copy().Scale(flagsR[QueuePop]))
-			flagsGrad[QueuePop] += vec.Dot(upstream.Expected[i-1])
-			flagsGradR[QueuePop] += vecR.Dot(upstream.Expected[i-1]) +
-				vec.Dot(upstream.RExpected[i-1])
-		}
-	}
-
-	pushDataGrad := make(linalg.Vector, len(q.Data()))
-	pushDataGradR := make(linalg.Vector, len(q.RData()))
-
-	for i, prob := range q.Last.SizeProbs {
-		probR := q.Last.RSizeProbs[i]
-		pushData := q.ControlIn[queueFlagCount:]
-		pushDataR := q.RControlIn[queueFlagCount:]
-		pushDataGrad.Add(upstream.Expected[i].Copy().Scale(flags[QueuePush] * prob))
-		pushDataGradR.Add(upstream.RExpected[i].Copy().Scale(flags[QueuePush] * prob))
-		pushDataGradR.Add(upstream.Expected[i].Copy().Scale(flagsR[QueuePush]*prob +
-			flags[QueuePush]*probR))
-		upstreamDot := upstream.Expected[i].Dot(pushData)
-		upstreamDotR := upstream.RExpected[i].Dot(pushData) + upstream.Expected[i].Dot(pushDataR)
+		Expected:   make(linalg.Vector, len(last)),
+		RExpected:  make(linalg.Vector, len(last)),
+		SizeProbs:  make(linalg.Vector, len(q.Last.SizeProbs)),
+		RSizeProbs: make(linalg.Vector, len(q.Last.SizeProbs)),
+	}
+
+	keepUpstream := upstream.Expected[:len(last)]
+	keepUpstreamR := upstream.RExpected[:len(last)]
+	keep := flags[QueueNop] + flags[QueuePush]
+	keepR := flagsR[QueueNop] + flagsR[QueuePush]
+	addScaled(downstream.Expected, keepUpstream, keep)
+	addScaled(downstream.RExpected, keepUpstreamR, keep)
+	addScaled(downstream.RExpected, keepUpstream, keepR)
+	keepDot := last.Dot(keepUpstream)
+	keepDotR := last.Dot(keepUpstreamR) + lastR.Dot(keepUpstream)
+	flagsGrad[QueueNop] += keepDot
+	flagsGrad[QueuePush] += keepDot
+	flagsGradR[QueueNop] += keepDotR
+	flagsGradR[QueuePush] += keepDotR
+	if len(last) > size {
+		popUpstream := upstream.Expected[:len(last)-size]
+		popUpstreamR := upstream.RExpected[:len(last)-size]
+		addScaled(downstream.Expected[size:], popUpstream, flags[QueuePop])
+		addScaled(downstream.RExpected[size:], popUpstreamR, flags[QueuePop])
+		addScaled(downstream.RExpected[size:], popUpstream, flagsR[QueuePop])
+		flagsGrad[QueuePop] += last[size:].Dot(popUpstream)
+		flagsGradR[QueuePop] += lastR[size:].Dot(popUpstream) +
+			last[size:].Dot(popUpstreamR)
+	}
+
+	pushData := q.ControlIn[queueFlagCount:]
+	pushDataR := q.RControlIn[queueFlagCount:]
+	pushDataGrad := make(linalg.Vector, size)
+	pushDataGradR := make(linalg.Vector, size)
+
+	lastProbs, lastProbsR := q.Last.sizeProbs()
+	for i, prob := range lastProbs {
+		probR := lastProbsR[i]
+		entryUpstream := upstream.Expected[i*size : (i+1)*size]
+		entryUpstreamR := upstream.RExpected[i*size : (i+1)*size]
+		addScaled(pushDataGrad, entryUpstream, flags[QueuePush]*prob)
+		addScaled(pushDataGradR, entryUpstreamR, flags[QueuePush]*prob)
+		addScaled(pushDataGradR, entryUpstream, flagsR[QueuePush]*prob+
+			flags[QueuePush]*probR)
+		upstreamDot := entryUpstream.Dot(pushData)
+		upstreamDotR := entryUpstreamR.Dot(pushData) + entryUpstream.Dot(pushDataR)
 		flagsGrad[QueuePush] += prob * upstreamDot
 		flagsGradR[QueuePush] += probR*upstreamDot + prob*upstreamDotR
-		downstream.SizeProbs[i] += flags[QueuePush] * upstreamDot
-		downstream.RSizeProbs[i] += flagsR[QueuePush]*upstreamDot +
-			flags[QueuePush]*upstreamDotR
+		sizeGrad := flags[QueuePush] * upstreamDot
+		sizeGradR := flagsR[QueuePush]*upstreamDot + flags[QueuePush]*upstreamDotR
+		if q.LogSpace {
+			sizeGrad, sizeGradR = sizeGrad*prob, sizeGradR*prob+sizeGrad*probR
+		}
+		downstream.SizeProbs[i] += sizeGrad
+		downstream.RSizeProbs[i] += sizeGradR
 	}
 
-	for i, old := range q.Last.SizeProbs {
-		oldR := q.Last.RSizeProbs[i]
-		downstream.SizeProbs[i] += flags[QueueNop] * upstream.SizeProbs[i]
-		downstream.RSizeProbs[i] += flagsR[QueueNop]*upstream.SizeProbs[i] +
-			flags[QueueNop]*upstream.RSizeProbs[i]
-		flagsGrad[QueueNop] += old * upstream.SizeProbs[i]
-		flagsGradR[QueueNop] += oldR*upstream.SizeProbs[i] + old*upstream.RSizeProbs[i]
-		if i > 0 {
-			downstream.SizeProbs[i] += flags[QueuePop] * upstream.SizeProbs[i-1]
-			downstream.RSizeProbs[i] += flagsR[QueuePop]*upstream.SizeProbs[i-1] +
-				flags[QueuePop]*upstream.RSizeProbs[i-1]
-			flagsGrad[QueuePop] += old * upstream.SizeProbs[i-1]
-			flagsGradR[QueuePop] += oldR*upstream.SizeProbs[i-1] +
-				old*upstream.RSizeProbs[i-1]
-		} else {
-			downstream.SizeProbs[i] += flags[QueuePop] * upstream.SizeProbs[i]
-			downstream.RSizeProbs[i] += flagsR[QueuePop]*upstream.SizeProbs[i] +
-				flags[QueuePop]*upstream.RSizeProbs[i]
-			flagsGrad[QueuePop] += old * upstream.SizeProbs[i]
-			flagsGradR[QueuePop] += oldR*upstream.SizeProbs[i] + old*upstream.RSizeProbs[i]
+	logFlagsGrad := make(linalg.Vector, queueFlagCount)
+	logFlagsGradR := make(linalg.Vector, queueFlagCount)
+	if q.LogSpace {
+		q.addLogSizeGradient(upstream, downstream, logFlagsGrad, logFlagsGradR)
+	} else {
+		for i, old := range q.Last.SizeProbs {
+			oldR := q.Last.RSizeProbs[i]
+			downstream.SizeProbs[i] += flags[QueueNop] * upstream.SizeProbs[i]
+			downstream.RSizeProbs[i] += flagsR[QueueNop]*upstream.SizeProbs[i] +
+				flags[QueueNop]*upstream.RSizeProbs[i]
+			flagsGrad[QueueNop] += old * upstream.SizeProbs[i]
+			flagsGradR[QueueNop] += oldR*upstream.SizeProbs[i] + old*upstream.RSizeProbs[i]
+			if i > 0 {
+				downstream.SizeProbs[i] += flags[QueuePop] * upstream.SizeProbs[i-1]
+				downstream.RSizeProbs[i] += flagsR[QueuePop]*upstream.SizeProbs[i-1] +
+					flags[QueuePop]*upstream.RSizeProbs[i-1]
+				flagsGrad[QueuePop] += old * upstream.SizeProbs[i-1]
+				flagsGradR[QueuePop] += oldR*upstream.SizeProbs[i-1] +
+					old*upstream.RSizeProbs[i-1]
+			} else {
+				downstream.SizeProbs[i] += flags[QueuePop] * upstream.SizeProbs[i]
+				downstream.RSizeProbs[i] += flagsR[QueuePop]*upstream.SizeProbs[i] +
+					flags[QueuePop]*upstream.RSizeProbs[i]
+				flagsGrad[QueuePop] += old * upstream.SizeProbs[i]
+				flagsGradR[QueuePop] += oldR*upstream.SizeProbs[i] + old*upstream.RSizeProbs[i]
+			}
+			downstream.SizeProbs[i] += flags[QueuePush] * upstream.SizeProbs[i+1]
+			downstream.RSizeProbs[i] += flagsR[QueuePush]*upstream.SizeProbs[i+1] +
+				flags[QueuePush]*upstream.RSizeProbs[i+1]
+			flagsGrad[QueuePush] += old * upstream.SizeProbs[i+1]
+			flagsGradR[QueuePush] += oldR*upstream.SizeProbs[i+1] + old*upstream.RSizeProbs[i+1]
 		}
-		downstream.SizeProbs[i] += flags[QueuePush] * upstream.SizeProbs[i+1]
-		downstream.RSizeProbs[i] += flagsR[QueuePush]*upstream.SizeProbs[i+1] +
-			flags[QueuePush]*upstream.RSizeProbs[i+1]
-		flagsGrad[QueuePush] += old * upstream.SizeProbs[i+1]
-		flagsGradR[QueuePush] += oldR*upstream.SizeProbs[i+1] + old*upstream.RSizeProbs[i+1]
 	}
 
-	fg := autofunc.NewGradient([]*autofunc.Variable{flagsVar.Variable})
-	fgR := autofunc.NewRGradient([]*autofunc.Variable{flagsVar.Variable})
-	flagRes.PropagateRGradient(flagsGrad, flagsGradR, fgR, fg)
-
 	ctrlGrad := make(linalg.Vector, queueFlagCount+len(pushDataGrad))
-	copy(ctrlGrad, fg[flagsVar.Variable])
 	copy(ctrlGrad[queueFlagCount:], pushDataGrad)
 	ctrlGradR := make(linalg.Vector, queueFlagCount+len(pushDataGrad))
-	copy(ctrlGradR, fgR[flagsVar.Variable])
 	copy(ctrlGradR[queueFlagCount:], pushDataGradR)
+	q.FlagNorm.addGradientR(ctrlGrad[:queueFlagCount], ctrlGradR[:queueFlagCount],
+		flagIn, flagInR, q.Noise, flagsGrad, flagsGradR)
+	if q.LogSpace {
+		q.FlagNorm.addLogGradientR(ctrlGrad[:queueFlagCount], ctrlGradR[:queueFlagCount],
+			flagIn, flagInR, q.Noise, logFlagsGrad, logFlagsGradR)
+	}
 
 	return ctrlGrad, ctrlGradR, downstream
 }
 
 func (q *queueRState) NextRState(ctrl, ctrlR linalg.Vector) RState {
-	probs := ctrl[:queueFlagCount]
-	softmax := autofunc.Softmax{}
-	probsVar := &autofunc.RVariable{
-		Variable:   &autofunc.Variable{Vector: probs},
-		ROutputVec: ctrlR[:queueFlagCount],
-	}
-	flagsRes := softmax.ApplyR(autofunc.RVector{}, probsVar)
-	flags := flagsRes.Output()
-	flagsR := flagsRes.ROutput()
+	flagIn, flagInR := ctrl[:queueFlagCount], ctrlR[:queueFlagCount]
+	noise := q.FlagNorm.noise(queueFlagCount)
+	flags, flagsR := q.FlagNorm.applyR(flagIn, flagInR, noise)
+
+	pushData := ctrl[queueFlagCount:]
+	pushDataR := ctrlR[queueFlagCount:]
+	size := len(pushData)
 
 	var res queueRState
 
-	res.Expected = make([]linalg.Vector, len(q.Expected)+1)
-	res.RExpected = make([]linalg.Vector, len(q.Expected)+1)
-	res.SizeProbs = make([]float64, len(q.SizeProbs)+1)
-	res.RSizeProbs = make([]float64, len(q.SizeProbs)+1)
+	res.Expected = make(linalg.Vector, len(q.Expected)+size)
+	res.RExpected = make(linalg.Vector, len(q.Expected)+size)
+	res.SizeProbs = make(linalg.Vector, len(q.SizeProbs)+1)
+	res.RSizeProbs = make(linalg.Vector, len(q.SizeProbs)+1)
+	res.LogSpace = q.LogSpace
+	res.FlagNorm = q.FlagNorm
+	res.Noise = noise
 
-	for i, old := range q.SizeProbs {
-		oldR := q.RSizeProbs[i]
-		res.SizeProbs[i] += old * flags[QueueNop]
-		res.RSizeProbs[i] += oldR*flags[QueueNop] + old*flagsR[QueueNop]
-		if i > 0 {
-			res.SizeProbs[i-1] += old * flags[QueuePop]
-			res.RSizeProbs[i-1] += oldR*flags[QueuePop] + old*flagsR[QueuePop]
-		} else {
-			res.SizeProbs[i] += old * flags[QueuePop]
-			res.RSizeProbs[i] += oldR*flags[QueuePop] + old*flagsR[QueuePop]
+	if q.LogSpace {
+		logFlags := q.FlagNorm.logFlags(flagIn, noise)
+		logFlagsR := q.FlagNorm.logFlagsR(flagIn, flagInR, noise)
+		nextLogSizeProbs(res.SizeProbs, q.SizeProbs, logFlags)
+		queueSizeTransitions(len(q.SizeProbs), func(src, dst, flag int) {
+			if math.IsInf(res.SizeProbs[dst], -1) {
+				return
+			}
+			weight := math.Exp(q.SizeProbs[src] + logFlags[flag] - res.SizeProbs[dst])
+			res.RSizeProbs[dst] += weight * (q.RSizeProbs[src] + logFlagsR[flag])
+		})
+	} else {
+		for i, old := range q.SizeProbs {
+			oldR := q.RSizeProbs[i]
+			res.SizeProbs[i] += old * flags[QueueNop]
+			res.RSizeProbs[i] += oldR*flags[QueueNop] + old*flagsR[QueueNop]
+			if i > 0 {
+				res.SizeProbs[i-1] += old * flags[QueuePop]
+				res.RSizeProbs[i-1] += oldR*flags[QueuePop] + old*flagsR[QueuePop]
+			} else {
+				res.SizeProbs[i] += old * flags[QueuePop]
+				res.RSizeProbs[i] += oldR*flags[QueuePop] + old*flagsR[QueuePop]
+			}
+			res.SizeProbs[i+1] += old * flags[QueuePush]
+			res.RSizeProbs[i+1] += oldR*flags[QueuePush] + old*flagsR[QueuePush]
 		}
-		res.SizeProbs[i+1] += old * flags[QueuePush]
-		res.RSizeProbs[i+1] += oldR*flags[QueuePush] + old*flagsR[QueuePush]
 	}
 
-	for i, vec := range q.Expected {
-		vecR := q.RExpected[i]
-		res.Expected[i] = vec.Copy().Scale(flags[QueueNop] + flags[QueuePush])
-		res.RExpected[i] = vec.Copy().Scale(flagsR[QueueNop] + flagsR[QueuePush])
-		res.RExpected[i].Add(vecR.Copy().Scale(flags[QueueNop] + flags[QueuePush]))
-		if i > 0 {
-			res.Expected[i-1].Add(vec.Copy().Scale(flags[QueuePop]))
-			res.RExpected[i-1].Add(vec.Copy().Scale(flagsR[QueuePop]))
-			res.RExpected[i-1].Add(vecR.Copy().Scale(flags[QueuePop]))
-		}
+	keep := flags[QueueNop] + flags[QueuePush]
+	keepR := flagsR[QueueNop] + flagsR[QueuePush]
+	addScaled(res.Expected, q.Expected, keep)
+	addScaled(res.RExpected, q.Expected, keepR)
+	addScaled(res.RExpected, q.RExpected, keep)
+	if len(q.Expected) > size {
+		addScaled(res.Expected, q.Expected[size:], flags[QueuePop])
+		addScaled(res.RExpected, q.Expected[size:], flagsR[QueuePop])
+		addScaled(res.RExpected, q.RExpected[size:], flags[QueuePop])
 	}
 
-	pushData := ctrl[queueFlagCount:]
-	pushDataR := ctrlR[queueFlagCount:]
-	for i, prob := range q.SizeProbs {
-		probR := q.RSizeProbs[i]
-		pushVec := pushData.Copy().Scale(flags[QueuePush] * prob)
-		pushVecR := pushDataR.Copy().Scale(flags[QueuePush] * prob)
-		pushVecR.Add(pushData.Copy().Scale(flagsR[QueuePush]*prob + flags[QueuePush]*probR))
-		if i == len(res.Expected)-1 {
-			res.Expected[i] = pushVec
-			res.RExpected[i] = pushVecR
-		} else {
-			res.Expected[i].Add(pushVec)
-			res.RExpected[i].Add(pushVecR)
-		}
+	sizeProbs, sizeProbsR := q.sizeProbs()
+	for i, prob := range sizeProbs {
+		probR := sizeProbsR[i]
+		addScaled(res.Expected[i*size:(i+1)*size], pushData, flags[QueuePush]*prob)
+		addScaled(res.RExpected[i*size:(i+1)*size], pushDataR, flags[QueuePush]*prob)
+		addScaled(res.RExpected[i*size:(i+1)*size], pushData,
+			flagsR[QueuePush]*prob+flags[QueuePush]*probR)
 	}
 
-	res.OutputData = res.Expected[0]
-	res.ROutputData = res.RExpected[0]
+	res.OutputData = res.Expected[:size]
+	res.ROutputData = res.RExpected[:size]
 	res.ControlIn = ctrl
 	res.RControlIn = ctrlR
 	res.Last = q
@@ -461,9 +1303,109 @@ func (q *queueRState) NextRState(ctrl, ctrlR linalg.Vector) RState {
 	return &res
 }
 
+// sizeProbs returns the size probabilities and their
+// r-operators, taking them out of log space if necessary.
+func (q *queueRState) sizeProbs() (probs, probsR linalg.Vector) {
+	if !q.LogSpace {
+		return q.SizeProbs, q.RSizeProbs
+	}
+	probs = make(linalg.Vector, len(q.SizeProbs))
+	probsR = make(linalg.Vector, len(q.SizeProbs))
+	for i, x := range q.SizeProbs {
+		probs[i] = math.Exp(x)
+		probsR[i] = probs[i] * q.RSizeProbs[i]
+	}
+	return
+}
+
+// addLogSizeGradient back-propagates the log-space size
+// probability gradients through the transition from
+// q.Last to q.
+func (q *queueRState) addLogSizeGradient(upstream, downstream *queueRUpstream,
+	logFlagsGrad, logFlagsGradR linalg.Vector) {
+	ctrl, ctrlR := q.ControlIn[:queueFlagCount], q.RControlIn[:queueFlagCount]
+	logFlags := q.FlagNorm.logFlags(ctrl, q.Noise)
+	logFlagsR := q.FlagNorm.logFlagsR(ctrl, ctrlR, q.Noise)
+	last, lastR := q.Last.SizeProbs, q.Last.RSizeProbs
+	queueSizeTransitions(len(last), func(src, dst, flag int) {
+		if math.IsInf(q.SizeProbs[dst], -1) {
+			return
+		}
+		weight := math.Exp(last[src] + logFlags[flag] - q.SizeProbs[dst])
+		weightR := weight * (lastR[src] + logFlagsR[flag] - q.RSizeProbs[dst])
+		up, upR := upstream.SizeProbs[dst], upstream.RSizeProbs[dst]
+		downstream.SizeProbs[src] += weight * up
+		downstream.RSizeProbs[src] += weightR*up + weight*upR
+		logFlagsGrad[flag] += weight * up
+		logFlagsGradR[flag] += weightR*up + weight*upR
+	})
+}
+
 type queueRUpstream struct {
-	Expected   []linalg.Vector
-	RExpected  []linalg.Vector
-	SizeProbs  []float64
-	RSizeProbs []float64
+	Expected   linalg.Vector
+	RExpected  linalg.Vector
+	SizeProbs  linalg.Vector
+	RSizeProbs linalg.Vector
+}
+
+// queueInferenceState is a forward-only queue state which
+// is updated in place.
+type queueInferenceState struct {
+	Queue     Queue
+	Expected  linalg.Vector
+	SizeProbs linalg.Vector
+
+	// Scratch and Flags are buffers which are reused
+	// between timesteps.
+	Scratch linalg.Vector
+	Flags   linalg.Vector
+}
+
+func (q *queueInferenceState) Data() linalg.Vector {
+	if len(q.Expected) == 0 {
+		return make(linalg.Vector, q.Queue.VectorSize)
+	}
+	return q.Expected[:q.Queue.VectorSize]
+}
+
+func (q *queueInferenceState) Gradient(dataGrad linalg.Vector,
+	upstream Grad) (linalg.Vector, Grad) {
+	panic("cannot propagate through inference state")
+}
+
+func (q *queueInferenceState) NextState(ctrl linalg.Vector) State {
+	flags := q.Flags
+	noise := q.Queue.FlagNorm.noise(queueFlagCount)
+	q.Queue.FlagNorm.applyInto(flags, ctrl[:queueFlagCount], noise)
+	pushData := ctrl[queueFlagCount:]
+	size := len(pushData)
+
+	// Entries only move towards the front of the queue, so
+	// they can be updated in place from front to back.
+	oldLen := len(q.Expected)
+	q.Expected = append(q.Expected, make(linalg.Vector, size)...)
+	keep := flags[QueueNop] + flags[QueuePush]
+	for i := 0; i < oldLen; i++ {
+		q.Expected[i] *= keep
+		if i+size < oldLen {
+			q.Expected[i] += q.Expected[i+size] * flags[QueuePop]
+		}
+	}
+	for i, prob := range q.SizeProbs {
+		if q.Queue.LogSpace {
+			prob = math.Exp(prob)
+		}
+		addScaled(q.Expected[i*size:(i+1)*size], pushData, flags[QueuePush]*prob)
+	}
+
+	q.Scratch = append(q.Scratch[:0], make(linalg.Vector, len(q.SizeProbs)+1)...)
+	if q.Queue.LogSpace {
+		nextLogSizeProbs(q.Scratch, q.SizeProbs,
+			q.Queue.FlagNorm.logFlags(ctrl[:queueFlagCount], noise))
+	} else {
+		addNextSizeProbs(q.Scratch, q.SizeProbs, flags)
+	}
+	q.SizeProbs, q.Scratch = q.Scratch, q.SizeProbs
+
+	return q
 }
@@ -41,6 +41,47 @@ func TestQueueDerivatives(t *testing.T) {
 	testAllDerivatives(t, &Queue{VectorSize: 4})
 }
 
+func TestQueueCheckpoint(t *testing.T) {
+	testAllDerivatives(t, &Queue{VectorSize: 4, Checkpoint: 2})
+	_, states := testEquivalent(t, &Queue{VectorSize: 3},
+		&Queue{VectorSize: 3, Checkpoint: 4}, 15, statesEqual)
+	for i, state := range states[:len(states)-1] {
+		stored := state.(*queueState).Expected != nil
+		if stored != ((i+1)%4 == 0) {
+			t.Errorf("state %d: unexpected storage status %v", i, stored)
+		}
+	}
+}
+
+func TestQueueLogSpace(t *testing.T) {
+	testAllDerivatives(t, &Queue{VectorSize: 4, LogSpace: true})
+	testEquivalent(t, &Queue{VectorSize: 3}, &Queue{VectorSize: 3, LogSpace: true}, 15,
+		closeWithin(1e-8))
+}
+
+func TestQueueLogSpaceLong(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	const steps = 3000
+	linearStates, logStates := testEquivalent(t, &Queue{VectorSize: 1},
+		&Queue{VectorSize: 1, LogSpace: true}, steps, closeWithin(1e-6))
+
+	linear := linearStates[steps-1].(*queueState).SizeProbs
+	logSpace := logStates[steps-1].(*queueState).SizeProbs
+	if linear[len(linear)-1] != 0 {
+		t.Error("expected linear size probabilities to underflow")
+	}
+	for i, x := range logSpace {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			t.Fatalf("log size probability %d is %f", i, x)
+		}
+		if p := linear[i]; p > 1e-100 && math.Abs(math.Exp(x)-p) > 1e-8*p+1e-12 {
+			t.Errorf("size %d: expected probability %e but got %e", i, p, math.Exp(x))
+		}
+	}
+}
+
 func BenchmarkQueueForward(b *testing.B) {
 	forwardBenchmark(b, &Queue{VectorSize: benchmarkVectorSize})
 }
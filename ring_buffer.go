@@ -0,0 +1,432 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+const ringBufferFlagCount = 2
+
+// These are the control flags (in order) of a RingBuffer.
+const (
+	RingBufferNop int = iota
+	RingBufferPush
+)
+
+func init() {
+	var r RingBuffer
+	serializer.RegisterTypedDeserializer(r.SerializerType(), DeserializeRingBuffer)
+}
+
+// A RingBuffer is a differentiable fixed-capacity buffer
+// of vectors.
+// Pushing a vector overwrites the oldest entry in the
+// buffer, so the amount of memory and computation needed
+// per timestep does not grow with the sequence length.
+//
+// The data output of a RingBuffer is the concatenation
+// of the ReadCount most recently pushed entries, ordered
+// from newest to oldest.
+type RingBuffer struct {
+	VectorSize int
+
+	// Capacity is the number of entries in the buffer.
+	// It must be at least 1.
+	Capacity int
+
+	// ReadCount is the number of recent entries which are
+	// visible in the data output.
+	// If it is 0, only the newest entry is visible.
+	// It must not exceed Capacity.
+	ReadCount int
+
+	// PushBias determines an optional bias towards pushing
+	// from the SuggestedActivation() method.
+	// Reasonable values are -1, 0, or 1, for pushing being
+	// e times less likely, unbiased, or e times more likely.
+	PushBias float64
+}
+
+// DeserializeRingBuffer deserializes a RingBuffer.
+func DeserializeRingBuffer(d []byte) (*RingBuffer, error) {
+	var r RingBuffer
+	if err := json.Unmarshal(d, &r); err != nil {
+		return nil, err
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ControlSize returns the number of control vector
+// components, which varies with r.VectorSize.
+func (r *RingBuffer) ControlSize() int {
+	return r.VectorSize + ringBufferFlagCount
+}
+
+// DataSize returns the number of data components, which
+// is r.VectorSize times the number of visible entries.
+func (r *RingBuffer) DataSize() int {
+	return r.VectorSize * r.readCount()
+}
+
+// StartState returns a state representing a buffer full
+// of zero vectors.
+//
+// It panics if the buffer is misconfigured, e.g. if
+// ReadCount exceeds Capacity.
+func (r *RingBuffer) StartState() State {
+	if err := r.validate(); err != nil {
+		panic(err)
+	}
+	res := &ringBufferState{
+		Buffer:  *r,
+		Entries: make([]linalg.Vector, r.Capacity),
+	}
+	for i := range res.Entries {
+		res.Entries[i] = make(linalg.Vector, r.VectorSize)
+	}
+	res.OutputData = r.joinEntries(res.Entries)
+	return res
+}
+
+// StartRState is like StartState, but for an RState.
+func (r *RingBuffer) StartRState() RState {
+	if err := r.validate(); err != nil {
+		panic(err)
+	}
+	res := &ringBufferRState{
+		Buffer:   *r,
+		Entries:  make([]linalg.Vector, r.Capacity),
+		REntries: make([]linalg.Vector, r.Capacity),
+	}
+	for i := range res.Entries {
+		res.Entries[i] = make(linalg.Vector, r.VectorSize)
+		res.REntries[i] = make(linalg.Vector, r.VectorSize)
+	}
+	res.OutputData = r.joinEntries(res.Entries)
+	res.ROutputData = r.joinEntries(res.REntries)
+	return res
+}
+
+// SerializerType returns the unique ID used to serialize
+// RingBuffers with the serializer package.
+func (r *RingBuffer) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.RingBuffer"
+}
+
+// Serialize encodes the buffer's parameters.
+func (r *RingBuffer) Serialize() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// SuggestedActivation returns an activation function
+// which applies a hyperbolic tangent to the data outputs
+// while leaving the control outputs untouched.
+func (r *RingBuffer) SuggestedActivation() neuralnet.Layer {
+	res := &PartialActivation{
+		Ranges:      []ComponentRange{{Start: ringBufferFlagCount, End: r.ControlSize()}},
+		Activations: []neuralnet.Layer{&neuralnet.HyperbolicTangent{}},
+	}
+	if r.PushBias != 0 {
+		res.Ranges = append([]ComponentRange{{Start: RingBufferPush, End: RingBufferPush + 1}},
+			res.Ranges...)
+		res.Activations = append([]neuralnet.Layer{
+			&neuralnet.RescaleLayer{Scale: 1, Bias: r.PushBias},
+		}, res.Activations...)
+	}
+	return res
+}
+
+// FlagNames returns the names of the control flags.
+func (r *RingBuffer) FlagNames() []string {
+	return []string{"nop", "push"}
+}
+
+func (r *RingBuffer) validate() error {
+	if r.VectorSize < 0 {
+		return errors.New("ring buffer vector size must be non-negative")
+	}
+	if r.Capacity < 1 {
+		return errors.New("ring buffer capacity must be at least 1")
+	}
+	if r.ReadCount < 0 || r.ReadCount > r.Capacity {
+		return errors.New("ring buffer read count must be between 0 and the capacity")
+	}
+	return nil
+}
+
+func (r *RingBuffer) readCount() int {
+	if r.ReadCount == 0 {
+		return 1
+	}
+	return r.ReadCount
+}
+
+func (r *RingBuffer) joinEntries(entries []linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, 0, r.DataSize())
+	for _, x := range entries[:r.readCount()] {
+		res = append(res, x...)
+	}
+	return res
+}
+
+// upstreamEntries splits a data gradient into per-entry
+// gradients and adds it to an existing upstream (or to
+// zero if upstream is nil).
+func (r *RingBuffer) upstreamEntries(dataGrad linalg.Vector,
+	upstream []linalg.Vector) []linalg.Vector {
+	if upstream == nil {
+		upstream = make([]linalg.Vector, r.Capacity)
+		zeroVec := make(linalg.Vector, r.VectorSize)
+		for i := range upstream {
+			if i < r.readCount() {
+				upstream[i] = make(linalg.Vector, r.VectorSize)
+			} else {
+				upstream[i] = zeroVec
+			}
+		}
+	}
+	for i := 0; i < r.readCount(); i++ {
+		upstream[i].Add(dataGrad[i*r.VectorSize : (i+1)*r.VectorSize])
+	}
+	return upstream
+}
+
+type ringBufferState struct {
+	Last       *ringBufferState
+	Buffer     RingBuffer
+	Entries    []linalg.Vector
+	OutputData linalg.Vector
+	Control    linalg.Vector
+}
+
+func (r *ringBufferState) Data() linalg.Vector {
+	return r.OutputData
+}
+
+func (r *ringBufferState) Gradient(dataGrad linalg.Vector, upstreamGrad Grad) (linalg.Vector,
+	Grad) {
+	if r.Last == nil {
+		panic("cannot propagate through start state")
+	}
+
+	var upstream []linalg.Vector
+	if upstreamGrad != nil {
+		upstream = upstreamGrad.([]linalg.Vector)
+	}
+	upstream = r.Buffer.upstreamEntries(dataGrad, upstream)
+
+	softmax := autofunc.Softmax{}
+	flagVar := &autofunc.Variable{Vector: r.Control[:ringBufferFlagCount]}
+	flagRes := softmax.Apply(flagVar)
+	flags := flagRes.Output()
+	pushData := r.Control[ringBufferFlagCount:]
+
+	flagsDownstream := make(linalg.Vector, ringBufferFlagCount)
+	downstream := make([]linalg.Vector, len(upstream))
+	for i, v := range r.Last.Entries {
+		downstream[i] = upstream[i].Copy().Scale(flags[RingBufferNop])
+		flagsDownstream[RingBufferNop] += upstream[i].Dot(v)
+		if i+1 < len(upstream) {
+			downstream[i].Add(upstream[i+1].Copy().Scale(flags[RingBufferPush]))
+			flagsDownstream[RingBufferPush] += upstream[i+1].Dot(v)
+		}
+	}
+	flagsDownstream[RingBufferPush] += upstream[0].Dot(pushData)
+
+	controlDownstream := make(linalg.Vector, len(r.Control))
+	copy(controlDownstream[ringBufferFlagCount:],
+		upstream[0].Copy().Scale(flags[RingBufferPush]))
+	flagGrad := autofunc.Gradient{flagVar: controlDownstream[:ringBufferFlagCount]}
+	flagRes.PropagateGradient(flagsDownstream, flagGrad)
+
+	return controlDownstream, downstream
+}
+
+func (r *ringBufferState) NextState(control linalg.Vector) State {
+	softmax := autofunc.Softmax{}
+	flagVar := &autofunc.Variable{Vector: control[:ringBufferFlagCount]}
+	flags := softmax.Apply(flagVar).Output()
+	pushData := control[ringBufferFlagCount:]
+
+	newState := &ringBufferState{
+		Last:    r,
+		Buffer:  r.Buffer,
+		Entries: make([]linalg.Vector, len(r.Entries)),
+		Control: control,
+	}
+	for i, v := range r.Entries {
+		newState.Entries[i] = v.Copy().Scale(flags[RingBufferNop])
+		if i == 0 {
+			newState.Entries[i].Add(pushData.Copy().Scale(flags[RingBufferPush]))
+		} else {
+			newState.Entries[i].Add(r.Entries[i-1].Copy().Scale(flags[RingBufferPush]))
+		}
+	}
+	newState.OutputData = r.Buffer.joinEntries(newState.Entries)
+
+	return newState
+}
+
+// Detach returns a state with the same entries and no
+// history.
+func (r *ringBufferState) Detach() State {
+	res := &ringBufferState{
+		Buffer:     r.Buffer,
+		Entries:    make([]linalg.Vector, len(r.Entries)),
+		OutputData: r.OutputData.Copy(),
+	}
+	for i, entry := range r.Entries {
+		res.Entries[i] = entry.Copy()
+	}
+	return res
+}
+
+// DetachR is like Detach, but for an RState.
+func (r *ringBufferState) DetachR() RState {
+	res := &ringBufferRState{
+		Buffer:      r.Buffer,
+		Entries:     make([]linalg.Vector, len(r.Entries)),
+		REntries:    make([]linalg.Vector, len(r.Entries)),
+		OutputData:  r.OutputData.Copy(),
+		ROutputData: make(linalg.Vector, len(r.OutputData)),
+	}
+	for i, entry := range r.Entries {
+		res.Entries[i] = entry.Copy()
+		res.REntries[i] = make(linalg.Vector, len(entry))
+	}
+	return res
+}
+
+type ringBufferRState struct {
+	Last        *ringBufferRState
+	Buffer      RingBuffer
+	Entries     []linalg.Vector
+	REntries    []linalg.Vector
+	OutputData  linalg.Vector
+	ROutputData linalg.Vector
+	Control     linalg.Vector
+	ControlR    linalg.Vector
+}
+
+func (r *ringBufferRState) Data() linalg.Vector {
+	return r.OutputData
+}
+
+func (r *ringBufferRState) RData() linalg.Vector {
+	return r.ROutputData
+}
+
+func (r *ringBufferRState) RGradient(dataGrad, dataGradR linalg.Vector,
+	upstreamGrad RGrad) (linalg.Vector, linalg.Vector, RGrad) {
+	if r.Last == nil {
+		panic("cannot propagate through start state")
+	}
+
+	var upstream, upstreamR []linalg.Vector
+	if upstreamGrad != nil {
+		upstreamVal := upstreamGrad.([2][]linalg.Vector)
+		upstream = upstreamVal[0]
+		upstreamR = upstreamVal[1]
+	}
+	upstream = r.Buffer.upstreamEntries(dataGrad, upstream)
+	upstreamR = r.Buffer.upstreamEntries(dataGradR, upstreamR)
+
+	softmax := autofunc.Softmax{}
+	flagVar := &autofunc.Variable{Vector: r.Control[:ringBufferFlagCount]}
+	flagRVar := &autofunc.RVariable{
+		Variable:   flagVar,
+		ROutputVec: r.ControlR[:ringBufferFlagCount],
+	}
+	flagRes := softmax.ApplyR(autofunc.RVector{}, flagRVar)
+	flags := flagRes.Output()
+	flagsR := flagRes.ROutput()
+	pushData := r.Control[ringBufferFlagCount:]
+	pushDataR := r.ControlR[ringBufferFlagCount:]
+
+	flagsDownstream := make(linalg.Vector, ringBufferFlagCount)
+	flagsDownstreamR := make(linalg.Vector, ringBufferFlagCount)
+	downstream := make([]linalg.Vector, len(upstream))
+	downstreamR := make([]linalg.Vector, len(upstream))
+	for i, v := range r.Last.Entries {
+		vR := r.Last.REntries[i]
+		downstream[i] = upstream[i].Copy().Scale(flags[RingBufferNop])
+		downstreamR[i] = upstreamR[i].Copy().Scale(flags[RingBufferNop])
+		downstreamR[i].Add(upstream[i].Copy().Scale(flagsR[RingBufferNop]))
+		flagsDownstream[RingBufferNop] += upstream[i].Dot(v)
+		flagsDownstreamR[RingBufferNop] += upstreamR[i].Dot(v) + upstream[i].Dot(vR)
+		if i+1 < len(upstream) {
+			downstream[i].Add(upstream[i+1].Copy().Scale(flags[RingBufferPush]))
+			downstreamR[i].Add(upstreamR[i+1].Copy().Scale(flags[RingBufferPush]))
+			downstreamR[i].Add(upstream[i+1].Copy().Scale(flagsR[RingBufferPush]))
+			flagsDownstream[RingBufferPush] += upstream[i+1].Dot(v)
+			flagsDownstreamR[RingBufferPush] += upstreamR[i+1].Dot(v) +
+				upstream[i+1].Dot(vR)
+		}
+	}
+	flagsDownstream[RingBufferPush] += upstream[0].Dot(pushData)
+	flagsDownstreamR[RingBufferPush] += upstreamR[0].Dot(pushData) +
+		upstream[0].Dot(pushDataR)
+
+	controlDownstream := make(linalg.Vector, len(r.Control))
+	controlDownstreamR := make(linalg.Vector, len(r.Control))
+	copy(controlDownstream[ringBufferFlagCount:],
+		upstream[0].Copy().Scale(flags[RingBufferPush]))
+	pushDataDownstreamR := upstreamR[0].Copy().Scale(flags[RingBufferPush])
+	pushDataDownstreamR.Add(upstream[0].Copy().Scale(flagsR[RingBufferPush]))
+	copy(controlDownstreamR[ringBufferFlagCount:], pushDataDownstreamR)
+	flagGrad := autofunc.Gradient{flagVar: controlDownstream[:ringBufferFlagCount]}
+	flagRGrad := autofunc.RGradient{flagVar: controlDownstreamR[:ringBufferFlagCount]}
+	flagRes.PropagateRGradient(flagsDownstream, flagsDownstreamR, flagRGrad, flagGrad)
+
+	return controlDownstream, controlDownstreamR,
+		[2][]linalg.Vector{downstream, downstreamR}
+}
+
+func (r *ringBufferRState) NextRState(control, controlR linalg.Vector) RState {
+	softmax := autofunc.Softmax{}
+	flagVar := &autofunc.Variable{Vector: control[:ringBufferFlagCount]}
+	flagRVar := &autofunc.RVariable{
+		Variable:   flagVar,
+		ROutputVec: controlR[:ringBufferFlagCount],
+	}
+	flagRes := softmax.ApplyR(autofunc.RVector{}, flagRVar)
+	flags := flagRes.Output()
+	flagsR := flagRes.ROutput()
+	pushData := control[ringBufferFlagCount:]
+	pushDataR := controlR[ringBufferFlagCount:]
+
+	newState := &ringBufferRState{
+		Last:     r,
+		Buffer:   r.Buffer,
+		Entries:  make([]linalg.Vector, len(r.Entries)),
+		REntries: make([]linalg.Vector, len(r.Entries)),
+		Control:  control,
+		ControlR: controlR,
+	}
+	for i, v := range r.Entries {
+		vR := r.REntries[i]
+		newState.Entries[i] = v.Copy().Scale(flags[RingBufferNop])
+		newState.REntries[i] = v.Copy().Scale(flagsR[RingBufferNop])
+		newState.REntries[i].Add(vR.Copy().Scale(flags[RingBufferNop]))
+
+		shifted, shiftedR := pushData, pushDataR
+		if i > 0 {
+			shifted, shiftedR = r.Entries[i-1], r.REntries[i-1]
+		}
+		newState.Entries[i].Add(shifted.Copy().Scale(flags[RingBufferPush]))
+		newState.REntries[i].Add(shifted.Copy().Scale(flagsR[RingBufferPush]))
+		newState.REntries[i].Add(shiftedR.Copy().Scale(flags[RingBufferPush]))
+	}
+	newState.OutputData = r.Buffer.joinEntries(newState.Entries)
+	newState.ROutputData = r.Buffer.joinEntries(newState.REntries)
+
+	return newState
+}
@@ -0,0 +1,66 @@
+package neuralstruct
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestRingBufferData(t *testing.T) {
+	buffer := &RingBuffer{VectorSize: 2, Capacity: 3, ReadCount: 2}
+	state := buffer.StartState()
+
+	controls := []linalg.Vector{
+		{math.Log(0.25), math.Log(0.75), 1, 2},
+		{math.Log(0.5), math.Log(0.5), 3, 4},
+		{math.Log(0.9), math.Log(0.1), -1, 1},
+	}
+	expected := []linalg.Vector{
+		{0.75, 1.5, 0, 0},
+		{0.5*0.75 + 0.5*3, 0.5*1.5 + 0.5*4, 0.5 * 0.75, 0.5 * 1.5},
+		{0.9*1.875 + 0.1*-1, 0.9*2.75 + 0.1*1, 0.9*0.375 + 0.1*1.875,
+			0.9*0.75 + 0.1*2.75},
+	}
+
+	for i, control := range controls {
+		state = state.NextState(control)
+		if !statesEqual(state.Data(), expected[i]) {
+			t.Errorf("bad state %d: expected %v got %v", i, expected[i], state.Data())
+		}
+	}
+}
+
+func TestRingBufferDerivatives(t *testing.T) {
+	testAllDerivatives(t, &RingBuffer{VectorSize: 3, Capacity: 3, ReadCount: 2})
+}
+
+func BenchmarkRingBufferForward(b *testing.B) {
+	forwardBenchmark(b, &RingBuffer{VectorSize: benchmarkVectorSize, Capacity: 20})
+}
+
+func BenchmarkRingBufferBackward(b *testing.B) {
+	backwardBenchmark(b, &RingBuffer{VectorSize: benchmarkVectorSize, Capacity: 20})
+}
+
+func TestRingBufferValidation(t *testing.T) {
+	invalid := []*RingBuffer{
+		{VectorSize: 2},
+		{VectorSize: 2, Capacity: 2, ReadCount: 3},
+		{VectorSize: 2, Capacity: 2, ReadCount: -1},
+		{VectorSize: -1, Capacity: 2},
+	}
+	for i, buffer := range invalid {
+		if buffer.validate() == nil {
+			t.Errorf("buffer %d: expected an error", i)
+		}
+		data, _ := buffer.Serialize()
+		if _, err := DeserializeRingBuffer(data); err == nil {
+			t.Errorf("buffer %d: expected a deserialization error", i)
+		}
+	}
+	buffer := &RingBuffer{VectorSize: 2, Capacity: 2, ReadCount: 2}
+	if err := buffer.validate(); err != nil {
+		t.Error(err)
+	}
+}
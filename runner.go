@@ -4,15 +4,31 @@ import (
 	"github.com/unixpickle/autofunc"
 	"github.com/unixpickle/autofunc/seqfunc"
 	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/neuralnet"
 	"github.com/unixpickle/weakai/rnn"
 )
 
 // A Runner evaluates an rnn.Block which has been
 // given control over a Struct.
+//
+// If the Struct is an InferenceStruct, StepTime uses
+// forward-only states to save memory.
 type Runner struct {
 	Block  rnn.Block
 	Struct Struct
 
+	// Activate is like Block.Activate.
+	Activate bool
+
+	// Layout is like Block.Layout.
+	Layout BlockLayout
+
+	// ControlNet is like Block.ControlNet.
+	ControlNet neuralnet.Network
+
+	// Steps is like Block.Steps.
+	Steps int
+
 	curBlockState  rnn.State
 	curStructState State
 }
@@ -30,41 +46,77 @@ func (r *Runner) Reset() {
 // the next StepTime works off of the state caused by
 // this StepTime.
 func (r *Runner) StepTime(input linalg.Vector) linalg.Vector {
-	res := r.StepTimeFull(input)
-	return res[r.Struct.ControlSize():]
+	data, res := r.step(input)
+	_, rest := r.block().splitOutput(res)
+	return r.Layout.output(rest, data)
 }
 
 // StepTimeFull is like StepTime, but instead of returning
 // part of the block's output, it returns the entire
 // output (including the control data).
+// The output never includes skipped data, regardless of
+// the Layout.
 func (r *Runner) StepTimeFull(input linalg.Vector) linalg.Vector {
+	_, res := r.step(input)
+	return res
+}
+
+// step runs a timestep and returns the struct data which
+// was fed to the block, along with the block's output.
+// If there are multiple micro-steps, the results are from
+// the last one.
+func (r *Runner) step(input linalg.Vector) (data, output linalg.Vector) {
 	if r.curBlockState == nil {
 		r.curBlockState = r.Block.StartState()
-		r.curStructState = r.Struct.StartState()
+		r.curStructState = startInferenceState(r.Struct)
+	}
+	for i := 0; i < r.Steps || i == 0; i++ {
+		data, output = r.microStep(input)
 	}
-	augmentedIn := make(linalg.Vector, len(r.curStructState.Data())+len(input))
-	copy(augmentedIn, r.curStructState.Data())
-	copy(augmentedIn[len(r.curStructState.Data()):], input)
+	return
+}
+
+func (r *Runner) microStep(input linalg.Vector) (data, output linalg.Vector) {
+	// Inference states may overwrite their data in place.
+	data = r.curStructState.Data().Copy()
+	augmentedIn := r.Layout.joinInput(data, input)
 
 	inRes := []autofunc.Result{&autofunc.Variable{Vector: augmentedIn}}
 	out := r.Block.ApplyBlock([]rnn.State{r.curBlockState}, inRes)
 
-	ctrl := out.Outputs()[0][:r.Struct.ControlSize()]
+	block := r.block()
+	ctrl, _ := block.splitOutput(out.Outputs()[0])
+	if net := block.controlNet(); net != nil {
+		ctrl = net.Apply(&autofunc.Variable{Vector: ctrl}).Output()
+	}
 
 	r.curStructState = r.curStructState.NextState(ctrl)
 	r.curBlockState = out.States()[0]
 
-	return out.Outputs()[0]
+	return data, out.Outputs()[0]
 }
 
 // RunAll applies the RNN to a batch of sequences.
 // It does not affect the state used by StepTime.
 func (r *Runner) RunAll(seqs [][]linalg.Vector) [][]linalg.Vector {
 	constIn := seqfunc.ConstResult(seqs)
-	sf := &rnn.BlockSeqFunc{B: &Block{Block: r.Block, Struct: &nopRStruct{r.Struct}}}
+	sf := &rnn.BlockSeqFunc{B: r.block()}
 	return sf.ApplySeqs(constIn).OutputSeqs()
 }
 
+// block returns a Block with the same configuration as
+// the Runner.
+func (r *Runner) block() *Block {
+	return &Block{
+		Block:      r.Block,
+		Struct:     &nopRStruct{r.Struct},
+		Activate:   r.Activate,
+		Layout:     r.Layout,
+		ControlNet: r.ControlNet,
+		Steps:      r.Steps,
+	}
+}
+
 type nopRStruct struct {
 	Struct
 }
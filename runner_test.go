@@ -14,6 +14,44 @@ import (
 const runnerTestSeqLen = 4
 
 func TestRunner(t *testing.T) {
+	testRunner(t, Runner{})
+}
+
+func TestRunnerActivate(t *testing.T) {
+	testRunner(t, Runner{Activate: true})
+}
+
+func TestRunnerLayout(t *testing.T) {
+	testRunner(t, Runner{
+		Activate: true,
+		Layout: BlockLayout{
+			Data:     DataInterleave,
+			Control:  ControlTail,
+			SkipData: true,
+		},
+	})
+}
+
+func TestRunnerControlNet(t *testing.T) {
+	controlNet := neuralnet.Network{
+		&neuralnet.DenseLayer{
+			InputCount:  11,
+			OutputCount: 8,
+		},
+	}
+	controlNet.Randomize()
+	testRunner(t, Runner{Activate: true, ControlNet: controlNet})
+}
+
+func TestRunnerSteps(t *testing.T) {
+	testRunner(t, Runner{Activate: true, Steps: 3})
+}
+
+// testRunner makes sure that a Runner behaves like the
+// equivalent Block.
+// The Block and Struct of the runner are set by this
+// function.
+func testRunner(t *testing.T, runner Runner) {
 	outNet := neuralnet.Network{
 		&neuralnet.DenseLayer{
 			InputCount:  5,
@@ -25,9 +63,10 @@ func TestRunner(t *testing.T) {
 		rnn.NewLSTM(6, 5),
 		rnn.NewNetworkBlock(outNet, 0),
 	}
-	structure := &Stack{VectorSize: 4}
+	structure := &Stack{VectorSize: 4, PushBias: 1}
 
-	runner := Runner{Block: block, Struct: structure}
+	runner.Block = block
+	runner.Struct = structure
 	inputSeq := make([]linalg.Vector, runnerTestSeqLen)
 	outputs := make([]linalg.Vector, runnerTestSeqLen)
 
@@ -42,8 +81,12 @@ func TestRunner(t *testing.T) {
 
 	seqFunc := &rnn.BlockSeqFunc{
 		B: &Block{
-			Block:  block,
-			Struct: structure,
+			Block:      block,
+			Struct:     structure,
+			Activate:   runner.Activate,
+			Layout:     runner.Layout,
+			ControlNet: runner.ControlNet,
+			Steps:      runner.Steps,
 		},
 	}
 	inRes := seqfunc.ConstResult([][]linalg.Vector{inputSeq})
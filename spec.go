@@ -0,0 +1,312 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rnn"
+)
+
+// These are the struct types supported by StructSpec.
+const (
+	StackSpecType     = "stack"
+	QueueSpecType     = "queue"
+	AggregateSpecType = "aggregate"
+)
+
+// These are the flag normalizations supported by
+// StructSpec, corresponding to the FlagNormKind values.
+const (
+	SoftmaxFlagSpec   = "softmax"
+	SparsemaxFlagSpec = "sparsemax"
+	GumbelFlagSpec    = "gumbel"
+)
+
+// A StructSpec is a declarative description of a Struct,
+// suitable for storing in a JSON config file.
+type StructSpec struct {
+	// Type is one of the *SpecType constants.
+	Type string `json:"type"`
+
+	// These fields are used by stacks and queues.
+	VectorSize int     `json:"vectorSize,omitempty"`
+	NoReplace  bool    `json:"noReplace,omitempty"`
+	PushBias   float64 `json:"pushBias,omitempty"`
+	Checkpoint int     `json:"checkpoint,omitempty"`
+	Float32    bool    `json:"float32,omitempty"`
+
+	// LogSpace is only used by queues.
+	LogSpace bool `json:"logSpace,omitempty"`
+
+	// These fields describe the FlagNorm of a stack or
+	// queue.
+	// FlagKind is one of the *FlagSpec constants, and it
+	// defaults to SoftmaxFlagSpec.
+	FlagKind    string  `json:"flagKind,omitempty"`
+	Temperature float64 `json:"temperature,omitempty"`
+	HardFlags   bool    `json:"hardFlags,omitempty"`
+
+	// Structs lists the sub-structures of an aggregate.
+	Structs []*StructSpec `json:"structs,omitempty"`
+}
+
+// StructToSpec creates a StructSpec for a Struct.
+// It fails if the Struct cannot be described by a spec.
+func StructToSpec(s Struct) (*StructSpec, error) {
+	switch s := s.(type) {
+	case *Stack:
+		res := &StructSpec{
+			Type:       StackSpecType,
+			VectorSize: s.VectorSize,
+			NoReplace:  s.NoReplace,
+			PushBias:   s.PushBias,
+			Checkpoint: s.Checkpoint,
+			Float32:    s.Float32,
+		}
+		if err := res.setFlagNorm(s.FlagNorm); err != nil {
+			return nil, err
+		}
+		return res, nil
+	case *Queue:
+		res := &StructSpec{
+			Type:       QueueSpecType,
+			VectorSize: s.VectorSize,
+			PushBias:   s.PushBias,
+			Checkpoint: s.Checkpoint,
+			Float32:    s.Float32,
+			LogSpace:   s.LogSpace,
+		}
+		if err := res.setFlagNorm(s.FlagNorm); err != nil {
+			return nil, err
+		}
+		return res, nil
+	case Aggregate:
+		return aggregateToSpec(s)
+	case RAggregate:
+		return aggregateToSpec(s.aggregate())
+	default:
+		return nil, fmt.Errorf("unsupported struct type: %T", s)
+	}
+}
+
+func aggregateToSpec(a Aggregate) (*StructSpec, error) {
+	res := &StructSpec{Type: AggregateSpecType}
+	for _, sub := range a {
+		subSpec, err := StructToSpec(sub)
+		if err != nil {
+			return nil, err
+		}
+		res.Structs = append(res.Structs, subSpec)
+	}
+	return res, nil
+}
+
+// Build creates the Struct described by the spec.
+func (s *StructSpec) Build() (RStruct, error) {
+	switch s.Type {
+	case StackSpecType:
+		if s.VectorSize <= 0 {
+			return nil, errors.New("stack needs a positive vector size")
+		}
+		if s.Checkpoint < 0 {
+			return nil, errors.New("stack needs a non-negative checkpoint interval")
+		}
+		if s.LogSpace {
+			return nil, errors.New("stack does not support logSpace")
+		}
+		flagNorm, err := s.flagNorm()
+		if err != nil {
+			return nil, fmt.Errorf("stack: %s", err)
+		}
+		return &Stack{VectorSize: s.VectorSize, NoReplace: s.NoReplace,
+			PushBias: s.PushBias, Checkpoint: s.Checkpoint, Float32: s.Float32,
+			FlagNorm: flagNorm}, nil
+	case QueueSpecType:
+		if s.VectorSize <= 0 {
+			return nil, errors.New("queue needs a positive vector size")
+		}
+		if s.Checkpoint < 0 {
+			return nil, errors.New("queue needs a non-negative checkpoint interval")
+		}
+		if s.NoReplace {
+			return nil, errors.New("queue does not support noReplace")
+		}
+		flagNorm, err := s.flagNorm()
+		if err != nil {
+			return nil, fmt.Errorf("queue: %s", err)
+		}
+		return &Queue{VectorSize: s.VectorSize, PushBias: s.PushBias,
+			Checkpoint: s.Checkpoint, Float32: s.Float32, LogSpace: s.LogSpace,
+			FlagNorm: flagNorm}, nil
+	case AggregateSpecType:
+		if len(s.Structs) == 0 {
+			return nil, errors.New("aggregate needs at least one struct")
+		}
+		var res RAggregate
+		for _, sub := range s.Structs {
+			subStruct, err := sub.Build()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, subStruct)
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("unknown struct type: %s", s.Type)
+	}
+}
+
+// setFlagNorm fills in the FlagNorm fields of a stack or
+// queue spec.
+func (s *StructSpec) setFlagNorm(f FlagNorm) error {
+	switch f.Kind {
+	case FlagSoftmax:
+		s.FlagKind = ""
+	case FlagSparsemax:
+		s.FlagKind = SparsemaxFlagSpec
+	case FlagGumbel:
+		s.FlagKind = GumbelFlagSpec
+	default:
+		return fmt.Errorf("unsupported flag kind: %d", f.Kind)
+	}
+	s.Temperature = f.Temperature
+	s.HardFlags = f.Hard
+	return nil
+}
+
+// flagNorm creates the FlagNorm of a stack or queue spec.
+func (s *StructSpec) flagNorm() (FlagNorm, error) {
+	var kind FlagNormKind
+	switch s.FlagKind {
+	case "", SoftmaxFlagSpec:
+		kind = FlagSoftmax
+	case SparsemaxFlagSpec:
+		kind = FlagSparsemax
+	case GumbelFlagSpec:
+		kind = FlagGumbel
+	default:
+		return FlagNorm{}, fmt.Errorf("unknown flag kind: %s", s.FlagKind)
+	}
+	if s.Temperature < 0 {
+		return FlagNorm{}, errors.New("temperature must be non-negative")
+	}
+	if s.HardFlags && kind != FlagGumbel {
+		return FlagNorm{}, errors.New("hardFlags requires the gumbel flag kind")
+	}
+	return FlagNorm{Kind: kind, Temperature: s.Temperature, Hard: s.HardFlags}, nil
+}
+
+// A ControllerSpec describes the RNN which controls a
+// Struct.
+//
+// The controller consists of stacked LSTMs followed by a
+// feed-forward output network.
+// The output network has zero or more hidden layers with
+// hyperbolic tangent activations, followed by a linear
+// layer which produces the control vector and the model
+// outputs.
+type ControllerSpec struct {
+	// LSTM lists the state size of each LSTM layer.
+	LSTM []int `json:"lstm"`
+
+	// Hidden lists the size of each hidden layer in the
+	// output network.
+	Hidden []int `json:"hidden,omitempty"`
+}
+
+// A ModelSpec is a declarative description of a model
+// consisting of a Struct and its controller.
+type ModelSpec struct {
+	InputSize  int            `json:"inputSize"`
+	OutputSize int            `json:"outputSize"`
+	Struct     StructSpec     `json:"struct"`
+	Controller ControllerSpec `json:"controller"`
+
+	// Activation indicates whether the struct's suggested
+	// activation (if it has one) should be applied to the
+	// control vector.
+	Activation bool `json:"activation,omitempty"`
+}
+
+// ParseModelSpec decodes a JSON ModelSpec.
+//
+// Other config formats, such as YAML, should be converted
+// to JSON before they are parsed.
+func ParseModelSpec(data []byte) (*ModelSpec, error) {
+	var res ModelSpec
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Marshal encodes the spec as JSON.
+func (m *ModelSpec) Marshal() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// Build creates a randomly initialized model from the
+// spec.
+func (m *ModelSpec) Build() (*Model, error) {
+	structure, err := m.Struct.Build()
+	if err != nil {
+		return nil, err
+	}
+	if m.InputSize < 0 || m.OutputSize < 0 {
+		return nil, errors.New("input and output sizes must be non-negative")
+	}
+	if len(m.Controller.LSTM) == 0 {
+		return nil, errors.New("controller needs at least one LSTM layer")
+	}
+
+	var controller rnn.StackedBlock
+	inSize := m.InputSize + structure.DataSize()
+	for _, size := range m.Controller.LSTM {
+		controller = append(controller, rnn.NewLSTM(inSize, size))
+		inSize = size
+	}
+
+	var outNet neuralnet.Network
+	for _, size := range m.Controller.Hidden {
+		outNet = append(outNet, &neuralnet.DenseLayer{
+			InputCount:  inSize,
+			OutputCount: size,
+		}, &neuralnet.HyperbolicTangent{})
+		inSize = size
+	}
+	outNet = append(outNet, &neuralnet.DenseLayer{
+		InputCount:  inSize,
+		OutputCount: structure.ControlSize() + m.OutputSize,
+	})
+	outNet.Randomize()
+	controller = append(controller, rnn.NewNetworkBlock(outNet, 0))
+
+	// The activation is applied by the Block and Runner,
+	// rather than being baked into outNet, so that it
+	// follows changes to the struct, such as new flag
+	// temperatures from a TemperatureSchedule.
+	block := &Block{Block: controller, Struct: structure, Activate: m.Activation}
+	specCopy := *m
+	return &Model{
+		Spec:   &specCopy,
+		Block:  block,
+		Runner: &Runner{Block: controller, Struct: structure, Activate: m.Activation},
+	}, nil
+}
+
+// A Model is a Struct and its controller, as built from
+// a ModelSpec.
+type Model struct {
+	// Spec is the spec which produced the model.
+	Spec *ModelSpec
+
+	// Block is the controller with access to the Struct,
+	// suitable for training.
+	Block *Block
+
+	// Runner evaluates the controller one timestep at a
+	// time.
+	Runner *Runner
+}
@@ -0,0 +1,126 @@
+package neuralstruct
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+const testModelSpec = `{
+  "inputSize": 3,
+  "outputSize": 2,
+  "struct": {
+    "type": "aggregate",
+    "structs": [
+      {"type": "stack", "vectorSize": 4, "noReplace": true, "pushBias": 1},
+      {"type": "queue", "vectorSize": 2, "temperature": 0.5},
+      {"type": "stack", "vectorSize": 2, "checkpoint": 3, "float32": true,
+       "flagKind": "gumbel", "hardFlags": true},
+      {"type": "queue", "vectorSize": 2, "logSpace": true, "flagKind": "sparsemax"}
+    ]
+  },
+  "controller": {"lstm": [5, 6], "hidden": [7]},
+  "activation": true
+}`
+
+func TestModelSpecBuild(t *testing.T) {
+	spec, err := ParseModelSpec([]byte(testModelSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, err := spec.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStruct := RAggregate{
+		&Stack{VectorSize: 4, NoReplace: true, PushBias: 1},
+		&Queue{VectorSize: 2, FlagNorm: FlagNorm{Temperature: 0.5}},
+		&Stack{VectorSize: 2, Checkpoint: 3, Float32: true,
+			FlagNorm: FlagNorm{Kind: FlagGumbel, Hard: true}},
+		&Queue{VectorSize: 2, LogSpace: true, FlagNorm: FlagNorm{Kind: FlagSparsemax}},
+	}
+	if !reflect.DeepEqual(model.Block.Struct, expectedStruct) {
+		t.Errorf("expected struct %v but got %v", expectedStruct, model.Block.Struct)
+	}
+	for i := 0; i < 3; i++ {
+		out := model.Runner.StepTime(linalg.Vector{1, -1, 0.5})
+		if len(out) != spec.OutputSize {
+			t.Fatalf("expected output size %d but got %d", spec.OutputSize, len(out))
+		}
+	}
+
+	structSpec, err := StructToSpec(model.Block.Struct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(structSpec, &spec.Struct) {
+		t.Errorf("expected spec %v but got %v", spec.Struct, structSpec)
+	}
+
+	encoded, err := model.Spec.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ParseModelSpec(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, spec) {
+		t.Errorf("expected %v but got %v", spec, decoded)
+	}
+}
+
+func TestModelSpecTemperature(t *testing.T) {
+	spec := &ModelSpec{
+		InputSize:  3,
+		OutputSize: 2,
+		Struct:     StructSpec{Type: StackSpecType, VectorSize: 3, PushBias: 1},
+		Controller: ControllerSpec{LSTM: []int{5}},
+		Activation: true,
+	}
+	model, err := spec.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := &TemperatureSchedule{Initial: 1, Final: 0.1, Decay: 0.5}
+	schedule.Apply(model.Block.Struct, 2)
+	for i, block := range []*Block{model.Block, model.Runner.block()} {
+		activation, ok := block.activation().(*PartialActivation)
+		if !ok {
+			t.Errorf("block %d: expected a PartialActivation but got %T", i,
+				block.activation())
+			continue
+		}
+		rescale := activation.Activations[0].(*neuralnet.RescaleLayer)
+		if rescale.Bias != 0.25 {
+			t.Errorf("block %d: expected push bias 0.25 but got %f", i, rescale.Bias)
+		}
+	}
+}
+
+func TestModelSpecErrors(t *testing.T) {
+	specs := []*ModelSpec{
+		{Struct: StructSpec{Type: "heap", VectorSize: 3}, Controller: ControllerSpec{LSTM: []int{3}}},
+		{Struct: StructSpec{Type: StackSpecType}, Controller: ControllerSpec{LSTM: []int{3}}},
+		{Struct: StructSpec{Type: StackSpecType, VectorSize: 3}},
+		{Struct: StructSpec{Type: AggregateSpecType}, Controller: ControllerSpec{LSTM: []int{3}}},
+		{Struct: StructSpec{Type: QueueSpecType, VectorSize: 3, Temperature: -1},
+			Controller: ControllerSpec{LSTM: []int{3}}},
+		{Struct: StructSpec{Type: QueueSpecType, VectorSize: 3, FlagKind: "argmax"},
+			Controller: ControllerSpec{LSTM: []int{3}}},
+		{Struct: StructSpec{Type: StackSpecType, VectorSize: 3, HardFlags: true},
+			Controller: ControllerSpec{LSTM: []int{3}}},
+		{Struct: StructSpec{Type: StackSpecType, VectorSize: 3, LogSpace: true},
+			Controller: ControllerSpec{LSTM: []int{3}}},
+		{Struct: StructSpec{Type: QueueSpecType, VectorSize: 3, Checkpoint: -1},
+			Controller: ControllerSpec{LSTM: []int{3}}},
+	}
+	for i, spec := range specs {
+		if _, err := spec.Build(); err == nil {
+			t.Errorf("spec %d: expected error", i)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package neuralstruct
 import (
 	"encoding/json"
 
-	"github.com/unixpickle/autofunc"
 	"github.com/unixpickle/num-analysis/linalg"
 	"github.com/unixpickle/serializer"
 	"github.com/unixpickle/weakai/neuralnet"
@@ -34,7 +33,37 @@ type Stack struct {
 	// from the SuggestedActivation() method.
 	// Reasonable values are -1, 0, or 1, for pushing being
 	// e times less likely, unbiased, or e times more likely.
+	// The bias is scaled by the flag temperature, so these
+	// odds hold at the temperature the activation was
+	// created with.
 	PushBias float64
+
+	// Checkpoint, if greater than 1, enables gradient
+	// checkpointing.
+	// In this mode, only every Checkpoint-th state keeps
+	// the full stack contents once it has been advanced;
+	// the contents of other states are recomputed from
+	// the nearest checkpoint when they are needed again.
+	// This saves memory at the cost of extra computation.
+	//
+	// Since advancing a state may discard its contents, a
+	// state should not be advanced concurrently with any
+	// other use of that state.
+	// This only affects States, not RStates.
+	Checkpoint int
+
+	// Float32, if true, makes States store their contents
+	// as float32 values, halving the memory used by long
+	// sequences.
+	// Computations are still done with float64 values, so
+	// the results only differ from those of a float64
+	// Stack by rounding errors.
+	// This only affects States, not RStates.
+	Float32 bool
+
+	// FlagNorm determines how the flag probabilities are
+	// computed from the control vectors.
+	FlagNorm FlagNorm
 }
 
 // DeserializeStack deserializes a Stack.
@@ -62,6 +91,12 @@ func (s *Stack) StartState() State {
 	return &stackState{Stack: *s}
 }
 
+// StartInferenceState returns the empty stack as a
+// forward-only state.
+func (s *Stack) StartInferenceState() State {
+	return &stackInferenceState{Stack: *s, Flags: make(linalg.Vector, s.flagCount())}
+}
+
 // StartRState returns the empty stack.
 func (s *Stack) StartRState() RState {
 	return &stackRState{Stack: *s}
@@ -90,12 +125,17 @@ func (s *Stack) SuggestedActivation() neuralnet.Layer {
 		res.Ranges = append([]ComponentRange{{Start: StackPush, End: StackPush + 1}},
 			res.Ranges...)
 		res.Activations = append([]neuralnet.Layer{
-			&neuralnet.RescaleLayer{Scale: 1, Bias: s.PushBias},
+			&neuralnet.RescaleLayer{Scale: 1, Bias: s.PushBias * s.FlagNorm.temperature()},
 		}, res.Activations...)
 	}
 	return res
 }
 
+// FlagNames returns the names of the control flags.
+func (s *Stack) FlagNames() []string {
+	return []string{"nop", "push", "pop", "replace"}[:s.flagCount()]
+}
+
 func (s *Stack) flagCount() int {
 	if s.NoReplace {
 		return 3
@@ -104,153 +144,681 @@ func (s *Stack) flagCount() int {
 	}
 }
 
-type stackState struct {
-	Last     *stackState
-	Stack    Stack
-	Expected []linalg.Vector
-	Control  linalg.Vector
+// MixStates computes a weighted sum of stack states.
+// Stacks with fewer entries are padded with zeroes.
+func (s *Stack) MixStates(states []State, weights linalg.Vector) State {
+	var size int
+	stateExpected := make([]linalg.Vector, len(states))
+	for i, state := range states {
+		stateExpected[i] = state.(*stackState).expected()
+		if l := len(stateExpected[i]); l > size {
+			size = l
+		}
+	}
+	expected := make(linalg.Vector, size)
+	for i, stateExpected := range stateExpected {
+		addScaled(expected[:len(stateExpected)], stateExpected, weights[i])
+	}
+	res := &stackState{Stack: *s}
+	res.setExpected(expected)
+	return res
 }
 
-func (s *stackState) Data() linalg.Vector {
-	if len(s.Expected) == 0 {
-		return make(linalg.Vector, s.Stack.VectorSize)
+// MixGradient propagates a gradient through MixStates.
+func (s *Stack) MixGradient(states []State, weights, dataGrad linalg.Vector,
+	upstream Grad) (linalg.Vector, []Grad) {
+	var size int
+	stateExpected := make([]linalg.Vector, len(states))
+	for i, state := range states {
+		stateExpected[i] = state.(*stackState).expected()
+		if l := len(stateExpected[i]); l > size {
+			size = l
+		}
 	}
-	return s.Expected[0]
+	var upstreamVec linalg.Vector
+	if upstream != nil {
+		upstreamVec = upstream.(linalg.Vector)
+	}
+	upstreamVec = s.upstreamExpected(dataGrad, upstreamVec, size)
+
+	weightsGrad := make(linalg.Vector, len(states))
+	grads := make([]Grad, len(states))
+	for i, expected := range stateExpected {
+		stateUpstream := upstreamVec[:len(expected)]
+		weightsGrad[i] = expected.Dot(stateUpstream)
+		grads[i] = stateUpstream.Copy().Scale(weights[i])
+	}
+	return weightsGrad, grads
 }
 
-func (s *stackState) Gradient(dataGrad linalg.Vector, upstreamGrad Grad) (linalg.Vector, Grad) {
-	if s.Last == nil {
-		panic("cannot propagate through start state")
+// AddGrads adds two upstream gradients for a stack state.
+func (s *Stack) AddGrads(g1, g2 Grad) Grad {
+	if g1 == nil {
+		return g2
+	} else if g2 == nil {
+		return g1
 	}
+	return g1.(linalg.Vector).Add(g2.(linalg.Vector))
+}
 
-	var upstream []linalg.Vector
-	if upstreamGrad != nil {
-		upstream = upstreamGrad.([]linalg.Vector)
-		upstream[0].Add(dataGrad)
-	} else {
-		upstream = make([]linalg.Vector, len(s.Expected))
-		upstream[0] = dataGrad
-		zeroGrad := make(linalg.Vector, len(dataGrad))
-		for i := 1; i < len(upstream); i++ {
-			upstream[i] = zeroGrad
+// MixRStates is like MixStates, but for RStates.
+func (s *Stack) MixRStates(states []RState, weights, weightsR linalg.Vector) RState {
+	var size int
+	for _, state := range states {
+		if l := len(state.(*stackRState).Expected); l > size {
+			size = l
 		}
 	}
+	expected := make(linalg.Vector, size)
+	expectedR := make(linalg.Vector, size)
+	for i, stateObj := range states {
+		state := stateObj.(*stackRState)
+		n := len(state.Expected)
+		addScaled(expected[:n], state.Expected, weights[i])
+		addScaled(expectedR[:n], state.ExpectedR, weights[i])
+		addScaled(expectedR[:n], state.Expected, weightsR[i])
+	}
+	return &stackRState{Stack: *s, Expected: expected, ExpectedR: expectedR}
+}
 
-	softmax := autofunc.Softmax{}
-	flagVar := &autofunc.Variable{Vector: s.Control[:s.Stack.flagCount()]}
-	flagRes := softmax.Apply(flagVar)
-	flags := flagRes.Output()
-	controlData := s.Control[s.Stack.flagCount():]
+// MixRGradient propagates a gradient through MixRStates.
+func (s *Stack) MixRGradient(states []RState, weights, weightsR, dataGrad,
+	dataGradR linalg.Vector, upstream RGrad) (linalg.Vector, linalg.Vector, []RGrad) {
+	var size int
+	for _, state := range states {
+		if l := len(state.(*stackRState).Expected); l > size {
+			size = l
+		}
+	}
+	var upstreamVec, upstreamVecR linalg.Vector
+	if upstream != nil {
+		upstreamVal := upstream.([2]linalg.Vector)
+		upstreamVec, upstreamVecR = upstreamVal[0], upstreamVal[1]
+	}
+	upstreamVec = s.upstreamExpected(dataGrad, upstreamVec, size)
+	upstreamVecR = s.upstreamExpected(dataGradR, upstreamVecR, size)
+
+	weightsGrad := make(linalg.Vector, len(states))
+	weightsGradR := make(linalg.Vector, len(states))
+	grads := make([]RGrad, len(states))
+	for i, stateObj := range states {
+		state := stateObj.(*stackRState)
+		stateUpstream := upstreamVec[:len(state.Expected)]
+		stateUpstreamR := upstreamVecR[:len(state.Expected)]
+		weightsGrad[i] = state.Expected.Dot(stateUpstream)
+		weightsGradR[i] = state.ExpectedR.Dot(stateUpstream) +
+			state.Expected.Dot(stateUpstreamR)
+		grad := stateUpstream.Copy().Scale(weights[i])
+		gradR := stateUpstreamR.Copy().Scale(weights[i])
+		addScaled(gradR, stateUpstream, weightsR[i])
+		grads[i] = [2]linalg.Vector{grad, gradR}
+	}
+	return weightsGrad, weightsGradR, grads
+}
+
+// AddRGrads adds two upstream r-gradients for a stack
+// state.
+func (s *Stack) AddRGrads(g1, g2 RGrad) RGrad {
+	if g1 == nil {
+		return g2
+	} else if g2 == nil {
+		return g1
+	}
+	v1, v2 := g1.([2]linalg.Vector), g2.([2]linalg.Vector)
+	v1[0].Add(v2[0])
+	v1[1].Add(v2[1])
+	return v1
+}
+
+// NextStates advances a batch of stack states.
+//
+// States with the same depth are advanced together, with
+// their contents stored as the rows of one matrix.
+func (s *Stack) NextStates(states []State, controls []linalg.Vector) []State {
+	lastExpected := make([]linalg.Vector, len(states))
+	for i, state := range states {
+		lastExpected[i] = state.(*stackState).expected()
+	}
+	res := make([]State, len(states))
+	groups := batchGroups(len(states), func(i int) int {
+		return len(lastExpected[i])
+	})
+	for _, group := range groups {
+		groupStates := make([]*stackState, len(group))
+		groupExpected := make([]linalg.Vector, len(group))
+		groupControls := make([]linalg.Vector, len(group))
+		for i, idx := range group {
+			groupStates[i] = states[idx].(*stackState)
+			groupExpected[i] = lastExpected[idx]
+			groupControls[i] = controls[idx]
+		}
+		next := s.nextStateRows(groupStates, groupExpected, groupControls)
+		for i, idx := range group {
+			res[idx] = next[i]
+		}
+	}
+	for _, state := range states {
+		state.(*stackState).discard()
+	}
+	return res
+}
 
-	flagsDownstream := make(linalg.Vector, len(flags))
-	downstream := make([]linalg.Vector, len(s.Last.Expected))
+// nextStateRows advances a batch of stack states which
+// all have the same depth, given their expected contents.
+func (s *Stack) nextStateRows(states []*stackState, lastExpected,
+	controls []linalg.Vector) []State {
+	flagCount := s.flagCount()
+	noises := s.FlagNorm.batchNoise(len(states), flagCount)
+	flags := s.FlagNorm.batchApply(controls, noises, flagCount)
+	last := joinRows(lastExpected, len(lastExpected[0]))
+	ctrl := joinRows(controls, s.ControlSize())
+
+	next := newRowMatrix(len(states), last.Cols+s.VectorSize)
+	s.addNextExpectedRows(next, last, flags, ctrl.Columns(flagCount, ctrl.Cols))
+
+	newStates := make([]stackState, len(states))
+	res := make([]State, len(states))
+	for i, state := range states {
+		newStates[i] = stackState{
+			Last:    state,
+			Stack:   *s,
+			Control: controls[i],
+			Depth:   state.Depth + 1,
+		}
+		if noises != nil {
+			newStates[i].Noise = noises[i]
+		}
+		newStates[i].setExpected(next.Row(i))
+		res[i] = &newStates[i]
+	}
+	return res
+}
 
-	for i, v := range s.Last.Expected {
-		scaler := flags[StackNop]
-		if i != 0 && !s.Stack.NoReplace {
-			scaler += flags[StackReplace]
+// StateGradients propagates gradients through a batch of
+// stack states.
+//
+// Like NextStates, this handles states of the same depth
+// together as the rows of one matrix.
+func (s *Stack) StateGradients(states []State, dataGrads []linalg.Vector,
+	upstream []Grad) ([]linalg.Vector, []Grad) {
+	lastExpected := make([]linalg.Vector, len(states))
+	for i, state := range states {
+		state := state.(*stackState)
+		if state.Last == nil {
+			panic("cannot propagate through start state")
 		}
-		downstream[i] = upstream[i].Copy().Scale(scaler)
+		lastExpected[i] = state.Last.expected()
+	}
+	ctrlGrads := make([]linalg.Vector, len(states))
+	downGrads := make([]Grad, len(states))
+	groups := batchGroups(len(states), func(i int) int {
+		return len(lastExpected[i])
+	})
+	for _, group := range groups {
+		groupStates := make([]*stackState, len(group))
+		groupExpected := make([]linalg.Vector, len(group))
+		groupDataGrads := make([]linalg.Vector, len(group))
+		groupUpstream := make([]linalg.Vector, len(group))
+		for i, idx := range group {
+			groupStates[i] = states[idx].(*stackState)
+			groupExpected[i] = lastExpected[idx]
+			groupDataGrads[i] = dataGrads[idx]
+			if upstream != nil && upstream[idx] != nil {
+				groupUpstream[i] = upstream[idx].(linalg.Vector)
+			}
+		}
+		ctrl, down := s.stateGradientRows(groupStates, groupExpected, groupDataGrads,
+			groupUpstream)
+		for i, idx := range group {
+			ctrlGrads[idx] = ctrl.Row(i)
+			downGrads[idx] = down.Row(i)
+		}
+	}
+	return ctrlGrads, downGrads
+}
+
+// stateGradientRows propagates gradients through a batch
+// of stack states which all have the same depth.
+// The entries of upstream may be nil.
+func (s *Stack) stateGradientRows(states []*stackState, lastExpected, dataGrads,
+	upstream []linalg.Vector) (ctrlGrad, down rowMatrix) {
+	flagCount := s.flagCount()
+	controls := make([]linalg.Vector, len(states))
+	noises := make([]linalg.Vector, len(states))
+	for i, state := range states {
+		controls[i] = state.Control
+		noises[i] = state.Noise
+	}
+	flags := s.FlagNorm.batchApply(controls, noises, flagCount)
+	last := joinRows(lastExpected, len(lastExpected[0]))
+	ctrl := joinRows(controls, s.ControlSize())
+	up := joinRows(upstream, last.Cols+s.VectorSize)
+	for i, dataGrad := range dataGrads {
+		up.Row(i)[:len(dataGrad)].Add(dataGrad)
+	}
+
+	flagsGrad := newRowMatrix(len(states), flagCount)
+	ctrlGrad = newRowMatrix(len(states), s.ControlSize())
+	down = newRowMatrix(len(states), last.Cols)
+	s.addExpectedGradientRows(flagsGrad, ctrlGrad.Columns(flagCount, ctrlGrad.Cols), down,
+		last, flags, ctrl.Columns(flagCount, ctrl.Cols), up)
+	for i, state := range states {
+		s.FlagNorm.addGradient(ctrlGrad.Row(i)[:flagCount], state.Control[:flagCount],
+			state.Noise, flagsGrad.Row(i))
+	}
+	return
+}
+
+// upstreamExpected creates an upstream gradient for the
+// expected stack contents by adding a data gradient to
+// an optional upstream gradient from the next state.
+// The dataGrad argument is not modified.
+func (s *Stack) upstreamExpected(dataGrad, upstream linalg.Vector,
+	size int) linalg.Vector {
+	if upstream != nil {
+		upstream[:len(dataGrad)].Add(dataGrad)
+		return upstream
+	}
+	upstream = make(linalg.Vector, size)
+	copy(upstream, dataGrad)
+	return upstream
+}
+
+// nextExpected computes the expected stack contents
+// after applying a control signal with the given flag
+// probabilities and data.
+//
+// Stack contents are stored contiguously, with the top
+// of the stack at the beginning.
+func (s *Stack) nextExpected(expected, flags, controlData linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, len(expected)+s.VectorSize)
+	s.addNextExpected(res, expected, flags, controlData)
+	return res
+}
+
+// addNextExpected is like nextExpected, but it adds the
+// result to a pre-allocated vector.
+func (s *Stack) addNextExpected(res, expected, flags, controlData linalg.Vector) {
+	size := s.VectorSize
+	if len(expected) > 0 {
+		addScaled(res[:size], expected[:size], flags[StackNop])
+		addScaled(res[size:len(expected)], expected[size:], s.keepProb(flags))
+		addScaled(res[:len(expected)-size], expected[size:], flags[StackPop])
+		addScaled(res[size:], expected, flags[StackPush])
+	}
+	addScaled(res[:size], controlData, s.pushReplaceProb(flags))
+}
+
+// addNextExpectedRows is like addNextExpected, but every
+// argument is a matrix with one row per stack in a batch.
+func (s *Stack) addNextExpectedRows(res, expected, flags, controlData rowMatrix) {
+	size := s.VectorSize
+	n := expected.Cols
+	probs := s.flagColumns(flags)
+	if n > 0 {
+		addScaledRows(res.Columns(0, size), expected.Columns(0, size), probs.Nop)
+		addScaledRows(res.Columns(size, n), expected.Columns(size, n), probs.Keep)
+		addScaledRows(res.Columns(0, n-size), expected.Columns(size, n), probs.Pop)
+		addScaledRows(res.Columns(size, n+size), expected, probs.Push)
+	}
+	addScaledRows(res.Columns(0, size), controlData, probs.PushReplace)
+}
 
-		gradDot := v.Dot(upstream[i])
-		flagsDownstream[StackNop] += gradDot
-		if i != 0 && !s.Stack.NoReplace {
-			flagsDownstream[StackReplace] += gradDot
+// expectedGradient back-propagates an upstream gradient
+// through nextExpected.
+func (s *Stack) expectedGradient(last, flags, controlData,
+	upstream linalg.Vector) (flagsGrad, controlDataGrad, downstream linalg.Vector) {
+	flagsGrad = make(linalg.Vector, len(flags))
+	controlDataGrad = make(linalg.Vector, s.VectorSize)
+	downstream = make(linalg.Vector, len(last))
+	s.addExpectedGradient(flagsGrad, controlDataGrad, downstream, last, flags,
+		controlData, upstream)
+	return
+}
+
+// addExpectedGradient is like expectedGradient, but it
+// adds the gradients to pre-allocated vectors.
+func (s *Stack) addExpectedGradient(flagsGrad, controlDataGrad, downstream, last,
+	flags, controlData, upstream linalg.Vector) {
+	size := s.VectorSize
+	if len(last) > 0 {
+		addScaled(downstream[:size], upstream[:size], flags[StackNop])
+		flagsGrad[StackNop] += last[:size].Dot(upstream[:size])
+
+		addScaled(downstream[size:], upstream[size:len(last)], s.keepProb(flags))
+		keepDot := last[size:].Dot(upstream[size:len(last)])
+		flagsGrad[StackNop] += keepDot
+		if !s.NoReplace {
+			flagsGrad[StackReplace] += keepDot
 		}
+
+		addScaled(downstream[size:], upstream[:len(last)-size], flags[StackPop])
+		flagsGrad[StackPop] += last[size:].Dot(upstream[:len(last)-size])
+
+		addScaled(downstream, upstream[size:], flags[StackPush])
+		flagsGrad[StackPush] += last.Dot(upstream[size:])
+	}
+
+	addScaled(controlDataGrad, upstream[:size], s.pushReplaceProb(flags))
+	pushReplaceDot := upstream[:size].Dot(controlData)
+	flagsGrad[StackPush] += pushReplaceDot
+	if !s.NoReplace {
+		flagsGrad[StackReplace] += pushReplaceDot
 	}
+}
 
-	if len(s.Last.Expected) > 0 {
-		for i, v := range s.Last.Expected[1:] {
-			downstream[i+1].Add(upstream[i].Copy().Scale(flags[StackPop]))
-			flagsDownstream[StackPop] += upstream[i].Dot(v)
+// addExpectedGradientRows is like addExpectedGradient,
+// but every argument is a matrix with one row per stack
+// in a batch.
+func (s *Stack) addExpectedGradientRows(flagsGrad, controlDataGrad, downstream, last,
+	flags, controlData, upstream rowMatrix) {
+	size := s.VectorSize
+	n := last.Cols
+	probs := s.flagColumns(flags)
+	if n > 0 {
+		addScaledRows(downstream.Columns(0, size), upstream.Columns(0, size), probs.Nop)
+		flagsGrad.AddColumn(StackNop, rowDots(last.Columns(0, size),
+			upstream.Columns(0, size)))
+
+		addScaledRows(downstream.Columns(size, n), upstream.Columns(size, n), probs.Keep)
+		keepDot := rowDots(last.Columns(size, n), upstream.Columns(size, n))
+		flagsGrad.AddColumn(StackNop, keepDot)
+		if !s.NoReplace {
+			flagsGrad.AddColumn(StackReplace, keepDot)
 		}
+
+		addScaledRows(downstream.Columns(size, n), upstream.Columns(0, n-size), probs.Pop)
+		flagsGrad.AddColumn(StackPop, rowDots(last.Columns(size, n),
+			upstream.Columns(0, n-size)))
+
+		addScaledRows(downstream, upstream.Columns(size, n+size), probs.Push)
+		flagsGrad.AddColumn(StackPush, rowDots(last, upstream.Columns(size, n+size)))
+	}
+
+	addScaledRows(controlDataGrad, upstream.Columns(0, size), probs.PushReplace)
+	pushReplaceDot := rowDots(upstream.Columns(0, size), controlData)
+	flagsGrad.AddColumn(StackPush, pushReplaceDot)
+	if !s.NoReplace {
+		flagsGrad.AddColumn(StackReplace, pushReplaceDot)
+	}
+}
+
+// nextExpectedR is like nextExpected, but with support
+// for the r-operator.
+func (s *Stack) nextExpectedR(expected, expectedR, flags, flagsR, controlData,
+	controlDataR linalg.Vector) (res, resR linalg.Vector) {
+	// Since nextExpected is bilinear in the flags and the
+	// (expected, controlData) pair, the product rule gives
+	// the r-operator in terms of nextExpected.
+	res = s.nextExpected(expected, flags, controlData)
+	resR = s.nextExpected(expected, flagsR, controlData)
+	resR.Add(s.nextExpected(expectedR, flags, controlDataR))
+	return
+}
+
+// expectedGradientR is like expectedGradient, but with
+// support for the r-operator.
+func (s *Stack) expectedGradientR(last, lastR, flags, flagsR, controlData, controlDataR,
+	upstream, upstreamR linalg.Vector) (flagsGrad, flagsGradR, controlDataGrad,
+	controlDataGradR, downstream, downstreamR linalg.Vector) {
+	// Like nextExpectedR, this relies on the fact that
+	// every output of expectedGradient is bilinear.
+	flagsGrad, controlDataGrad, downstream = s.expectedGradient(last, flags,
+		controlData, upstream)
+
+	_, controlDataGradR, downstreamR = s.expectedGradient(last, flagsR, controlData,
+		upstream)
+	flagsGradR, cdGradR, dsR := s.expectedGradient(last, flags, controlData, upstreamR)
+	controlDataGradR.Add(cdGradR)
+	downstreamR.Add(dsR)
+	fgR, _, _ := s.expectedGradient(lastR, flags, controlDataR, upstream)
+	flagsGradR.Add(fgR)
+
+	return
+}
+
+// keepProb returns the probability that an entry below
+// the top of the stack stays in place.
+func (s *Stack) keepProb(flags linalg.Vector) float64 {
+	if s.NoReplace {
+		return flags[StackNop]
 	}
+	return flags[StackNop] + flags[StackReplace]
+}
 
-	pushReplaceProb := flags[StackPush]
-	if !s.Stack.NoReplace {
-		pushReplaceProb += flags[StackReplace]
+// pushReplaceProb returns the probability that the
+// control data is written to the top of the stack.
+func (s *Stack) pushReplaceProb(flags linalg.Vector) float64 {
+	if s.NoReplace {
+		return flags[StackPush]
 	}
-	controlDataDownstream := upstream[0].Copy().Scale(pushReplaceProb)
-	pushReplaceDot := upstream[0].Dot(controlData)
-	flagsDownstream[StackPush] += pushReplaceDot
-	if !s.Stack.NoReplace {
-		flagsDownstream[StackReplace] += pushReplaceDot
+	return flags[StackPush] + flags[StackReplace]
+}
+
+// flagColumns computes the probability of every kind of
+// stack update for each row of a flag matrix.
+func (s *Stack) flagColumns(flags rowMatrix) stackFlagColumns {
+	res := stackFlagColumns{
+		Nop:  flags.Column(StackNop),
+		Push: flags.Column(StackPush),
+		Pop:  flags.Column(StackPop),
+	}
+	res.Keep = res.Nop.Copy()
+	res.PushReplace = res.Push.Copy()
+	if !s.NoReplace {
+		replace := flags.Column(StackReplace)
+		res.Keep.Add(replace)
+		res.PushReplace.Add(replace)
 	}
+	return res
+}
+
+// stackFlagColumns stores the update probabilities for a
+// batch of stacks, with one component per stack.
+// Keep and PushReplace correspond to keepProb and
+// pushReplaceProb.
+type stackFlagColumns struct {
+	Nop         linalg.Vector
+	Push        linalg.Vector
+	Pop         linalg.Vector
+	Keep        linalg.Vector
+	PushReplace linalg.Vector
+}
+
+type stackState struct {
+	Last  *stackState
+	Stack Stack
 
-	for i, v := range s.Last.Expected {
-		downstream[i].Add(upstream[i+1].Copy().Scale(flags[StackPush]))
-		flagsDownstream[StackPush] += upstream[i+1].Dot(v)
+	// Expected stores the expected stack entries back to
+	// back, starting with the top of the stack.
+	// It is nil if the entries were discarded due to
+	// checkpointing, or if they are stored in Expected32.
+	Expected linalg.Vector
+
+	// Expected32 replaces Expected if Stack.Float32 is set.
+	Expected32 []float32
+
+	// Top stores the top of the stack if Expected has been
+	// discarded or replaced by Expected32.
+	Top linalg.Vector
+
+	Control linalg.Vector
+
+	// Noise is the noise which the FlagNorm used to
+	// compute the flags from Control, if any.
+	Noise linalg.Vector
+
+	// Depth is the number of steps since the last state
+	// with no Last state.
+	Depth int
+}
+
+func (s *stackState) Data() linalg.Vector {
+	if s.Top != nil {
+		return s.Top
 	}
+	if len(s.Expected) == 0 {
+		return make(linalg.Vector, s.Stack.VectorSize)
+	}
+	return s.Expected[:s.Stack.VectorSize]
+}
+
+func (s *stackState) Gradient(dataGrad linalg.Vector, upstreamGrad Grad) (linalg.Vector, Grad) {
+	if s.Last == nil {
+		panic("cannot propagate through start state")
+	}
+
+	lastExpected := s.Last.expected()
+
+	var upstream linalg.Vector
+	if upstreamGrad != nil {
+		upstream = upstreamGrad.(linalg.Vector)
+	}
+	upstream = s.Stack.upstreamExpected(dataGrad, upstream,
+		len(lastExpected)+s.Stack.VectorSize)
+
+	flagIn := s.Control[:s.Stack.flagCount()]
+	flags := s.Stack.FlagNorm.apply(flagIn, s.Noise)
+	controlData := s.Control[s.Stack.flagCount():]
+
+	flagsDownstream, controlDataDownstream, downstream := s.Stack.expectedGradient(
+		lastExpected, flags, controlData, upstream)
 
 	controlDownstream := make(linalg.Vector, len(s.Control))
 	copy(controlDownstream[len(flags):], controlDataDownstream)
-	flagGrad := autofunc.Gradient{flagVar: controlDownstream[:len(flags)]}
-	flagRes.PropagateGradient(flagsDownstream, flagGrad)
+	s.Stack.FlagNorm.addGradient(controlDownstream[:len(flags)], flagIn, s.Noise,
+		flagsDownstream)
 
 	return controlDownstream, downstream
 }
 
 func (s *stackState) NextState(control linalg.Vector) State {
-	softmax := autofunc.Softmax{}
-	flagVar := &autofunc.Variable{Vector: control[:s.Stack.flagCount()]}
-	flags := softmax.Apply(flagVar).Output()
 	controlData := control[s.Stack.flagCount():]
+	res := &stackState{
+		Last:    s,
+		Stack:   s.Stack,
+		Control: control,
+		Noise:   s.Stack.FlagNorm.noise(s.Stack.flagCount()),
+		Depth:   s.Depth + 1,
+	}
+	flags := s.flags(control, res.Noise)
+	res.setExpected(s.Stack.nextExpected(s.expected(), flags, controlData))
+	s.discard()
+	return res
+}
+
+// Detach returns a stack state with the same contents
+// and no history.
+func (s *stackState) Detach() State {
+	res := &stackState{Stack: s.Stack}
+	res.setExpected(s.expected().Copy())
+	return res
+}
 
-	newState := &stackState{
-		Last:     s,
-		Stack:    s.Stack,
-		Expected: make([]linalg.Vector, len(s.Expected)+1),
-		Control:  control,
+// DetachR is like Detach, but for an RState.
+func (s *stackState) DetachR() RState {
+	expected := s.expected().Copy()
+	return &stackRState{
+		Stack:     s.Stack,
+		Expected:  expected,
+		ExpectedR: make(linalg.Vector, len(expected)),
 	}
+}
 
-	for i, v := range s.Expected {
-		scaler := flags[StackNop]
-		if i != 0 && !s.Stack.NoReplace {
-			scaler += flags[StackReplace]
+// expected returns the expected stack contents,
+// recomputing them from the nearest checkpoint if they
+// have been discarded.
+// Recomputed contents are not stored in the state.
+func (s *stackState) expected() linalg.Vector {
+	if s.stored() || s.Last == nil {
+		return s.storedExpected()
+	}
+	var path []*stackState
+	state := s
+	for !state.stored() && state.Last != nil {
+		path = append(path, state)
+		state = state.Last
+	}
+	expected := state.storedExpected()
+	for i := len(path) - 1; i >= 0; i-- {
+		control := path[i].Control
+		expected = s.Stack.nextExpected(expected, s.flags(control, path[i].Noise),
+			control[s.Stack.flagCount():])
+		if s.Stack.Float32 {
+			expected = fromFloat32(toFloat32(expected))
 		}
-		newState.Expected[i] = v.Copy().Scale(scaler)
 	}
-	newState.Expected[len(s.Expected)] = make(linalg.Vector, s.Stack.VectorSize)
+	return expected
+}
 
-	if len(s.Expected) > 0 {
-		for i, v := range s.Expected[1:] {
-			newState.Expected[i].Add(v.Copy().Scale(flags[StackPop]))
-		}
+// setExpected sets the expected stack contents, storing
+// them as float32 values if the Stack calls for it.
+func (s *stackState) setExpected(expected linalg.Vector) {
+	if !s.Stack.Float32 {
+		s.Expected = expected
+		return
+	}
+	s.Expected32 = toFloat32(expected)
+	if len(expected) > 0 {
+		s.Top = fromFloat32(s.Expected32[:s.Stack.VectorSize])
 	}
+}
+
+// stored returns whether the state stores its expected
+// stack contents.
+func (s *stackState) stored() bool {
+	return s.Expected != nil || s.Expected32 != nil
+}
 
-	pushReplace := flags[StackPush]
-	if !s.Stack.NoReplace {
-		pushReplace += flags[StackReplace]
+// storedExpected returns the stored expected stack
+// contents as a linalg.Vector.
+func (s *stackState) storedExpected() linalg.Vector {
+	if s.Expected32 != nil {
+		return fromFloat32(s.Expected32)
 	}
-	newState.Expected[0].Add(controlData.Copy().Scale(pushReplace))
-	for i, v := range s.Expected {
-		newState.Expected[i+1].Add(v.Copy().Scale(flags[StackPush]))
+	return s.Expected
+}
+
+// discard discards the expected stack contents if the
+// state is not a checkpoint.
+func (s *stackState) discard() {
+	checkpoint := s.Stack.Checkpoint
+	if checkpoint < 2 || s.Last == nil || !s.stored() || s.Depth%checkpoint == 0 {
+		return
 	}
+	s.Top = s.Data().Copy()
+	s.Expected = nil
+	s.Expected32 = nil
+}
 
-	return newState
+// flags computes the flag probabilities for a control
+// vector, given the noise for the FlagNorm.
+func (s *stackState) flags(control, noise linalg.Vector) linalg.Vector {
+	return s.Stack.FlagNorm.apply(control[:s.Stack.flagCount()], noise)
 }
 
 type stackRState struct {
 	Last      *stackRState
 	Stack     Stack
-	Expected  []linalg.Vector
-	ExpectedR []linalg.Vector
+	Expected  linalg.Vector
+	ExpectedR linalg.Vector
 	Control   linalg.Vector
 	ControlR  linalg.Vector
+	Noise     linalg.Vector
 }
 
 func (s *stackRState) Data() linalg.Vector {
 	if len(s.Expected) == 0 {
 		return make(linalg.Vector, s.Stack.VectorSize)
 	}
-	return s.Expected[0]
+	return s.Expected[:s.Stack.VectorSize]
 }
 
 func (s *stackRState) RData() linalg.Vector {
 	if len(s.ExpectedR) == 0 {
 		return make(linalg.Vector, s.Stack.VectorSize)
 	}
-	return s.ExpectedR[0]
+	return s.ExpectedR[:s.Stack.VectorSize]
 }
 
 func (s *stackRState) RGradient(dataGrad, dataGradR linalg.Vector,
@@ -259,181 +827,89 @@ func (s *stackRState) RGradient(dataGrad, dataGradR linalg.Vector,
 		panic("cannot propagate through start state")
 	}
 
-	var upstream, upstreamR []linalg.Vector
+	var upstream, upstreamR linalg.Vector
 	if upstreamGrad != nil {
-		upstreamVal := upstreamGrad.([2][]linalg.Vector)
+		upstreamVal := upstreamGrad.([2]linalg.Vector)
 		upstream = upstreamVal[0]
 		upstreamR = upstreamVal[1]
-		upstream[0].Add(dataGrad)
-		upstreamR[0].Add(dataGradR)
-	} else {
-		upstream = make([]linalg.Vector, len(s.Expected))
-		upstreamR = make([]linalg.Vector, len(s.ExpectedR))
-		upstream[0] = dataGrad
-		upstreamR[0] = dataGradR
-		zeroGrad := make(linalg.Vector, len(dataGrad))
-		for i := 1; i < len(upstream); i++ {
-			upstream[i] = zeroGrad
-			upstreamR[i] = zeroGrad
-		}
 	}
+	upstream = s.Stack.upstreamExpected(dataGrad, upstream, len(s.Expected))
+	upstreamR = s.Stack.upstreamExpected(dataGradR, upstreamR, len(s.ExpectedR))
 
-	softmax := autofunc.Softmax{}
-	flagVar := &autofunc.Variable{Vector: s.Control[:s.Stack.flagCount()]}
-	flagRVar := &autofunc.RVariable{
-		Variable:   flagVar,
-		ROutputVec: s.ControlR[:s.Stack.flagCount()],
-	}
-	flagRes := softmax.ApplyR(autofunc.RVector{}, flagRVar)
-	flags := flagRes.Output()
-	flagsR := flagRes.ROutput()
+	flagIn := s.Control[:s.Stack.flagCount()]
+	flagInR := s.ControlR[:s.Stack.flagCount()]
+	flags, flagsR := s.Stack.FlagNorm.applyR(flagIn, flagInR, s.Noise)
 	controlData := s.Control[s.Stack.flagCount():]
 	controlDataR := s.ControlR[s.Stack.flagCount():]
 
-	flagsDownstream := make(linalg.Vector, len(flags))
-	downstream := make([]linalg.Vector, len(s.Last.Expected))
-	flagsDownstreamR := make(linalg.Vector, len(flags))
-	downstreamR := make([]linalg.Vector, len(s.Last.Expected))
-
-	for i, v := range s.Last.Expected {
-		vR := s.Last.ExpectedR[i]
-
-		scaler := flags[StackNop]
-		scalerR := flagsR[StackNop]
-		if i != 0 && !s.Stack.NoReplace {
-			scaler += flags[StackReplace]
-			scalerR += flagsR[StackReplace]
-		}
-		downstream[i] = upstream[i].Copy().Scale(scaler)
-		downstreamR[i] = upstream[i].Copy().Scale(scalerR)
-		downstreamR[i].Add(upstreamR[i].Copy().Scale(scaler))
-
-		gradDot := v.Dot(upstream[i])
-		gradDotR := vR.Dot(upstream[i]) + v.Dot(upstreamR[i])
-		flagsDownstream[StackNop] += gradDot
-		flagsDownstreamR[StackNop] += gradDotR
-		if i != 0 && !s.Stack.NoReplace {
-			flagsDownstream[StackReplace] += gradDot
-			flagsDownstreamR[StackReplace] += gradDotR
-		}
-	}
-
-	if len(s.Last.Expected) > 0 {
-		for i, v := range s.Last.Expected[1:] {
-			vR := s.Last.ExpectedR[i+1]
-			downstream[i+1].Add(upstream[i].Copy().Scale(flags[StackPop]))
-			downstreamR[i+1].Add(upstreamR[i].Copy().Scale(flags[StackPop]))
-			downstreamR[i+1].Add(upstream[i].Copy().Scale(flagsR[StackPop]))
-			flagsDownstream[StackPop] += upstream[i].Dot(v)
-			flagsDownstreamR[StackPop] += upstreamR[i].Dot(v) + upstream[i].Dot(vR)
-		}
-	}
-
-	var controlDataDownstream, controlDataDownstreamR linalg.Vector
-	if s.Stack.NoReplace {
-		controlDataDownstream = upstream[0].Copy().Scale(flags[StackPush])
-		controlDataDownstreamR = upstream[0].Copy().Scale(flagsR[StackPush])
-		controlDataDownstreamR.Add(upstreamR[0].Copy().Scale(flags[StackPush]))
-	} else {
-		controlDataDownstream = upstream[0].Copy().Scale(flags[StackPush] +
-			flags[StackReplace])
-		controlDataDownstreamR = upstream[0].Copy().Scale(flagsR[StackPush] +
-			flagsR[StackReplace])
-		controlDataDownstreamR.Add(upstreamR[0].Copy().Scale(flags[StackPush] +
-			flags[StackReplace]))
-	}
-	pushReplaceDot := upstream[0].Dot(controlData)
-	pushReplaceDotR := upstreamR[0].Dot(controlData) + upstream[0].Dot(controlDataR)
-	flagsDownstream[StackPush] += pushReplaceDot
-	flagsDownstreamR[StackPush] += pushReplaceDotR
-	if !s.Stack.NoReplace {
-		flagsDownstream[StackReplace] += pushReplaceDot
-		flagsDownstreamR[StackReplace] += pushReplaceDotR
-	}
-
-	for i, v := range s.Last.Expected {
-		vR := s.Last.ExpectedR[i]
-		downstream[i].Add(upstream[i+1].Copy().Scale(flags[StackPush]))
-		downstreamR[i].Add(upstreamR[i+1].Copy().Scale(flags[StackPush]))
-		downstreamR[i].Add(upstream[i+1].Copy().Scale(flagsR[StackPush]))
-		flagsDownstream[StackPush] += upstream[i+1].Dot(v)
-		flagsDownstreamR[StackPush] += upstreamR[i+1].Dot(v) + upstream[i+1].Dot(vR)
-	}
+	flagsDownstream, flagsDownstreamR, controlDataDownstream, controlDataDownstreamR,
+		downstream, downstreamR := s.Stack.expectedGradientR(s.Last.Expected,
+		s.Last.ExpectedR, flags, flagsR, controlData, controlDataR, upstream, upstreamR)
 
 	controlDownstream := make(linalg.Vector, len(s.Control))
 	controlDownstreamR := make(linalg.Vector, len(s.Control))
 	copy(controlDownstream[len(flags):], controlDataDownstream)
 	copy(controlDownstreamR[len(flags):], controlDataDownstreamR)
-	flagGrad := autofunc.Gradient{flagVar: controlDownstream[:len(flags)]}
-	flagRGrad := autofunc.RGradient{flagVar: controlDownstreamR[:len(flags)]}
-	flagRes.PropagateRGradient(flagsDownstream, flagsDownstreamR, flagRGrad, flagGrad)
+	s.Stack.FlagNorm.addGradientR(controlDownstream[:len(flags)],
+		controlDownstreamR[:len(flags)], flagIn, flagInR, s.Noise, flagsDownstream,
+		flagsDownstreamR)
 
 	return controlDownstream, controlDownstreamR,
-		[2][]linalg.Vector{downstream, downstreamR}
+		[2]linalg.Vector{downstream, downstreamR}
 }
 
 func (s *stackRState) NextRState(control, controlR linalg.Vector) RState {
-	softmax := autofunc.Softmax{}
-	flagVar := &autofunc.Variable{Vector: control[:s.Stack.flagCount()]}
-	flagRVar := &autofunc.RVariable{
-		Variable:   flagVar,
-		ROutputVec: controlR[:s.Stack.flagCount()],
-	}
-	flagRes := softmax.ApplyR(autofunc.RVector{}, flagRVar)
-	flags := flagRes.Output()
-	flagsR := flagRes.ROutput()
+	noise := s.Stack.FlagNorm.noise(s.Stack.flagCount())
+	flags, flagsR := s.Stack.FlagNorm.applyR(control[:s.Stack.flagCount()],
+		controlR[:s.Stack.flagCount()], noise)
 	controlData := control[s.Stack.flagCount():]
 	controlDataR := controlR[s.Stack.flagCount():]
 
-	newState := &stackRState{
+	expected, expectedR := s.Stack.nextExpectedR(s.Expected, s.ExpectedR, flags, flagsR,
+		controlData, controlDataR)
+
+	return &stackRState{
 		Last:      s,
 		Stack:     s.Stack,
-		Expected:  make([]linalg.Vector, len(s.Expected)+1),
-		ExpectedR: make([]linalg.Vector, len(s.Expected)+1),
+		Expected:  expected,
+		ExpectedR: expectedR,
 		Control:   control,
 		ControlR:  controlR,
+		Noise:     noise,
 	}
+}
 
-	for i, v := range s.Expected {
-		vR := s.ExpectedR[i]
-
-		scaler := flags[StackNop]
-		scalerR := flagsR[StackNop]
-		if i != 0 && !s.Stack.NoReplace {
-			scaler += flags[StackReplace]
-			scalerR += flagsR[StackReplace]
-		}
+// stackInferenceState is a forward-only stack state which
+// is updated in place.
+type stackInferenceState struct {
+	Stack    Stack
+	Expected linalg.Vector
 
-		newState.Expected[i] = v.Copy().Scale(scaler)
-		newState.ExpectedR[i] = v.Copy().Scale(scalerR).Add(vR.Copy().Scale(scaler))
-	}
-	newState.Expected[len(s.Expected)] = make(linalg.Vector, s.Stack.VectorSize)
-	newState.ExpectedR[len(s.Expected)] = make(linalg.Vector, s.Stack.VectorSize)
+	// Scratch and Flags are buffers which are reused
+	// between timesteps.
+	Scratch linalg.Vector
+	Flags   linalg.Vector
+}
 
-	if len(s.Expected) > 0 {
-		for i, v := range s.Expected[1:] {
-			vR := s.ExpectedR[i+1]
-			newState.Expected[i].Add(v.Copy().Scale(flags[StackPop]))
-			newState.ExpectedR[i].Add(v.Copy().Scale(flagsR[StackPop]))
-			newState.ExpectedR[i].Add(vR.Copy().Scale(flags[StackPop]))
-		}
+func (s *stackInferenceState) Data() linalg.Vector {
+	if len(s.Expected) == 0 {
+		return make(linalg.Vector, s.Stack.VectorSize)
 	}
+	return s.Expected[:s.Stack.VectorSize]
+}
 
-	pushReplace := flags[StackPush]
-	pushReplaceR := flagsR[StackPush]
-	if !s.Stack.NoReplace {
-		pushReplace += flags[StackReplace]
-		pushReplaceR += flagsR[StackReplace]
-	}
-	newState.Expected[0].Add(controlData.Copy().Scale(pushReplace))
-	newState.ExpectedR[0].Add(controlDataR.Copy().Scale(pushReplace))
-	newState.ExpectedR[0].Add(controlData.Copy().Scale(pushReplaceR))
-	for i, v := range s.Expected {
-		vR := s.ExpectedR[i]
-		newState.Expected[i+1].Add(v.Copy().Scale(flags[StackPush]))
-		newState.ExpectedR[i+1].Add(vR.Copy().Scale(flags[StackPush]))
-		newState.ExpectedR[i+1].Add(v.Copy().Scale(flagsR[StackPush]))
-	}
+func (s *stackInferenceState) Gradient(dataGrad linalg.Vector,
+	upstream Grad) (linalg.Vector, Grad) {
+	panic("cannot propagate through inference state")
+}
 
-	return newState
+func (s *stackInferenceState) NextState(control linalg.Vector) State {
+	flagCount := s.Stack.flagCount()
+	noise := s.Stack.FlagNorm.noise(flagCount)
+	s.Stack.FlagNorm.applyInto(s.Flags, control[:flagCount], noise)
+	size := len(s.Expected) + s.Stack.VectorSize
+	s.Scratch = append(s.Scratch[:0], make(linalg.Vector, size)...)
+	s.Stack.addNextExpected(s.Scratch, s.Expected, s.Flags, control[flagCount:])
+	s.Expected, s.Scratch = s.Scratch, s.Expected
+	return s
 }
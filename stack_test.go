@@ -99,6 +99,18 @@ func TestStackDerivativesNoReplace(t *testing.T) {
 	testAllDerivatives(t, &Stack{VectorSize: 4, NoReplace: true})
 }
 
+func TestStackCheckpoint(t *testing.T) {
+	testAllDerivatives(t, &Stack{VectorSize: 4, Checkpoint: 2})
+	_, states := testEquivalent(t, &Stack{VectorSize: 3},
+		&Stack{VectorSize: 3, Checkpoint: 4}, 15, statesEqual)
+	for i, state := range states[:len(states)-1] {
+		stored := state.(*stackState).Expected != nil
+		if stored != ((i+1)%4 == 0) {
+			t.Errorf("state %d: unexpected storage status %v", i, stored)
+		}
+	}
+}
+
 func BenchmarkStackForward(b *testing.B) {
 	forwardBenchmark(b, &Stack{VectorSize: benchmarkVectorSize})
 }
@@ -0,0 +1,65 @@
+package neuralstruct
+
+import (
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/weakai/rnn"
+)
+
+// A StartFromBlock is a Block whose sequences start from
+// given struct states rather than from the struct's start
+// state.
+// This makes it possible to use a Block with helpers like
+// rnn.BlockSeqFunc, which create a start state for every
+// sequence by calling StartState.
+//
+// The n-th call to StartState uses the n-th entry of
+// StartStructs, wrapping around to the first entry after
+// the last one.
+// Thus, if StartStructs has one struct state per sequence
+// in the same order as the sequences, every pass over the
+// sequences starts each sequence from its own struct
+// state.
+// StartRState works the same way, with its own count.
+//
+// A StartFromBlock is not safe for concurrent use, since
+// StartState and StartRState update the counts.
+type StartFromBlock struct {
+	*Block
+
+	// StartStructs contains the initial struct states,
+	// as passed to Block.StartStateFrom.
+	// For StartRState, they must be Detachers (see
+	// Block.StartRStateFrom).
+	StartStructs []State
+
+	nextStart  int
+	nextRStart int
+}
+
+// StartState returns a start state using the next struct
+// state in s.StartStructs.
+func (s *StartFromBlock) StartState() rnn.State {
+	if len(s.StartStructs) == 0 {
+		panic("no start struct states")
+	}
+	structState := s.StartStructs[s.nextStart]
+	s.nextStart = (s.nextStart + 1) % len(s.StartStructs)
+	return s.Block.StartStateFrom(structState)
+}
+
+// StartRState is like StartState for rnn.RStates.
+func (s *StartFromBlock) StartRState(rv autofunc.RVector) rnn.RState {
+	if len(s.StartStructs) == 0 {
+		panic("no start struct states")
+	}
+	structState := s.StartStructs[s.nextRStart]
+	s.nextRStart = (s.nextRStart + 1) % len(s.StartStructs)
+	return s.Block.StartRStateFrom(rv, structState)
+}
+
+// Reset makes the next calls to StartState and
+// StartRState use the first entry of s.StartStructs.
+func (s *StartFromBlock) Reset() {
+	s.nextStart = 0
+	s.nextRStart = 0
+}
@@ -0,0 +1,71 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/autofunc/seqfunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/rnn"
+	"github.com/unixpickle/weakai/rnn/rnntest"
+)
+
+func TestStartFromBlockSeqFunc(t *testing.T) {
+	structure := &Queue{VectorSize: 2}
+	b := &Block{
+		Block:  rnn.NewLSTM(6, 5+structure.ControlSize()),
+		Struct: structure,
+	}
+	var structStates []State
+	var inputs [][]linalg.Vector
+	for seq := 0; seq < 3; seq++ {
+		state := structure.StartState()
+		for i := 0; i < seq+1; i++ {
+			state = state.NextState(testRandVec(structure.ControlSize()))
+		}
+		structStates = append(structStates, Detach(state))
+		var input []linalg.Vector
+		for i := 0; i < 4-seq; i++ {
+			input = append(input, testRandVec(4))
+		}
+		inputs = append(inputs, input)
+	}
+
+	seqFunc := &rnn.BlockSeqFunc{B: &StartFromBlock{Block: b, StartStructs: structStates}}
+	for pass := 0; pass < 2; pass++ {
+		actual := seqFunc.ApplySeqs(seqfunc.ConstResult(inputs)).OutputSeqs()
+		for seq, input := range inputs {
+			state := b.StartStateFrom(structStates[seq])
+			for i, x := range input {
+				res := b.ApplyBlock([]rnn.State{state},
+					[]autofunc.Result{&autofunc.Variable{Vector: x}})
+				state = res.States()[0]
+				if !statesEqual(res.Outputs()[0], actual[seq][i]) {
+					t.Errorf("pass %d, seq %d, time %d: expected %v but got %v", pass, seq,
+						i, res.Outputs()[0], actual[seq][i])
+				}
+			}
+		}
+	}
+}
+
+func TestStartFromBlockGradients(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	structure := &Stack{VectorSize: 3}
+	var structStates []State
+	for seq := 0; seq < 2; seq++ {
+		state := structure.StartState()
+		for i := 0; i < seq+2; i++ {
+			state = state.NextState(testRandVec(structure.ControlSize()))
+		}
+		structStates = append(structStates, Detach(state))
+	}
+	b := &Block{
+		Block:  rnn.NewLSTM(7, 9),
+		Struct: structure,
+	}
+	checker := rnntest.NewChecker4In(&StartFromBlock{Block: b, StartStructs: structStates}, b)
+	checker.FullCheck(t)
+}
@@ -0,0 +1,97 @@
+package neuralstruct
+
+import (
+	"errors"
+	"math"
+)
+
+// A TemperatureSchedule anneals the flag temperatures of
+// stacks and queues during training.
+// Lowering the temperature sharpens the flag
+// probabilities, so that the learned policy gradually
+// becomes discrete.
+//
+// The temperature starts at Initial and is multiplied by
+// Decay after every epoch, until it reaches Final.
+// Both temperatures must be positive, and Decay must move
+// the temperature from Initial toward Final.
+type TemperatureSchedule struct {
+	Initial float64
+	Final   float64
+	Decay   float64
+}
+
+// Temperature returns the temperature for the given
+// epoch, starting at epoch 0.
+//
+// It panics if the schedule is invalid.
+func (t *TemperatureSchedule) Temperature(epoch int) float64 {
+	if err := t.validate(); err != nil {
+		panic(err)
+	}
+	temp := t.Initial * math.Pow(t.Decay, float64(epoch))
+	if t.Initial > t.Final {
+		return math.Max(temp, t.Final)
+	}
+	return math.Min(temp, t.Final)
+}
+
+// Apply sets the flag temperature of every Stack and
+// Queue in s to the temperature for the given epoch.
+// See SetFlagTemperature for the structs which are
+// searched.
+func (t *TemperatureSchedule) Apply(s Struct, epoch int) {
+	SetFlagTemperature(s, t.Temperature(epoch))
+}
+
+// SetFlagTemperature sets the FlagNorm temperature of s,
+// if it is a Stack or Queue, or of the stacks and queues
+// it contains, if it is an aggregate, a mixture, or a
+// chain.
+// Other structs are left untouched.
+//
+// Stack and queue states copy the FlagNorm when they are
+// started, so the new temperature only affects states
+// which are created with StartState afterwards.
+// Existing states, and the states which follow them, keep
+// using the old temperature.
+func SetFlagTemperature(s Struct, temp float64) {
+	switch s := s.(type) {
+	case *Stack:
+		s.FlagNorm.Temperature = temp
+	case *Queue:
+		s.FlagNorm.Temperature = temp
+	case Aggregate:
+		for _, sub := range s {
+			SetFlagTemperature(sub, temp)
+		}
+	case RAggregate:
+		SetFlagTemperature(s.aggregate(), temp)
+	case *ParallelAggregate:
+		SetFlagTemperature(s.Structs, temp)
+	case *NamedAggregate:
+		SetFlagTemperature(s.Structs, temp)
+	case Mixture:
+		SetFlagTemperature(Aggregate(s), temp)
+	case RMixture:
+		for _, sub := range s {
+			SetFlagTemperature(sub, temp)
+		}
+	case *Chain:
+		SetFlagTemperature(s.First, temp)
+		SetFlagTemperature(s.Second, temp)
+	case *RChain:
+		SetFlagTemperature(s.First, temp)
+		SetFlagTemperature(s.Second, temp)
+	}
+}
+
+func (t *TemperatureSchedule) validate() error {
+	if t.Initial <= 0 || t.Final <= 0 {
+		return errors.New("temperatures must be positive")
+	}
+	if (t.Initial > t.Final && t.Decay >= 1) || (t.Initial < t.Final && t.Decay <= 1) {
+		return errors.New("decay must move the temperature toward the final temperature")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package neuralstruct
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func TestTemperatureSchedule(t *testing.T) {
+	schedule := &TemperatureSchedule{Initial: 2, Final: 0.3, Decay: 0.5}
+	expected := []float64{2, 1, 0.5, 0.3, 0.3}
+	for epoch, exp := range expected {
+		if actual := schedule.Temperature(epoch); math.Abs(actual-exp) > 1e-8 {
+			t.Errorf("epoch %d: expected %f but got %f", epoch, exp, actual)
+		}
+	}
+
+	rising := &TemperatureSchedule{Initial: 1, Final: 3, Decay: 2}
+	if actual := rising.Temperature(5); actual != 3 {
+		t.Errorf("expected rising schedule to stop at 3 but got %f", actual)
+	}
+
+	constant := &TemperatureSchedule{Initial: 0.5, Final: 0.5, Decay: 1}
+	if actual := constant.Temperature(3); actual != 0.5 {
+		t.Errorf("expected constant schedule to stay at 0.5 but got %f", actual)
+	}
+}
+
+func TestTemperatureScheduleInvalid(t *testing.T) {
+	schedules := []*TemperatureSchedule{
+		{Initial: 1, Final: 0, Decay: 0.5},
+		{Initial: 1, Final: -0.5, Decay: 0.5},
+		{Initial: 0, Final: 0.5, Decay: 2},
+		{Initial: 2, Final: 0.5, Decay: 2},
+		{Initial: 2, Final: 0.5, Decay: 1},
+		{Initial: 1, Final: 3, Decay: 0.5},
+	}
+	for i, schedule := range schedules {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("schedule %d: expected panic", i)
+				}
+			}()
+			schedule.Temperature(1)
+		}()
+	}
+}
+
+func TestTemperatureScheduleApply(t *testing.T) {
+	stacks := []*Stack{{VectorSize: 2}, {VectorSize: 3}, {VectorSize: 1}}
+	queues := []*Queue{{VectorSize: 2}, {VectorSize: 1}, {VectorSize: 4}}
+	multi := &MultiStack{VectorSize: 2, StackCount: 2}
+	structure := &NamedAggregate{
+		Names: []string{"agg", "chain", "mixture", "multi"},
+		Structs: RAggregate{
+			RAggregate{stacks[0], queues[0]},
+			&RChain{First: stacks[1], Second: queues[1]},
+			RMixture{stacks[2], queues[2]},
+			multi,
+		},
+	}
+	schedule := &TemperatureSchedule{Initial: 1, Final: 0.1, Decay: 0.5}
+	schedule.Apply(structure, 2)
+	for i, s := range stacks {
+		if s.FlagNorm.Temperature != 0.25 {
+			t.Errorf("stack %d: expected temperature 0.25 but got %f", i,
+				s.FlagNorm.Temperature)
+		}
+	}
+	for i, q := range queues {
+		if q.FlagNorm.Temperature != 0.25 {
+			t.Errorf("queue %d: expected temperature 0.25 but got %f", i,
+				q.FlagNorm.Temperature)
+		}
+	}
+	if !reflect.DeepEqual(multi, &MultiStack{VectorSize: 2, StackCount: 2}) {
+		t.Errorf("expected multi-stack to be untouched but got %v", multi)
+	}
+}
+
+func TestTemperatureActivation(t *testing.T) {
+	structs := []Activator{
+		&Stack{VectorSize: 3, PushBias: 1, FlagNorm: FlagNorm{Temperature: 0.5}},
+		&Queue{VectorSize: 3, PushBias: 1, FlagNorm: FlagNorm{Temperature: 0.5}},
+	}
+	for _, s := range structs {
+		activation := s.SuggestedActivation().(*PartialActivation)
+		rescale := activation.Activations[0].(*neuralnet.RescaleLayer)
+		if rescale.Bias != 0.5 {
+			t.Errorf("%T: expected bias 0.5 but got %f", s, rescale.Bias)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package neuralstruct
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+const treeFlagCount = 7
+
+// These are the control flags (in order) of a Tree.
+//
+// TreeCreateLeft and TreeCreateRight act like TreeNop on
+// nodes at the Tree's maximum depth, since those nodes
+// have no children.
+const (
+	TreeNop int = iota
+	TreeLeft
+	TreeRight
+	TreeParent
+	TreeCreateLeft
+	TreeCreateRight
+	TreeWrite
+)
+
+func init() {
+	var t Tree
+	serializer.RegisterTypedDeserializer(t.SerializerType(), DeserializeTree)
+}
+
+// A Tree is a differentiable binary tree of vectors with
+// a soft pointer to the current node.
+//
+// At every timestep, a softmax over the control flags
+// decides between the following operations:
+//
+//   - TreeNop leaves the tree alone.
+//   - TreeLeft and TreeRight move to a child.
+//   - TreeParent moves to the parent.
+//   - TreeCreateLeft and TreeCreateRight set a child to
+//     the control's data vector and move to it.
+//   - TreeWrite sets the current node to the control's
+//     data vector.
+//
+// Operations which would leave the tree (e.g. moving to
+// the parent of the root) leave the pointer where it is.
+// In particular, TreeCreateLeft and TreeCreateRight do
+// nothing at all on nodes at the maximum depth: they
+// neither write the data vector nor move the pointer, so
+// they behave like TreeNop there.
+// Nodes which have not been created hold zero vectors.
+//
+// The data output of a Tree is the current node's vector.
+type Tree struct {
+	VectorSize int
+
+	// Depth is the maximum number of levels in the tree,
+	// including the root.
+	// It must be at least 1.
+	Depth int
+}
+
+// DeserializeTree deserializes a Tree.
+func DeserializeTree(d []byte) (*Tree, error) {
+	var t Tree
+	if err := json.Unmarshal(d, &t); err != nil {
+		return nil, err
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ControlSize returns the number of control components,
+// which varies based on the vector size.
+func (t *Tree) ControlSize() int {
+	return treeFlagCount + t.VectorSize
+}
+
+// DataSize returns the vector size.
+func (t *Tree) DataSize() int {
+	return t.VectorSize
+}
+
+// StartState returns a tree with a zero root and the
+// pointer at the root.
+//
+// The state copies the Tree's fields, so later changes to
+// the Tree do not affect it.
+// StartState panics if the Tree is misconfigured, e.g. if
+// its Depth is 0.
+func (t *Tree) StartState() State {
+	config := t.config()
+	return &funcState{
+		Transition: config.transition,
+		DataSize:   config.DataSize(),
+		Joined:     config.startJoined(),
+	}
+}
+
+// StartRState is like StartState, but for an RState.
+func (t *Tree) StartRState() RState {
+	config := t.config()
+	joined := config.startJoined()
+	return &funcRState{
+		Transition: config.transition,
+		DataSize:   config.DataSize(),
+		Joined:     joined,
+		RJoined:    make(linalg.Vector, len(joined)),
+	}
+}
+
+// SerializerType returns the unique ID used to serialize
+// Trees with the serializer package.
+func (t *Tree) SerializerType() string {
+	return "github.com/unixpickle/neuralstruct.Tree"
+}
+
+// Serialize encodes the tree's parameters.
+func (t *Tree) Serialize() ([]byte, error) {
+	return json.Marshal(t)
+}
+
+// SuggestedActivation returns an activation function
+// which applies a hyperbolic tangent to the data outputs
+// while leaving the control outputs untouched.
+func (t *Tree) SuggestedActivation() neuralnet.Layer {
+	return &PartialActivation{
+		Ranges:      []ComponentRange{{Start: treeFlagCount, End: t.ControlSize()}},
+		Activations: []neuralnet.Layer{&neuralnet.HyperbolicTangent{}},
+	}
+}
+
+// FlagNames returns the names of the control flags.
+func (t *Tree) FlagNames() []string {
+	return []string{"nop", "left", "right", "parent", "create left", "create right", "write"}
+}
+
+// nodeCount returns the number of nodes in a full tree.
+// Nodes are indexed like a binary heap, so the children
+// of node i are 2i+1 and 2i+2.
+func (t *Tree) nodeCount() int {
+	return (1 << uint(t.Depth)) - 1
+}
+
+// startJoined returns the joined data and internal
+// vector for the start state.
+// The internal vector stores the nodes, followed by the
+// pointer's probability for each node.
+// config validates the tree and returns a copy of it for
+// states to use.
+func (t *Tree) config() *Tree {
+	if err := t.validate(); err != nil {
+		panic(err)
+	}
+	res := *t
+	return &res
+}
+
+func (t *Tree) validate() error {
+	if t.Depth < 1 {
+		return errors.New("tree depth must be at least 1")
+	}
+	if t.VectorSize < 0 {
+		return errors.New("tree vector size must be non-negative")
+	}
+	return nil
+}
+
+func (t *Tree) startJoined() linalg.Vector {
+	res := make(linalg.Vector, t.DataSize()+t.nodeCount()*(t.VectorSize+1))
+	res[t.DataSize()+t.nodeCount()*t.VectorSize] = 1
+	return res
+}
+
+// targets returns, for each node, the node that the
+// pointer lands on after the given operation.
+// If stay is true, invalid operations leave the pointer
+// where it is; otherwise, they produce a target of -1.
+func (t *Tree) targets(op int, stay bool) []int {
+	res := make([]int, t.nodeCount())
+	for i := range res {
+		target := -1
+		switch op {
+		case TreeNop, TreeWrite:
+			target = i
+		case TreeLeft, TreeCreateLeft:
+			target = 2*i + 1
+		case TreeRight, TreeCreateRight:
+			target = 2*i + 2
+		case TreeParent:
+			if i > 0 {
+				target = (i - 1) / 2
+			}
+		}
+		if target >= len(res) {
+			target = -1
+		}
+		if target < 0 && stay {
+			target = i
+		}
+		res[i] = target
+	}
+	return res
+}
+
+func (t *Tree) transition(last, control autofunc.RResult) autofunc.RResult {
+	n := t.nodeCount()
+	nodesSize := n * t.VectorSize
+	return autofunc.PoolR(control, func(control autofunc.RResult) autofunc.RResult {
+		softmax := autofunc.Softmax{}
+		flags := softmax.ApplyR(autofunc.RVector{}, autofunc.SliceR(control, 0, treeFlagCount))
+		return autofunc.PoolR(flags, func(flags autofunc.RResult) autofunc.RResult {
+			pointer := autofunc.SliceR(last, nodesSize, nodesSize+n)
+			flag := func(op int) autofunc.RResult {
+				return autofunc.SliceR(flags, op, op+1)
+			}
+
+			var pointerTerms []autofunc.RResult
+			for op := 0; op < treeFlagCount; op++ {
+				moved := gatherR(pointer, t.targets(op, true), n)
+				pointerTerms = append(pointerTerms, autofunc.ScaleFirstR(moved, flag(op)))
+			}
+			newPointer := sumR(pointerTerms)
+
+			amounts := sumR([]autofunc.RResult{
+				autofunc.ScaleFirstR(pointer, flag(TreeWrite)),
+				autofunc.ScaleFirstR(gatherR(pointer, t.targets(TreeCreateLeft, false), n),
+					flag(TreeCreateLeft)),
+				autofunc.ScaleFirstR(gatherR(pointer, t.targets(TreeCreateRight, false), n),
+					flag(TreeCreateRight)),
+			})
+			writeVec := autofunc.SliceR(control, treeFlagCount, t.ControlSize())
+			nodes := blendCellsR(autofunc.SliceR(last, 0, nodesSize), amounts, writeVec)
+
+			return autofunc.PoolR(newPointer, func(newPointer autofunc.RResult) autofunc.RResult {
+				return autofunc.PoolR(nodes, func(nodes autofunc.RResult) autofunc.RResult {
+					identity := make([]int, n)
+					for i := range identity {
+						identity[i] = i
+					}
+					data := weightedCellsR(nodes, newPointer, identity)
+					return autofunc.ConcatR(data, nodes, newPointer)
+				})
+			})
+		})
+	})
+}
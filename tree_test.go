@@ -0,0 +1,95 @@
+package neuralstruct
+
+import (
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestTreeData(t *testing.T) {
+	tree := &Tree{VectorSize: 2, Depth: 2}
+	state := tree.StartState()
+
+	opControl := func(op int, vec ...float64) linalg.Vector {
+		res := make(linalg.Vector, treeFlagCount, treeFlagCount+len(vec))
+		res[op] = 50
+		return append(res, vec...)
+	}
+	controls := []linalg.Vector{
+		opControl(TreeWrite, 1, 2),
+		opControl(TreeCreateLeft, 3, 4),
+		opControl(TreeParent, 9, 9),
+		opControl(TreeLeft, 9, 9),
+		opControl(TreeRight, 9, 9),
+		opControl(TreeParent, 9, 9),
+		opControl(TreeRight, 9, 9),
+
+		// The pointer is at a leaf, so this acts like a nop.
+		opControl(TreeCreateRight, 5, 6),
+
+		opControl(TreeParent, 9, 9),
+		opControl(TreeNop, 9, 9),
+	}
+	expected := []linalg.Vector{
+		{1, 2},
+		{3, 4},
+		{1, 2},
+		{3, 4},
+		{3, 4},
+		{1, 2},
+		{0, 0},
+		{0, 0},
+		{1, 2},
+		{1, 2},
+	}
+
+	for i, control := range controls {
+		state = state.NextState(control)
+		if !statesEqual(state.Data(), expected[i]) {
+			t.Errorf("bad state %d: expected %v got %v", i, expected[i], state.Data())
+		}
+	}
+}
+
+func TestTreeDerivatives(t *testing.T) {
+	testAllDerivatives(t, &Tree{VectorSize: 2, Depth: 3})
+}
+
+func BenchmarkTreeForward(b *testing.B) {
+	forwardBenchmark(b, &Tree{VectorSize: benchmarkVectorSize, Depth: 4})
+}
+
+func BenchmarkTreeBackward(b *testing.B) {
+	backwardBenchmark(b, &Tree{VectorSize: benchmarkVectorSize, Depth: 4})
+}
+
+func TestTreeConfigCopy(t *testing.T) {
+	tree := &Tree{VectorSize: 2, Depth: 3}
+	reference := &Tree{VectorSize: 2, Depth: 3}
+	state, refState := tree.StartState(), reference.StartState()
+	tree.Depth = 5
+	for i := 0; i < 4; i++ {
+		control := testRandVec(tree.ControlSize())
+		state = state.NextState(control)
+		refState = refState.NextState(control)
+		if !statesEqual(state.Data(), refState.Data()) {
+			t.Errorf("step %d: expected %v but got %v", i, refState.Data(), state.Data())
+		}
+	}
+}
+
+func TestTreeValidation(t *testing.T) {
+	invalid := []*Tree{
+		{VectorSize: 2},
+		{VectorSize: -1, Depth: 2},
+	}
+	for i, tree := range invalid {
+		if tree.validate() == nil {
+			t.Errorf("tree %d: expected an error", i)
+		}
+		data, _ := tree.Serialize()
+		if _, err := DeserializeTree(data); err == nil {
+			t.Errorf("tree %d: expected a deserialization error", i)
+		}
+	}
+}
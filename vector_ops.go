@@ -0,0 +1,268 @@
+package neuralstruct
+
+import (
+	"math"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// addScaled adds scale*src to dst in place.
+// The dst vector must be at least as long as src.
+//
+// This avoids the temporary vector that would be created
+// by dst.Add(src.Copy().Scale(scale)).
+func addScaled(dst, src linalg.Vector, scale float64) {
+	dst = dst[:len(src)]
+	for i, x := range src {
+		dst[i] += x * scale
+	}
+}
+
+// batchSoftmax applies the softmax function to the first
+// n components of each vector.
+// The results are the rows of the returned matrix.
+func batchSoftmax(vecs []linalg.Vector, n int) rowMatrix {
+	res := newRowMatrix(len(vecs), n)
+	for i, vec := range vecs {
+		softmaxInto(res.Row(i), vec[:n])
+	}
+	return res
+}
+
+// softmaxInto writes the softmax of vec to dst.
+func softmaxInto(dst, vec linalg.Vector) {
+	max := math.Inf(-1)
+	for _, x := range vec {
+		max = math.Max(max, x)
+	}
+	var sum float64
+	for i, x := range vec {
+		dst[i] = math.Exp(x - max)
+		sum += dst[i]
+	}
+	dst.Scale(1 / sum)
+}
+
+// softmaxGradient adds the gradient of a softmax's input
+// to dst, given the softmax's output and the gradient of
+// that output.
+func softmaxGradient(dst, out, upstream linalg.Vector) {
+	dot := out.Dot(upstream)
+	for i, y := range out {
+		dst[i] += y * (upstream[i] - dot)
+	}
+}
+
+// toFloat32 converts a vector to single precision.
+func toFloat32(v linalg.Vector) []float32 {
+	res := make([]float32, len(v))
+	for i, x := range v {
+		res[i] = float32(x)
+	}
+	return res
+}
+
+// fromFloat32 converts a single precision vector back to
+// a linalg.Vector.
+func fromFloat32(v []float32) linalg.Vector {
+	res := make(linalg.Vector, len(v))
+	for i, x := range v {
+		res[i] = float64(x)
+	}
+	return res
+}
+
+// logSoftmax computes the logarithm of the softmax of a
+// vector without underflowing.
+func logSoftmax(vec linalg.Vector) linalg.Vector {
+	max := math.Inf(-1)
+	for _, x := range vec {
+		max = math.Max(max, x)
+	}
+	var sum float64
+	for _, x := range vec {
+		sum += math.Exp(x - max)
+	}
+	logSum := max + math.Log(sum)
+	res := make(linalg.Vector, len(vec))
+	for i, x := range vec {
+		res[i] = x - logSum
+	}
+	return res
+}
+
+// logSoftmaxGradient adds the gradient of a log-softmax's
+// input to dst, given the softmax's output (not its log)
+// and the gradient of the log-softmax's output.
+func logSoftmaxGradient(dst, probs, upstream linalg.Vector) {
+	var sum float64
+	for _, x := range upstream {
+		sum += x
+	}
+	for i, p := range probs {
+		dst[i] += upstream[i] - p*sum
+	}
+}
+
+// logAdd computes log(exp(x)+exp(y)) without underflowing.
+func logAdd(x, y float64) float64 {
+	if x < y {
+		x, y = y, x
+	}
+	if math.IsInf(y, -1) {
+		return x
+	}
+	return x + math.Log1p(math.Exp(y-x))
+}
+
+// logSoftmaxR computes the r-operator of a log-softmax,
+// given the softmax's output and the r-operator of its
+// input.
+func logSoftmaxR(probs, inR linalg.Vector) linalg.Vector {
+	dot := probs.Dot(inR)
+	res := make(linalg.Vector, len(inR))
+	for i, x := range inR {
+		res[i] = x - dot
+	}
+	return res
+}
+
+// logSoftmaxGradientR is like logSoftmaxGradient, but it
+// also adds the r-gradient to dstR.
+func logSoftmaxGradientR(dst, dstR, probs, probsR, upstream, upstreamR linalg.Vector) {
+	var sum, sumR float64
+	for i, x := range upstream {
+		sum += x
+		sumR += upstreamR[i]
+	}
+	for i, p := range probs {
+		dst[i] += upstream[i] - p*sum
+		dstR[i] += upstreamR[i] - probsR[i]*sum - p*sumR
+	}
+}
+
+// A rowMatrix is a view of a row-major matrix.
+// Each row holds one entry of a batch.
+//
+// The rows of a view may be narrower than the stride, so
+// that a view can select a range of columns from a larger
+// matrix.
+type rowMatrix struct {
+	Data   linalg.Vector
+	Rows   int
+	Cols   int
+	Stride int
+}
+
+// newRowMatrix allocates a zero matrix.
+func newRowMatrix(rows, cols int) rowMatrix {
+	return rowMatrix{
+		Data:   make(linalg.Vector, rows*cols),
+		Rows:   rows,
+		Cols:   cols,
+		Stride: cols,
+	}
+}
+
+// joinRows creates a matrix whose rows are the given
+// vectors, which must have cols components (or be nil,
+// for a row of zeroes).
+//
+// If the vectors are already the rows of one matrix, as
+// returned by Row, the matrix shares their memory.
+// Otherwise, the vectors are copied.
+func joinRows(vecs []linalg.Vector, cols int) rowMatrix {
+	if res, ok := sharedRows(vecs, cols); ok {
+		return res
+	}
+	res := newRowMatrix(len(vecs), cols)
+	for i, vec := range vecs {
+		copy(res.Row(i), vec)
+	}
+	return res
+}
+
+func sharedRows(vecs []linalg.Vector, cols int) (rowMatrix, bool) {
+	if cols == 0 || len(vecs) == 0 || len(vecs[0]) != cols {
+		return rowMatrix{}, false
+	}
+	buf := vecs[0][:cap(vecs[0])]
+	if len(buf) < len(vecs)*cols {
+		return rowMatrix{}, false
+	}
+	for i, vec := range vecs {
+		if len(vec) != cols || &vec[0] != &buf[i*cols] {
+			return rowMatrix{}, false
+		}
+	}
+	return rowMatrix{Data: buf[:len(vecs)*cols], Rows: len(vecs), Cols: cols, Stride: cols},
+		true
+}
+
+// Row returns a slice of the i-th row.
+// The capacity of the slice extends to the end of the
+// matrix, so that joinRows can tell that the rows are
+// stored together.
+func (r rowMatrix) Row(i int) linalg.Vector {
+	start := i * r.Stride
+	return r.Data[start : start+r.Cols]
+}
+
+// Columns returns a view of the columns in [start, end).
+func (r rowMatrix) Columns(start, end int) rowMatrix {
+	if start == end {
+		return rowMatrix{Rows: r.Rows, Stride: r.Stride}
+	}
+	return rowMatrix{Data: r.Data[start:], Rows: r.Rows, Cols: end - start, Stride: r.Stride}
+}
+
+// Column copies the given column into a new vector.
+func (r rowMatrix) Column(col int) linalg.Vector {
+	res := make(linalg.Vector, r.Rows)
+	for i := range res {
+		res[i] = r.Data[i*r.Stride+col]
+	}
+	return res
+}
+
+// AddColumn adds v to the given column.
+func (r rowMatrix) AddColumn(col int, v linalg.Vector) {
+	for i, x := range v {
+		r.Data[i*r.Stride+col] += x
+	}
+}
+
+// addScaledRows adds diag(scales)*src to dst, scaling the
+// i-th row of src by scales[i].
+// The matrices must have the same shape.
+func addScaledRows(dst, src rowMatrix, scales linalg.Vector) {
+	if src.Cols == 0 {
+		return
+	}
+	for i, scale := range scales {
+		dstRow := dst.Data[i*dst.Stride : i*dst.Stride+dst.Cols]
+		srcRow := src.Data[i*src.Stride : i*src.Stride+src.Cols]
+		for j, x := range srcRow {
+			dstRow[j] += x * scale
+		}
+	}
+}
+
+// rowDots computes the dot product of every row of a with
+// the corresponding row of b.
+func rowDots(a, b rowMatrix) linalg.Vector {
+	res := make(linalg.Vector, a.Rows)
+	if a.Cols == 0 {
+		return res
+	}
+	for i := range res {
+		aRow := a.Data[i*a.Stride : i*a.Stride+a.Cols]
+		bRow := b.Data[i*b.Stride : i*b.Stride+b.Cols]
+		var sum float64
+		for j, x := range aRow {
+			sum += x * bRow[j]
+		}
+		res[i] = sum
+	}
+	return res
+}